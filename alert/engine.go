@@ -0,0 +1,398 @@
+package alert
+
+import (
+	"fmt"
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	log "github.com/laik/logger"
+)
+
+const (
+	// 告警规则与采集规则存放在同一个库
+	ALERT_RULE_DATABASE = "audit_rule"
+	ALERT_RULE          = "alert"
+	// 告警记录按天分集合 alert_YYYY_MM_DD
+	ALERT_DATABASE = "audit_alert"
+
+	// 等待入库与投递的告警数上限
+	queueSize = 1024
+	// 清理窗口状态并补发冷却期内被抑制告警的间隔
+	sweepInterval = time.Minute
+)
+
+// Alert 一次触发的告警
+type Alert struct {
+	Id      string `bson:"_id" json:"id"`
+	Name    string `bson:"name" json:"name"`
+	Rule    string `bson:"rule,omitempty" json:"rule,omitempty"`
+	Level   string `bson:"level,omitempty" json:"level,omitempty"`
+	Key     string `bson:"key,omitempty" json:"key,omitempty"`
+	Message string `bson:"message,omitempty" json:"message,omitempty"`
+	// 窗口内命中次数
+	Count int `bson:"count" json:"count"`
+	// 上一次告警后冷却期内被抑制的次数
+	Suppressed int         `bson:"suppressed,omitempty" json:"suppressed,omitempty"`
+	FirstAt    time.Time   `bson:"firstAt" json:"firstAt"`
+	LastAt     time.Time   `bson:"lastAt" json:"lastAt"`
+	Record     in.AuditLog `bson:"record" json:"record"`
+	Notifiers  []string    `bson:"notifiers,omitempty" json:"notifiers,omitempty"`
+}
+
+// Dispatcher 告警产生后的投递
+type Dispatcher interface {
+	Dispatch(a *Alert)
+}
+
+// stateKey 告警规则名与分组值, 规则名可以包含任意字符, 不拼接为字符串
+type stateKey struct {
+	name  string
+	group string
+}
+
+type state struct {
+	// 告警中的 Key, 规则名或 规则名|分组值
+	key        string
+	hits       []time.Time
+	lastFired  time.Time
+	suppressed int
+	// 最后一次被抑制的记录, 冷却期结束后补发
+	lastSuppressed time.Time
+	record         in.AuditLog
+	// 最后一次被抑制记录所属的日志规则
+	rule string
+}
+
+// Engine 在记录入库后按告警规则进行匹配, 实现 logmining.Hook
+type Engine struct {
+	mu     sync.Mutex
+	rules  map[string]*Rule
+	states map[stateKey]*state
+
+	sp          *dbapi.StorageParts
+	persistType dbapi.DBType
+
+	dispatchers []Dispatcher
+	now         func() time.Time
+
+	// 入库与投递在单独的 goroutine 中进行, 不阻塞入库流程
+	queue  chan *Alert
+	closed bool
+	done   chan struct{}
+}
+
+func NewEngine(sp *dbapi.StorageParts, persistType dbapi.DBType) *Engine {
+	e := &Engine{
+		rules:       make(map[string]*Rule),
+		states:      make(map[stateKey]*state),
+		sp:          sp,
+		persistType: persistType,
+		now:         time.Now,
+		queue:       make(chan *Alert, queueSize),
+		done:        make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// Close 停止匹配, 等待队列中的告警入库与投递后返回, 可重复调用
+func (e *Engine) Close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+	<-e.done
+}
+
+// Load 从持久化存储加载告警规则
+func (e *Engine) Load() error {
+	var _err error
+	var _list []*Rule
+	dbapi.AccessDatabase(e.sp, ALERT_RULE_DATABASE, ALERT_RULE, nil, &_list, dbapi.KEYS, e.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range _list {
+		if err := r.Compile(); err != nil {
+			log.Error("load alert rule error: %s\n", err)
+			continue
+		}
+		e.rules[r.Name] = r
+	}
+	return nil
+}
+
+// AddDispatcher 添加告警投递
+func (e *Engine) AddDispatcher(d Dispatcher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dispatchers = append(e.dispatchers, d)
+}
+
+// Set 新增或更新告警规则并持久化
+func (e *Engine) Set(r *Rule) error {
+	if err := r.Compile(); err != nil {
+		return err
+	}
+	var _err error
+	dbapi.AccessDatabase(e.sp, ALERT_RULE_DATABASE, ALERT_RULE, bson.M{"_id": r.Name}, r, dbapi.SET, e.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules[r.Name] = r
+	e.resetStates(r.Name)
+	return nil
+}
+
+// Del 删除告警规则
+func (e *Engine) Del(name string) error {
+	e.mu.Lock()
+	_, ok := e.rules[name]
+	e.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("alert rule (%s) not found.", name)
+	}
+	var _err error
+	dbapi.AccessDatabase(e.sp, ALERT_RULE_DATABASE, ALERT_RULE, bson.M{"_id": name}, nil, dbapi.DEL, e.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.rules, name)
+	e.resetStates(name)
+	return nil
+}
+
+// Get 获取告警规则
+func (e *Engine) Get(name string) (*Rule, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r, ok := e.rules[name]
+	return r, ok
+}
+
+// List 告警规则名称列表
+func (e *Engine) List() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r := make([]string, 0, len(e.rules))
+	for name := range e.rules {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Alerts 查询某天的告警记录, date 格式 yyyy-mm-dd
+func (e *Engine) Alerts(date string) ([]Alert, error) {
+	res := make([]Alert, 0)
+	var _err error
+	dbapi.AccessDatabase(e.sp, ALERT_DATABASE, Collection(date), nil, &res, dbapi.KEYS, e.persistType, &_err)
+	if _err != nil {
+		return nil, _err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].LastAt.After(res[j].LastAt) })
+	return res, nil
+}
+
+// Fire 实现 logmining.Hook, 产生的告警放入队列, 队列满时丢弃
+func (e *Engine) Fire(entry *ll.Entry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	for _, a := range e.evaluate(entry) {
+		select {
+		case e.queue <- a:
+		default:
+			log.Warn("alert queue is full, drop alert (%s).\n", a.Name)
+		}
+	}
+}
+
+func (e *Engine) loop() {
+	defer close(e.done)
+	tick := time.NewTicker(sweepInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case a, ok := <-e.queue:
+			if !ok {
+				return
+			}
+			e.deliver(a)
+		case <-tick.C:
+			e.mu.Lock()
+			flushed := e.sweep(e.now())
+			e.mu.Unlock()
+			for _, a := range flushed {
+				e.deliver(a)
+			}
+		}
+	}
+}
+
+// deliver 告警入库并投递
+func (e *Engine) deliver(a *Alert) {
+	e.persist(a)
+	e.mu.Lock()
+	dispatchers := e.dispatchers
+	e.mu.Unlock()
+	for _, d := range dispatchers {
+		d.Dispatch(a)
+	}
+}
+
+// evaluate 调用时持有 e.mu
+func (e *Engine) evaluate(entry *ll.Entry) []*Alert {
+	now := e.now()
+	var fired []*Alert
+	for _, r := range e.rules {
+		if !r.Matches(entry.Rule, entry.Log) {
+			continue
+		}
+		sk := stateKey{name: r.Name}
+		key := r.Name
+		if r.Threshold != nil && r.Threshold.GroupBy != "" {
+			sk.group = fieldValue(entry.Log, r.Threshold.GroupBy)
+			key = key + "|" + sk.group
+		}
+		st, ok := e.states[sk]
+		if !ok {
+			st = &state{key: key}
+			e.states[sk] = st
+		}
+
+		count := 1
+		first := now
+		if t := r.Threshold; t != nil {
+			st.hits = append(prune(st.hits, now.Add(-t.window)), now)
+			if len(st.hits) < t.Count {
+				continue
+			}
+			count, first = len(st.hits), st.hits[0]
+			st.hits = st.hits[:0]
+		}
+
+		// 冷却期内去重
+		if r.cooldown > 0 && !st.lastFired.IsZero() && now.Sub(st.lastFired) < r.cooldown {
+			st.suppressed++
+			st.lastSuppressed, st.record, st.rule = now, *entry.Log, entry.Rule
+			continue
+		}
+
+		a := &Alert{
+			Id:         bson.NewObjectId().Hex(),
+			Name:       r.Name,
+			Rule:       entry.Rule,
+			Level:      r.Level,
+			Key:        key,
+			Count:      count,
+			Suppressed: st.suppressed,
+			FirstAt:    first,
+			LastAt:     now,
+			Record:     *entry.Log,
+			Notifiers:  r.Notifiers,
+		}
+		a.Message = r.message(a)
+		st.lastFired = now
+		st.suppressed = 0
+		fired = append(fired, a)
+	}
+	return fired
+}
+
+func (e *Engine) persist(a *Alert) {
+	var _err error
+	dbapi.AccessDatabase(e.sp, ALERT_DATABASE, Collection(a.LastAt.Format("2006-01-02")), nil, a, dbapi.INSERT, e.persistType, &_err)
+	if _err != nil {
+		log.Error("persist alert (%s) error: %s\n", a.Name, _err)
+	}
+}
+
+// sweep 清理过期的窗口状态, 防止分组键无限增长; 冷却期结束时仍有被抑制的告警则返回汇总告警
+func (e *Engine) sweep(now time.Time) []*Alert {
+	var flushed []*Alert
+	for sk, st := range e.states {
+		r, ok := e.rules[sk.name]
+		if !ok {
+			delete(e.states, sk)
+			continue
+		}
+		if st.suppressed > 0 && now.Sub(st.lastFired) >= r.cooldown {
+			a := &Alert{
+				Id:         bson.NewObjectId().Hex(),
+				Name:       r.Name,
+				Rule:       st.rule,
+				Level:      r.Level,
+				Key:        st.key,
+				Suppressed: st.suppressed,
+				FirstAt:    st.lastFired,
+				LastAt:     st.lastSuppressed,
+				Record:     st.record,
+				Notifiers:  r.Notifiers,
+			}
+			a.Message = fmt.Sprintf("alert (%s) key (%s) suppressed %d times in cooldown (%s).", r.Name, st.key, st.suppressed, r.Cooldown)
+			flushed = append(flushed, a)
+			st.suppressed, st.record, st.rule = 0, in.AuditLog{}, ""
+		}
+		idle := r.cooldown
+		if r.Threshold != nil && r.Threshold.window > idle {
+			idle = r.Threshold.window
+		}
+		last := st.lastFired
+		if n := len(st.hits); n > 0 && st.hits[n-1].After(last) {
+			last = st.hits[n-1]
+		}
+		if now.Sub(last) > idle && st.suppressed == 0 {
+			delete(e.states, sk)
+		}
+	}
+	return flushed
+}
+
+func (e *Engine) resetStates(name string) {
+	for sk := range e.states {
+		if sk.name == name {
+			delete(e.states, sk)
+		}
+	}
+}
+
+func (r *Rule) message(a *Alert) string {
+	if r.Message != "" {
+		return r.Message
+	}
+	if r.Threshold != nil {
+		return fmt.Sprintf("alert (%s) key (%s) matched %d times in %s.", r.Name, a.Key, a.Count, r.Threshold.Window)
+	}
+	return fmt.Sprintf("alert (%s) matched host (%s) user (%s) operation (%s).",
+		r.Name, a.Record.Host, a.Record.UserName, a.Record.Operation)
+}
+
+func prune(hits []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && hits[i].Before(since) {
+		i++
+	}
+	return hits[i:]
+}
+
+// Collection 告警记录集合名
+func Collection(date string) string {
+	return "alert_" + strings.Replace(date, "-", "_", 2)
+}
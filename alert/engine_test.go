@@ -0,0 +1,343 @@
+package alert
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+)
+
+func TestRuleMatch(t *testing.T) {
+	cases := []struct {
+		cond  Condition
+		value string
+		match bool
+	}{
+		{Condition{Field: "UserName", Op: EQ, Value: "root"}, "root", true},
+		{Condition{Field: "UserName", Op: EQ, Value: "root"}, "admin", false},
+		{Condition{Field: "UserName", Op: NE, Value: "root"}, "admin", true},
+		{Condition{Field: "Operation", Op: MATCH, Value: `^rm\s+-rf`}, "rm -rf /", true},
+		{Condition{Field: "Operation", Op: MATCH, Value: `^rm\s+-rf`}, "ls; rm -rf /", false},
+		{Condition{Field: "Operation", Op: NOTMATCH, Value: `^ls`}, "rm", true},
+		{Condition{Field: "IpAddr", Op: IN, Values: []string{"10.0.0.0/8", "192.168.1.1"}}, "(10.1.2.3)", true},
+		{Condition{Field: "IpAddr", Op: IN, Value: "10.0.0.0/8, 192.168.1.1"}, "192.168.1.1", true},
+		{Condition{Field: "IpAddr", Op: IN, Values: []string{"10.0.0.0/8"}}, "172.16.0.1", false},
+		{Condition{Field: "IpAddr", Op: NOTIN, Values: []string{"10.0.0.0/8"}}, "[172.16.0.1]", true},
+	}
+	for _, c := range cases {
+		cond := c.cond
+		r := &Rule{Name: "r", Match: []*Condition{&cond}}
+		if err := r.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		al := &in.AuditLog{}
+		switch cond.Field {
+		case "UserName":
+			al.UserName = c.value
+		case "Operation":
+			al.Operation = c.value
+		case "IpAddr":
+			al.IpAddr = c.value
+		}
+		if got := r.Matches("rule", al); got != c.match {
+			t.Errorf("%s %s %s%v on %s = %v, want %v", cond.Field, cond.Op, cond.Value, cond.Values, c.value, got, c.match)
+		}
+	}
+
+	r := &Rule{Name: "r", Rule: "ssh", Match: []*Condition{{Field: "UserName", Op: EQ, Value: "root"}}}
+	if err := r.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	root := &in.AuditLog{UserName: "root"}
+	if !r.Matches("ssh", root) || r.Matches("ftp", root) {
+		t.Error("rule filter not applied")
+	}
+	r.Disabled = true
+	if r.Matches("ssh", root) {
+		t.Error("disabled rule matched")
+	}
+}
+
+func TestRuleCompileError(t *testing.T) {
+	cases := []string{
+		`{"match": []}`,
+		`{"match": [{"field": "Nope", "op": "="}]}`,
+		`{"match": [{"field": "RiskScore", "op": "="}]}`,
+		`{"match": [{"field": "UserName", "op": "like"}]}`,
+		`{"match": [{"field": "UserName", "op": "~", "value": "("}]}`,
+		`{"match": [{"field": "IpAddr", "op": "in", "values": ["10.0.0.0/33"]}]}`,
+		`{"match": [{"field": "UserName", "op": "="}], "threshold": {"count": 0, "window": "1m"}}`,
+		`{"match": [{"field": "UserName", "op": "="}], "threshold": {"count": 1, "window": "-1m"}}`,
+		`{"match": [{"field": "UserName", "op": "="}], "threshold": {"count": 1, "window": "1m", "groupBy": "Nope"}}`,
+		`{"match": [{"field": "UserName", "op": "="}], "cooldown": "soon"}`,
+		`{"match": `,
+	}
+	for _, c := range cases {
+		if _, err := ParseRule("r", []byte(c)); err == nil {
+			t.Errorf("ParseRule(%s) expect error", c)
+		}
+	}
+}
+
+// clock 测试中可调整的当前时间
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+type collector chan *Alert
+
+func (c collector) Dispatch(a *Alert) {
+	c <- a
+}
+
+func testEngine(t *testing.T, rules ...string) (*Engine, *clock, collector) {
+	e := NewEngine(dbapi.NewStorageParts(), dbapi.KV)
+	t.Cleanup(e.Close)
+	c := &clock{t: time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)}
+	e.now = c.now
+	ch := make(collector, 64)
+	e.AddDispatcher(ch)
+	for i, data := range rules {
+		r, err := ParseRule(string(rune('a'+i)), []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Set(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e, c, ch
+}
+
+func fire(e *Engine, ip, user string) {
+	e.Fire(&ll.Entry{Rule: "ssh", Log: &in.AuditLog{IpAddr: ip, UserName: user, Operation: "login"}})
+}
+
+// expect 等待 n 条告警, 之后不应再有告警
+func expect(t *testing.T, ch collector, n int) []*Alert {
+	t.Helper()
+	var r []*Alert
+	for len(r) < n {
+		select {
+		case a := <-ch:
+			r = append(r, a)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("alerts %d, want %d", len(r), n)
+		}
+	}
+	select {
+	case a := <-ch:
+		t.Fatalf("unexpected alert %+v", a)
+	case <-time.After(20 * time.Millisecond):
+	}
+	return r
+}
+
+func TestThreshold(t *testing.T) {
+	e, c, ch := testEngine(t,
+		`{"match": [{"field": "Operation", "op": "=", "value": "login"}], "threshold": {"count": 3, "window": "1m", "groupBy": "IpAddr"}}`)
+
+	cases := []struct {
+		after time.Duration
+		ip    string
+		fired int
+	}{
+		{0, "10.0.0.1", 0},
+		{10 * time.Second, "10.0.0.1", 0},
+		// 其它分组单独计数
+		{10 * time.Second, "10.0.0.2", 0},
+		{10 * time.Second, "10.0.0.1", 1},
+		// 告警后重新计数
+		{10 * time.Second, "10.0.0.1", 0},
+		{10 * time.Second, "10.0.0.1", 0},
+		// 窗口外的命中不计数
+		{2 * time.Minute, "10.0.0.1", 0},
+		{10 * time.Second, "10.0.0.1", 0},
+		{10 * time.Second, "10.0.0.1", 1},
+	}
+	for i, k := range cases {
+		c.add(k.after)
+		fire(e, k.ip, "root")
+		for _, a := range expect(t, ch, k.fired) {
+			if a.Count != 3 || a.Key != "a|10.0.0.1" || a.LastAt.Sub(a.FirstAt) > time.Minute {
+				t.Errorf("step %d alert %+v", i, a)
+			}
+		}
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	e, c, ch := testEngine(t,
+		`{"match": [{"field": "UserName", "op": "=", "value": "root"}], "cooldown": "5m"}`)
+
+	fire(e, "10.0.0.1", "root")
+	expect(t, ch, 1)
+	for i := 0; i < 3; i++ {
+		c.add(time.Minute)
+		fire(e, "10.0.0.1", "root")
+	}
+	fire(e, "10.0.0.1", "admin")
+	expect(t, ch, 0)
+
+	// 冷却期结束后的告警带有被抑制的次数
+	c.add(2 * time.Minute)
+	fire(e, "10.0.0.1", "root")
+	if a := expect(t, ch, 1)[0]; a.Suppressed != 3 || a.Count != 1 {
+		t.Errorf("alert %+v", a)
+	}
+	c.add(time.Minute)
+	fire(e, "10.0.0.1", "root")
+	expect(t, ch, 0)
+}
+
+func TestSweep(t *testing.T) {
+	e, c, ch := testEngine(t,
+		`{"match": [{"field": "UserName", "op": "=", "value": "root"}], "cooldown": "5m"}`,
+		`{"match": [{"field": "UserName", "op": "=", "value": "root"}], "threshold": {"count": 5, "window": "1m", "groupBy": "IpAddr"}}`)
+
+	start := c.now()
+	fire(e, "10.0.0.1", "root")
+	c.add(time.Minute)
+	fire(e, "10.0.0.2", "root")
+	c.add(time.Minute)
+	fire(e, "10.0.0.3", "root")
+	expect(t, ch, 1)
+
+	sweep := func() []*Alert {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.sweep(c.now())
+	}
+	states := func() int {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return len(e.states)
+	}
+	// 窗口内的分组与冷却中的告警保留
+	if r := sweep(); len(r) != 0 || states() != 3 {
+		t.Fatalf("flushed %d states %d", len(r), states())
+	}
+	// 窗口过期的分组删除
+	c.add(90 * time.Second)
+	if r := sweep(); len(r) != 0 || states() != 1 {
+		t.Fatalf("flushed %d states %d", len(r), states())
+	}
+
+	// 冷却期结束时补发被抑制的告警并删除状态
+	c.add(2 * time.Minute)
+	if r := sweep(); len(r) != 1 || r[0].Suppressed != 2 || r[0].Count != 0 || !r[0].FirstAt.Equal(start) ||
+		!r[0].LastAt.Equal(start.Add(2*time.Minute)) || r[0].Record.IpAddr != "10.0.0.3" || r[0].Rule != "ssh" || r[0].Key != "a" {
+		t.Fatalf("flushed %+v", r)
+	}
+	if states() != 0 {
+		t.Fatalf("states %d", states())
+	}
+	expect(t, ch, 0)
+}
+
+// 规则名包含 | 时状态不与其它规则或分组混淆
+func TestStateKey(t *testing.T) {
+	e, c, ch := testEngine(t)
+	for name, data := range map[string]string{
+		"x":   `{"match": [{"field": "UserName", "op": "=", "value": "root"}], "cooldown": "5m", "threshold": {"count": 1, "window": "1m", "groupBy": "IpAddr"}}`,
+		"x|y": `{"match": [{"field": "UserName", "op": "=", "value": "root"}], "cooldown": "5m"}`,
+	} {
+		r, err := ParseRule(name, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Set(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fire(e, "y", "root")
+	c.add(time.Minute)
+	fire(e, "y", "root")
+	expect(t, ch, 2)
+
+	// 更新规则 x 不清理 x|y 的状态
+	r, _ := ParseRule("x", []byte(`{"match": [{"field": "UserName", "op": "=", "value": "admin"}]}`))
+	if err := e.Set(r); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	st, ok := e.states[stateKey{name: "x|y"}]
+	n := len(e.states)
+	e.mu.Unlock()
+	if !ok || n != 1 || st.suppressed != 1 || st.key != "x|y" {
+		t.Fatalf("states %d %+v", n, st)
+	}
+
+	c.add(5 * time.Minute)
+	e.mu.Lock()
+	flushed := e.sweep(c.now())
+	e.mu.Unlock()
+	if len(flushed) != 1 || flushed[0].Name != "x|y" || flushed[0].Key != "x|y" || flushed[0].Suppressed != 1 || flushed[0].Rule != "ssh" {
+		t.Errorf("flushed %+v", flushed)
+	}
+}
+
+type blocked struct {
+	release chan struct{}
+	got     chan *Alert
+}
+
+func (b *blocked) Dispatch(a *Alert) {
+	<-b.release
+	b.got <- a
+}
+
+func TestFireNotBlocked(t *testing.T) {
+	e := NewEngine(dbapi.NewStorageParts(), dbapi.KV)
+	b := &blocked{release: make(chan struct{}), got: make(chan *Alert, queueSize)}
+	e.AddDispatcher(b)
+	r, err := ParseRule("a", []byte(`{"match": [{"field": "UserName", "op": "=", "value": "root"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Set(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// 投递阻塞时入库流程不等待
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			fire(e, "10.0.0.1", "root")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fire blocked by dispatcher")
+	}
+
+	// Close 等待队列中的告警投递完成, 之后不再产生告警
+	close(b.release)
+	e.Close()
+	if len(b.got) != 10 {
+		t.Errorf("dispatched %d, want 10", len(b.got))
+	}
+	fire(e, "10.0.0.1", "root")
+	e.Close()
+	if len(b.got) != 10 {
+		t.Errorf("dispatched %d after close", len(b.got))
+	}
+}
@@ -0,0 +1,208 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	in "logauditer/internal"
+)
+
+// 条件操作符
+const (
+	EQ       = "="
+	NE       = "!="
+	MATCH    = "~"
+	NOTMATCH = "!~"
+	IN       = "in"
+	NOTIN    = "notin"
+)
+
+// Condition 针对审计记录某个字段的匹配条件
+type Condition struct {
+	Field  string   `bson:"field" json:"field"`
+	Op     string   `bson:"op" json:"op"`
+	Value  string   `bson:"value,omitempty" json:"value,omitempty"`
+	Values []string `bson:"values,omitempty" json:"values,omitempty"`
+
+	re    *regexp.Regexp
+	nets  []*net.IPNet
+	exact map[string]struct{}
+}
+
+// Threshold 滑动窗口阈值, 例如每个IpAddr 1分钟内5次
+type Threshold struct {
+	Count   int    `bson:"count" json:"count"`
+	Window  string `bson:"window" json:"window"`
+	GroupBy string `bson:"groupBy,omitempty" json:"groupBy,omitempty"`
+
+	window time.Duration
+}
+
+// Rule 告警规则
+type Rule struct {
+	Name string `bson:"_id" json:"name"`
+	// 限定采集规则, 为空时对所有规则生效
+	Rule      string       `bson:"rule,omitempty" json:"rule,omitempty"`
+	Level     string       `bson:"level,omitempty" json:"level,omitempty"`
+	Message   string       `bson:"message,omitempty" json:"message,omitempty"`
+	Match     []*Condition `bson:"match" json:"match"`
+	Threshold *Threshold   `bson:"threshold,omitempty" json:"threshold,omitempty"`
+	// 同一告警(规则+分组)的冷却时间, 冷却期内重复的告警只计数不产生
+	Cooldown string `bson:"cooldown,omitempty" json:"cooldown,omitempty"`
+	Disabled bool   `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	// 告警通知渠道名称
+	Notifiers []string `bson:"notifiers,omitempty" json:"notifiers,omitempty"`
+
+	cooldown time.Duration
+}
+
+// ParseRule 解析并校验告警规则
+func ParseRule(name string, data []byte) (*Rule, error) {
+	r := &Rule{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("alert rule unmarshal err: %s", err)
+	}
+	r.Name = name
+	if err := r.Compile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Compile 预编译正则/网段/时间窗口
+func (r *Rule) Compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule name is empty.")
+	}
+	if len(r.Match) == 0 {
+		return fmt.Errorf("alert rule (%s) without match condition.", r.Name)
+	}
+	for _, c := range r.Match {
+		if err := c.compile(); err != nil {
+			return fmt.Errorf("alert rule (%s) %s", r.Name, err)
+		}
+	}
+	if t := r.Threshold; t != nil {
+		if t.Count < 1 {
+			return fmt.Errorf("alert rule (%s) threshold count must be greater than 0.", r.Name)
+		}
+		d, err := time.ParseDuration(t.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("alert rule (%s) invalid threshold window (%s).", r.Name, t.Window)
+		}
+		t.window = d
+		if t.GroupBy != "" && !hasField(t.GroupBy) {
+			return fmt.Errorf("alert rule (%s) unknown group by field (%s).", r.Name, t.GroupBy)
+		}
+	}
+	if r.Cooldown != "" {
+		d, err := time.ParseDuration(r.Cooldown)
+		if err != nil {
+			return fmt.Errorf("alert rule (%s) invalid cooldown (%s).", r.Name, r.Cooldown)
+		}
+		r.cooldown = d
+	}
+	return nil
+}
+
+// Matches 记录是否满足所有条件
+func (r *Rule) Matches(rule string, al *in.AuditLog) bool {
+	if r.Disabled {
+		return false
+	}
+	if r.Rule != "" && r.Rule != rule {
+		return false
+	}
+	for _, c := range r.Match {
+		if !c.match(fieldValue(al, c.Field)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Condition) compile() error {
+	if !hasField(c.Field) {
+		return fmt.Errorf("unknown field (%s).", c.Field)
+	}
+	switch c.Op {
+	case EQ, NE:
+	case MATCH, NOTMATCH:
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return fmt.Errorf("compile field (%s) pattern error: %s", c.Field, err)
+		}
+		c.re = re
+	case IN, NOTIN:
+		c.exact = make(map[string]struct{})
+		values := c.Values
+		if len(values) == 0 && c.Value != "" {
+			values = strings.Split(c.Value, ",")
+		}
+		for _, v := range values {
+			v = strings.TrimSpace(v)
+			if strings.Contains(v, "/") {
+				_, ipnet, err := net.ParseCIDR(v)
+				if err != nil {
+					return fmt.Errorf("field (%s) invalid cidr (%s).", c.Field, v)
+				}
+				c.nets = append(c.nets, ipnet)
+				continue
+			}
+			c.exact[v] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("unsupported op (%s) on field (%s).", c.Op, c.Field)
+	}
+	return nil
+}
+
+func (c *Condition) match(v string) bool {
+	switch c.Op {
+	case EQ:
+		return v == c.Value
+	case NE:
+		return v != c.Value
+	case MATCH:
+		return c.re.MatchString(v)
+	case NOTMATCH:
+		return !c.re.MatchString(v)
+	case IN:
+		return c.contains(v)
+	case NOTIN:
+		return !c.contains(v)
+	}
+	return false
+}
+
+func (c *Condition) contains(v string) bool {
+	// IpAddr 等字段由列表达式截取, 常带有括号
+	v = strings.Trim(v, "()[] ")
+	if _, ok := c.exact[v]; ok {
+		return true
+	}
+	if ip := net.ParseIP(v); ip != nil {
+		for _, n := range c.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var auditLogType = reflect.TypeOf(in.AuditLog{})
+
+func hasField(name string) bool {
+	f, ok := auditLogType.FieldByName(name)
+	return ok && f.Type.Kind() == reflect.String
+}
+
+func fieldValue(al *in.AuditLog, name string) string {
+	return reflect.ValueOf(al).Elem().FieldByName(name).String()
+}
@@ -0,0 +1,703 @@
+// Code generated by Makefile from api.swagger.json. DO NOT EDIT.
+
+package api
+
+// Swagger 管理接口的 OpenAPI 文档
+const Swagger = `{
+  "swagger": "2.0",
+  "info": {
+    "title": "api.proto",
+    "version": "version not set"
+  },
+  "consumes": [
+    "application/json"
+  ],
+  "produces": [
+    "application/json"
+  ],
+  "paths": {
+    "/api/v1/rules": {
+      "get": {
+        "operationId": "LogAuditer_ListRules",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiListRulesResponse"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "pattern",
+            "description": "POSIX regexp matched against rule names, empty means all.",
+            "in": "query",
+            "required": false,
+            "type": "string"
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      },
+      "post": {
+        "operationId": "LogAuditer_CreateRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiRule"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {
+              "$ref": "#/definitions/apiCreateRuleRequest"
+            }
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/rules/{name}": {
+      "get": {
+        "operationId": "LogAuditer_GetRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiRule"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      },
+      "delete": {
+        "operationId": "LogAuditer_DropRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiDropRuleResponse"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/rules/{name}/commit": {
+      "post": {
+        "operationId": "LogAuditer_CommitRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiRule"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {
+              "$ref": "#/definitions/apiCommitRuleRequest"
+            }
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/rules/{name}/start": {
+      "post": {
+        "operationId": "LogAuditer_StartRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiRule"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {
+              "$ref": "#/definitions/apiStartRuleRequest"
+            }
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/rules/{name}/stop": {
+      "post": {
+        "operationId": "LogAuditer_StopRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiRule"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {
+              "$ref": "#/definitions/apiStopRuleRequest"
+            }
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/rules/{name}/test": {
+      "post": {
+        "operationId": "LogAuditer_TestRule",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiTestRuleResponse"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "body",
+            "in": "body",
+            "required": true,
+            "schema": {
+              "$ref": "#/definitions/apiTestRuleRequest"
+            }
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/workers": {
+      "get": {
+        "operationId": "LogAuditer_ListWorkers",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiListWorkersResponse"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    },
+    "/api/v1/workers/{rule}/files": {
+      "get": {
+        "operationId": "LogAuditer_ListFiles",
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "schema": {
+              "$ref": "#/definitions/apiListFilesResponse"
+            }
+          },
+          "default": {
+            "description": "An unexpected error response.",
+            "schema": {
+              "$ref": "#/definitions/runtimeError"
+            }
+          }
+        },
+        "parameters": [
+          {
+            "name": "rule",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "tags": [
+          "LogAuditer"
+        ]
+      }
+    }
+  },
+  "definitions": {
+    "apiAuditRecord": {
+      "type": "object",
+      "properties": {
+        "rule": {
+          "type": "string"
+        },
+        "file": {
+          "type": "string"
+        },
+        "time": {
+          "type": "string",
+          "format": "int64",
+          "title": "unix nanoseconds when the record was stored"
+        },
+        "host": {
+          "type": "string"
+        },
+        "date": {
+          "type": "string"
+        },
+        "device": {
+          "type": "string"
+        },
+        "system_type": {
+          "type": "string"
+        },
+        "date_time": {
+          "type": "string"
+        },
+        "ip_addr": {
+          "type": "string"
+        },
+        "operation": {
+          "type": "string"
+        },
+        "state": {
+          "type": "string"
+        },
+        "user_name": {
+          "type": "string"
+        },
+        "categories": {
+          "type": "array",
+          "items": {
+            "type": "string"
+          }
+        },
+        "risk_score": {
+          "type": "integer",
+          "format": "int32"
+        },
+        "masked": {
+          "type": "array",
+          "items": {
+            "type": "string"
+          }
+        },
+        "dropped": {
+          "type": "string",
+          "format": "uint64",
+          "title": "records dropped for this subscriber since the previous one"
+        }
+      },
+      "description": "AuditRecord is a record stored by a running worker."
+    },
+    "apiCommandExecutionReply": {
+      "type": "string",
+      "enum": [
+        "NIL",
+        "OK",
+        "STRING",
+        "SLICE",
+        "ERR"
+      ],
+      "default": "NIL",
+      "description": "CommandExecutionReply describes all available replies."
+    },
+    "apiCommitRuleRequest": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        }
+      }
+    },
+    "apiCreateRuleRequest": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        },
+        "options": {
+          "type": "string"
+        }
+      }
+    },
+    "apiDropRuleResponse": {
+      "type": "object"
+    },
+    "apiExecuteCommandResponse": {
+      "type": "object",
+      "properties": {
+        "reply": {
+          "$ref": "#/definitions/apiCommandExecutionReply"
+        },
+        "item": {
+          "type": "string"
+        },
+        "items": {
+          "type": "array",
+          "items": {
+            "type": "string"
+          }
+        }
+      }
+    },
+    "apiListFilesResponse": {
+      "type": "object",
+      "properties": {
+        "files": {
+          "type": "array",
+          "items": {
+            "$ref": "#/definitions/apiWatchedFile"
+          }
+        }
+      }
+    },
+    "apiListRulesResponse": {
+      "type": "object",
+      "properties": {
+        "rules": {
+          "type": "array",
+          "items": {
+            "$ref": "#/definitions/apiRule"
+          }
+        }
+      }
+    },
+    "apiListWorkersResponse": {
+      "type": "object",
+      "properties": {
+        "workers": {
+          "type": "array",
+          "items": {
+            "$ref": "#/definitions/apiWorker"
+          }
+        }
+      }
+    },
+    "apiLoginResponse": {
+      "type": "object",
+      "properties": {
+        "token": {
+          "type": "string",
+          "title": "sent back as \"authorization: Bearer ${token}\" metadata"
+        },
+        "user": {
+          "type": "string"
+        },
+        "roles": {
+          "type": "array",
+          "items": {
+            "type": "string"
+          }
+        },
+        "expires": {
+          "type": "string",
+          "format": "int64",
+          "title": "unix seconds, extended on every call"
+        }
+      }
+    },
+    "apiLogoutResponse": {
+      "type": "object"
+    },
+    "apiRule": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        },
+        "options": {
+          "type": "string"
+        },
+        "committed": {
+          "type": "boolean",
+          "title": "persisted by CommitRule"
+        },
+        "running": {
+          "type": "boolean",
+          "title": "a worker is applying the rule"
+        }
+      },
+      "description": "Rule is a collection rule, options is the RuntimeOptions JSON accepted by SET."
+    },
+    "apiStartRuleRequest": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        }
+      }
+    },
+    "apiStopRuleRequest": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        }
+      }
+    },
+    "apiTestRuleRequest": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        },
+        "data": {
+          "type": "string",
+          "title": "a raw log line"
+        }
+      }
+    },
+    "apiTestRuleResponse": {
+      "type": "object",
+      "properties": {
+        "record": {
+          "$ref": "#/definitions/apiAuditRecord"
+        }
+      }
+    },
+    "apiWatchedFile": {
+      "type": "object",
+      "properties": {
+        "name": {
+          "type": "string"
+        },
+        "offset": {
+          "type": "string",
+          "format": "int64"
+        },
+        "pattern": {
+          "type": "string",
+          "title": "include glob or filePattern that matched the file"
+        }
+      }
+    },
+    "apiWorker": {
+      "type": "object",
+      "properties": {
+        "rule": {
+          "type": "string"
+        },
+        "files": {
+          "type": "integer",
+          "format": "int32",
+          "title": "number of files being followed"
+        }
+      }
+    },
+    "apiWorkerEvent": {
+      "type": "object",
+      "properties": {
+        "type": {
+          "$ref": "#/definitions/apiWorkerEventType"
+        },
+        "rule": {
+          "type": "string"
+        },
+        "file": {
+          "type": "string"
+        },
+        "message": {
+          "type": "string"
+        },
+        "time": {
+          "type": "string",
+          "format": "int64",
+          "title": "unix nanoseconds"
+        },
+        "dropped": {
+          "type": "string",
+          "format": "uint64",
+          "title": "events dropped for this subscriber since the previous one"
+        }
+      },
+      "description": "WorkerEvent describes a worker state change."
+    },
+    "apiWorkerEventType": {
+      "type": "string",
+      "enum": [
+        "STARTED",
+        "STOPPED",
+        "FILE_ADDED",
+        "FILE_REMOVED",
+        "ERROR"
+      ],
+      "default": "STARTED"
+    },
+    "protobufAny": {
+      "type": "object",
+      "properties": {
+        "type_url": {
+          "type": "string"
+        },
+        "value": {
+          "type": "string",
+          "format": "byte"
+        }
+      }
+    },
+    "runtimeError": {
+      "type": "object",
+      "properties": {
+        "error": {
+          "type": "string"
+        },
+        "code": {
+          "type": "integer",
+          "format": "int32"
+        },
+        "message": {
+          "type": "string"
+        },
+        "details": {
+          "type": "array",
+          "items": {
+            "$ref": "#/definitions/protobufAny"
+          }
+        }
+      }
+    },
+    "runtimeStreamError": {
+      "type": "object",
+      "properties": {
+        "grpc_code": {
+          "type": "integer",
+          "format": "int32"
+        },
+        "http_code": {
+          "type": "integer",
+          "format": "int32"
+        },
+        "message": {
+          "type": "string"
+        },
+        "http_status": {
+          "type": "string"
+        },
+        "details": {
+          "type": "array",
+          "items": {
+            "$ref": "#/definitions/protobufAny"
+          }
+        }
+      }
+    }
+  }
+}
+`
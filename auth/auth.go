@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"logauditer/dbapi"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	log "github.com/laik/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// 用户与规则存放在同一个库
+	USER_DATABASE = "audit_rule"
+	USER          = "user"
+)
+
+// 角色
+const (
+	// 管理规则/告警/通知/报表/用户, 拥有全部权限
+	ADMIN = "admin"
+	// 查询/导出审计记录
+	AUDITOR = "auditor"
+	// 启动/停止规则
+	OPERATOR = "operator"
+)
+
+// Roles 所有角色
+var Roles = []string{ADMIN, AUDITOR, OPERATOR}
+
+// 会话默认有效期, 每次使用后顺延
+const DefaultTTL = 8 * time.Hour
+
+var (
+	ErrInvalidCredentials = errors.New("invalid user name or password.")
+	ErrInvalidToken       = errors.New("invalid or expired token.")
+)
+
+// User 本地用户, LDAP 用户不持久化
+type User struct {
+	Name  string   `bson:"_id" json:"name"`
+	Hash  string   `bson:"hash,omitempty" json:"-"`
+	Roles []string `bson:"roles" json:"roles"`
+	// 来源, local 或 ldap
+	Source string `bson:"-" json:"source"`
+}
+
+// Authenticator 外部账号认证, 返回的用户须带角色
+type Authenticator interface {
+	Authenticate(name, password string) (*User, error)
+}
+
+// Session 登录会话, 令牌用于 gRPC metadata 与 HTTP cookie
+type Session struct {
+	Token  string
+	User   string
+	Roles  []string
+	Expire time.Time
+}
+
+// Allow 会话角色是否满足其一, admin 总是满足
+func (s *Session) Allow(roles ...string) bool {
+	return Allow(s.Roles, roles...)
+}
+
+// Allow has 中是否包含 need 中的任一角色, admin 总是满足
+func Allow(has []string, need ...string) bool {
+	for _, h := range has {
+		if h == ADMIN {
+			return true
+		}
+		for _, n := range need {
+			if h == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseRoles 解析逗号分隔的角色列表
+func ParseRoles(s string) ([]string, error) {
+	r := make([]string, 0)
+	for _, role := range strings.Split(s, ",") {
+		role = strings.ToLower(strings.TrimSpace(role))
+		if role == "" {
+			continue
+		}
+		if !validRole(role) {
+			return nil, fmt.Errorf("invalid role (%s), expect one of %s.", role, strings.Join(Roles, ","))
+		}
+		r = append(r, role)
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("roles is empty.")
+	}
+	return r, nil
+}
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Manager 管理本地用户与登录会话
+type Manager struct {
+	mu       sync.RWMutex
+	users    map[string]*User
+	sessions map[string]*Session
+
+	sp          *dbapi.StorageParts
+	persistType dbapi.DBType
+
+	ldap Authenticator
+	ttl  time.Duration
+}
+
+func NewManager(sp *dbapi.StorageParts, persistType dbapi.DBType, ttl time.Duration) *Manager {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Manager{
+		users:       make(map[string]*User),
+		sessions:    make(map[string]*Session),
+		sp:          sp,
+		persistType: persistType,
+		ttl:         ttl,
+	}
+}
+
+// SetLDAP 设置 LDAP 认证, 本地用户优先
+func (m *Manager) SetLDAP(a Authenticator) {
+	m.ldap = a
+}
+
+// Load 从持久化存储加载本地用户
+func (m *Manager) Load() error {
+	var _err error
+	var _list []*User
+	dbapi.AccessDatabase(m.sp, USER_DATABASE, USER, nil, &_list, dbapi.KEYS, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range _list {
+		u.Source = "local"
+		m.users[u.Name] = u
+	}
+	return nil
+}
+
+// Bootstrap 没有任何本地用户时创建 admin, password 为空时随机生成并返回
+func (m *Manager) Bootstrap(password string) (string, error) {
+	if len(m.List()) > 0 {
+		return "", nil
+	}
+	if password == "" {
+		password = randomHex(8)
+	}
+	if err := m.Set(ADMIN, password, []string{ADMIN}); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// Set 新增或更新本地用户, password 为空时只更新角色
+func (m *Manager) Set(name, password string, roles []string) error {
+	if name == "" {
+		return fmt.Errorf("user name is empty.")
+	}
+	for _, r := range roles {
+		if !validRole(r) {
+			return fmt.Errorf("invalid role (%s), expect one of %s.", r, strings.Join(Roles, ","))
+		}
+	}
+	u := &User{Name: name, Roles: roles, Source: "local"}
+	if password == "" {
+		old, ok := m.Get(name)
+		if !ok {
+			return fmt.Errorf("user (%s) password is empty.", name)
+		}
+		u.Hash = old.Hash
+	} else {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		u.Hash = string(hash)
+	}
+
+	var _err error
+	dbapi.AccessDatabase(m.sp, USER_DATABASE, USER, bson.M{"_id": name}, u, dbapi.SET, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[name] = u
+	// 角色或密码变更后原有会话失效
+	m.revoke(name)
+	return nil
+}
+
+// Del 删除本地用户及其会话
+func (m *Manager) Del(name string) error {
+	if _, ok := m.Get(name); !ok {
+		return fmt.Errorf("user (%s) not found.", name)
+	}
+	var _err error
+	dbapi.AccessDatabase(m.sp, USER_DATABASE, USER, bson.M{"_id": name}, nil, dbapi.DEL, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, name)
+	m.revoke(name)
+	return nil
+}
+
+// Get 获取本地用户
+func (m *Manager) Get(name string) (*User, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[name]
+	return u, ok
+}
+
+// List 本地用户名称列表
+func (m *Manager) List() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := make([]string, 0, len(m.users))
+	for name := range m.users {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Authenticate 校验用户名密码, 本地用户不存在时尝试 LDAP
+func (m *Manager) Authenticate(name, password string) (*User, error) {
+	if name == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if u, ok := m.Get(name); ok {
+		if bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) != nil {
+			return nil, ErrInvalidCredentials
+		}
+		return u, nil
+	}
+	if m.ldap == nil {
+		return nil, ErrInvalidCredentials
+	}
+	u, err := m.ldap.Authenticate(name, password)
+	if err != nil {
+		if err != ErrInvalidCredentials {
+			log.Error("ldap authenticate user (%s) error: %s\n", name, err)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// Login 认证成功后创建会话
+func (m *Manager) Login(name, password string) (*Session, error) {
+	u, err := m.Authenticate(name, password)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		Token:  randomHex(32),
+		User:   u.Name,
+		Roles:  u.Roles,
+		Expire: time.Now().Add(m.ttl),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	m.sessions[s.Token] = s
+	return s, nil
+}
+
+// CertSession 已校验的客户端证书对应的本地用户会话, 不生成令牌
+func (m *Manager) CertSession(name string) (*Session, error) {
+	u, ok := m.Get(name)
+	if name == "" || !ok {
+		return nil, fmt.Errorf("client certificate user (%s) not found.", name)
+	}
+	return &Session{User: u.Name, Roles: u.Roles, Expire: time.Now().Add(m.ttl)}, nil
+}
+
+// Logout 使会话失效
+func (m *Manager) Logout(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, token)
+}
+
+// Verify 校验令牌并顺延有效期
+func (m *Manager) Verify(token string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[token]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if now.After(s.Expire) {
+		delete(m.sessions, token)
+		return nil, ErrInvalidToken
+	}
+	s.Expire = now.Add(m.ttl)
+	return s, nil
+}
+
+// 调用方持有写锁
+func (m *Manager) revoke(name string) {
+	for token, s := range m.sessions {
+		if s.User == name {
+			delete(m.sessions, token)
+		}
+	}
+}
+
+// 调用方持有写锁
+func (m *Manager) expire() {
+	now := time.Now()
+	for token, s := range m.sessions {
+		if now.After(s.Expire) {
+			delete(m.sessions, token)
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
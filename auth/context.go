@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+type sessionKey struct{}
+
+// NewContext 将会话放入 context, 供后续处理获取当前用户
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// FromContext 获取 context 中的会话, 未启用认证时不存在
+func FromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	return s, ok
+}
+
+// BearerToken 解析 "Bearer ${TOKEN}" 格式的 authorization 值
+func BearerToken(v string) string {
+	const prefix = "bearer "
+	if len(v) > len(prefix) && strings.ToLower(v[:len(prefix)]) == prefix {
+		return strings.TrimSpace(v[len(prefix):])
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig LDAP 认证配置
+//
+//	{
+//	  "url": "ldap://127.0.0.1:389",
+//	  "bindDN": "cn=admin,dc=example,dc=org",
+//	  "bindPassword": "admin",
+//	  "baseDN": "ou=people,dc=example,dc=org",
+//	  "userFilter": "(uid=%s)",
+//	  "groupRoles": {"cn=auditors,ou=groups,dc=example,dc=org": "auditor"}
+//	}
+type LDAPConfig struct {
+	URL string `json:"url"`
+	// 查询用户使用的账号, 为空时匿名查询
+	BindDN       string `json:"bindDN"`
+	BindPassword string `json:"bindPassword"`
+	BaseDN       string `json:"baseDN"`
+	// 用户查询条件, %s 替换为转义后的用户名, 默认 (uid=%s)
+	UserFilter string `json:"userFilter"`
+	// 用户所属组的属性, 默认 memberOf
+	GroupAttr string `json:"groupAttr"`
+	// 组 DN 到角色的映射
+	GroupRoles map[string]string `json:"groupRoles"`
+	// 不属于任何映射组时的角色, 为空时拒绝登录
+	DefaultRole string `json:"defaultRole"`
+	StartTLS    bool   `json:"startTLS"`
+	// 仅用于测试目录
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	Timeout            string `json:"timeout"`
+}
+
+// LDAP 先用查询账号按 userFilter 找到用户 DN, 再以用户 DN 与密码绑定校验
+type LDAP struct {
+	c       *LDAPConfig
+	timeout time.Duration
+}
+
+// LoadLDAP 从 json 文件加载 LDAP 配置
+func LoadLDAP(fn string) (*LDAP, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	c := &LDAPConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("ldap config (%s) unmarshal err: %s", fn, err)
+	}
+	return NewLDAP(c)
+}
+
+func NewLDAP(c *LDAPConfig) (*LDAP, error) {
+	if c.URL == "" || c.BaseDN == "" {
+		return nil, fmt.Errorf("ldap url and baseDN are required.")
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if !strings.Contains(c.UserFilter, "%s") {
+		return nil, fmt.Errorf("ldap userFilter (%s) must contain %%s.", c.UserFilter)
+	}
+	if c.GroupAttr == "" {
+		c.GroupAttr = "memberOf"
+	}
+	for dn, role := range c.GroupRoles {
+		if !validRole(role) {
+			return nil, fmt.Errorf("ldap group (%s) invalid role (%s).", dn, role)
+		}
+	}
+	if c.DefaultRole != "" && !validRole(c.DefaultRole) {
+		return nil, fmt.Errorf("ldap invalid default role (%s).", c.DefaultRole)
+	}
+	timeout := 5 * time.Second
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("ldap invalid timeout (%s).", c.Timeout)
+		}
+		timeout = d
+	}
+	return &LDAP{c: c, timeout: timeout}, nil
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	tc := &tls.Config{InsecureSkipVerify: l.c.InsecureSkipVerify}
+	conn, err := ldap.DialURL(l.c.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: l.timeout}),
+		ldap.DialWithTLSConfig(tc),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.timeout)
+	if l.c.StartTLS {
+		if err := conn.StartTLS(tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate 实现 Authenticator
+func (l *LDAP) Authenticate(name, password string) (*User, error) {
+	// 空密码会被当作匿名绑定而成功
+	if name == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if l.c.BindDN != "" {
+		if err := conn.Bind(l.c.BindDN, l.c.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap bind (%s) error: %s", l.c.BindDN, err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.c.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.c.UserFilter, ldap.EscapeFilter(name)),
+		[]string{l.c.GroupAttr},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search user (%s) error: %s", name, err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	roles := l.roles(entry.GetAttributeValues(l.c.GroupAttr))
+	if len(roles) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	return &User{Name: name, Roles: roles, Source: "ldap"}, nil
+}
+
+func (l *LDAP) roles(groups []string) []string {
+	seen := make(map[string]bool)
+	r := make([]string, 0)
+	for _, g := range groups {
+		for dn, role := range l.c.GroupRoles {
+			if strings.EqualFold(dn, g) && !seen[role] {
+				seen[role] = true
+				r = append(r, role)
+			}
+		}
+	}
+	if len(r) == 0 && l.c.DefaultRole != "" {
+		r = append(r, l.c.DefaultRole)
+	}
+	return r
+}
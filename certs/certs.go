@@ -0,0 +1,221 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"logauditer/insecure"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/laik/logger"
+)
+
+// 客户端证书校验方式
+const (
+	// 不要求客户端证书
+	CLIENT_NONE = "none"
+	// 提交时校验, 未提交时仍可用令牌登录
+	CLIENT_OPTIONAL = "optional"
+	// 必须提交由 ClientCAFile 签发的证书
+	CLIENT_REQUIRE = "require"
+)
+
+// Config 服务端证书配置
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// 签发客户端证书的 CA, 为空时不校验客户端证书
+	ClientCAFile string
+	// none/optional/require, 配置了 ClientCAFile 时默认 optional
+	ClientAuth string
+}
+
+// Reloader 持有当前证书, 文件变化后重新加载, 新连接使用新证书
+type Reloader struct {
+	c          *Config
+	clientAuth tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// 文件修改时间, 用于检查变化
+	stamps map[string]time.Time
+}
+
+func NewReloader(c *Config) (*Reloader, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls cert and key files are required.")
+	}
+	r := &Reloader{c: c}
+	switch c.ClientAuth {
+	case "":
+		if c.ClientCAFile != "" {
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	case CLIENT_NONE:
+		r.clientAuth = tls.NoClientCert
+	case CLIENT_OPTIONAL:
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_REQUIRE:
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls client auth (%s), expect none/optional/require.", c.ClientAuth)
+	}
+	if r.clientAuth != tls.NoClientCert && c.ClientCAFile == "" {
+		return nil, fmt.Errorf("tls client auth (%s) requires client ca file.", c.ClientAuth)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新加载证书与客户端 CA, 失败时保留原有证书
+func (r *Reloader) Reload() error {
+	stamps := make(map[string]time.Time)
+	for _, fn := range r.files() {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		stamps[fn] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.c.CertFile, r.c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load tls key pair (%s, %s) error: %s", r.c.CertFile, r.c.KeyFile, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.c.ClientCAFile != "" {
+		if pool, err = LoadPool(r.c.ClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.clientCAs, r.stamps = &cert, pool, stamps
+	log.Info("load tls cert (%s) subject (%s) expire at (%s).\n", r.c.CertFile, cert.Leaf.Subject, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (r *Reloader) files() []string {
+	fs := []string{r.c.CertFile, r.c.KeyFile}
+	if r.c.ClientCAFile != "" {
+		fs = append(fs, r.c.ClientCAFile)
+	}
+	return fs
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, fn := range r.files() {
+		fi, err := os.Stat(fn)
+		// 证书轮换时文件可能短暂不存在, 下一次再检查
+		if err != nil {
+			return false
+		}
+		if !fi.ModTime().Equal(r.stamps[fn]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 定期检查证书文件, 变化后重新加载
+func (r *Reloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			log.Error("reload tls cert error: %s\n", err)
+		}
+	}
+}
+
+// ServerConfig 每次握手取当前证书与客户端 CA
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   r.clientAuth,
+				ClientCAs:    r.clientCAs,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// InsecureServerConfig 使用内置的自签名证书, 所有部署共用同一私钥, 只用于开发
+func InsecureServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{insecure.Cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+}
+
+// ClientConfig 客户端配置, caFile 为空时使用系统 CA, certFile 非空时提交客户端证书
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+	if caFile != "" {
+		pool, err := LoadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls key pair (%s, %s) error: %s", certFile, keyFile, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// InsecureClientConfig 信任内置的自签名证书, 只用于开发
+func InsecureClientConfig() *tls.Config {
+	return &tls.Config{RootCAs: insecure.CertPool}
+}
+
+// LoadPool 加载 PEM 格式的 CA 证书
+func LoadPool(fn string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in (%s).", fn)
+	}
+	return pool, nil
+}
+
+// Identity 客户端证书对应的用户名, 取 CommonName, 为空时取第一个邮箱的用户部分
+func Identity(chains [][]*x509.Certificate) string {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return ""
+	}
+	leaf := chains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName
+	}
+	if len(leaf.EmailAddresses) > 0 {
+		return strings.SplitN(leaf.EmailAddresses[0], "@", 2)[0]
+	}
+	return ""
+}
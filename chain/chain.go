@@ -0,0 +1,272 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	log "github.com/laik/logger"
+)
+
+const (
+	// 每个采集规则一个集合保存各文件流的链头
+	CHAIN_DATABASE = "audit_chain"
+	CHECKPOINT     = "checkpoint"
+)
+
+// Head 文件流最后一条记录
+type Head struct {
+	Stream string `bson:"_id" json:"stream"`
+	Seq    int64  `bson:"seq" json:"seq"`
+	Hash   string `bson:"hash" json:"hash"`
+}
+
+// Checkpoint 链头签名
+type Checkpoint struct {
+	Id        string    `bson:"_id" json:"id"`
+	Rule      string    `bson:"rule" json:"rule"`
+	Stream    string    `bson:"stream" json:"stream"`
+	Seq       int64     `bson:"seq" json:"seq"`
+	Hash      string    `bson:"hash" json:"hash"`
+	Time      time.Time `bson:"time" json:"time"`
+	PublicKey string    `bson:"publicKey" json:"publicKey"`
+	Signature string    `bson:"signature" json:"signature"`
+}
+
+func (c *Checkpoint) payload() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s\n%d", c.Rule, c.Stream, c.Seq, c.Hash, c.Time.UnixNano()))
+}
+
+type head struct {
+	Head
+	rule string
+	// 已计算未确认入库的记录
+	pending *Head
+	// 最近一次签名的序号
+	signed int64
+	// 链头有变化未保存
+	dirty bool
+}
+
+// Chain 为每个规则/文件流的记录计算哈希链, 入库前实现 logmining.Filter, 入库后实现 logmining.Hook
+type Chain struct {
+	mu    sync.Mutex
+	heads map[string]*head
+
+	access accessor
+	key    ed25519.PrivateKey
+	now    func() time.Time
+}
+
+// accessor 访问存储, 测试时替换
+type accessor func(db, table string, query, res interface{}, op dbapi.OPType) error
+
+func storage(sp *dbapi.StorageParts, persistType dbapi.DBType) accessor {
+	return func(db, table string, query, res interface{}, op dbapi.OPType) error {
+		var _err error
+		dbapi.AccessDatabase(sp, db, table, query, res, op, persistType, &_err)
+		return _err
+	}
+}
+
+// New key 为空时不生成签名检查点
+func New(sp *dbapi.StorageParts, persistType dbapi.DBType, key ed25519.PrivateKey) *Chain {
+	return &Chain{
+		heads:  make(map[string]*head),
+		access: storage(sp, persistType),
+		key:    key,
+		now:    time.Now,
+	}
+}
+
+// PublicKey 校验签名使用的公钥
+func (c *Chain) PublicKey() ed25519.PublicKey {
+	if c.key == nil {
+		return nil
+	}
+	return c.key.Public().(ed25519.PublicKey)
+}
+
+// Filter 计算记录哈希, 必须在所有修改记录的 Filter 之后注册
+func (c *Chain) Filter(e *ll.Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, err := c.head(e.Rule, e.File)
+	if err != nil {
+		return err
+	}
+	e.Log.Stream = e.File
+	e.Log.Seq = h.Seq + 1
+	e.Log.PrevHash = h.Hash
+	e.Log.Hash = Sum(e.Log)
+	h.pending = &Head{Stream: e.File, Seq: e.Log.Seq, Hash: e.Log.Hash}
+	return nil
+}
+
+// Fire 记录入库成功后推进链头, 链头在 Checkpoint 时保存
+func (c *Chain) Fire(e *ll.Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.heads[key(e.Rule, e.File)]
+	if !ok || h.pending == nil || h.pending.Seq != e.Log.Seq {
+		return
+	}
+	h.Head, h.pending, h.dirty = *h.pending, nil, true
+}
+
+func (c *Chain) head(rule, stream string) (*head, error) {
+	k := key(rule, stream)
+	if h, ok := c.heads[k]; ok {
+		return h, nil
+	}
+	h := &head{rule: rule}
+	err := c.access(CHAIN_DATABASE, rule, bson.M{"_id": stream}, &h.Head, dbapi.GET)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	h.Stream, h.signed = stream, h.Seq
+	if err := c.recover(h); err != nil {
+		return nil, err
+	}
+	c.heads[k] = h
+	return h, nil
+}
+
+// recover 链头只在 Checkpoint 时保存, 异常退出后保存的链头可能落后于已入库的记录;
+// 记录按入库日期分集合, 从当天与前一天的集合中取该流序号最大的记录作为链头
+func (c *Chain) recover(h *head) error {
+	now := c.now()
+	for _, date := range []string{now.Format("2006-01-02"), now.AddDate(0, 0, -1).Format("2006-01-02")} {
+		var last []in.AuditLog
+		err := c.access(ll.LOG_RECORD, ll.Collection(date), &dbapi.FindQuery{
+			Query: bson.M{"Rule": h.rule, "Stream": h.Stream, "Seq": bson.M{"$gt": h.Seq}},
+			Sort:  []string{"-Seq"},
+			Limit: 1,
+		}, &last, dbapi.FIND)
+		if err != nil {
+			return err
+		}
+		if len(last) > 0 {
+			log.Warn("chain head (%s.%s) recovered from seq (%d) to (%d).\n", h.rule, h.Stream, h.Seq, last[0].Seq)
+			h.Seq, h.Hash, h.dirty = last[0].Seq, last[0].Hash, true
+			return nil
+		}
+	}
+	return nil
+}
+
+// Checkpoint 保存有新记录的链头并对其签名
+func (c *Chain) Checkpoint() {
+	now := c.now()
+	var pub string
+	if c.key != nil {
+		pub = hex.EncodeToString(c.PublicKey())
+	}
+
+	type saved struct {
+		h    *head
+		head Head
+	}
+	c.mu.Lock()
+	var heads []saved
+	var cps []*Checkpoint
+	for _, h := range c.heads {
+		if h.dirty {
+			heads = append(heads, saved{h, h.Head})
+			h.dirty = false
+		}
+		if c.key == nil || h.Seq == h.signed {
+			continue
+		}
+		cp := &Checkpoint{
+			Id:        bson.NewObjectId().Hex(),
+			Rule:      h.rule,
+			Stream:    h.Stream,
+			Seq:       h.Seq,
+			Hash:      h.Hash,
+			Time:      now,
+			PublicKey: pub,
+		}
+		cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, cp.payload()))
+		h.signed = h.Seq
+		cps = append(cps, cp)
+	}
+	c.mu.Unlock()
+
+	for _, s := range heads {
+		head := s.head
+		if err := c.access(CHAIN_DATABASE, s.h.rule, bson.M{"_id": head.Stream}, &head, dbapi.SET); err != nil {
+			log.Error("save chain head (%s.%s) error: %s\n", s.h.rule, head.Stream, err)
+			// 下次 Checkpoint 重试
+			c.mu.Lock()
+			s.h.dirty = true
+			c.mu.Unlock()
+		}
+	}
+	for _, cp := range cps {
+		if err := c.access(CHAIN_DATABASE, CHECKPOINT, nil, cp, dbapi.INSERT); err != nil {
+			log.Error("save chain checkpoint (%s.%s) error: %s\n", cp.Rule, cp.Stream, err)
+		}
+	}
+}
+
+// Run 定时保存链头并生成检查点
+func (c *Chain) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		c.Checkpoint()
+	}
+}
+
+// Sum 记录哈希: sha256(PrevHash + 各字段), 字段按固定顺序以长度前缀编码
+func Sum(al *in.AuditLog) string {
+	h := sha256.New()
+	for _, v := range []string{
+		al.PrevHash,
+		al.Rule,
+		al.Stream,
+		strconv.FormatInt(al.Seq, 10),
+		al.Host,
+		al.Date,
+		al.Device,
+		al.SystemType,
+		al.DateTime,
+		al.IpAddr,
+		al.Operation,
+		al.State,
+		al.UserName,
+		strconv.Itoa(al.RiskScore),
+	} {
+		write(h, v)
+	}
+	for _, vs := range [][]string{al.Categories, al.Masked} {
+		write(h, strconv.Itoa(len(vs)))
+		for _, v := range vs {
+			write(h, v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func write(h hash.Hash, v string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(v)))
+	h.Write(n[:])
+	h.Write([]byte(v))
+}
+
+func key(rule, stream string) string {
+	return rule + "\x00" + stream
+}
@@ -0,0 +1,317 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// store 内存中的链头、检查点与按天的记录集合, 只支持本包使用的查询
+type store struct {
+	heads       map[string]Head
+	checkpoints []Checkpoint
+	logs        map[string][]in.AuditLog
+	// 每次 FIND 检查点返回的数量
+	loaded []int
+}
+
+func newStore() *store {
+	return &store{heads: make(map[string]Head), logs: make(map[string][]in.AuditLog)}
+}
+
+func (s *store) access(db, table string, query, res interface{}, op dbapi.OPType) error {
+	switch {
+	case db == CHAIN_DATABASE && table == CHECKPOINT && op == dbapi.INSERT:
+		s.checkpoints = append(s.checkpoints, *res.(*Checkpoint))
+	case db == CHAIN_DATABASE && table == CHECKPOINT && op == dbapi.FIND:
+		q := query.(*dbapi.FindQuery).Query.(bson.M)
+		var r []Checkpoint
+		for _, cp := range s.checkpoints {
+			if cp.Rule != q["rule"] {
+				continue
+			}
+			for _, c := range q["$or"].([]bson.M) {
+				seq := c["seq"].(bson.M)
+				if cp.Stream == c["stream"] && cp.Seq >= seq["$gte"].(int64) && cp.Seq <= seq["$lte"].(int64) {
+					r = append(r, cp)
+					break
+				}
+			}
+		}
+		sort.Slice(r, func(i, j int) bool {
+			if r[i].Stream != r[j].Stream {
+				return r[i].Stream < r[j].Stream
+			}
+			return r[i].Seq < r[j].Seq
+		})
+		s.loaded = append(s.loaded, len(r))
+		*res.(*[]Checkpoint) = r
+	case db == CHAIN_DATABASE && op == dbapi.GET:
+		h, ok := s.heads[table+"/"+query.(bson.M)["_id"].(string)]
+		if !ok {
+			return mgo.ErrNotFound
+		}
+		*res.(*Head) = h
+	case db == CHAIN_DATABASE && op == dbapi.SET:
+		s.heads[table+"/"+query.(bson.M)["_id"].(string)] = *res.(*Head)
+	case db == ll.LOG_RECORD && op == dbapi.FIND:
+		fq := query.(*dbapi.FindQuery)
+		q := fq.Query.(bson.M)
+		var r []in.AuditLog
+		for _, l := range s.logs[table] {
+			if l.Rule == q["Rule"] && l.Stream == q["Stream"] && l.Seq > q["Seq"].(bson.M)["$gt"].(int64) {
+				r = append(r, l)
+			}
+		}
+		sort.Slice(r, func(i, j int) bool { return r[i].Seq > r[j].Seq })
+		if len(r) > fq.Limit {
+			r = r[:fq.Limit]
+		}
+		*res.(*[]in.AuditLog) = r
+	case db == ll.LOG_RECORD && op == dbapi.AGGREGATE:
+		rule := query.([]bson.M)[0]["$match"].(bson.M)["Rule"]
+		ranges := make(map[string]*seqRange)
+		for _, l := range s.logs[table] {
+			if l.Rule != rule || l.Seq == 0 {
+				continue
+			}
+			r, ok := ranges[l.Stream]
+			if !ok {
+				r = &seqRange{Stream: l.Stream, First: l.Seq, Last: l.Seq}
+				ranges[l.Stream] = r
+			}
+			if l.Seq < r.First {
+				r.First = l.Seq
+			}
+			if l.Seq > r.Last {
+				r.Last = l.Seq
+			}
+		}
+		list := res.(*[]seqRange)
+		for _, r := range ranges {
+			*list = append(*list, *r)
+		}
+	case db == ll.LOG_RECORD && op == dbapi.EACH:
+		q := query.(*dbapi.FindQuery).Query.(bson.M)
+		var r []in.AuditLog
+		for _, l := range s.logs[table] {
+			if l.Rule == q["Rule"] {
+				r = append(r, l)
+			}
+		}
+		sort.SliceStable(r, func(i, j int) bool {
+			if r[i].Stream != r[j].Stream {
+				return r[i].Stream < r[j].Stream
+			}
+			return r[i].Seq < r[j].Seq
+		})
+		each := res.(*dbapi.Each)
+		for _, l := range r {
+			*each.Doc.(*in.AuditLog) = l
+			if err := each.Fn(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported %s.%s op (%d)", db, table, op)
+	}
+	return nil
+}
+
+func testChain(t *testing.T, s *store, key ed25519.PrivateKey, now time.Time) *Chain {
+	c := New(dbapi.NewStorageParts(), dbapi.KV, key)
+	c.access = s.access
+	c.now = func() time.Time { return now }
+	return c
+}
+
+// insert 模拟入库流程: Filter 计算哈希, 写入当天集合后 Fire
+func insert(t *testing.T, c *Chain, s *store, date, rule, stream string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		e := &ll.Entry{Rule: rule, File: stream, Log: &in.AuditLog{Rule: rule, UserName: "root", Operation: fmt.Sprintf("op %d", i)}}
+		if err := c.Filter(e); err != nil {
+			t.Fatal(err)
+		}
+		s.logs[ll.Collection(date)] = append(s.logs[ll.Collection(date)], *e.Log)
+		c.Fire(e)
+	}
+}
+
+func testKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCheckpointSavesHeads(t *testing.T) {
+	s := newStore()
+	now := time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)
+	c := testChain(t, s, nil, now)
+	insert(t, c, s, "2019-02-25", "r", "/a.log", 3)
+	// 入库时不保存链头
+	if len(s.heads) != 0 {
+		t.Fatalf("heads %v saved before checkpoint", s.heads)
+	}
+	c.Checkpoint()
+	if h := s.heads["r//a.log"]; h.Seq != 3 || h.Hash != s.logs["log_2019_02_25"][2].Hash {
+		t.Errorf("head %+v", h)
+	}
+	// 没有密钥时不签名
+	if len(s.checkpoints) != 0 {
+		t.Errorf("checkpoints %v", s.checkpoints)
+	}
+}
+
+func TestRecoverHead(t *testing.T) {
+	cases := []struct {
+		desc string
+		// 保存链头后再写入的记录数及其日期
+		saved, lost int
+		date        string
+	}{
+		{"no saved head", 0, 3, "2019-02-25"},
+		{"saved head", 3, 0, "2019-02-25"},
+		{"lost today", 3, 2, "2019-02-25"},
+		{"lost yesterday", 3, 2, "2019-02-24"},
+	}
+	for _, k := range cases {
+		s := newStore()
+		now := time.Date(2019, 2, 25, 0, 1, 0, 0, time.Local)
+		c := testChain(t, s, nil, now)
+		insert(t, c, s, k.date, "r", "/a.log", k.saved)
+		c.Checkpoint()
+		insert(t, c, s, k.date, "r", "/a.log", k.lost)
+
+		// 异常退出后重新启动
+		c = testChain(t, s, nil, now)
+		insert(t, c, s, "2019-02-25", "r", "/a.log", 1)
+		c.Checkpoint()
+		want := int64(k.saved + k.lost + 1)
+		if h := s.heads["r//a.log"]; h.Seq != want {
+			t.Errorf("%s: head seq %d, want %d", k.desc, h.Seq, want)
+		}
+		for _, date := range []string{"2019-02-24", "2019-02-25"} {
+			r, err := verify(s.access, "r", date, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Broken != nil {
+				t.Errorf("%s: %s broken %s", k.desc, date, r.Broken)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key := testKey(t)
+	pub := key.Public().(ed25519.PublicKey)
+	s := newStore()
+	c := testChain(t, s, key, time.Date(2019, 2, 24, 23, 0, 0, 0, time.Local))
+	insert(t, c, s, "2019-02-24", "r", "/a.log", 4)
+	c.Checkpoint()
+	c.now = func() time.Time { return time.Date(2019, 2, 25, 1, 0, 0, 0, time.Local) }
+	insert(t, c, s, "2019-02-25", "r", "/a.log", 3)
+	insert(t, c, s, "2019-02-25", "r", "/b.log", 2)
+	insert(t, c, s, "2019-02-25", "other", "/a.log", 2)
+	c.Checkpoint()
+	insert(t, c, s, "2019-02-25", "r", "/a.log", 2)
+	c.Checkpoint()
+	// 未纳入哈希链的记录
+	s.logs["log_2019_02_25"] = append(s.logs["log_2019_02_25"], in.AuditLog{Rule: "r", UserName: "old"})
+
+	s.loaded = nil
+	r, err := verify(s.access, "r", "2019-02-25", pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Broken != nil || r.Records != 8 || r.Unchained != 1 || len(r.Streams) != 2 {
+		t.Fatalf("report %+v", r)
+	}
+	a, b := r.Streams[0], r.Streams[1]
+	if a.Stream != "/a.log" || a.First != 5 || a.Last != 9 || a.Records != 5 || a.Checkpoints != 2 {
+		t.Errorf("stream %+v", a)
+	}
+	if b.Stream != "/b.log" || b.First != 1 || b.Last != 2 || b.Checkpoints != 1 {
+		t.Errorf("stream %+v", b)
+	}
+	// 只加载当天序号范围内的检查点, 前一天的检查点不加载
+	if len(s.loaded) != 1 || s.loaded[0] != 3 {
+		t.Errorf("loaded checkpoints %v, want [3]", s.loaded)
+	}
+
+	tampers := []struct {
+		desc   string
+		modify func(logs []in.AuditLog, cps []Checkpoint)
+		seq    int64
+		reason string
+	}{
+		{"modified", func(l []in.AuditLog, _ []Checkpoint) { l[1].Operation = "ls" }, 6, "hash mismatch"},
+		{"rehashed", func(l []in.AuditLog, _ []Checkpoint) { l[1].Operation = "ls"; l[1].Hash = Sum(&l[1]) }, 7, "previous hash"},
+		{"deleted", func(l []in.AuditLog, _ []Checkpoint) { l[1].Rule = "x" }, 6, "record missing"},
+		{"duplicated", func(l []in.AuditLog, _ []Checkpoint) { l[1] = l[0] }, 5, "duplicate sequence"},
+		{"resigned", func(l []in.AuditLog, cps []Checkpoint) {
+			for i := range cps {
+				if cps[i].Stream == "/a.log" && cps[i].Seq == 7 {
+					cps[i].Hash = l[0].Hash
+				}
+			}
+		}, 7, "signature invalid"},
+		// 重新计算整条链后与签名的检查点不一致
+		{"rechained", func(l []in.AuditLog, _ []Checkpoint) {
+			for i := 0; i < 5; i++ {
+				if i > 0 {
+					l[i].PrevHash = l[i-1].Hash
+				}
+				l[i].Operation += "!"
+				l[i].Hash = Sum(&l[i])
+			}
+		}, 7, "differs from signed checkpoint"},
+	}
+	for _, k := range tampers {
+		// 复制一份再修改
+		logs := append([]in.AuditLog(nil), s.logs["log_2019_02_25"]...)
+		var stream []in.AuditLog
+		for _, l := range logs {
+			if l.Rule == "r" && l.Stream == "/a.log" {
+				stream = append(stream, l)
+			}
+		}
+		cps := append([]Checkpoint(nil), s.checkpoints...)
+		k.modify(stream, cps)
+		ts := newStore()
+		ts.checkpoints = cps
+		for _, l := range logs {
+			if l.Rule == "r" && l.Stream == "/a.log" {
+				continue
+			}
+			ts.logs["log_2019_02_25"] = append(ts.logs["log_2019_02_25"], l)
+		}
+		ts.logs["log_2019_02_25"] = append(ts.logs["log_2019_02_25"], stream...)
+
+		r, err := verify(ts.access, "r", "2019-02-25", pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Broken == nil || r.Broken.Stream != "/a.log" || r.Broken.Seq != k.seq || !strings.Contains(r.Broken.Reason, k.reason) {
+			t.Errorf("%s: broken %v, want seq %d %s", k.desc, r.Broken, k.seq, k.reason)
+		}
+		// 断裂后仍统计全部记录
+		if r.Records != 8 && k.desc != "deleted" {
+			t.Errorf("%s: records %d", k.desc, r.Records)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/laik/logger"
+)
+
+// LoadKey 读取hex编码的Ed25519私钥种子, 文件不存在时生成新密钥
+func LoadKey(fn string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(fn, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Info("generate chain checkpoint key (%s) public key (%s).\n", fn, hex.EncodeToString(priv.Public().(ed25519.PublicKey)))
+		return priv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("chain key (%s) must be a hex encoded %d bytes ed25519 seed.", fn, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
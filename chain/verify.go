@@ -0,0 +1,200 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Broken 链断裂位置
+type Broken struct {
+	Stream string `json:"stream"`
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+func (b *Broken) String() string {
+	return fmt.Sprintf("stream (%s) seq (%d) %s", b.Stream, b.Seq, b.Reason)
+}
+
+// StreamReport 单个文件流的校验结果
+type StreamReport struct {
+	Stream      string  `json:"stream"`
+	First       int64   `json:"first"`
+	Last        int64   `json:"last"`
+	Records     int     `json:"records"`
+	Checkpoints int     `json:"checkpoints"`
+	Broken      *Broken `json:"broken,omitempty"`
+}
+
+// Report 规则某天的校验结果
+type Report struct {
+	Rule    string `json:"rule"`
+	Date    string `json:"date"`
+	Records int    `json:"records"`
+	// 未纳入哈希链的记录数(启用哈希链之前写入)
+	Unchained int             `json:"unchained"`
+	Streams   []*StreamReport `json:"streams"`
+	// 第一处断裂
+	Broken *Broken `json:"broken,omitempty"`
+}
+
+// Verify 按序号遍历规则某天的记录, 校验哈希、前后链接与签名检查点
+func Verify(sp *dbapi.StorageParts, persistType dbapi.DBType, rule, date string, pub ed25519.PublicKey) (*Report, error) {
+	return verify(storage(sp, persistType), rule, date, pub)
+}
+
+// seqRange 某天一个文件流的序号范围
+type seqRange struct {
+	Stream string `bson:"_id"`
+	First  int64  `bson:"first"`
+	Last   int64  `bson:"last"`
+}
+
+// verify 记录按流与序号排序后逐条校验, 只加载当天序号范围内的检查点
+func verify(access accessor, rule, date string, pub ed25519.PublicKey) (*Report, error) {
+	report := &Report{Rule: rule, Date: date}
+	collection := ll.Collection(date)
+
+	cps := make(map[string][]Checkpoint)
+	if pub != nil {
+		var ranges []seqRange
+		err := access(ll.LOG_RECORD, collection, []bson.M{
+			{"$match": bson.M{"Rule": rule, "Seq": bson.M{"$gt": 0}}},
+			{"$group": bson.M{"_id": "$Stream", "first": bson.M{"$min": "$Seq"}, "last": bson.M{"$max": "$Seq"}}},
+		}, &ranges, dbapi.AGGREGATE)
+		if err != nil {
+			return nil, err
+		}
+		if len(ranges) > 0 {
+			or := make([]bson.M, 0, len(ranges))
+			for _, r := range ranges {
+				or = append(or, bson.M{"stream": r.Stream, "seq": bson.M{"$gte": r.First, "$lte": r.Last}})
+			}
+			var list []Checkpoint
+			err := access(CHAIN_DATABASE, CHECKPOINT, &dbapi.FindQuery{
+				Query: bson.M{"rule": rule, "$or": or},
+				Sort:  []string{"stream", "seq"},
+			}, &list, dbapi.FIND)
+			if err != nil {
+				return nil, err
+			}
+			for _, cp := range list {
+				cps[cp.Stream] = append(cps[cp.Stream], cp)
+			}
+		}
+	}
+
+	var cur *streamVerifier
+	done := func() {
+		if cur == nil {
+			return
+		}
+		report.Streams = append(report.Streams, cur.sr)
+		if cur.sr.Broken != nil && report.Broken == nil {
+			report.Broken = cur.sr.Broken
+		}
+	}
+	rec := new(in.AuditLog)
+	each := &dbapi.Each{
+		Doc: rec,
+		Fn: func() error {
+			r := *rec
+			// 游标复用同一个对象, 清空以免缺失的字段沿用上一条记录的值
+			*rec = in.AuditLog{}
+			report.Records++
+			if r.Seq == 0 {
+				report.Unchained++
+				return nil
+			}
+			if cur == nil || cur.sr.Stream != r.Stream {
+				done()
+				cur = &streamVerifier{sr: &StreamReport{Stream: r.Stream}, cps: cps[r.Stream], pub: pub}
+			}
+			cur.add(&r)
+			return nil
+		},
+	}
+	err := access(ll.LOG_RECORD, collection, &dbapi.FindQuery{
+		Query: bson.M{"Rule": rule},
+		Sort:  []string{"Stream", "Seq"},
+	}, each, dbapi.EACH)
+	if err != nil {
+		return nil, err
+	}
+	done()
+	return report, nil
+}
+
+// streamVerifier 按序号逐条校验一个文件流, 断裂后只统计记录数
+type streamVerifier struct {
+	sr   *StreamReport
+	prev *in.AuditLog
+	// 按序号排序的检查点
+	cps []Checkpoint
+	pub ed25519.PublicKey
+}
+
+func (v *streamVerifier) add(r *in.AuditLog) {
+	sr := v.sr
+	if sr.Records == 0 {
+		sr.First = r.Seq
+	}
+	sr.Last = r.Seq
+	sr.Records++
+	if sr.Broken != nil {
+		return
+	}
+	broken := func(seq int64, format string, v ...interface{}) {
+		sr.Broken = &Broken{Stream: sr.Stream, Seq: seq, Reason: fmt.Sprintf(format, v...)}
+	}
+
+	if r.Hash != Sum(r) {
+		broken(r.Seq, "hash mismatch, record was modified.")
+		return
+	}
+	if prev := v.prev; prev == nil {
+		// 当天第一条记录的上一条在前一天的集合中, 只有流的起点可以校验
+		if r.Seq == 1 && r.PrevHash != "" {
+			broken(r.Seq, "first record of stream has previous hash.")
+			return
+		}
+	} else {
+		if r.Seq == prev.Seq {
+			broken(r.Seq, "duplicate sequence.")
+			return
+		}
+		if r.Seq != prev.Seq+1 {
+			broken(prev.Seq+1, "record missing, next sequence is (%d).", r.Seq)
+			return
+		}
+		if r.PrevHash != prev.Hash {
+			broken(r.Seq, "previous hash does not link to record (%d).", prev.Seq)
+			return
+		}
+	}
+	v.prev = r
+
+	for len(v.cps) > 0 && v.cps[0].Seq <= r.Seq {
+		cp := &v.cps[0]
+		v.cps = v.cps[1:]
+		if cp.Seq < r.Seq {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+		if err != nil || !ed25519.Verify(v.pub, cp.payload(), sig) {
+			broken(cp.Seq, "checkpoint (%s) signature invalid.", cp.Id)
+			return
+		}
+		if r.Hash != cp.Hash {
+			broken(cp.Seq, "hash differs from signed checkpoint (%s).", cp.Id)
+			return
+		}
+		sr.Checkpoints++
+	}
+}
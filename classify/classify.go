@@ -0,0 +1,183 @@
+package classify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+)
+
+// 敏感操作分类
+const (
+	FILE_DELETE          = "file_delete"
+	PRIVILEGE_ESCALATION = "privilege_escalation"
+	DATA_EXFILTRATION    = "data_exfiltration"
+	PACKAGE_INSTALL      = "package_install"
+	SERVICE_STOP         = "service_stop"
+	CONFIG_CHANGE        = "config_change"
+)
+
+const maxScore = 100
+
+// Rule 分类规则, Operation 匹配 Pattern 时打上 Category 并累加 Score
+type Rule struct {
+	Category string `json:"category"`
+	Pattern  string `json:"pattern"`
+	Score    int    `json:"score"`
+	// 限定系统类型 server/switch/app, 为空时不限
+	SystemType string `json:"systemType,omitempty"`
+	// 仅当操作涉及外部地址时命中, 用于 scp/rsync/curl 外传
+	External bool `json:"external,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// RuleSet 分类规则集
+type RuleSet struct {
+	// 内部网段, 其余地址视为外部
+	InternalNets []string `json:"internalNets,omitempty"`
+	Rules        []*Rule  `json:"rules"`
+
+	nets []*net.IPNet
+}
+
+// DefaultRuleSet 内置规则
+func DefaultRuleSet() *RuleSet {
+	return &RuleSet{
+		InternalNets: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8"},
+		Rules: []*Rule{
+			{Category: FILE_DELETE, Pattern: `(^|[;&|\s])rm\s+(-\w*[rf]\w*\s+)+`, Score: 60},
+			{Category: FILE_DELETE, Pattern: `(^|[;&|\s])(rm|unlink|shred)\s`, Score: 30},
+			{Category: FILE_DELETE, Pattern: `(?i)(^|\s)(delete|erase)\s+(flash|startup-config|/force)`, Score: 60, SystemType: in.SWITCH},
+			{Category: PRIVILEGE_ESCALATION, Pattern: `(^|[;&|\s])(sudo|su)(\s|$)`, Score: 50},
+			{Category: PRIVILEGE_ESCALATION, Pattern: `(^|[;&|\s])(chmod\s+[0-7]*[4-7][0-7]{3}|chmod\s+\S*\+s|visudo|passwd|usermod\s+.*-G\s*\S*(wheel|sudo))`, Score: 50},
+			{Category: DATA_EXFILTRATION, Pattern: `(^|[;&|\s])(scp|rsync|sftp|curl|wget|nc|ncat)\s`, Score: 70, External: true},
+			{Category: PACKAGE_INSTALL, Pattern: `(^|[;&|\s])(yum|dnf|apt|apt-get|zypper)\s+(-\S+\s+)*(install|remove|erase|update|upgrade)|(^|[;&|\s])(rpm\s+-[a-zA-Z]*[iUe]|dpkg\s+-[a-zA-Z]*[ir]|pip3?\s+install)`, Score: 30},
+			{Category: SERVICE_STOP, Pattern: `(^|[;&|\s])(systemctl\s+(stop|disable|mask|restart)|service\s+\S+\s+(stop|restart)|kill(all)?\s|pkill\s|shutdown|reboot|halt|init\s+[06])`, Score: 40},
+			{Category: CONFIG_CHANGE, Pattern: `(?i)(configured from|config_i|configure terminal|system-view|undo\s|shutdown|no\s+\S+|commit|save)`, Score: 40, SystemType: in.SWITCH},
+			{Category: CONFIG_CHANGE, Pattern: `(^|[;&|\s])(vi|vim|sed\s+-i|tee)\s+\S*/etc/|>\s*/etc/`, Score: 30},
+		},
+	}
+}
+
+// Load 从json文件加载规则集, 文件为空时使用内置规则
+func Load(fn string) (*RuleSet, error) {
+	if fn == "" {
+		rs := DefaultRuleSet()
+		return rs, rs.Compile()
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	rs := &RuleSet{}
+	if err := json.Unmarshal(b, rs); err != nil {
+		return nil, fmt.Errorf("risk rules (%s) unmarshal err: %s", fn, err)
+	}
+	return rs, rs.Compile()
+}
+
+// Compile 预编译规则
+func (rs *RuleSet) Compile() error {
+	rs.nets = rs.nets[:0]
+	for _, cidr := range rs.InternalNets {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid internal net (%s).", cidr)
+		}
+		rs.nets = append(rs.nets, ipnet)
+	}
+	for i, r := range rs.Rules {
+		if r.Category == "" {
+			return fmt.Errorf("risk rule #%d without category.", i)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("risk rule #%d (%s) compile pattern error: %s", i, r.Category, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// Classify 返回命中的分类及风险分值
+func (rs *RuleSet) Classify(al *in.AuditLog) ([]string, int) {
+	seen := make(map[string]int)
+	for _, r := range rs.Rules {
+		if r.SystemType != "" && !strings.EqualFold(r.SystemType, al.SystemType) {
+			continue
+		}
+		if !r.re.MatchString(al.Operation) {
+			continue
+		}
+		if r.External && !rs.external(al.Operation) {
+			continue
+		}
+		// 同一分类取最高分
+		if s, ok := seen[r.Category]; !ok || r.Score > s {
+			seen[r.Category] = r.Score
+		}
+	}
+	if len(seen) == 0 {
+		return nil, 0
+	}
+	categories := make([]string, 0, len(seen))
+	score := 0
+	for c, s := range seen {
+		categories = append(categories, c)
+		score += s
+	}
+	sort.Strings(categories)
+	if score > maxScore {
+		score = maxScore
+	}
+	return categories, score
+}
+
+// Filter 实现 logmining.Filter
+func (rs *RuleSet) Filter(e *ll.Entry) error {
+	e.Log.Categories, e.Log.RiskScore = rs.Classify(e.Log)
+	return nil
+}
+
+var (
+	ipPattern   = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+	hostPattern = regexp.MustCompile(`(?:@|://)([A-Za-z0-9][A-Za-z0-9.-]*)`)
+)
+
+// external 操作中是否出现内部网段以外的地址
+func (rs *RuleSet) external(op string) bool {
+	hosts := ipPattern.FindAllString(op, -1)
+	for _, m := range hostPattern.FindAllStringSubmatch(op, -1) {
+		hosts = append(hosts, m[1])
+	}
+	for _, h := range hosts {
+		ip := net.ParseIP(h)
+		if ip == nil {
+			// 域名无法判断归属, 视为外部
+			if h != "localhost" {
+				return true
+			}
+			continue
+		}
+		if !rs.internal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *RuleSet) internal(ip net.IP) bool {
+	for _, n := range rs.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
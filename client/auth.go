@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"logauditer/api"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// tokenAuth 将登录令牌放入每次调用的 authorization metadata
+type tokenAuth struct {
+	mu    sync.RWMutex
+	token string
+}
+
+func (t *tokenAuth) set(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = token
+}
+
+func (t *tokenAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.token == "" {
+		return nil, nil
+	}
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t *tokenAuth) RequireTransportSecurity() bool {
+	return true
+}
+
+// login 密码为空时从终端读取
+func (c *CLI) login(user, password string) error {
+	if password == "" {
+		fmt.Fprintf(os.Stderr, "password for %s: ", user)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("could not read password: %v", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	resp, err := c.client.Login(context.Background(), &api.LoginRequest{User: user, Password: password})
+	if err != nil {
+		return err
+	}
+	c.creds.set(resp.Token)
+	c.printer.println(fmt.Sprintf("login as %s [%s].", resp.User, strings.Join(resp.Roles, ",")))
+	return nil
+}
@@ -2,9 +2,9 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"logauditer/api"
-	"logauditer/insecure"
 	"logauditer/raw"
 	"os"
 	"time"
@@ -26,16 +26,19 @@ type CLI struct {
 	term    *prompt.Prompt
 	conn    *grpc.ClientConn
 	client  api.LogAuditerClient
+	creds   *tokenAuth
 }
 
-//Run runs a new CLI.
-func Run(hostPorts string) (err error) {
+//Run runs a new CLI over tls, it logs in first when user is not empty.
+func Run(hostPorts string, tlsConfig *tls.Config, user, password string) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
 	defer cancel()
+	creds := &tokenAuth{}
 	conn, err := grpc.DialContext(
 		ctx,
 		hostPorts,
-		grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(insecure.CertPool, "")),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithPerRPCCredentials(creds),
 	)
 	if err != nil {
 		return fmt.Errorf("could not dial %s: %v", hostPorts, err)
@@ -55,12 +58,21 @@ func Run(hostPorts string) (err error) {
 		term:    term,
 		client:  api.NewLogAuditerClient(conn),
 		conn:    conn,
+		creds:   creds,
 	}
 
 	defer func() {
-		err = c.Close()
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
 	}()
 
+	if user != "" {
+		if err := c.login(user, password); err != nil {
+			return fmt.Errorf("could not login: %v", err)
+		}
+	}
+
 	c.run()
 
 	return nil
@@ -81,6 +93,9 @@ func (c *CLI) run() {
 	c.printer.printLogo()
 
 	h := func(command string) {
+		if c.follow(command) {
+			return
+		}
 		req := &api.ExecuteRequest{Command: raw.Raw(command)}
 		prmpt = fmt.Sprintf("%s%s", "", prefix)
 		if resp, err := c.client.Execute(context.Background(), req); err != nil {
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"io"
+	"logauditer/api"
+	"logauditer/command"
+	"os"
+	"os/signal"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// follow runs FOLLOW locally over the streaming RPCs, it returns false for any other command.
+func (c *CLI) follow(line string) bool {
+	cmd, args, err := command.NewParser().Parse(line)
+	if err != nil {
+		return false
+	}
+	if _, ok := cmd.(*command.Follow); !ok {
+		return false
+	}
+	reply := cmd.Execute(args...)
+	op, ok := reply.(*command.FollowReply)
+	if !ok {
+		c.printer.println(c.printer.errColor.Sprintf("E| %v", reply.Val()))
+		return true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if op.Message.Workers {
+		err = c.followWorkers(ctx, &op.Message)
+	} else {
+		err = c.followRecords(ctx, &op.Message)
+	}
+	if err != nil && status.Code(err) != codes.Canceled {
+		c.printer.printError(err)
+	}
+	return true
+}
+
+func (c *CLI) followRecords(ctx context.Context, op *command.FollowOp) error {
+	stream, err := c.client.TailRecords(ctx, &api.AuditRecordFilter{
+		Rule: op.Rule,
+		Host: op.Host,
+		User: op.User,
+		Op:   op.Op,
+	})
+	if err != nil {
+		return err
+	}
+	for n := 0; op.Limit == 0 || n < op.Limit; n++ {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.printer.printRecord(r)
+	}
+	return nil
+}
+
+func (c *CLI) followWorkers(ctx context.Context, op *command.FollowOp) error {
+	stream, err := c.client.WatchWorkers(ctx, &api.WatchWorkersRequest{Rule: op.Rule})
+	if err != nil {
+		return err
+	}
+	for n := 0; op.Limit == 0 || n < op.Limit; n++ {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.printer.printWorkerEvent(e)
+	}
+	return nil
+}
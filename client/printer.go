@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"logauditer/api"
 
@@ -83,3 +84,28 @@ func (p *printer) printResponse(resp *api.ExecuteCommandResponse) {
 		fmt.Fprintf(p.out, "%v\n", resp)
 	}
 }
+
+func (p *printer) printRecord(r *api.AuditRecord) {
+	if r.Dropped > 0 {
+		p.println(p.nilColor.Sprintf("(%d records dropped)", r.Dropped))
+	}
+	p.println(fmt.Sprintf("%s| %s %s %s@%s [%s] %s",
+		time.Unix(0, r.Time).Format("15:04:05"),
+		r.Rule, r.Host, r.UserName, r.IpAddr, r.State, r.Operation,
+	))
+}
+
+func (p *printer) printWorkerEvent(e *api.WorkerEvent) {
+	if e.Dropped > 0 {
+		p.println(p.nilColor.Sprintf("(%d events dropped)", e.Dropped))
+	}
+	line := fmt.Sprintf("%s| %s %s %s %s",
+		time.Unix(0, e.Time).Format("15:04:05"),
+		e.Rule, e.Type, e.File, e.Message,
+	)
+	if e.Type == api.WorkerEvent_ERROR {
+		p.println(p.errColor.Sprint(line))
+		return
+	}
+	p.println(line)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
 
 	"logauditer/api"
+	"logauditer/certs"
 	cli "logauditer/client"
 )
 
@@ -19,6 +21,20 @@ var (
 
 var hosts = flag.String("host", "127.0.0.1:9992", "Host to connect to a server.")
 
+var user = flag.String("user", "", "User to login, empty when the server has no authentication.")
+
+var password = flag.String("password", "", "Password of user, read from LOGAUDITER_PASSWORD or the terminal when empty.")
+
+var caFile = flag.String("ca", "", "CA file to verify the server certificate, empty use system CAs.")
+
+var certFile = flag.String("cert", "", "Client certificate file for mutual tls, its common name is the login user.")
+
+var keyFile = flag.String("key", "", "Client private key file for mutual tls.")
+
+var serverName = flag.String("server-name", "", "Server name to verify the server certificate, empty use the host.")
+
+var insecureDev = flag.Bool("insecure-dev", false, "Trust the built-in development certificate, never use in production.")
+
 var showVersion = flag.Bool("version", false, "Show logAuditer version.")
 
 func main() {
@@ -29,7 +45,23 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err := cli.Run(*hosts); err != nil {
+	if *password == "" {
+		*password = os.Getenv("LOGAUDITER_PASSWORD")
+	}
+
+	var tlsConfig *tls.Config
+	if *insecureDev {
+		tlsConfig = certs.InsecureClientConfig()
+	} else {
+		c, err := certs.ClientConfig(*caFile, *certFile, *keyFile, *serverName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load tls config: %v", err)
+			os.Exit(1)
+		}
+		tlsConfig = c
+	}
+
+	if err := cli.Run(*hosts, tlsConfig, *user, *password); err != nil {
 		fmt.Fprintf(os.Stderr, "could not run CLI: %v", err)
 	}
 }
@@ -1,37 +1,72 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"logauditer/alert"
+	"logauditer/auth"
 	"logauditer/cache"
+	"logauditer/certs"
+	"logauditer/chain"
+	"logauditer/classify"
 	"logauditer/command"
+	"logauditer/config"
 	"logauditer/dbapi"
+	"logauditer/live"
+	ll "logauditer/logmining"
+	"logauditer/provision"
+	"logauditer/redact"
+	"logauditer/report"
+	"logauditer/retention"
 	"logauditer/server"
+	"logauditer/trail"
 	"logauditer/web"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/laik/logger"
 )
 
 func main() {
-	var httpAddr = flag.String("http", ":80", "http server addr.")
-	var url = flag.String("dburl", "localhost:27017", "mgo db url addr.")
+	cfg := config.Default()
+	cfg.BindFlags(flag.CommandLine)
+	var configFile = flag.String("config", "", "yaml or json config file, flags and LOGAUDITER_* env override it.")
+	var printConfig = flag.Bool("print-config", false, "print the effective config and exit.")
 
 	flag.Parse()
 
-	Addr := "127.0.0.1:9992"
+	cfg, err := loadConfig(*configFile)
+	if *printConfig {
+		fmt.Print(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		os.Exit(0)
+	}
 
 	//	go http.ListenAndServe(fmt.Sprintf(":%d", 12345), nil)
 
 	sp := dbapi.NewStorageParts()
 
-	m, err := dbapi.NewKVMongo(*url)
+	m, err := dbapi.NewKVMongo(cfg.Storage.URL)
 
-	log.UnSetOutFile()
-	log.SetConsole()
+	if cfg.Log.Output == config.OUTPUT_FILE {
+		log.SetOutFile(cfg.Log.File)
+	} else {
+		log.UnSetOutFile()
+		log.SetConsole()
+	}
 
 	log.NewLogger(
-		map[string]interface{}{"level": log.DEBUG},
+		map[string]interface{}{"level": logLevel(cfg.Log.Level)},
 	)
 
 	defer log.Flush()
@@ -45,12 +80,49 @@ func main() {
 	}
 	sp.AddStoragePart(m)
 
-	go web.NewHttpServer(*httpAddr, &web.HttpService{SP: sp})
+	rs, err := classify.Load(cfg.RiskRules)
+	if err != nil {
+		log.Error("[ERROR] load risk rules occur error: %s.\n", err)
+		os.Exit(1)
+	}
+	// 分类需要原始内容, 先于脱敏执行
+	ll.RegisterFilter(rs)
+
+	rd, err := redact.Load(cfg.RedactRules)
+	if err != nil {
+		log.Error("[ERROR] load redact rules occur error: %s.\n", err)
+		os.Exit(1)
+	}
+	ll.RegisterFilter(rd)
+
+	// 哈希链覆盖最终入库内容, 最后执行
+	var key []byte
+	if cfg.Chain.Key != "" {
+		if key, err = chain.LoadKey(cfg.Chain.Key); err != nil {
+			log.Error("[ERROR] load chain key occur error: %s.\n", err)
+			os.Exit(1)
+		}
+	}
+	ch := chain.New(sp, dbapi.KV, key)
+	ll.RegisterFilter(ch)
+	ll.RegisterHook(ch)
+	go ch.Run(time.Duration(cfg.Chain.Checkpoint))
+
+	reports := report.NewManager(sp, dbapi.KV, cfg.ReportDir, cfg.ExportMaxRows)
+	if err := reports.Load(); err != nil {
+		log.Error("[ERROR] load reports occur error: %s.\n", err)
+		os.Exit(1)
+	}
+	go reports.Start()
+
+	hub := live.NewHub()
+	ll.RegisterHook(hub)
+	ll.RegisterListener(hub)
 
 	c := cache.NewCache()
 
 	server, err := server.NewServer(
-		command.NewParser(c),
+		command.NewParser(),
 		c,
 		sp,
 		dbapi.KV,
@@ -59,9 +131,231 @@ func main() {
 		log.Error("[ERROR] initialization server occur error: %s.\n", err)
 		os.Exit(1)
 	}
+	server.SetChain(ch)
+	server.SetReports(reports)
+	server.SetLive(hub)
+	server.SetMaxWorkers(cfg.Workers.Max)
+
+	rec := trail.New(sp, dbapi.KV)
+	server.SetTrail(rec)
+
+	var users *auth.Manager
+	if cfg.Auth.Enabled {
+		users = auth.NewManager(sp, dbapi.KV, time.Duration(cfg.Auth.SessionTTL))
+		if err := users.Load(); err != nil {
+			log.Error("[ERROR] load users occur error: %s.\n", err)
+			os.Exit(1)
+		}
+		pw, err := users.Bootstrap(cfg.Auth.AdminPassword)
+		if err != nil {
+			log.Error("[ERROR] create admin user occur error: %s.\n", err)
+			os.Exit(1)
+		}
+		if pw != "" && cfg.Auth.AdminPassword == "" {
+			log.Warn("created user (admin) with password (%s), change it with USER SET.\n", pw)
+		}
+		if cfg.Auth.LDAPConfig != "" {
+			l, err := auth.LoadLDAP(cfg.Auth.LDAPConfig)
+			if err != nil {
+				log.Error("[ERROR] load ldap config occur error: %s.\n", err)
+				os.Exit(1)
+			}
+			users.SetLDAP(l)
+		}
+		server.SetAuth(users)
+	} else {
+		log.Warn("authentication is disabled, anyone can manage rules and read records.\n")
+	}
+
+	var tlsConfig *tls.Config
+	var reloader *certs.Reloader
+	switch {
+	case cfg.TLS.Cert != "":
+		reloader, err = certs.NewReloader(&certs.Config{
+			CertFile:     cfg.TLS.Cert,
+			KeyFile:      cfg.TLS.Key,
+			ClientCAFile: cfg.TLS.ClientCA,
+			ClientAuth:   cfg.TLS.ClientAuth,
+		})
+		if err != nil {
+			log.Error("[ERROR] load tls cert occur error: %s.\n", err)
+			os.Exit(1)
+		}
+		if cfg.TLS.Reload > 0 {
+			go reloader.Watch(time.Duration(cfg.TLS.Reload))
+		}
+		tlsConfig = reloader.ServerConfig()
+	default:
+		log.Warn("using the built-in development certificate, its private key is public.\n")
+		tlsConfig = certs.InsecureServerConfig()
+	}
+	server.SetTLS(tlsConfig)
+
+	if err := loadRules(server, cfg.Rules); err != nil {
+		log.Error("[ERROR] %s.\n", err)
+		os.Exit(1)
+	}
+
+	var pv *provision.Provisioner
+	if cfg.Provision.Dir != "" {
+		pv = provision.New(cfg.Provision.Dir, cfg.Provision.Prune, time.Duration(cfg.Provision.Debounce), server)
+		server.SetProvisioner(pv)
+		pv.Sync()
+		go func() {
+			if err := pv.Watch(); err != nil {
+				log.Error("[ERROR] watch rules dir (%s) occur error: %s.\n", cfg.Provision.Dir, err)
+			}
+		}()
+	}
 
-	if err := server.Run(Addr); err != nil {
-		log.Error("[ERROR] run server occur error: %s.\n", err)
+	cleaner := retention.New(sp, dbapi.KV, time.Duration(cfg.Retention.Interval), retentionPolicies(cfg)...)
+	go cleaner.Run()
+
+	httpService := &web.HttpService{SP: sp, Chain: ch, ExportMaxRows: cfg.ExportMaxRows, Reports: reports, Live: hub, Auth: users, Trail: rec}
+	if cfg.HTTP.TLS {
+		httpService.TLS = tlsConfig
+	}
+
+	gw, err := web.Gateway(server)
+	if err != nil {
+		log.Error("[ERROR] initialization gateway occur error: %s.\n", err)
 		os.Exit(1)
 	}
+	httpService.Gateway = gw
+	go web.NewHttpServer(cfg.HTTP.Addr, httpService)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.Run(cfg.GRPC.Addr) }()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	code := 0
+wait:
+	for {
+		select {
+		case err := <-errCh:
+			// 已启动的工作进程同样需要入库并保存读取位置
+			log.Error("[ERROR] run server occur error, shutdown in %s: %s.\n", time.Duration(cfg.Shutdown.Timeout), err)
+			code = 1
+			break wait
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				cfg = reload(*configFile, cfg, server, pv, reloader, cleaner)
+				continue
+			}
+			log.Info("receive signal (%s), shutdown in %s.\n", sig, time.Duration(cfg.Shutdown.Timeout))
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Shutdown.Timeout))
+	// 先结束实时推送, 否则推送连接不会结束
+	hub.Close()
+	if err := httpService.Shutdown(ctx); err != nil {
+		log.Error("[ERROR] shutdown http server occur error: %s.\n", err)
+		code = 1
+	}
+	if pv != nil {
+		pv.Close()
+	}
+	cleaner.Close()
+	// 停止接受请求, 关闭全部工作进程, 已读取的行入库并保存读取位置
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("[ERROR] shutdown server occur error: %s.\n", err)
+		code = 1
+	}
+	cancel()
+	ch.Checkpoint()
+	log.Info("stop logaudit server.\n")
+	log.Flush()
+	os.Exit(code)
+}
+
+// loadConfig 依次应用配置文件、环境变量与命令行参数并检查
+func loadConfig(fn string) (*config.Config, error) {
+	cfg, err := config.Load(fn)
+	if err == nil {
+		err = cfg.Env()
+	}
+	if err == nil {
+		err = cfg.Override(flag.CommandLine)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	return cfg, err
+}
+
+// loadRules 创建并提交配置文件中的规则
+func loadRules(server *server.Server, rules []config.Rule) error {
+	for i := range rules {
+		r := &rules[i]
+		options, _ := r.JSON()
+		if err := server.LoadRule(r.Name, options, r.Start); err != nil {
+			return fmt.Errorf("load rule (%s) from config occur error: %s", r.Name, err)
+		}
+		log.Info("load rule (%s) from config, start (%t).\n", r.Name, r.Start)
+	}
+	return nil
+}
+
+// retentionPolicies 记录、告警与操作审计集合的保留策略
+func retentionPolicies(cfg *config.Config) []retention.Policy {
+	return []retention.Policy{
+		{Database: ll.LOG_RECORD, Prefix: "log_", Days: cfg.Retention.Records},
+		{Database: alert.ALERT_DATABASE, Prefix: "alert_", Days: cfg.Retention.Alerts},
+		{Database: trail.TRAIL_DATABASE, Prefix: "trail_", Days: cfg.Retention.Trail},
+	}
+}
+
+// reload 收到 SIGHUP 时重新读取配置, 应用日志级别、规则数上限、数据保留、规则、规则目录与证书;
+// 监听地址、存储等其它配置需要重启生效. 返回运行中的配置, 配置有错误时保持原配置
+func reload(fn string, cur *config.Config, server *server.Server, pv *provision.Provisioner, reloader *certs.Reloader, cleaner *retention.Cleaner) *config.Config {
+	log.Info("receive signal (SIGHUP), reload config (%s).\n", fn)
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		log.Error("[ERROR] reload config occur error, keep the running config: %s.\n", err)
+		return cur
+	}
+	log.NewLogger(
+		map[string]interface{}{"level": logLevel(cfg.Log.Level)},
+	)
+	server.SetMaxWorkers(cfg.Workers.Max)
+	if cfg.Retention != cur.Retention {
+		cleaner.Set(time.Duration(cfg.Retention.Interval), retentionPolicies(cfg)...)
+	}
+	if err := loadRules(server, cfg.Rules); err != nil {
+		log.Error("[ERROR] %s.\n", err)
+	}
+	if pv != nil {
+		pv.Sync()
+	}
+	if reloader != nil {
+		if err := reloader.Reload(); err != nil {
+			log.Error("[ERROR] reload tls cert occur error: %s.\n", err)
+		}
+	}
+	switch {
+	case cfg.GRPC != cur.GRPC, cfg.HTTP != cur.HTTP, cfg.Storage != cur.Storage, cfg.TLS != cur.TLS,
+		cfg.Log.Output != cur.Log.Output, cfg.Log.File != cur.Log.File, cfg.Auth != cur.Auth,
+		cfg.Provision != cur.Provision, cfg.Chain != cur.Chain:
+		log.Warn("listen addresses, storage, tls, auth, rules dir and chain changes take effect after restart.\n")
+	}
+	// 需要重启的配置仍是启动时的值, 下次重新读取时与其比较
+	cfg.GRPC, cfg.HTTP, cfg.Storage, cfg.TLS, cfg.Auth, cfg.Provision, cfg.Chain = cur.GRPC, cur.HTTP, cur.Storage, cur.TLS, cur.Auth, cur.Provision, cur.Chain
+	cfg.Log.Output, cfg.Log.File = cur.Log.Output, cur.Log.File
+	cfg.RedactRules, cfg.RiskRules, cfg.ExportMaxRows, cfg.ReportDir = cur.RedactRules, cur.RiskRules, cur.ExportMaxRows, cur.ReportDir
+	return cfg
+}
+
+func logLevel(level string) interface{} {
+	switch level {
+	case config.LEVEL_INFO:
+		return log.INFO
+	case config.LEVEL_WARN:
+		return log.WARN
+	case config.LEVEL_ERROR:
+		return log.ERROR
+	}
+	return log.DEBUG
 }
@@ -0,0 +1,71 @@
+package command
+
+import (
+	"errors"
+	"logauditer/alert"
+	"strings"
+	"time"
+)
+
+// ALERT 子命令
+const (
+	ALERT_SET   = "SET"
+	ALERT_DESC  = "DESC"
+	ALERT_DEL   = "DEL"
+	ALERT_RULES = "RULES"
+	ALERT_LIST  = "LIST"
+)
+
+type Alert struct{}
+
+func (this *Alert) Name() string {
+	return "ALERT"
+}
+
+func (this *Alert) Help() string {
+	return `Usage: ALERT SET ${NAME} ${DATA} | ALERT DESC ${NAME} | ALERT DEL ${NAME} | ALERT RULES | ALERT LIST [${yyyy-mm-dd}]`
+}
+
+func (this *Alert) Execute(args ...string) Reply {
+	if len(args) < 1 {
+		return &ErrReply{Message: ErrWrongArgsNumber}
+	}
+	op := AlertOp{Op: strings.ToUpper(args[0])}
+	args = args[1:]
+
+	switch op.Op {
+	case ALERT_SET:
+		if len(args) != 2 {
+			return &ErrReply{Message: ErrWrongArgsNumber}
+		}
+		rule, err := alert.ParseRule(args[0], []byte(args[1]))
+		if err != nil {
+			return &ErrReply{Message: err}
+		}
+		op.Name, op.Rule = args[0], rule
+	case ALERT_DESC, ALERT_DEL:
+		if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
+			return reply
+		}
+		op.Name = args[0]
+	case ALERT_RULES:
+		if reply, ok := checkExpcetArgs(0, args...).(*ErrReply); ok {
+			return reply
+		}
+	case ALERT_LIST:
+		switch len(args) {
+		case 0:
+			op.Date = time.Now().Format("2006-01-02")
+		case 1:
+			if _, err := time.Parse("2006-01-02", args[0]); err != nil {
+				return &ErrReply{Message: errors.New(this.Help())}
+			}
+			op.Date = args[0]
+		default:
+			return &ErrReply{Message: ErrWrongArgsNumber}
+		}
+	default:
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	return &AlertReply{Message: op}
+}
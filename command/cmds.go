@@ -1,23 +1,28 @@
 package command
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"logauditer/internal"
-	"os"
-	"regexp"
+	"logauditer/query"
 	"strings"
+	"time"
 )
 
+// 规则管理操作, 由服务端转换为对应的规则管理接口
 const (
-	START = iota
-	STOP
+	RULE_SET    = "SET"
+	RULE_DESC   = "DESC"
+	RULE_KEYS   = "RULES"
+	RULE_TEST   = "TEST"
+	RULE_COMMIT = "COMMIT"
+	RULE_START  = "START"
+	RULE_STOP   = "STOP"
+	RULE_DROP   = "DROP"
+	RULE_TOP    = "TOP"
+	RULE_LIST   = "LIST"
 )
 
-type Test struct {
-	stge DataStore
-}
+type Test struct{}
 
 func (this *Test) Name() string {
 	return "TEST"
@@ -34,16 +39,10 @@ func (this *Test) Execute(args ...string) Reply {
 	if strings.ToLower(args[1]) != "with" {
 		return &ErrReply{Message: errors.New(this.Help())}
 	}
-	rule, err := this.stge.Get(args[2])
-	if err != nil {
-		return &ErrReply{Message: err}
-	}
-	return &TestReply{Message: Tester{Rule: rule, Data: []byte(args[0])}}
+	return &RuleReply{Message: RuleOp{Op: RULE_TEST, Name: args[2], Data: args[0]}}
 }
 
-type Commit struct {
-	stge DataStore
-}
+type Commit struct{}
 
 func (this *Commit) Name() string {
 	return "COMMIT"
@@ -57,18 +56,10 @@ func (this *Commit) Execute(args ...string) Reply {
 	if len(args) != 1 {
 		return &ErrReply{Message: ErrWrongArgsNumber}
 	}
-	value, err := this.stge.Get(args[0])
-	if err != nil {
-		return &ErrReply{Message: errors.New("not found rule in cache.")}
-	}
-	p := Persist{Id: args[0], Value: value}
-
-	return &PersistReply{Message: p}
+	return &RuleReply{Message: RuleOp{Op: RULE_COMMIT, Name: args[0]}}
 }
 
-type Set struct {
-	stge DataStore
-}
+type Set struct{}
 
 //Name returns the command name.
 func (this *Set) Name() string {
@@ -85,21 +76,10 @@ func (this *Set) Execute(args ...string) Reply {
 	if len(args) < 2 {
 		return &ErrReply{Message: ErrWrongArgsNumber}
 	}
-	runtimeOps := internal.RuntimeOptions{}
-	err := runtimeOps.Unmarshal([]byte(args[1]), json.Unmarshal)
-	if err != nil {
-		return &ErrReply{Message: fmt.Errorf("rule unmarshal err: %s", err)}
-	}
-	err = this.stge.Set(args[0], args[1])
-	if err != nil {
-		return &ErrReply{Message: err}
-	}
-	return &OkReply{}
+	return &RuleReply{Message: RuleOp{Op: RULE_SET, Name: args[0], Options: args[1]}}
 }
 
-type Get struct {
-	stge DataStore
-}
+type Get struct{}
 
 //Name returns the command name.
 func (this *Get) Name() string {
@@ -113,27 +93,13 @@ func (this *Get) Help() string {
 
 //Execute executes the command with the given arguments.
 func (this *Get) Execute(args ...string) Reply {
-	var reply Reply
-
-	reply = checkExpcetArgs(1, args...)
-	if _, ok := reply.(*ErrReply); ok {
+	if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
 		return reply
 	}
-
-	value, err := this.stge.Get(args[0])
-
-	if err != nil {
-		reply = &ErrReply{Message: err}
-	}
-	reply = &StringReply{
-		Message: value,
-	}
-	return reply
+	return &RuleReply{Message: RuleOp{Op: RULE_DESC, Name: args[0]}}
 }
 
-type Keys struct {
-	stge DataStore
-}
+type Keys struct{}
 
 //Name returns the command name.
 func (this *Keys) Name() string {
@@ -147,35 +113,14 @@ func (this *Keys) Help() string {
 
 //Execute executes the command with the given arguments.
 func (this *Keys) Execute(args ...string) Reply {
-	var (
-		err     error
-		pattern *regexp.Regexp
-	)
 	if len(args) > 1 {
 		return &ErrReply{Message: ErrWrongArgsNumber}
 	}
+	op := RuleOp{Op: RULE_KEYS}
 	if len(args) == 1 {
-		pattern, err = regexp.CompilePOSIX(args[0])
-		if err != nil {
-			return &ErrReply{Message: err}
-		}
-	}
-
-	keysIter, err := this.stge.Keys()
-	if err != nil {
-		return &ErrReply{Message: err}
-	}
-	keysName := make([]string, 0, len(keysIter))
-	for _, k := range keysIter {
-		if pattern != nil {
-			if !pattern.MatchString(k) {
-				fmt.Fprintf(os.Stdout, "[DEBUG] regexp compile posix is not match %s %v\n", args[0], pattern)
-				continue
-			}
-		}
-		keysName = append(keysName, k)
+		op.Pattern = args[0]
 	}
-	return &SliceReply{Message: keysName}
+	return &RuleReply{Message: op}
 }
 
 //Help is the Help command
@@ -216,9 +161,7 @@ func (c *Help) Execute(args ...string) Reply {
 	return reply
 }
 
-type Start struct {
-	stge DataStore
-}
+type Start struct{}
 
 func (this *Start) Name() string {
 	return "START"
@@ -232,23 +175,10 @@ func (this *Start) Execute(args ...string) Reply {
 	if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
 		return reply
 	}
-	_, err := this.stge.Get(args[0])
-	if err != nil {
-		return &ErrReply{
-			Message: fmt.Errorf("not define rule (%s).", args[0]),
-		}
-	}
-	return &RunnerReply{
-		RunnerState{
-			Rule:  args[0],
-			State: START,
-		},
-	}
+	return &RuleReply{Message: RuleOp{Op: RULE_START, Name: args[0]}}
 }
 
-type Stop struct {
-	stge DataStore
-}
+type Stop struct{}
 
 func (this *Stop) Name() string {
 	return "STOP"
@@ -262,23 +192,10 @@ func (this *Stop) Execute(args ...string) Reply {
 	if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
 		return reply
 	}
-	_, err := this.stge.Get(args[0])
-	if err != nil {
-		return &ErrReply{
-			Message: fmt.Errorf("not define rule (%s).", args[0]),
-		}
-	}
-	return &RunnerReply{
-		RunnerState{
-			Rule:  args[0],
-			State: STOP,
-		},
-	}
+	return &RuleReply{Message: RuleOp{Op: RULE_STOP, Name: args[0]}}
 }
 
-type Drop struct {
-	stge DataStore
-}
+type Drop struct{}
 
 func (this *Drop) Name() string {
 	return "DROP"
@@ -292,7 +209,7 @@ func (this *Drop) Execute(args ...string) Reply {
 	if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
 		return reply
 	}
-	return &DropReply{Message: args[0]}
+	return &RuleReply{Message: RuleOp{Op: RULE_DROP, Name: args[0]}}
 }
 
 type Top struct{}
@@ -309,12 +226,10 @@ func (this *Top) Execute(args ...string) Reply {
 	if reply, ok := checkExpcetArgs(0, args...).(*ErrReply); ok {
 		return reply
 	}
-	return &TopReply{}
+	return &RuleReply{Message: RuleOp{Op: RULE_TOP}}
 }
 
-type List struct {
-	stge DataStore
-}
+type List struct{}
 
 func (this *List) Name() string {
 	return "LIST"
@@ -327,8 +242,69 @@ func (this *List) Execute(args ...string) Reply {
 	if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
 		return reply
 	}
-	if _, err := this.stge.Get(args[0]); err != nil {
-		return &ErrReply{Message: fmt.Errorf("rule is not exists.")}
+	return &RuleReply{Message: RuleOp{Op: RULE_LIST, Name: args[0]}}
+}
+
+type Verify struct{}
+
+func (this *Verify) Name() string {
+	return "VERIFY"
+}
+
+func (this *Verify) Help() string {
+	return `Usage: VERIFY ${RULE_NAME} [${yyyy-mm-dd}]`
+}
+
+func (this *Verify) Execute(args ...string) Reply {
+	if len(args) < 1 || len(args) > 2 {
+		return &ErrReply{Message: ErrWrongArgsNumber}
+	}
+	op := VerifyOp{Rule: args[0], Date: time.Now().Format("2006-01-02")}
+	if len(args) == 2 {
+		if _, err := time.Parse("2006-01-02", args[1]); err != nil {
+			return &ErrReply{Message: errors.New(this.Help())}
+		}
+		op.Date = args[1]
+	}
+	return &VerifyReply{Message: op}
+}
+
+type Search struct{}
+
+func (this *Search) Name() string {
+	return "SEARCH"
+}
+
+func (this *Search) Help() string {
+	return "Usage: SEARCH `${QUERY}` [LIMIT ${N}] [CURSOR ${NEXT}]\n" +
+		"e.g. SEARCH `user:root AND ip:10.10.3.* AND op:~\"scp .*\" AND time:[2019-02-25 TO 2019-02-28]` LIMIT 20"
+}
+
+func (this *Search) Execute(args ...string) Reply {
+	op := SearchOp{Limit: 20}
+	var terms []string
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LIMIT", "CURSOR":
+			if i+1 >= len(args) {
+				return &ErrReply{Message: errors.New(this.Help())}
+			}
+			if strings.ToUpper(args[i]) == "CURSOR" {
+				op.Cursor = args[i+1]
+			} else if _, err := fmt.Sscanf(args[i+1], "%d", &op.Limit); err != nil || op.Limit <= 0 {
+				return &ErrReply{Message: fmt.Errorf("invalid limit (%s).", args[i+1])}
+			}
+			i++
+		default:
+			terms = append(terms, args[i])
+		}
+	}
+	if len(terms) == 0 {
+		return &ErrReply{Message: ErrWrongArgsNumber}
+	}
+	op.Query = strings.Join(terms, " ")
+	if _, err := query.Parse(op.Query); err != nil {
+		return &ErrReply{Message: err}
 	}
-	return &ListRuleReply{Message: args[0]}
+	return &SearchReply{Message: op}
 }
@@ -0,0 +1,54 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Follow 由终端客户端通过流式接口执行, 服务端只负责参数校验
+type Follow struct{}
+
+func (this *Follow) Name() string {
+	return "FOLLOW"
+}
+
+func (this *Follow) Help() string {
+	return "Usage: FOLLOW [RULE ${RULE_NAME}] [HOST ${HOST}] [USER ${USER}] [OP `${REGEXP}`] [LIMIT ${N}] | FOLLOW WORKERS [RULE ${RULE_NAME}] [LIMIT ${N}]\n" +
+		"press Ctrl-C to stop following."
+}
+
+func (this *Follow) Execute(args ...string) Reply {
+	op := FollowOp{}
+	if len(args) > 0 && strings.ToUpper(args[0]) == "WORKERS" {
+		op.Workers = true
+		args = args[1:]
+	}
+	if len(args)%2 != 0 {
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	for i := 0; i < len(args); i += 2 {
+		key, value := strings.ToUpper(args[i]), args[i+1]
+		switch {
+		case key == "RULE":
+			op.Rule = value
+		case key == "LIMIT":
+			if _, err := fmt.Sscanf(value, "%d", &op.Limit); err != nil || op.Limit <= 0 {
+				return &ErrReply{Message: fmt.Errorf("invalid limit (%s).", value)}
+			}
+		case key == "HOST" && !op.Workers:
+			op.Host = value
+		case key == "USER" && !op.Workers:
+			op.User = value
+		case key == "OP" && !op.Workers:
+			if _, err := regexp.Compile(value); err != nil {
+				return &ErrReply{Message: fmt.Errorf("invalid op regexp (%s).", value)}
+			}
+			op.Op = value
+		default:
+			return &ErrReply{Message: errors.New(this.Help())}
+		}
+	}
+	return &FollowReply{Message: op}
+}
@@ -0,0 +1,58 @@
+package command
+
+import (
+	"errors"
+	"logauditer/notify"
+	"strings"
+)
+
+// NOTIFIER 子命令
+const (
+	NOTIFIER_SET  = "SET"
+	NOTIFIER_DESC = "DESC"
+	NOTIFIER_DEL  = "DEL"
+	NOTIFIER_LIST = "LIST"
+	NOTIFIER_TEST = "TEST"
+)
+
+type Notifier struct{}
+
+func (this *Notifier) Name() string {
+	return "NOTIFIER"
+}
+
+func (this *Notifier) Help() string {
+	return `Usage: NOTIFIER SET ${NAME} ${DATA} | NOTIFIER DESC ${NAME} | NOTIFIER DEL ${NAME} | NOTIFIER LIST | NOTIFIER TEST ${NAME}`
+}
+
+func (this *Notifier) Execute(args ...string) Reply {
+	if len(args) < 1 {
+		return &ErrReply{Message: ErrWrongArgsNumber}
+	}
+	op := NotifierOp{Op: strings.ToUpper(args[0])}
+	args = args[1:]
+
+	switch op.Op {
+	case NOTIFIER_SET:
+		if len(args) != 2 {
+			return &ErrReply{Message: ErrWrongArgsNumber}
+		}
+		c, err := notify.ParseConfig(args[0], []byte(args[1]))
+		if err != nil {
+			return &ErrReply{Message: err}
+		}
+		op.Name, op.Config = args[0], c
+	case NOTIFIER_DESC, NOTIFIER_DEL, NOTIFIER_TEST:
+		if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
+			return reply
+		}
+		op.Name = args[0]
+	case NOTIFIER_LIST:
+		if reply, ok := checkExpcetArgs(0, args...).(*ErrReply); ok {
+			return reply
+		}
+	default:
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	return &NotifierReply{Message: op}
+}
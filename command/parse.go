@@ -13,13 +13,11 @@ import (
 var ErrCommandNotFound = errors.New("command: not found")
 
 //Parser is a parser that parses user input and creates the appropriate command.
-type Parser struct {
-	stge DataStore
-}
+type Parser struct{}
 
 //NewParser creates a new parser
-func NewParser(stge DataStore) *Parser {
-	return &Parser{stge: stge}
+func NewParser() *Parser {
+	return &Parser{}
 }
 
 //Parse parses string to Command with args
@@ -36,25 +34,43 @@ func (p *Parser) Parse(str string) (Command, []string, error) {
 	case "HELP":
 		cmd = &Help{parser: p}
 	case "DESC":
-		cmd = &Get{stge: p.stge}
+		cmd = &Get{}
 	case "SET":
-		cmd = &Set{stge: p.stge}
+		cmd = &Set{}
 	case "RULES":
-		cmd = &Keys{stge: p.stge}
+		cmd = &Keys{}
 	case "COMMIT":
-		cmd = &Commit{stge: p.stge}
+		cmd = &Commit{}
 	case "TEST":
-		cmd = &Test{stge: p.stge}
+		cmd = &Test{}
 	case "START":
-		cmd = &Start{stge: p.stge}
+		cmd = &Start{}
 	case "STOP":
-		cmd = &Stop{stge: p.stge}
+		cmd = &Stop{}
 	case "DROP":
-		cmd = &Drop{stge: p.stge}
+		cmd = &Drop{}
 	case "TOP":
 		cmd = &Top{}
 	case "LIST":
-		cmd = &List{stge: p.stge}
+		cmd = &List{}
+	case "SEARCH":
+		cmd = &Search{}
+	case "VERIFY":
+		cmd = &Verify{}
+	case "ALERT":
+		cmd = &Alert{}
+	case "NOTIFIER":
+		cmd = &Notifier{}
+	case "REPORT":
+		cmd = &Report{}
+	case "FOLLOW":
+		cmd = &Follow{}
+	case "USER":
+		cmd = &User{}
+	case "TRAIL":
+		cmd = &Trail{}
+	case "PROVISION":
+		cmd = &Provision{}
 	default:
 		return nil, nil, ErrCommandNotFound
 	}
@@ -70,12 +86,13 @@ func (p *Parser) extractArgs(val string) []string {
 		switch {
 		case r == '`':
 			inQuote = !inQuote
+		case unicode.IsSpace(r) && inQuote:
+			buf.WriteRune(r)
 		case unicode.IsSpace(r):
-			if !inQuote && buf.Len() > 0 {
+			// 连续的空白只分隔参数, 不并入下一个参数
+			if buf.Len() > 0 {
 				args = append(args, buf.String())
 				buf.Reset()
-			} else {
-				buf.WriteRune(r)
 			}
 		default:
 			buf.WriteRune(r)
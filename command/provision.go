@@ -0,0 +1,41 @@
+package command
+
+import (
+	"errors"
+	"strings"
+)
+
+// PROVISION 子命令, 不带子命令时为查看最近一次同步结果
+const (
+	PROVISION_STATUS = "STATUS"
+	PROVISION_SYNC   = "SYNC"
+)
+
+type Provision struct{}
+
+func (this *Provision) Name() string {
+	return "PROVISION"
+}
+
+func (this *Provision) Help() string {
+	return "Usage: PROVISION [STATUS] | PROVISION SYNC\n" +
+		"e.g. PROVISION SYNC    -- reload the rules dir and reconcile now"
+}
+
+func (this *Provision) Execute(args ...string) Reply {
+	op := ProvisionOp{Op: PROVISION_STATUS}
+	switch len(args) {
+	case 0:
+	case 1:
+		switch strings.ToUpper(args[0]) {
+		case PROVISION_STATUS:
+		case PROVISION_SYNC:
+			op.Op = PROVISION_SYNC
+		default:
+			return &ErrReply{Message: errors.New(this.Help())}
+		}
+	default:
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	return &ProvisionReply{Message: op}
+}
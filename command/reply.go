@@ -1,5 +1,11 @@
 package command
 
+import (
+	"logauditer/alert"
+	"logauditer/notify"
+	"logauditer/report"
+)
+
 type Reply interface {
 	Val() interface{}
 }
@@ -44,56 +50,136 @@ type Persist struct {
 	Id     string `bson:"_id,omitempty" json:"_id,omitempty"`
 	Value  string `bson:"value,omitempty" json:"value,omitempty"`
 	Isopen bool   `bson:"isopen,omitempty" json:"isopen,omitempty" `
+	// 由规则目录创建时为规则文件
+	Source string `bson:"source,omitempty" json:"source,omitempty"`
 }
 
-type PersistReply struct {
-	Message Persist
+type RuleOp struct {
+	Op      string
+	Name    string
+	Options string
+	// TEST 的日志数据
+	Data string
+	// RULES 的名称正则
+	Pattern string
 }
 
-func (this *PersistReply) Val() interface{} {
-	return this.Message
+type RuleReply struct {
+	Message RuleOp
 }
 
-type TestReply struct {
-	Message Tester
+func (this *RuleReply) Val() interface{} { return this.Message }
+
+type AlertOp struct {
+	Op   string
+	Name string
+	Rule *alert.Rule
+	Date string
 }
 
-func (this *TestReply) Val() interface{} {
-	return this.Message
+type AlertReply struct {
+	Message AlertOp
 }
 
-type Tester struct {
-	Rule string `bson:"rule,omitempty" json:"rule,omitempty"`
-	Data []byte `bson:"data,omitempty" json:"data,omitempty"`
+func (this *AlertReply) Val() interface{} { return this.Message }
+
+type NotifierOp struct {
+	Op     string
+	Name   string
+	Config *notify.Config
 }
 
-type RunnerState struct {
-	Rule  string `bson:"rule,omitempty" json:"rule,omitempty"`
-	State int    `bson:"state,omitempty" json:"state,omitempty"`
+type NotifierReply struct {
+	Message NotifierOp
 }
 
-type RunnerReply struct {
-	Message RunnerState
+func (this *NotifierReply) Val() interface{} { return this.Message }
+
+type VerifyOp struct {
+	Rule string
+	Date string
 }
 
-func (this *RunnerReply) Val() interface{} {
-	return this.Message
+type VerifyReply struct {
+	Message VerifyOp
 }
 
-type DropReply struct {
-	Message string
+func (this *VerifyReply) Val() interface{} { return this.Message }
+
+type SearchOp struct {
+	Query  string
+	Limit  int
+	Cursor string
 }
 
-func (this *DropReply) Val() interface{} {
-	return this.Message
+type SearchReply struct {
+	Message SearchOp
 }
 
-type TopReply struct{}
+func (this *SearchReply) Val() interface{} { return this.Message }
 
-func (this *TopReply) Val() interface{} { return nil }
+type ReportOp struct {
+	Op         string
+	Name       string
+	Definition *report.Definition
+}
 
-type ListRuleReply struct {
-	Message string
+type ReportReply struct {
+	Message ReportOp
+}
+
+func (this *ReportReply) Val() interface{} { return this.Message }
+
+type FollowOp struct {
+	Workers bool
+	Rule    string
+	Host    string
+	User    string
+	Op      string
+	Limit   int
+}
+
+type FollowReply struct {
+	Message FollowOp
+}
+
+func (this *FollowReply) Val() interface{} { return this.Message }
+
+type UserOp struct {
+	Op       string
+	Name     string
+	Password string
+	Roles    []string
+}
+
+type UserReply struct {
+	Message UserOp
+}
+
+func (this *UserReply) Val() interface{} { return this.Message }
+
+type TrailOp struct {
+	Op     string
+	Date   string
+	User   string
+	Rule   string
+	Action string
+	Result string
+	Limit  int
+}
+
+type TrailReply struct {
+	Message TrailOp
+}
+
+func (this *TrailReply) Val() interface{} { return this.Message }
+
+type ProvisionOp struct {
+	Op string
+}
+
+type ProvisionReply struct {
+	Message ProvisionOp
 }
 
-func (this ListRuleReply) Val() interface{} { return this.Message }
+func (this *ProvisionReply) Val() interface{} { return this.Message }
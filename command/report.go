@@ -0,0 +1,66 @@
+package command
+
+import (
+	"errors"
+	"logauditer/report"
+	"strings"
+)
+
+// REPORT 子命令
+const (
+	REPORT_SET  = "SET"
+	REPORT_DESC = "DESC"
+	REPORT_DEL  = "DEL"
+	REPORT_LIST = "LIST"
+	REPORT_RUN  = "RUN"
+	REPORT_RUNS = "RUNS"
+)
+
+type Report struct{}
+
+func (this *Report) Name() string {
+	return "REPORT"
+}
+
+func (this *Report) Help() string {
+	return `Usage: REPORT SET ${NAME} ${DATA} | REPORT DESC ${NAME} | REPORT DEL ${NAME} | REPORT LIST | REPORT RUN ${NAME} | REPORT RUNS [${NAME}]`
+}
+
+func (this *Report) Execute(args ...string) Reply {
+	if len(args) < 1 {
+		return &ErrReply{Message: ErrWrongArgsNumber}
+	}
+	op := ReportOp{Op: strings.ToUpper(args[0])}
+	args = args[1:]
+
+	switch op.Op {
+	case REPORT_SET:
+		if len(args) != 2 {
+			return &ErrReply{Message: ErrWrongArgsNumber}
+		}
+		d, err := report.ParseDefinition(args[0], []byte(args[1]))
+		if err != nil {
+			return &ErrReply{Message: err}
+		}
+		op.Name, op.Definition = args[0], d
+	case REPORT_DESC, REPORT_DEL, REPORT_RUN:
+		if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
+			return reply
+		}
+		op.Name = args[0]
+	case REPORT_LIST:
+		if reply, ok := checkExpcetArgs(0, args...).(*ErrReply); ok {
+			return reply
+		}
+	case REPORT_RUNS:
+		if len(args) > 1 {
+			return &ErrReply{Message: ErrWrongArgsNumber}
+		}
+		if len(args) == 1 {
+			op.Name = args[0]
+		}
+	default:
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	return &ReportReply{Message: op}
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TRAIL 子命令, 不带子命令时为查询
+const (
+	TRAIL_FIND  = "FIND"
+	TRAIL_PURGE = "PURGE"
+)
+
+type Trail struct{}
+
+func (this *Trail) Name() string {
+	return "TRAIL"
+}
+
+func (this *Trail) Help() string {
+	return "Usage: TRAIL [DATE ${yyyy-mm-dd}] [USER ${USER}] [RULE ${RULE_NAME}] [ACTION ${ACTION}] [RESULT ok|error|denied] [LIMIT ${N}] | TRAIL PURGE ${yyyy-mm-dd}\n" +
+		"e.g. TRAIL USER alice ACTION START LIMIT 20"
+}
+
+func (this *Trail) Execute(args ...string) Reply {
+	op := TrailOp{Op: TRAIL_FIND}
+	if len(args) > 0 && strings.ToUpper(args[0]) == TRAIL_PURGE {
+		if reply, ok := checkExpcetArgs(1, args[1:]...).(*ErrReply); ok {
+			return reply
+		}
+		if _, err := time.Parse("2006-01-02", args[1]); err != nil {
+			return &ErrReply{Message: fmt.Errorf("invalid date (%s).", args[1])}
+		}
+		op.Op, op.Date = TRAIL_PURGE, args[1]
+		return &TrailReply{Message: op}
+	}
+	if len(args)%2 != 0 {
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "DATE":
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return &ErrReply{Message: fmt.Errorf("invalid date (%s).", value)}
+			}
+			op.Date = value
+		case "USER":
+			op.User = value
+		case "RULE":
+			op.Rule = value
+		case "ACTION":
+			op.Action = value
+		case "RESULT":
+			op.Result = strings.ToLower(value)
+		case "LIMIT":
+			if _, err := fmt.Sscanf(value, "%d", &op.Limit); err != nil || op.Limit <= 0 {
+				return &ErrReply{Message: fmt.Errorf("invalid limit (%s).", value)}
+			}
+		default:
+			return &ErrReply{Message: errors.New(this.Help())}
+		}
+	}
+	return &TrailReply{Message: op}
+}
@@ -0,0 +1,66 @@
+package command
+
+import (
+	"errors"
+	"logauditer/auth"
+	"strings"
+)
+
+// USER 子命令
+const (
+	USER_SET  = "SET"
+	USER_ROLE = "ROLE"
+	USER_DEL  = "DEL"
+	USER_LIST = "LIST"
+	USER_WHO  = "WHOAMI"
+)
+
+type User struct{}
+
+func (this *User) Name() string {
+	return "USER"
+}
+
+func (this *User) Help() string {
+	return "Usage: USER SET ${NAME} ${PASSWORD} ${ROLES} | USER ROLE ${NAME} ${ROLES} | USER DEL ${NAME} | USER LIST | USER WHOAMI\n" +
+		"roles are comma separated: " + strings.Join(auth.Roles, ",") + "."
+}
+
+func (this *User) Execute(args ...string) Reply {
+	if len(args) < 1 {
+		return &ErrReply{Message: ErrWrongArgsNumber}
+	}
+	op := UserOp{Op: strings.ToUpper(args[0])}
+	args = args[1:]
+
+	switch op.Op {
+	case USER_SET, USER_ROLE:
+		n := 3
+		if op.Op == USER_ROLE {
+			n = 2
+		}
+		if reply, ok := checkExpcetArgs(n, args...).(*ErrReply); ok {
+			return reply
+		}
+		roles, err := auth.ParseRoles(args[n-1])
+		if err != nil {
+			return &ErrReply{Message: err}
+		}
+		op.Name, op.Roles = args[0], roles
+		if op.Op == USER_SET {
+			op.Password = args[1]
+		}
+	case USER_DEL:
+		if reply, ok := checkExpcetArgs(1, args...).(*ErrReply); ok {
+			return reply
+		}
+		op.Name = args[0]
+	case USER_LIST, USER_WHO:
+		if reply, ok := checkExpcetArgs(0, args...).(*ErrReply); ok {
+			return reply
+		}
+	default:
+		return &ErrReply{Message: errors.New(this.Help())}
+	}
+	return &UserReply{Message: op}
+}
@@ -0,0 +1,425 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"logauditer/certs"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// 环境变量前缀, 如 LOGAUDITER_GRPC_ADDR, LOGAUDITER_TLS_CLIENT_CA
+const ENV_PREFIX = "LOGAUDITER_"
+
+// 日志级别
+const (
+	LEVEL_DEBUG = "debug"
+	LEVEL_INFO  = "info"
+	LEVEL_WARN  = "warn"
+	LEVEL_ERROR = "error"
+)
+
+// 日志输出
+const (
+	OUTPUT_CONSOLE = "console"
+	OUTPUT_FILE    = "file"
+)
+
+// 目前只支持 mongodb
+const BACKEND_MONGO = "mongo"
+
+// Duration 以 "30s"/"8h" 形式读写的时长
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration (%s).", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type GRPC struct {
+	Addr string `yaml:"addr"`
+}
+
+type HTTP struct {
+	Addr string `yaml:"addr"`
+	// 使用与 gRPC 相同的证书提供 HTTPS
+	TLS bool `yaml:"tls"`
+}
+
+type Storage struct {
+	Backend string `yaml:"backend"`
+	URL     string `yaml:"url"`
+}
+
+type TLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientCA"`
+	// none/optional/require
+	ClientAuth string `yaml:"clientAuth"`
+	// 检查证书文件变化的间隔, 0 不检查
+	Reload Duration `yaml:"reload"`
+	// 使用内置的开发证书
+	InsecureDev bool `yaml:"insecureDev"`
+}
+
+type Log struct {
+	Level string `yaml:"level"`
+	// console/file
+	Output string `yaml:"output"`
+	File   string `yaml:"file"`
+}
+
+type Auth struct {
+	Enabled       bool     `yaml:"enabled"`
+	AdminPassword string   `yaml:"adminPassword"`
+	LDAPConfig    string   `yaml:"ldapConfig"`
+	SessionTTL    Duration `yaml:"sessionTTL"`
+}
+
+type Workers struct {
+	// 同时运行的规则数上限, 0 不限制
+	Max int `yaml:"max"`
+}
+
+// Retention 按天保留的天数, 0 永久保留
+type Retention struct {
+	Records int `yaml:"records"`
+	Alerts  int `yaml:"alerts"`
+	Trail   int `yaml:"trail"`
+	// 清理间隔
+	Interval Duration `yaml:"interval"`
+}
+
+// Provision 从目录加载规则文件并在变化时同步
+type Provision struct {
+	Dir string `yaml:"dir"`
+	// 删除由文件创建但文件中已不存在的规则
+	Prune bool `yaml:"prune"`
+	// 目录变化后等待的时间
+	Debounce Duration `yaml:"debounce"`
+}
+
+// Shutdown 停止服务时等待处理中的请求与工作进程入库的时间
+type Shutdown struct {
+	Timeout Duration `yaml:"timeout"`
+}
+
+type Chain struct {
+	Key        string   `yaml:"key"`
+	Checkpoint Duration `yaml:"checkpoint"`
+}
+
+// Rule 启动时加载的规则, options 为规则 JSON 文本或等价的对象
+type Rule struct {
+	Name    string      `yaml:"name"`
+	Options interface{} `yaml:"options"`
+	Start   bool        `yaml:"start"`
+	// 规则文件, 只由规则目录加载时填写
+	Source string `yaml:"-"`
+}
+
+// JSON 规则选项的 JSON 文本
+func (r *Rule) JSON() (string, error) {
+	if s, ok := r.Options.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(jsonValue(r.Options))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// yaml 解析出的 map[interface{}]interface{} 转为 JSON 可以编码的类型
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = jsonValue(t[i])
+		}
+	}
+	return v
+}
+
+// Config 服务端配置, 优先级: 命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	GRPC      GRPC      `yaml:"grpc"`
+	HTTP      HTTP      `yaml:"http"`
+	Storage   Storage   `yaml:"storage"`
+	TLS       TLS       `yaml:"tls"`
+	Log       Log       `yaml:"log"`
+	Auth      Auth      `yaml:"auth"`
+	Workers   Workers   `yaml:"workers"`
+	Retention Retention `yaml:"retention"`
+	Provision Provision `yaml:"provision"`
+	Shutdown  Shutdown  `yaml:"shutdown"`
+	Chain     Chain     `yaml:"chain"`
+
+	RedactRules   string `yaml:"redactRules"`
+	RiskRules     string `yaml:"riskRules"`
+	ExportMaxRows int    `yaml:"exportMaxRows"`
+	ReportDir     string `yaml:"reportDir"`
+
+	Rules []Rule `yaml:"rules"`
+}
+
+func Default() *Config {
+	return &Config{
+		GRPC:      GRPC{Addr: "127.0.0.1:9992"},
+		HTTP:      HTTP{Addr: ":80"},
+		Storage:   Storage{Backend: BACKEND_MONGO, URL: "localhost:27017"},
+		TLS:       TLS{Reload: Duration(30 * time.Second)},
+		Log:       Log{Level: LEVEL_DEBUG, Output: OUTPUT_CONSOLE},
+		Auth:      Auth{Enabled: true, SessionTTL: Duration(8 * time.Hour)},
+		Retention: Retention{Interval: Duration(time.Hour)},
+		Provision: Provision{Debounce: Duration(time.Second)},
+		Shutdown:  Shutdown{Timeout: Duration(30 * time.Second)},
+		Chain:     Chain{Checkpoint: Duration(time.Minute)},
+
+		ExportMaxRows: 1000000,
+		ReportDir:     "reports",
+	}
+}
+
+// Load 在默认值之上读取 YAML 配置文件, JSON 也可以按 YAML 读取, 不允许未知字段
+func Load(fn string) (*Config, error) {
+	c := Default()
+	if fn == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("config (%s) unmarshal err: %s", fn, err)
+	}
+	return c, nil
+}
+
+// Env 用 LOGAUDITER_ 前缀的环境变量覆盖配置, 不支持 rules
+func (c *Config) Env() error {
+	return env(reflect.ValueOf(c).Elem(), ENV_PREFIX)
+}
+
+func env(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		name := prefix + envName(strings.Split(f.Tag.Get("yaml"), ",")[0])
+		if f.Type.Kind() == reflect.Struct {
+			if err := env(fv, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch fv.Interface().(type) {
+		case string:
+			fv.SetString(s)
+		case bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s (%s), expect true/false.", name, s)
+			}
+			fv.SetBool(b)
+		case int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s (%s), expect integer.", name, s)
+			}
+			fv.SetInt(int64(n))
+		case Duration:
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s (%s), expect duration like 30s.", name, s)
+			}
+			fv.SetInt(int64(d))
+		}
+	}
+	return nil
+}
+
+// clientCA => CLIENT_CA, sessionTTL => SESSION_TTL
+func envName(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && unicode.IsLower(r[i-1]) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+// Validate 检查全部配置项, 一次返回所有错误
+func (c *Config) Validate() error {
+	var errs []string
+	add := func(format string, v ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, v...))
+	}
+	if _, _, err := net.SplitHostPort(c.GRPC.Addr); err != nil {
+		add("grpc.addr (%s) is not host:port", c.GRPC.Addr)
+	}
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		add("http.addr (%s) is not host:port", c.HTTP.Addr)
+	}
+	if c.Storage.Backend != BACKEND_MONGO {
+		add("storage.backend (%s) is not supported, expect %s", c.Storage.Backend, BACKEND_MONGO)
+	}
+	if c.Storage.URL == "" {
+		add("storage.url is empty")
+	}
+
+	switch {
+	case c.TLS.Cert != "" || c.TLS.Key != "":
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			add("tls.cert and tls.key must be set together")
+		}
+		if c.TLS.InsecureDev {
+			add("tls.insecureDev conflicts with tls.cert")
+		}
+	case !c.TLS.InsecureDev:
+		add("tls.cert and tls.key are required, or tls.insecureDev for development")
+	}
+	switch c.TLS.ClientAuth {
+	case "", certs.CLIENT_NONE:
+	case certs.CLIENT_OPTIONAL, certs.CLIENT_REQUIRE:
+		if c.TLS.ClientCA == "" {
+			add("tls.clientAuth (%s) requires tls.clientCA", c.TLS.ClientAuth)
+		}
+	default:
+		add("tls.clientAuth (%s) is invalid, expect none/optional/require", c.TLS.ClientAuth)
+	}
+	if c.TLS.Reload < 0 {
+		add("tls.reload must not be negative")
+	}
+	for _, fn := range []string{c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA, c.Auth.LDAPConfig, c.RedactRules, c.RiskRules} {
+		if fn == "" {
+			continue
+		}
+		if _, err := os.Stat(fn); err != nil {
+			add("file (%s) error: %s", fn, err)
+		}
+	}
+
+	switch c.Log.Level {
+	case LEVEL_DEBUG, LEVEL_INFO, LEVEL_WARN, LEVEL_ERROR:
+	default:
+		add("log.level (%s) is invalid, expect debug/info/warn/error", c.Log.Level)
+	}
+	switch c.Log.Output {
+	case OUTPUT_CONSOLE:
+	case OUTPUT_FILE:
+		if c.Log.File == "" {
+			add("log.file is required when log.output is file")
+		}
+	default:
+		add("log.output (%s) is invalid, expect console/file", c.Log.Output)
+	}
+
+	if c.Auth.SessionTTL <= 0 {
+		add("auth.sessionTTL must be positive")
+	}
+	if c.Workers.Max < 0 {
+		add("workers.max must not be negative")
+	}
+	if c.Retention.Records < 0 || c.Retention.Alerts < 0 || c.Retention.Trail < 0 {
+		add("retention days must not be negative")
+	}
+	if c.Retention.Interval <= 0 {
+		add("retention.interval must be positive")
+	}
+	if c.Provision.Dir != "" {
+		if fi, err := os.Stat(c.Provision.Dir); err != nil {
+			add("provision.dir (%s) error: %s", c.Provision.Dir, err)
+		} else if !fi.IsDir() {
+			add("provision.dir (%s) is not a directory", c.Provision.Dir)
+		}
+	}
+	if c.Provision.Debounce <= 0 {
+		add("provision.debounce must be positive")
+	}
+	if c.Shutdown.Timeout <= 0 {
+		add("shutdown.timeout must be positive")
+	}
+	if c.Chain.Checkpoint <= 0 {
+		add("chain.checkpoint must be positive")
+	}
+	if c.ExportMaxRows <= 0 {
+		add("exportMaxRows must be positive")
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Name == "" {
+			add("rules[%d].name is empty", i)
+			continue
+		}
+		if names[r.Name] {
+			add("rules[%d].name (%s) is duplicated", i, r.Name)
+		}
+		names[r.Name] = true
+		if r.Options == nil {
+			add("rules[%d] (%s) options is empty", i, r.Name)
+			continue
+		}
+		s, err := r.JSON()
+		if err == nil && !json.Valid([]byte(s)) {
+			err = fmt.Errorf("invalid json")
+		}
+		if err != nil {
+			add("rules[%d] (%s) options error: %s", i, r.Name, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// String YAML 格式的配置, 密码不输出
+func (c *Config) String() string {
+	cc := *c
+	if cc.Auth.AdminPassword != "" {
+		cc.Auth.AdminPassword = "***"
+	}
+	b, err := yaml.Marshal(&cc)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// 默认值 < 配置文件 < 环境变量 < 命令行参数
+func TestLoadOrder(t *testing.T) {
+	fn := writeConfig(t, `
+grpc:
+  addr: 0.0.0.0:9992
+http:
+  addr: :8080
+log:
+  level: info
+retention:
+  records: 30
+  interval: 10m
+`)
+	setenv(t, "LOGAUDITER_HTTP_ADDR", ":8081")
+	setenv(t, "LOGAUDITER_LOG_LEVEL", "warn")
+	setenv(t, "LOGAUDITER_RETENTION_ALERTS", "90")
+	setenv(t, "LOGAUDITER_AUTH_SESSION_TTL", "1h")
+
+	c, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Env(); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	Default().BindFlags(fs)
+	if err := fs.Parse([]string{"-log-level", "error"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Override(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"storage.url", c.Storage.URL, "localhost:27017"},
+		{"shutdown.timeout", c.Shutdown.Timeout, Duration(30 * time.Second)},
+		{"grpc.addr", c.GRPC.Addr, "0.0.0.0:9992"},
+		{"retention.records", c.Retention.Records, 30},
+		{"retention.interval", c.Retention.Interval, Duration(10 * time.Minute)},
+		{"http.addr", c.HTTP.Addr, ":8081"},
+		{"retention.alerts", c.Retention.Alerts, 90},
+		{"auth.sessionTTL", c.Auth.SessionTTL, Duration(time.Hour)},
+		{"log.level", c.Log.Level, LEVEL_ERROR},
+	}
+	for _, k := range checks {
+		if k.got != k.want {
+			t.Errorf("%s = %v, want %v", k.name, k.got, k.want)
+		}
+	}
+}
+
+func TestEnvError(t *testing.T) {
+	for _, kv := range [][2]string{
+		{"LOGAUDITER_WORKERS_MAX", "many"},
+		{"LOGAUDITER_HTTP_TLS", "maybe"},
+		{"LOGAUDITER_RETENTION_INTERVAL", "1 hour"},
+	} {
+		t.Run(kv[0], func(t *testing.T) {
+			setenv(t, kv[0], kv[1])
+			if err := Default().Env(); err == nil || !strings.Contains(err.Error(), kv[0]) {
+				t.Errorf("Env() = %v, want error of %s", err, kv[0])
+			}
+		})
+	}
+}
+
+func TestLoadStrict(t *testing.T) {
+	cases := []string{
+		"grpc:\n  adr: :9992\n",
+		"retention:\n  days: 30\n",
+		"unknown: 1\n",
+		"shutdown:\n  timeout: soon\n",
+	}
+	for _, data := range cases {
+		if _, err := Load(writeConfig(t, data)); err == nil {
+			t.Errorf("Load(%q) expect error", data)
+		}
+	}
+	if _, err := Load(filepath.Join(os.TempDir(), "logauditer-missing.yaml")); err == nil {
+		t.Error("Load of missing file expect error")
+	}
+	c, err := Load(writeConfig(t, `{"workers": {"max": 3}}`))
+	if err != nil || c.Workers.Max != 3 {
+		t.Errorf("json config %+v %v", c, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.TLS.InsecureDev = true
+	if err := c.Validate(); err != nil {
+		t.Fatalf("default config: %s", err)
+	}
+
+	c.GRPC.Addr = "9992"
+	c.Log.Level = "trace"
+	c.Retention.Records = -1
+	c.Retention.Interval = 0
+	c.Workers.Max = -1
+	c.Rules = []Rule{{Name: "a", Options: "{"}, {Name: "a"}, {}}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	// 一次列出全部错误
+	for _, want := range []string{
+		"grpc.addr (9992)",
+		"log.level (trace)",
+		"retention days must not be negative",
+		"retention.interval must be positive",
+		"workers.max must not be negative",
+		"rules[0] (a) options error",
+		"rules[1].name (a) is duplicated",
+		"rules[1] (a) options is empty",
+		"rules[2].name is empty",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error missing %q:\n%s", want, err)
+		}
+	}
+
+	c = Default()
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "tls.cert and tls.key are required") {
+		t.Errorf("without tls: %v", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	c := Default()
+	c.Auth.AdminPassword = "secret"
+	s := c.String()
+	if strings.Contains(s, "secret") || !strings.Contains(s, "adminPassword: '***'") {
+		t.Errorf("password not masked:\n%s", s)
+	}
+	if c.Auth.AdminPassword != "secret" {
+		t.Error("String modified the config")
+	}
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"flag"
+	"time"
+)
+
+// BindFlags 命令行参数绑定到配置项, 默认值取自当前配置
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.GRPC.Addr, "grpc", c.GRPC.Addr, "grpc server addr.")
+	fs.StringVar(&c.HTTP.Addr, "http", c.HTTP.Addr, "http server addr.")
+	fs.BoolVar(&c.HTTP.TLS, "http-tls", c.HTTP.TLS, "serve http with the same certificate.")
+	fs.StringVar(&c.Storage.URL, "dburl", c.Storage.URL, "mgo db url addr.")
+
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "log level debug/info/warn/error.")
+	fs.StringVar(&c.Log.Output, "log-output", c.Log.Output, "log output console/file.")
+	fs.StringVar(&c.Log.File, "log-file", c.Log.File, "log file when log output is file.")
+
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "server certificate file of grpc and https.")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "server private key file of grpc and https.")
+	fs.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "CA file to verify client certificates, client common name maps to a local user.")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "client certificate policy none/optional/require, default optional when -tls-client-ca is set.")
+	fs.DurationVar((*time.Duration)(&c.TLS.Reload), "tls-reload", time.Duration(c.TLS.Reload), "interval to check certificate files and reload on change, 0 disable.")
+	fs.BoolVar(&c.TLS.InsecureDev, "tls-insecure-dev", c.TLS.InsecureDev, "use the built-in development certificate shared by all deployments, never use in production.")
+
+	fs.BoolVar(&c.Auth.Enabled, "auth", c.Auth.Enabled, "require login and check roles for grpc and http.")
+	fs.StringVar(&c.Auth.AdminPassword, "admin-password", c.Auth.AdminPassword, "password of the admin user created when there is no user, empty generate one and log it.")
+	fs.StringVar(&c.Auth.LDAPConfig, "ldap-config", c.Auth.LDAPConfig, "ldap authentication config json file, empty disable ldap.")
+	fs.DurationVar((*time.Duration)(&c.Auth.SessionTTL), "session-ttl", time.Duration(c.Auth.SessionTTL), "idle timeout of login sessions.")
+
+	fs.StringVar(&c.Provision.Dir, "rules-dir", c.Provision.Dir, "directory of yaml/json rule files, synced on change, empty disable.")
+	fs.BoolVar(&c.Provision.Prune, "rules-prune", c.Provision.Prune, "delete rules created from files that no longer exist in -rules-dir.")
+
+	fs.DurationVar((*time.Duration)(&c.Shutdown.Timeout), "shutdown-timeout", time.Duration(c.Shutdown.Timeout), "max time to wait for requests and workers on SIGINT/SIGTERM.")
+
+	fs.IntVar(&c.Workers.Max, "max-workers", c.Workers.Max, "max running rules, 0 unlimited.")
+
+	fs.StringVar(&c.RedactRules, "redact-rules", c.RedactRules, "global redact rules json file, empty use built-in detectors.")
+	fs.StringVar(&c.RiskRules, "risk-rules", c.RiskRules, "sensitive command classification rules json file, empty use built-in rules.")
+	fs.StringVar(&c.Chain.Key, "chain-key", c.Chain.Key, "ed25519 seed file for signing chain checkpoints, generated if not exists, empty disable checkpoints.")
+	fs.DurationVar((*time.Duration)(&c.Chain.Checkpoint), "chain-checkpoint", time.Duration(c.Chain.Checkpoint), "chain checkpoint interval.")
+	fs.IntVar(&c.ExportMaxRows, "export-max-rows", c.ExportMaxRows, "max rows of one export.")
+	fs.StringVar(&c.ReportDir, "report-dir", c.ReportDir, "scheduled report output dir.")
+}
+
+// Override 把 fs 中显式设置的参数应用到配置, 使命令行参数优先于配置文件与环境变量
+func (c *Config) Override(fs *flag.FlagSet) error {
+	bound := flag.NewFlagSet("", flag.ContinueOnError)
+	c.BindFlags(bound)
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || bound.Lookup(f.Name) == nil {
+			return
+		}
+		err = bound.Set(f.Name, f.Value.String())
+	})
+	return err
+}
@@ -23,6 +23,10 @@ const (
 	LIST
 	MV
 	REMOVEALL
+	FIND
+	COUNT
+	AGGREGATE
+	EACH
 )
 
 type DBType interface{}
@@ -43,6 +47,10 @@ type DBApiHandler interface {
 	Drop(Storager)
 	Mv(Storager)
 	RemoveAll(Storager)
+	Find(Storager)
+	Count(Storager)
+	Aggregate(Storager)
+	Each(Storager)
 	Op() OPType
 	Types() DBType
 }
@@ -109,6 +117,14 @@ func (s *StorageParts) Accept(h DBApiHandler) {
 			return h.List
 		case REMOVEALL:
 			return h.RemoveAll
+		case FIND:
+			return h.Find
+		case COUNT:
+			return h.Count
+		case AGGREGATE:
+			return h.Aggregate
+		case EACH:
+			return h.Each
 		default:
 			return nil
 		}
@@ -139,9 +155,32 @@ func defaultH(h DBApiHandler, s Storager) {
 		h.Mv(s)
 	case REMOVEALL:
 		h.RemoveAll(s)
+	case FIND:
+		h.Find(s)
+	case COUNT:
+		h.Count(s)
+	case AGGREGATE:
+		h.Aggregate(s)
+	case EACH:
+		h.Each(s)
 	}
 }
 
+// FindQuery FIND 操作的查询条件, 支持排序与分页
+type FindQuery struct {
+	Query  interface{}
+	Sort   []string
+	Skip   int
+	Limit  int
+	Select interface{}
+}
+
+// Each EACH 操作的结果, 游标逐条解码到 Doc 后回调 Fn, Fn 返回错误时停止遍历
+type Each struct {
+	Doc interface{}
+	Fn  func() error
+}
+
 type DBApiRequestMessage struct {
 	DB    string
 	Table string
@@ -286,6 +325,102 @@ func (a *DBApiRequestMessage) List(s Storager) {
 	default:
 	}
 }
+func (a *DBApiRequestMessage) Find(s Storager) {
+	switch a.Dtyp {
+	case RDBMS:
+		//
+	case KV:
+		fq, ok := a.Query.(*FindQuery)
+		if !ok {
+			*a.Err = errors.New("query is not *FindQuery type.")
+			return
+		}
+		q := a.cursor(s).Find(fq.Query)
+		if fq.Select != nil {
+			q = q.Select(fq.Select)
+		}
+		if len(fq.Sort) > 0 {
+			q = q.Sort(fq.Sort...)
+		}
+		if fq.Skip > 0 {
+			q = q.Skip(fq.Skip)
+		}
+		if fq.Limit > 0 {
+			q = q.Limit(fq.Limit)
+		}
+		*a.Err = q.All(a.Res)
+	default:
+	}
+}
+
+func (a *DBApiRequestMessage) Count(s Storager) {
+	switch a.Dtyp {
+	case RDBMS:
+		//
+	case KV:
+		r, ok := a.Res.(*int)
+		if !ok {
+			*a.Err = errors.New("result is not *int type.")
+			return
+		}
+		*r, *a.Err = a.cursor(s).Find(a.Query).Count()
+	default:
+	}
+}
+
+// Each 按 FindQuery 遍历游标, 不把结果全部载入内存
+func (a *DBApiRequestMessage) Each(s Storager) {
+	switch a.Dtyp {
+	case RDBMS:
+		//
+	case KV:
+		fq, ok := a.Query.(*FindQuery)
+		if !ok {
+			*a.Err = errors.New("query is not *FindQuery type.")
+			return
+		}
+		each, ok := a.Res.(*Each)
+		if !ok {
+			*a.Err = errors.New("result is not *Each type.")
+			return
+		}
+		q := a.cursor(s).Find(fq.Query)
+		if fq.Select != nil {
+			q = q.Select(fq.Select)
+		}
+		if len(fq.Sort) > 0 {
+			q = q.Sort(fq.Sort...)
+		}
+		if fq.Skip > 0 {
+			q = q.Skip(fq.Skip)
+		}
+		if fq.Limit > 0 {
+			q = q.Limit(fq.Limit)
+		}
+		iter := q.Iter()
+		for iter.Next(each.Doc) {
+			if err := each.Fn(); err != nil {
+				iter.Close()
+				*a.Err = err
+				return
+			}
+		}
+		*a.Err = iter.Close()
+	default:
+	}
+}
+
+// Aggregate Query 为聚合管道
+func (a *DBApiRequestMessage) Aggregate(s Storager) {
+	switch a.Dtyp {
+	case RDBMS:
+		//
+	case KV:
+		*a.Err = a.cursor(s).Pipe(a.Query).AllowDiskUse().All(a.Res)
+	default:
+	}
+}
+
 func (a *DBApiRequestMessage) Op() OPType { return a.Otyp }
 
 func (a *DBApiRequestMessage) Types() DBType { return a.Dtyp }
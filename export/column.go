@@ -0,0 +1,114 @@
+package export
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"logauditer/search"
+)
+
+// CREATED_AT 入库时间, 取自 _id
+const CREATED_AT = "CreatedAt"
+
+// DefaultColumns 未指定列时导出的字段
+var DefaultColumns = []string{
+	CREATED_AT, "Host", "Rule", "Date", "Device", "SystemType", "DateTime",
+	"IpAddr", "UserName", "Operation", "State", "Categories", "RiskScore",
+}
+
+// 本地化表头, 未列出的语言或字段使用字段名
+var headers = map[string]map[string]string{
+	"zh": {
+		CREATED_AT:   "入库时间",
+		"Host":       "主机",
+		"Rule":       "采集规则",
+		"Date":       "日志日期",
+		"Device":     "设备",
+		"SystemType": "系统类型",
+		"DateTime":   "时间",
+		"IpAddr":     "来源IP",
+		"UserName":   "用户",
+		"Operation":  "操作",
+		"State":      "状态",
+		"Categories": "分类",
+		"RiskScore":  "风险分值",
+		"Masked":     "脱敏字段",
+		"Stream":     "流",
+		"Seq":        "序号",
+		"PrevHash":   "前一哈希",
+		"Hash":       "哈希",
+	},
+}
+
+// Column 导出列
+type Column struct {
+	Field  string
+	Header string
+}
+
+// Columns 解析逗号分隔的列名, 为空时为 DefaultColumns; lang 为表头语言(zh), 为空时表头为字段名
+func Columns(names string, lang string) ([]Column, error) {
+	fields := DefaultColumns
+	if names != "" {
+		fields = strings.Split(names, ",")
+	}
+	cols := make([]Column, 0, len(fields))
+	for _, name := range fields {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, CREATED_AT) {
+			name = CREATED_AT
+		} else if f, ok := search.LookupField(name); ok {
+			name = f.Name
+		} else {
+			return nil, &search.Error{Message: fmt.Sprintf("unknown column (%s).", name)}
+		}
+		header := name
+		if h, ok := headers[lang][name]; ok {
+			header = h
+		}
+		cols = append(cols, Column{Field: name, Header: header})
+	}
+	if len(cols) == 0 {
+		return nil, &search.Error{Message: "no columns."}
+	}
+	if lang != "" && headers[lang] == nil {
+		return nil, &search.Error{Message: fmt.Sprintf("unsupported lang (%s).", lang)}
+	}
+	return cols, nil
+}
+
+// values 按列取记录的值, 字符串, 整数或字符串数组
+func values(rec *search.Record, cols []Column) []interface{} {
+	res := make([]interface{}, len(cols))
+	rv := reflect.ValueOf(&rec.AuditLog).Elem()
+	for i, c := range cols {
+		if c.Field == CREATED_AT {
+			res[i] = rec.Id.Time().Format("2006-01-02 15:04:05")
+			continue
+		}
+		res[i] = rv.FieldByName(c.Field).Interface()
+	}
+	return res
+}
+
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,96 @@
+package export
+
+import (
+	"logauditer/dbapi"
+	ll "logauditer/logmining"
+	"logauditer/search"
+)
+
+// DefaultMaxRows 单次导出的默认行数上限
+const DefaultMaxRows = 1000000
+
+// Service 按日期逐个集合遍历游标导出记录
+type Service struct {
+	SP          *dbapi.StorageParts
+	PersistType dbapi.DBType
+	// 行数上限, <=0 时为 DefaultMaxRows
+	MaxRows int
+
+	// 访问某天的记录集合, 为空时使用 dbapi; 测试时替换
+	access func(day string, query, res interface{}, op dbapi.OPType) error
+}
+
+func (s *Service) collection(day string, query, res interface{}, op dbapi.OPType) error {
+	if s.access != nil {
+		return s.access(day, query, res, op)
+	}
+	var _err error
+	dbapi.AccessDatabase(s.SP, ll.LOG_RECORD, ll.Collection(day), query, res, op, s.PersistType, &_err)
+	return _err
+}
+
+// Check 校验检索请求, 在开始写响应之前调用
+func (s *Service) Check(r *search.Request) error {
+	if _, err := r.Days(); err != nil {
+		return err
+	}
+	_, err := r.Match()
+	return err
+}
+
+// Export 写出匹配的记录, r.Limit 可以进一步限制行数, 返回写出的行数
+func (s *Service) Export(w Writer, r *search.Request, cols []Column) (int, error) {
+	days, err := r.Days()
+	if err != nil {
+		return 0, err
+	}
+	match, err := r.Match()
+	if err != nil {
+		return 0, err
+	}
+	max := s.MaxRows
+	if max <= 0 {
+		max = DefaultMaxRows
+	}
+	if r.Limit > 0 && r.Limit < max {
+		max = r.Limit
+	}
+	sort := []string{"_id"}
+	if r.Desc {
+		sort = []string{"-_id"}
+	}
+	if r.Sort != "" {
+		f, ok := search.LookupField(r.Sort)
+		if !ok {
+			return 0, &search.Error{Message: "unknown sort field (" + r.Sort + ")."}
+		}
+		if r.Desc {
+			sort = []string{"-" + f.Name, "-_id"}
+		} else {
+			sort = []string{f.Name, "_id"}
+		}
+	}
+
+	n := 0
+	rec := new(search.Record)
+	each := &dbapi.Each{
+		Doc: rec,
+		Fn: func() error {
+			err := w.Write(values(rec, cols))
+			// 游标复用同一个对象, 清空以免缺失的字段沿用上一条记录的值
+			*rec = search.Record{}
+			n++
+			return err
+		},
+	}
+	for _, day := range days {
+		if n >= max {
+			break
+		}
+		q := &dbapi.FindQuery{Query: match, Sort: sort, Limit: max - n}
+		if err := s.collection(day, q, each, dbapi.EACH); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,333 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	"logauditer/search"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func cols(t *testing.T, names, lang string) []Column {
+	c, err := Columns(names, lang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestColumns(t *testing.T) {
+	c := cols(t, "", "")
+	if len(c) != len(DefaultColumns) || c[0].Field != CREATED_AT || c[0].Header != CREATED_AT {
+		t.Errorf("default columns %+v", c)
+	}
+	// 不区分大小写, 忽略空列
+	c = cols(t, "createdat, username,,ipaddr,riskscore", "zh")
+	want := []Column{{CREATED_AT, "入库时间"}, {"UserName", "用户"}, {"IpAddr", "来源IP"}, {"RiskScore", "风险分值"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("columns %+v, want %+v", c, want)
+	}
+	for _, c := range [][2]string{{"Nope", ""}, {",", ""}, {"Host", "fr"}} {
+		if _, err := Columns(c[0], c[1]); err == nil {
+			t.Errorf("Columns(%q, %q) expect error", c[0], c[1])
+		} else if _, ok := err.(*search.Error); !ok {
+			t.Errorf("Columns(%q, %q) error %T, want request error", c[0], c[1], err)
+		}
+	}
+}
+
+var record = search.Record{
+	Id: bson.NewObjectIdWithTime(time.Date(2019, 2, 25, 10, 30, 0, 0, time.Local)),
+	AuditLog: in.AuditLog{Host: "web1", UserName: "root", Operation: `echo "a,b"`,
+		Categories: []string{"shell", "priv"}, RiskScore: 80},
+}
+
+func TestValues(t *testing.T) {
+	v := values(&record, cols(t, "CreatedAt,Host,Operation,Categories,RiskScore,IpAddr", ""))
+	want := []interface{}{"2019-02-25 10:30:00", "web1", `echo "a,b"`, []string{"shell", "priv"}, 80, ""}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("values %#v, want %#v", v, want)
+	}
+}
+
+func write(t *testing.T, format string, c []Column, bom bool, recs ...search.Record) []byte {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(format, buf, c, bom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range recs {
+		if err := w.Write(values(&recs[i], c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	c := cols(t, "Host,UserName,Operation,Categories,RiskScore", "zh")
+	b := write(t, CSV, c, true, record, search.Record{AuditLog: in.AuditLog{Host: "db1"}})
+	if !bytes.HasPrefix(b, []byte("\xEF\xBB\xBF")) {
+		t.Fatalf("csv without bom %q", b)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(b[3:])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"主机", "用户", "操作", "分类", "风险分值"},
+		{"web1", "root", `echo "a,b"`, "shell,priv", "80"},
+		{"db1", "", "", "", "0"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("csv rows %q, want %q", rows, want)
+	}
+	if b := write(t, "", c[:1], false); string(b) != "主机\n" {
+		t.Errorf("csv default format %q", b)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	c := cols(t, "RiskScore,Host,Categories,CreatedAt", "zh")
+	b := write(t, JSONL, c, false, record, search.Record{Id: record.Id})
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	// 键为字段名而不是本地化表头, 保持列顺序
+	want := []string{
+		`{"RiskScore":80,"Host":"web1","Categories":["shell","priv"],"CreatedAt":"2019-02-25 10:30:00"}`,
+		`{"RiskScore":0,"Host":"","Categories":null,"CreatedAt":"2019-02-25 10:30:00"}`,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("jsonl %q, want %q", lines, want)
+	}
+	for _, l := range lines {
+		if !json.Valid([]byte(l)) {
+			t.Errorf("invalid json %s", l)
+		}
+	}
+	if _, err := NewWriter("pdf", new(bytes.Buffer), c, false); err == nil {
+		t.Error("unsupported format expect error")
+	}
+}
+
+// unzip 解压 xlsx, 返回文件名到内容
+func unzip(t *testing.T, b []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestXLSX(t *testing.T) {
+	c := cols(t, "Host,Operation,RiskScore", "zh")
+	files := unzip(t, write(t, XLSX, c, false, record))
+	sheet := files["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{
+		`<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">主机</t></is></c>`,
+		`<c r="B2" t="inlineStr"><is><t xml:space="preserve">echo &#34;a,b&#34;</t></is></c>`,
+		`<c r="C2"><v>80</v></c></row>`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("sheet missing %s:\n%s", want, sheet)
+		}
+	}
+	for _, f := range []string{"xl/workbook.xml", "xl/_rels/workbook.xml.rels", "_rels/.rels", "[Content_Types].xml"} {
+		if files[f] == "" {
+			t.Errorf("missing %s", f)
+		}
+	}
+	if _, ok := files["xl/worksheets/sheet2.xml"]; ok {
+		t.Error("unexpected second sheet")
+	}
+}
+
+func TestXLSXSheets(t *testing.T) {
+	c := cols(t, "RiskScore", "")
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(XLSX, buf, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个 sheet 含表头共 SheetRows 行, 多出的 10 行写入第二个 sheet
+	n := SheetRows - 1 + 10
+	for i := 1; i <= n; i++ {
+		if err := w.Write([]interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := unzip(t, buf.Bytes())
+	s1, s2 := files["xl/worksheets/sheet1.xml"], files["xl/worksheets/sheet2.xml"]
+	if rows := strings.Count(s1, "<row "); rows != SheetRows {
+		t.Errorf("sheet1 rows %d, want %d", rows, SheetRows)
+	}
+	if !strings.Contains(s1, `<row r="65534"><c r="A65534"><v>65533</v></c></row></sheetData>`) {
+		t.Error("sheet1 last row")
+	}
+	if rows := strings.Count(s2, "<row "); rows != 11 {
+		t.Errorf("sheet2 rows %d, want 11", rows)
+	}
+	if !strings.Contains(s2, `<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">RiskScore</t></is></c></row><row r="2"><c r="A2"><v>65534</v></c></row>`) {
+		t.Errorf("sheet2 should start with header then row 65534:\n%.300s", s2)
+	}
+	for _, f := range []string{"xl/workbook.xml", "[Content_Types].xml", "xl/_rels/workbook.xml.rels"} {
+		if !strings.Contains(files[f], "sheet2") && !strings.Contains(files[f], "Sheet2") {
+			t.Errorf("%s does not reference sheet2", f)
+		}
+	}
+}
+
+func TestColName(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := colName(i); got != want {
+			t.Errorf("colName(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+// rowsWriter 记录写出的行
+type rowsWriter struct {
+	rows [][]interface{}
+}
+
+func (w *rowsWriter) Write(v []interface{}) error {
+	w.rows = append(w.rows, v)
+	return nil
+}
+
+func (w *rowsWriter) Close() error { return nil }
+
+// memory 按天保存记录, 模拟 dbapi.EACH 并记录查询
+type memory struct {
+	days    map[string][]search.Record
+	queries []*dbapi.FindQuery
+	err     error
+}
+
+func (m *memory) access(day string, query, res interface{}, op dbapi.OPType) error {
+	if op != dbapi.EACH {
+		return errors.New("unexpected op")
+	}
+	if m.err != nil {
+		return m.err
+	}
+	q := query.(*dbapi.FindQuery)
+	m.queries = append(m.queries, q)
+	each := res.(*dbapi.Each)
+	for i, r := range m.days[day] {
+		if i == q.Limit {
+			break
+		}
+		*each.Doc.(*search.Record) = r
+		if err := each.Fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	rec := func(host string) search.Record { return search.Record{AuditLog: in.AuditLog{Host: host}} }
+	days := map[string][]search.Record{
+		"2019-02-25": {rec("a"), rec("b"), {AuditLog: in.AuditLog{Host: "c", UserName: "root"}}},
+		"2019-02-26": {rec("d"), rec("e")},
+	}
+	c := cols(t, "Host,UserName", "")
+	cases := []struct {
+		max   int
+		req   search.Request
+		hosts string
+		// 每个集合的查询上限
+		limits []int
+	}{
+		{0, search.Request{From: "2019-02-25", To: "2019-02-26"}, "abcde", []int{DefaultMaxRows, DefaultMaxRows - 3}},
+		{4, search.Request{From: "2019-02-25", To: "2019-02-26"}, "abcd", []int{4, 1}},
+		{3, search.Request{From: "2019-02-25", To: "2019-02-26"}, "abc", []int{3}},
+		{4, search.Request{From: "2019-02-25", To: "2019-02-26", Limit: 2}, "ab", []int{2}},
+		{2, search.Request{From: "2019-02-25", To: "2019-02-26", Limit: 10}, "ab", []int{2}},
+		{0, search.Request{From: "2019-02-25", To: "2019-02-27", Desc: true, Limit: 3}, "dea", []int{3, 3, 1}},
+	}
+	for _, c2 := range cases {
+		m := &memory{days: days}
+		s := &Service{MaxRows: c2.max, access: m.access}
+		w := &rowsWriter{}
+		req := c2.req
+		n, err := s.Export(w, &req, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := ""
+		for _, r := range w.rows {
+			hosts += r[0].(string)
+		}
+		if n != len(w.rows) || hosts != c2.hosts {
+			t.Errorf("max %d %+v: %d rows %s, want %s", c2.max, c2.req, n, hosts, c2.hosts)
+		}
+		var limits []int
+		for _, q := range m.queries {
+			limits = append(limits, q.Limit)
+		}
+		if !reflect.DeepEqual(limits, c2.limits) {
+			t.Errorf("max %d %+v: limits %v, want %v", c2.max, c2.req, limits, c2.limits)
+		}
+	}
+
+	// 复用的记录对象在每行之后清空
+	m := &memory{days: map[string][]search.Record{"2019-02-25": {
+		{AuditLog: in.AuditLog{Host: "a", UserName: "root"}}, rec("b")}}}
+	w := &rowsWriter{}
+	if _, err := (&Service{access: m.access}).Export(w, &search.Request{From: "2019-02-25"}, c); err != nil {
+		t.Fatal(err)
+	}
+	if w.rows[1][1] != "" {
+		t.Errorf("second row user %v, want empty", w.rows[1][1])
+	}
+
+	m = &memory{days: days}
+	if _, err := (&Service{access: m.access}).Export(&rowsWriter{}, &search.Request{From: "2019-02-25", Sort: "DateTime", Desc: true}, c); err != nil {
+		t.Fatal(err)
+	}
+	if sort := m.queries[0].Sort; !reflect.DeepEqual(sort, []string{"-DateTime", "-_id"}) {
+		t.Errorf("sort %v", sort)
+	}
+
+	for _, req := range []search.Request{
+		{From: "bad"},
+		{Sort: "nope"},
+		{Filters: []*search.Filter{{Field: "RiskScore", Value: "x"}}},
+	} {
+		if _, err := (&Service{access: (&memory{}).access}).Export(&rowsWriter{}, &req, c); err == nil {
+			t.Errorf("%+v expect error", req)
+		}
+	}
+	m = &memory{err: errors.New("db down")}
+	if _, err := (&Service{access: m.access}).Export(&rowsWriter{}, &search.Request{}, c); err == nil || err.Error() != "db down" {
+		t.Errorf("storage error %v", err)
+	}
+}
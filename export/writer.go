@@ -0,0 +1,110 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// 导出格式
+const (
+	CSV   = "csv"
+	JSONL = "jsonl"
+	XLSX  = "xlsx"
+)
+
+// ContentTypes 各格式的 Content-Type
+var ContentTypes = map[string]string{
+	CSV:   "text/csv; charset=utf-8",
+	JSONL: "application/x-ndjson; charset=utf-8",
+	XLSX:  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Writer 逐行写出记录
+type Writer interface {
+	Write(values []interface{}) error
+	Close() error
+}
+
+// NewWriter 创建导出格式的 Writer, bom 为 true 时 csv 带 UTF-8 BOM 以便 Excel 识别编码
+func NewWriter(format string, w io.Writer, cols []Column, bom bool) (Writer, error) {
+	switch format {
+	case CSV, "":
+		return newCSV(w, cols, bom)
+	case JSONL:
+		return newJSONL(w, cols), nil
+	case XLSX:
+		return newXLSX(w, cols)
+	}
+	return nil, fmt.Errorf("unsupported format (%s).", format)
+}
+
+type csvWriter struct {
+	w    *csv.Writer
+	cols []Column
+	row  []string
+}
+
+func newCSV(w io.Writer, cols []Column, bom bool) (*csvWriter, error) {
+	if bom {
+		if _, err := io.WriteString(w, "\xEF\xBB\xBF"); err != nil {
+			return nil, err
+		}
+	}
+	c := &csvWriter{w: csv.NewWriter(w), cols: cols, row: make([]string, len(cols))}
+	for i, col := range cols {
+		c.row[i] = col.Header
+	}
+	return c, c.w.Write(c.row)
+}
+
+func (c *csvWriter) Write(values []interface{}) error {
+	for i, v := range values {
+		c.row[i] = text(v)
+	}
+	return c.w.Write(c.row)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonlWriter 每行一个 json 对象, 键为字段名并保持列顺序
+type jsonlWriter struct {
+	w    *bufio.Writer
+	keys [][]byte
+}
+
+func newJSONL(w io.Writer, cols []Column) *jsonlWriter {
+	j := &jsonlWriter{w: bufio.NewWriter(w)}
+	for _, col := range cols {
+		k, _ := json.Marshal(col.Field)
+		j.keys = append(j.keys, k)
+	}
+	return j
+}
+
+func (j *jsonlWriter) Write(values []interface{}) error {
+	j.w.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		j.w.Write(j.keys[i])
+		j.w.WriteByte(':')
+		j.w.Write(b)
+	}
+	j.w.WriteByte('}')
+	return j.w.WriteByte('\n')
+}
+
+func (j *jsonlWriter) Close() error {
+	return j.w.Flush()
+}
@@ -63,6 +63,8 @@ var systemName2Type = map[string]string{
 // 命令相关操作信息
 type AuditLog struct {
 	Host string `bson:"Host,omitempty" json:"Host,omitempty"`
+	// 采集规则
+	Rule string `bson:"Rule,omitempty" json:"Rule,omitempty"`
 	// 日志产生日期
 	Date string `bson:"Date,omitempty" json:"Date,omitempty"`
 
@@ -76,6 +78,19 @@ type AuditLog struct {
 	Operation string `bson:"Operation,omitempty" json:"Operation,omitempty"`
 	State     string `bson:"State,omitempty" json:"State,omitempty"`
 	UserName  string `bson:"UserName,omitempty" json:"UserName,omitempty"`
+
+	// 敏感操作分类及风险分值
+	Categories []string `bson:"Categories,omitempty" json:"Categories,omitempty"`
+	RiskScore  int      `bson:"RiskScore,omitempty" json:"RiskScore,omitempty"`
+
+	// 已脱敏字段
+	Masked []string `bson:"Masked,omitempty" json:"Masked,omitempty"`
+
+	// 哈希链: 同一规则下每个文件为一个流, Hash 覆盖 PrevHash 与记录内容
+	Stream   string `bson:"Stream,omitempty" json:"Stream,omitempty"`
+	Seq      int64  `bson:"Seq,omitempty" json:"Seq,omitempty"`
+	PrevHash string `bson:"PrevHash,omitempty" json:"PrevHash,omitempty"`
+	Hash     string `bson:"Hash,omitempty" json:"Hash,omitempty"`
 }
 
 func Marshal(auditlog *AuditLog) (b []byte, err error) {
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -92,6 +93,14 @@ func (c *ColumnPattern) unMarshal(b []byte, aud *AuditLog) {
 	}
 }
 
+// 脱敏规则, 只写 name 时引用内置检测器(password/token/privatekey/idcard/phone)
+type RedactRule struct {
+	Name    string   `bson:"name,omitempty" json:"name,omitempty"`
+	Pattern string   `bson:"pattern,omitempty" json:"pattern,omitempty"`
+	Replace string   `bson:"replace,omitempty" json:"replace,omitempty"`
+	Fields  []string `bson:"fields,omitempty" json:"fields,omitempty"`
+}
+
 // 运行时配置文件; ?持久化
 type RuntimeOptions struct {
 	Host string `bson:"host,omitempty" json:"host,omitempty"`
@@ -112,6 +121,25 @@ type RuntimeOptions struct {
 
 	ColumnPattern *ColumnPattern `bson:"columnPattern,omitempty" json:"columnPattern,omitempty"`
 
+	// 入库前脱敏规则, 在全局规则之后执行
+	Redact []*RedactRule `bson:"redact,omitempty" json:"redact,omitempty"`
+
+	// 文件监听方式 inotify(默认)/poll; 网络文件系统上其它主机的写入不产生 inotify 事件, 使用 poll 按间隔比较文件状态
+	WatchMode string `bson:"watchMode,omitempty" json:"watchMode,omitempty"`
+	// poll 的间隔, 如 "5s", 默认 1s
+	PollInterval string `bson:"pollInterval,omitempty" json:"pollInterval,omitempty"`
+
+	// dir 之外的其它日志目录; 都为空时取 include 中绝对路径的固定前缀, 该前缀不能为 /
+	Roots []string `bson:"roots,omitempty" json:"roots,omitempty"`
+	// 文件路径 glob, ** 匹配任意层目录; 以 / 开头时匹配绝对路径, 否则匹配相对目录的路径. 设置后不使用 filePattern
+	Include []string `bson:"include,omitempty" json:"include,omitempty"`
+	// 排除的文件或目录 glob, 规则同 include, 匹配的目录不再进入
+	Exclude []string `bson:"exclude,omitempty" json:"exclude,omitempty"`
+	// 最大深度, 目录下的文件为 1, 0 不限制
+	MaxDepth int `bson:"maxDepth,omitempty" json:"maxDepth,omitempty"`
+	// 符号链接 follow(默认, 跟踪链接的文件并进入链接的目录)/file(不进入链接的目录)/ignore(忽略全部链接)
+	Symlinks string `bson:"symlinks,omitempty" json:"symlinks,omitempty"`
+
 	// 日志头格式
 	p []byte
 
@@ -119,6 +147,40 @@ type RuntimeOptions struct {
 	o string
 }
 
+// 文件监听方式
+const (
+	WATCH_INOTIFY = "inotify"
+	WATCH_POLL    = "poll"
+)
+
+// DefaultPollInterval 轮询文件状态的默认间隔
+const DefaultPollInterval = time.Second
+
+// Poll watchMode 为 poll 时返回轮询间隔, inotify 时为 0
+func (ro *RuntimeOptions) Poll() (time.Duration, error) {
+	switch ro.WatchMode {
+	case "", WATCH_INOTIFY:
+		return 0, nil
+	case WATCH_POLL:
+		if ro.PollInterval == "" {
+			return DefaultPollInterval, nil
+		}
+		d, err := time.ParseDuration(ro.PollInterval)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid pollInterval (%s).", ro.PollInterval)
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid watchMode (%s), expect inotify/poll.", ro.WatchMode)
+}
+
+// 符号链接的处理方式
+const (
+	SYMLINK_FILE   = "file"
+	SYMLINK_FOLLOW = "follow"
+	SYMLINK_IGNORE = "ignore"
+)
+
 func (ro *RuntimeOptions) Clone() *RuntimeOptions {
 	r := *ro
 	return &r
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	cases := []struct {
+		mode, interval string
+		poll           time.Duration
+		err            bool
+	}{
+		{"", "", 0, false},
+		{WATCH_INOTIFY, "", 0, false},
+		// inotify 时忽略轮询间隔
+		{WATCH_INOTIFY, "5s", 0, false},
+		{WATCH_POLL, "", DefaultPollInterval, false},
+		{WATCH_POLL, "500ms", 500 * time.Millisecond, false},
+		{WATCH_POLL, "1m", time.Minute, false},
+		{WATCH_POLL, "0", 0, true},
+		{WATCH_POLL, "0s", 0, true},
+		{WATCH_POLL, "-1s", 0, true},
+		{WATCH_POLL, "5", 0, true},
+		{WATCH_POLL, "fast", 0, true},
+		{"fanotify", "", 0, true},
+	}
+	for _, c := range cases {
+		ro := &RuntimeOptions{WatchMode: c.mode, PollInterval: c.interval}
+		poll, err := ro.Poll()
+		if (err != nil) != c.err || poll != c.poll {
+			t.Errorf("Poll(%s, %s) = %s %v, want %s error %v", c.mode, c.interval, poll, err, c.poll, c.err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package live
+
+import (
+	"sync/atomic"
+
+	ll "logauditer/logmining"
+)
+
+// Watch 工作进程事件订阅, 缓冲满时丢弃新事件并计数
+type Watch struct {
+	C <-chan *ll.Event
+
+	c       chan *ll.Event
+	rule    string
+	dropped uint64
+	hub     *Hub
+}
+
+// Dropped 返回并清零自上次调用以来丢弃的事件数
+func (w *Watch) Dropped() uint64 {
+	return atomic.SwapUint64(&w.dropped, 0)
+}
+
+// Close 取消订阅
+func (w *Watch) Close() {
+	w.hub.unwatch(w)
+}
+
+// Watch 订阅工作进程事件, rule 为空时订阅全部规则, buffer <= 0 时为 DefaultBuffer
+func (h *Hub) Watch(rule string, buffer int) *Watch {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	c := make(chan *ll.Event, buffer)
+	w := &Watch{C: c, c: c, rule: rule, hub: h}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+		return w
+	}
+	h.watches[w] = struct{}{}
+	return w
+}
+
+func (h *Hub) unwatch(w *Watch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watches[w]; ok {
+		delete(h.watches, w)
+		close(w.c)
+	}
+}
+
+// Notify 实现 logmining.Listener, 不阻塞
+func (h *Hub) Notify(e *ll.Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for w := range h.watches {
+		if w.rule != "" && w.rule != e.Rule {
+			continue
+		}
+		select {
+		case w.c <- e:
+		default:
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	}
+}
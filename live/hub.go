@@ -0,0 +1,161 @@
+package live
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+)
+
+const (
+	// DefaultBuffer 每个订阅者的缓冲条数
+	DefaultBuffer = 256
+	// MaxBuffer 订阅者可以指定的最大缓冲条数
+	MaxBuffer = 10000
+)
+
+// Message 推送给订阅者的记录
+type Message struct {
+	Rule   string      `json:"rule"`
+	File   string      `json:"file"`
+	Time   time.Time   `json:"time"`
+	Record in.AuditLog `json:"record"`
+}
+
+// Filter 订阅过滤条件, 为空的条件不限制
+type Filter struct {
+	Rule string
+	Host string
+	User string
+	// Operation 正则
+	Op *regexp.Regexp
+}
+
+// Match 记录是否满足过滤条件
+func (f *Filter) Match(m *Message) bool {
+	if f == nil {
+		return true
+	}
+	switch {
+	case f.Rule != "" && f.Rule != m.Rule:
+		return false
+	case f.Host != "" && f.Host != m.Record.Host:
+		return false
+	case f.User != "" && f.User != m.Record.UserName:
+		return false
+	case f.Op != nil && !f.Op.MatchString(m.Record.Operation):
+		return false
+	}
+	return true
+}
+
+// Subscription 订阅, 缓冲满时丢弃新记录并计数, 不阻塞入库
+type Subscription struct {
+	C <-chan *Message
+
+	c       chan *Message
+	filter  *Filter
+	dropped uint64
+	hub     *Hub
+}
+
+// Dropped 返回并清零自上次调用以来丢弃的条数
+func (s *Subscription) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Close 取消订阅
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// Hub 进程内发布订阅, 作为 logmining.Hook 接收入库成功的记录,
+// 作为 logmining.Listener 接收工作进程事件
+type Hub struct {
+	mu      sync.RWMutex
+	subs    map[*Subscription]struct{}
+	watches map[*Watch]struct{}
+	closed  bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:    make(map[*Subscription]struct{}),
+		watches: make(map[*Watch]struct{}),
+	}
+}
+
+// Subscribe 订阅记录, buffer <= 0 时为 DefaultBuffer
+func (h *Hub) Subscribe(f *Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	c := make(chan *Message, buffer)
+	s := &Subscription{C: c, c: c, filter: f, hub: h}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+// Close 结束全部订阅, 之后的订阅立即结束, 用于停止服务
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.c)
+	}
+	for w := range h.watches {
+		delete(h.watches, w)
+		close(w.c)
+	}
+}
+
+// Subscribers 当前订阅数
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+// Publish 发布记录, 不阻塞
+func (h *Hub) Publish(m *Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.filter.Match(m) {
+			continue
+		}
+		select {
+		case s.c <- m:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Fire 实现 logmining.Hook
+func (h *Hub) Fire(e *ll.Entry) {
+	if h.Subscribers() == 0 {
+		return
+	}
+	h.Publish(&Message{Rule: e.Rule, File: e.File, Time: time.Now(), Record: *e.Log})
+}
@@ -14,11 +14,18 @@ type DBWrite struct {
 	sp          *dbapi.StorageParts
 	Database    string
 	Collections string
+
+	runtimeOptions *in.RuntimeOptions
+	rule           string
+	file           string
 }
 
-func NewDBWrite(sp *dbapi.StorageParts) *DBWrite {
+func NewDBWrite(sp *dbapi.StorageParts, runtimeOptions *in.RuntimeOptions, rule, file string) *DBWrite {
 	dbw := &DBWrite{
-		sp: sp,
+		sp:             sp,
+		runtimeOptions: runtimeOptions,
+		rule:           rule,
+		file:           file,
 	}
 	dbw.updateCollection()
 	return dbw
@@ -31,6 +38,13 @@ func (d *DBWrite) Write(host string, date string, data []byte) error {
 	}
 	res.Host = host
 	res.Date = date
+	res.Rule = d.rule
+
+	e := &Entry{Rule: d.rule, File: d.file, Options: d.runtimeOptions, Log: res}
+	if err := defaultPipeline.filter(e); err != nil {
+		return err
+	}
+	d.updateCollection()
 	var _err error
 	dbapi.AccessDatabase(
 		d.sp,
@@ -42,24 +56,20 @@ func (d *DBWrite) Write(host string, date string, data []byte) error {
 		dbapi.KV,
 		&_err,
 	)
-	return _err
+	if _err != nil {
+		return _err
+	}
+	defaultPipeline.fire(e)
+	return nil
+}
+
+// Collection 记录按天分集合, date 格式 yyyy-mm-dd
+func Collection(date string) string {
+	return "log_" + strings.Replace(date, "-", "_", 2)
 }
 
+// updateCollection 按写入时的日期选择集合, 只在入库 goroutine 中调用
 func (d *DBWrite) updateCollection() {
 	d.Database = LOG_RECORD
-	gencoll := func() {
-		timeLayout := "2006 01 02" //
-		source := time.Unix(time.Now().Unix(), 0).Format(timeLayout)
-		d.Collections = "log_" + strings.Replace(source, " ", "_", 2)
-	}
-	gencoll()
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				gencoll()
-			}
-		}
-	}()
+	d.Collections = Collection(time.Now().Format("2006-01-02"))
 }
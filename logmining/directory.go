@@ -1,7 +1,7 @@
 package logmining
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"io/ioutil"
 	"logauditer/dbapi"
@@ -16,6 +16,7 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/globalsign/mgo/bson"
 	log "github.com/laik/logger"
+	"golang.org/x/sync/errgroup"
 )
 
 type FileType uint8
@@ -32,14 +33,24 @@ type Directory struct {
 	name           string
 	runtimeOptions *in.RuntimeOptions
 	level          int
-	filePattern    *regexp.Regexp
+	// 所在的根目录, 相对路径的 glob 以此为准
+	root    string
+	matcher *Matcher
+	parent  *Directory
+	// 跟随符号链接时用于发现循环
+	info os.FileInfo
 
-	watcher *fsnotify.Watcher
+	watch *Watch
 
 	fileMap map[string]*file
 	dirMap  map[string]*Directory
 
-	closeCh chan struct{}
+	// 子目录与文件的 ctx 由 ctx 派生, 结束时整棵目录树停止
+	ctx    context.Context
+	cancel context.CancelFunc
+	g      *errgroup.Group
+	// 关闭文件并保存读取位置后关闭
+	done chan struct{}
 
 	mu sync.Mutex
 
@@ -48,66 +59,132 @@ type Directory struct {
 	persists *dbapi.StorageParts
 }
 
-func NewDirectory(runtimeOptions *in.RuntimeOptions, level int, persists *dbapi.StorageParts, rule string) (*Directory, error) {
-	watcher, err := fsnotify.NewWatcher()
+// NewDirectory 跟踪 runtimeOptions.Dir 目录树直到 ctx 结束或调用 Close, 结束时保存读取位置
+func NewDirectory(ctx context.Context, runtimeOptions *in.RuntimeOptions, level int, persists *dbapi.StorageParts, rule string) (*Directory, error) {
+	matcher, err := NewMatcher(runtimeOptions)
 	if err != nil {
-		log.Error("cloud not initialize watcher.\n")
+		return nil, err
 	}
+	return newDirectory(ctx, &Directory{
+		name:           runtimeOptions.Dir,
+		root:           runtimeOptions.Dir,
+		level:          level,
+		matcher:        matcher,
+		runtimeOptions: runtimeOptions,
+		persists:       persists,
+		libcoll:        rule,
+	})
+}
 
-	if _, err := os.Stat(runtimeOptions.Dir); os.IsNotExist(err) {
-		err = os.MkdirAll(runtimeOptions.Dir, 0655)
+// newDirectory 监听 dir.name 并启动跟踪
+func newDirectory(ctx context.Context, dir *Directory) (*Directory, error) {
+	if _, err := os.Stat(dir.name); os.IsNotExist(err) {
+		err = os.MkdirAll(dir.name, 0655)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = watcher.Add(runtimeOptions.Dir)
+	info, err := os.Stat(dir.name)
 	if err != nil {
 		return nil, err
 	}
+	dir.info = info
 
-	dir := &Directory{
-		name:           runtimeOptions.Dir,
-		level:          level,
-		runtimeOptions: runtimeOptions,
-		watcher:        watcher,
-		mu:             sync.Mutex{},
-		persists:       persists,
-		libcoll:        rule,
+	poll, err := dir.runtimeOptions.Poll()
+	if err != nil {
+		return nil, err
 	}
-	dir.fileMap = make(map[string]*file)
-	dir.dirMap = make(map[string]*Directory)
-	dir.closeCh = make(chan struct{})
 
-	filePattern, err := regexp.Compile(dir.runtimeOptions.FilePattern)
+	watch, err := defaultWatches.Add(dir.name, poll)
 	if err != nil {
+		log.Error("cloud not watch dir (%s): %s.\n", dir.name, err)
 		return nil, err
 	}
-	dir.filePattern = filePattern
+	dir.watch = watch
+
+	dir.fileMap = make(map[string]*file)
+	dir.dirMap = make(map[string]*Directory)
+	dir.done = make(chan struct{})
+	dir.ctx, dir.cancel = context.WithCancel(ctx)
+	dir.g, dir.ctx = errgroup.WithContext(dir.ctx)
 
-	go dir.track()
 	dir.start()
-	dir.monitorCurrentDateFile()
-	dir.async2second()
+	dir.g.Go(dir.track)
+	dir.g.Go(dir.monitorCurrentDateFile)
+	dir.g.Go(dir.async2second)
+	go func() {
+		dir.g.Wait()
+		dir.shutdown()
+		close(dir.done)
+	}()
 
 	return dir, nil
 }
 
+// Roots 规则全部根目录的目录树
+type Roots []*Directory
+
+// NewRoots 跟踪规则的全部根目录直到 ctx 结束或调用 Close
+func NewRoots(ctx context.Context, runtimeOptions *in.RuntimeOptions, persists *dbapi.StorageParts, rule string) (Roots, error) {
+	matcher, err := NewMatcher(runtimeOptions)
+	if err != nil {
+		return nil, err
+	}
+	var r Roots
+	for _, root := range matcher.Roots() {
+		ops := runtimeOptions.Clone()
+		ops.Dir = root
+		d, err := newDirectory(ctx, &Directory{
+			name:           root,
+			root:           root,
+			level:          ROOT,
+			matcher:        matcher,
+			runtimeOptions: ops,
+			persists:       persists,
+			libcoll:        rule,
+		})
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = append(r, d)
+	}
+	return r, nil
+}
+
+// Close 关闭全部根目录
+func (r Roots) Close() {
+	for _, d := range r {
+		d.Close()
+	}
+}
+
+// Files 全部根目录跟踪的文件及读取位置
+func (r Roots) Files(res *[]LastPosition) {
+	for _, d := range r {
+		d.Files(res)
+	}
+}
+
+// Close 关闭目录树, 等待已读取的行入库并保存读取位置后返回; 可重复调用
 func (d *Directory) Close() {
-	d.closeCh <- struct{}{}
+	d.cancel()
+	<-d.done
 }
 
-func (d *Directory) async2second() {
-	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				r := new([]LastPosition)
-				d.asyncFlush(r)
-			}
+func (d *Directory) async2second() error {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r := new([]LastPosition)
+			d.asyncFlush(r)
+		case <-d.ctx.Done():
+			return nil
 		}
-	}()
+	}
 }
 
 func (d *Directory) asyncFlush(r *[]LastPosition) {
@@ -127,22 +204,54 @@ func (d *Directory) asyncFlush(r *[]LastPosition) {
 	}
 }
 
-func (d *Directory) List(r *[]string) {
+// Files 当前跟踪的文件及读取位置, 包括子目录
+func (d *Directory) Files(r *[]LastPosition) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	for _, v := range d.fileMap {
-		info := "name:" + v.name + "," + "offset" + ":" + fmt.Sprintf("%d", v.lastPosition.Offset)
-		*r = append(*r, info)
+		*r = append(*r, *v.lastPosition)
 	}
 	for _, _d := range d.dirMap {
-		_d.List(r)
+		_d.Files(r)
 	}
 }
 
+// loop 跟随符号链接的目录是否为自身或上层目录
+func (d *Directory) loop(dir string) bool {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	for p := d; p != nil; p = p.parent {
+		if os.SameFile(p.info, fi) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Directory) addDir(dir string) error {
+	if d.loop(dir) {
+		log.Debug("directory (%s) is a symlink loop, skip.\n", dir)
+		return nil
+	}
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if _, ok := d.dirMap[dir]; ok {
+		return nil
+	}
 	cloneOps := d.runtimeOptions.Clone()
 	cloneOps.Dir = dir
-	directory, err := NewDirectory(cloneOps, d.level+1, d.persists, d.libcoll)
+	directory, err := newDirectory(d.ctx, &Directory{
+		name:           dir,
+		root:           d.root,
+		level:          d.level + 1,
+		matcher:        d.matcher,
+		parent:         d,
+		runtimeOptions: cloneOps,
+		persists:       d.persists,
+		libcoll:        d.libcoll,
+	})
 	if err != nil {
 		return err
 	}
@@ -153,21 +262,29 @@ func (d *Directory) addDir(dir string) error {
 
 func (d *Directory) removeDir(dir string) {
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	childD, ok := d.dirMap[dir]
+	delete(d.dirMap, dir)
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
 	log.Debug("remove directory %s\n", dir)
-	if childD, ok := d.dirMap[dir]; ok {
-		for f, _ := range childD.fileMap {
-			childD.removeFile(f)
-		}
-		childD.removeDir(childD.name)
-		childD.Close()
-		delete(d.dirMap, dir)
+
+	// 不持有锁等待子目录树关闭, 之后清除其中全部文件的读取位置
+	childD.Close()
+	var r []LastPosition
+	childD.Files(&r)
+	for _, p := range r {
+		d.forget(p.Name)
 	}
 }
 
-func (d *Directory) addFile(f string) error {
+func (d *Directory) addFile(f, pattern string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if _, ok := d.fileMap[f]; ok {
+		return nil
+	}
 	lastp := &LastPosition{}
 	var _err error
 	dbapi.AccessDatabase(d.persists,
@@ -194,24 +311,31 @@ func (d *Directory) addFile(f string) error {
 		lastp.Whence = io.SeekCurrent
 		lastp.Reopen = true
 	}
-	file, err := newFile(d.runtimeOptions, lastp, NewDBWrite(d.persists))
+	lastp.Pattern = pattern
+	file, err := newFile(d.ctx, d.runtimeOptions, lastp, NewDBWrite(d.persists, d.runtimeOptions, d.libcoll, f))
 	if err != nil {
 		return err
 	}
 	d.fileMap[f] = file
 	log.Debug("add file (%s).\n", f)
+	Emit(FILE_ADDED, d.libcoll, f, "")
 	return nil
 }
 
-func (d *Directory) addEventFile(f string) error {
+func (d *Directory) addEventFile(f, pattern string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	// 轮转后重新创建的同名文件由原来的跟踪重新打开
+	if _, ok := d.fileMap[f]; ok {
+		return nil
+	}
 
 	lastp := &LastPosition{
-		Name:   f,
-		Offset: 0,
-		Whence: io.SeekStart,
-		Reopen: true,
+		Name:    f,
+		Offset:  0,
+		Whence:  io.SeekStart,
+		Reopen:  true,
+		Pattern: pattern,
 	}
 	var _err error
 	dbapi.AccessDatabase(d.persists, LIBDB, d.libcoll, bson.M{"_id": f}, lastp, dbapi.SET, dbapi.KV, &_err)
@@ -219,47 +343,69 @@ func (d *Directory) addEventFile(f string) error {
 		return _err
 	}
 
-	file, err := newFile(d.runtimeOptions, lastp, NewDBWrite(d.persists))
+	file, err := newFile(d.ctx, d.runtimeOptions, lastp, NewDBWrite(d.persists, d.runtimeOptions, d.libcoll, f))
 	if err != nil {
 		return err
 	}
 	d.fileMap[f] = file
 	log.Debug("add event file (%s).\n", f)
+	Emit(FILE_ADDED, d.libcoll, f, "")
 	return nil
 }
 
 func (d *Directory) removeFile(f string) {
 	d.mu.Lock()
-	defer d.mu.Unlock()
 	log.Debug("remove file %s\n", f)
 	ff, ok := d.fileMap[f]
 	if !ok {
+		d.mu.Unlock()
 		return
 	}
-	go ff.close() //异步可关闭
+	delete(d.fileMap, f)
+	d.mu.Unlock()
+
+	// 等待已读取的行入库, 不持有锁
+	ff.close()
+	d.forget(f)
+}
+
+// forget 删除文件的读取位置
+func (d *Directory) forget(f string) {
 	var _err error
 	dbapi.AccessDatabase(d.persists, LIBDB, d.libcoll, bson.M{"_id": f}, nil, dbapi.DEL, dbapi.KV, &_err)
 	if _err != nil {
 		log.Error("%s\n", _err)
 	}
-	delete(d.fileMap, f)
+	Emit(FILE_REMOVED, d.libcoll, f, "")
 }
 
-func (d *Directory) monitorCurrentDateFile() {
+// files 当前跟踪的文件名, 不包括子目录
+func (d *Directory) files() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := make([]string, 0, len(d.fileMap))
+	for fn := range d.fileMap {
+		r = append(r, fn)
+	}
+	return r
+}
+
+func (d *Directory) monitorCurrentDateFile() error {
 	ticker := time.NewTicker(1 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				for fn, _ := range d.fileMap {
-					if !d.isExpired(fn) {
-						continue
-					}
-					d.removeFile(fn)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, fn := range d.files() {
+				if !d.isExpired(fn) {
+					continue
 				}
+				d.removeFile(fn)
 			}
+		case <-d.ctx.Done():
+			return nil
 		}
-	}()
+	}
 }
 
 func (d *Directory) isExpired(fn string) bool {
@@ -269,6 +415,10 @@ func (d *Directory) isExpired(fn string) bool {
 	getDate, _ := regexp.Compile("\\d+-\\d+-\\d+")
 	_, name := filepath.Split(fn)
 	date := getDate.FindString(name)
+	// 使用 include 时文件名可以不带日期
+	if date == "" && len(d.matcher.include) > 0 {
+		return false
+	}
 	if date == curDate {
 		return false
 	}
@@ -279,6 +429,7 @@ func (d *Directory) start() {
 	ffinfos, err := ioutil.ReadDir(d.name)
 	if err != nil {
 		log.Error("read dir error:%s.\n", err)
+		Emit(ERROR, d.libcoll, d.name, err.Error())
 		return
 	}
 
@@ -286,45 +437,68 @@ func (d *Directory) start() {
 		ff := finfo.Name()
 		newff := filepath.Join(d.name, ff)
 
-		if finfo.IsDir() {
+		switch d.matcher.kind(newff, finfo) {
+		case DIR:
+			if !d.matcher.Dir(d.root, newff, d.level) {
+				log.Debug("dir (%s) excluded or exceed max depth.\n", newff)
+				continue
+			}
 			if err := d.addDir(newff); err != nil {
 				log.Error("add child dir error:%s.\n", err)
+				Emit(ERROR, d.libcoll, newff, err.Error())
+			}
+		case FILE:
+			pattern, ok := d.matcher.File(d.root, newff)
+			if !ok || d.isExpired(ff) {
+				log.Debug("file (%s) not match define rule or is expried file.\n", newff)
+				continue
+			}
+			if err := d.addFile(newff, pattern); err != nil {
+				log.Error("add child file tail follower error:%s.\n", err)
+				Emit(ERROR, d.libcoll, newff, err.Error())
 			}
-			continue
-		}
-		if !d.filePattern.MatchString(ff) || d.isExpired(ff) {
-			log.Debug("file (%s) not match define rule or is expried file.\n", newff)
-			continue
-		}
-		if err := d.addFile(newff); err != nil {
-			log.Error("add child file tail follower error:%s.\n", err)
 		}
 	}
 }
 
-func (d *Directory) track() {
+func (d *Directory) track() error {
 	for {
 		select {
-		case event, ok := <-d.watcher.Events:
+		case event, ok := <-d.watch.Events:
 			if !ok {
-				return
+				return nil
 			}
 
 			switch event.Op {
 			case fsnotify.Create:
-				switch ftype(event.Name) {
+				fi, err := os.Lstat(event.Name)
+				if err != nil {
+					break
+				}
+				switch d.matcher.kind(event.Name, fi) {
 				case FILE:
 					_, fileName := filepath.Split(event.Name)
-					if !d.filePattern.MatchString(fileName) || d.isExpired(fileName) {
+					pattern, ok := d.matcher.File(d.root, event.Name)
+					if !ok || d.isExpired(fileName) {
 						log.Debug("file (%s) not match define rule or is expired file.\n", event.Name)
 						break
 					}
-					d.addEventFile(event.Name)
+					if err := d.addEventFile(event.Name, pattern); err != nil {
+						log.Error("add event file error:%s.\n", err)
+						Emit(ERROR, d.libcoll, event.Name, err.Error())
+					}
 				case DIR:
-					d.addDir(event.Name)
+					if !d.matcher.Dir(d.root, event.Name, d.level) {
+						log.Debug("dir (%s) excluded or exceed max depth.\n", event.Name)
+						break
+					}
+					if err := d.addDir(event.Name); err != nil {
+						log.Error("add event dir error:%s.\n", err)
+						Emit(ERROR, d.libcoll, event.Name, err.Error())
+					}
 				}
 			case fsnotify.Remove:
-				if _, ok := d.fileMap[event.Name]; ok {
+				if d.tracked(event.Name) {
 					log.Debug("remove file op %s.\n", event.Name)
 					d.removeFile(event.Name)
 				} else {
@@ -334,37 +508,37 @@ func (d *Directory) track() {
 			default:
 			}
 
-		case <-d.closeCh:
+		case <-d.ctx.Done():
 			log.Debug("recevier stop directory (%s).\n", d.name)
-			var _err error
-			for _fn, _f := range d.fileMap {
-				(*_f).close()
-				lastp := _f.lastPosition
-				dbapi.AccessDatabase(d.persists, LIBDB, d.libcoll, bson.M{"_id": _fn}, lastp, dbapi.SET, dbapi.KV, &_err)
-				if _err != nil {
-					log.Error("close file save record error: (%s)\n", _err)
-				}
-				log.Debug("graceful close (%s) save lastposition.\n", _fn)
-			}
-
-			for _, _d := range d.dirMap {
-				(*_d).Close()
-			}
-			if err := d.watcher.Close(); err != nil {
-				log.Error("close watch dir (%s) error:%s.\n", d.name, err)
-			}
-			return
+			return nil
 		}
 	}
 }
 
-func ftype(fn string) FileType {
-	info, e := os.Stat(fn)
-	if e != nil {
-		return UNKNOW
+func (d *Directory) tracked(fn string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.fileMap[fn]
+	return ok
+}
+
+// shutdown 在全部 goroutine 退出后关闭文件与子目录并保存读取位置
+func (d *Directory) shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var _err error
+	for _fn, _f := range d.fileMap {
+		(*_f).close()
+		lastp := _f.lastPosition
+		dbapi.AccessDatabase(d.persists, LIBDB, d.libcoll, bson.M{"_id": _fn}, lastp, dbapi.SET, dbapi.KV, &_err)
+		if _err != nil {
+			log.Error("close file save record error: (%s)\n", _err)
+		}
+		log.Debug("graceful close (%s) save lastposition.\n", _fn)
 	}
-	if !info.IsDir() {
-		return FILE
+
+	for _, _d := range d.dirMap {
+		(*_d).Close()
 	}
-	return DIR
+	d.watch.Close()
 }
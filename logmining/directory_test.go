@@ -0,0 +1,215 @@
+package logmining
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+)
+
+const cycles = 20
+
+func testOptions(dir string) *in.RuntimeOptions {
+	return &in.RuntimeOptions{
+		Dir:           dir,
+		FilePattern:   `.*\.log$`,
+		Host:          `\d+\.\d+\.\d+\.\d+`,
+		LogDate:       `\d+-\d+-\d+`,
+		SystemType:    "server",
+		ColumnPattern: &in.ColumnPattern{UserName: "x"},
+	}
+}
+
+// todayLog 带当天日期的文件名, 其它日期的文件视为过期
+func todayLog() string {
+	return "10.0.0.1_" + time.Now().Format("2006-01-02") + ".log"
+}
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkGoroutines 等待 goroutine 数回到 base, 超时后失败并输出堆栈
+func checkGoroutines(t *testing.T, base int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if runtime.NumGoroutine() <= base {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<20)
+	t.Fatalf("goroutines %d, want <= %d\n%s", runtime.NumGoroutine(), base, buf[:runtime.Stack(buf, true)])
+}
+
+func TestTailfollowerCycles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "a.log")
+	writeFile(t, fn, "a\nb\n")
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < cycles; i++ {
+		tf, err := NewTailfollower(context.Background(), &LastPosition{Name: fn, Reopen: true}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 读一行后关闭, 另一行停在发送中
+		<-tf.Lines()
+		tf.Close()
+		tf.Close()
+	}
+	checkGoroutines(t, base)
+}
+
+func TestTailfollowerContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "a.log")
+	writeFile(t, fn, "")
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < cycles; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		tf, err := NewTailfollower(ctx, &LastPosition{Name: fn, Reopen: true}, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		for range tf.Lines() {
+		}
+	}
+	checkGoroutines(t, base)
+}
+
+func TestFileCycles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, todayLog())
+	writeFile(t, fn, "a\nb\nc\n")
+	ops := testOptions(dir)
+	sp := dbapi.NewStorageParts()
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < cycles; i++ {
+		f, err := newFile(context.Background(), ops, &LastPosition{Name: fn, Reopen: true}, NewDBWrite(sp, ops, "r", fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.close()
+	}
+	checkGoroutines(t, base)
+}
+
+func TestDirectoryCycles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, todayLog()), "a\n")
+	writeFile(t, filepath.Join(dir, "sub", todayLog()), "a\n")
+	writeFile(t, filepath.Join(dir, "sub", "deep", todayLog()), "a\n")
+	ops := testOptions(dir)
+	sp := dbapi.NewStorageParts()
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < cycles; i++ {
+		d, err := NewDirectory(context.Background(), ops, ROOT, sp, "r")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r []LastPosition
+		d.Files(&r)
+		if len(r) != 3 {
+			t.Fatalf("files %v, want 3", r)
+		}
+		d.Close()
+		d.Close()
+	}
+	checkGoroutines(t, base)
+}
+
+func TestDirectoryRecreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, todayLog())
+	writeFile(t, fn, "a\n")
+	writeFile(t, filepath.Join(dir, "sub", todayLog()), "a\n")
+
+	base := runtime.NumGoroutine()
+	d, err := NewDirectory(context.Background(), testOptions(dir), ROOT, dbapi.NewStorageParts(), "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	running := runtime.NumGoroutine()
+	// 轮转: 移走后重新创建同名文件, 不增加跟踪
+	for i := 0; i < cycles; i++ {
+		if err := os.Rename(fn, fn+".1"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fn, "b\n")
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkGoroutines(t, running)
+
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	var r []LastPosition
+	d.Files(&r)
+	if len(r) != 1 || r[0].Name != fn {
+		t.Errorf("files %v, want only %s", r, fn)
+	}
+	d.Close()
+	checkGoroutines(t, base)
+}
+
+func TestDirectoryContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "sub", todayLog()), "a\n")
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < cycles; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		d, err := NewDirectory(ctx, testOptions(dir), ROOT, dbapi.NewStorageParts(), "r")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		<-d.done
+	}
+	checkGoroutines(t, base)
+}
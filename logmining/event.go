@@ -0,0 +1,62 @@
+package logmining
+
+import (
+	"time"
+)
+
+// EventType 工作进程事件类型
+type EventType int
+
+const (
+	STARTED EventType = iota
+	STOPPED
+	FILE_ADDED
+	FILE_REMOVED
+	ERROR
+)
+
+var eventNames = map[EventType]string{
+	STARTED:      "started",
+	STOPPED:      "stopped",
+	FILE_ADDED:   "file_added",
+	FILE_REMOVED: "file_removed",
+	ERROR:        "error",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+// Event 工作进程状态变化: 启动、停止、新增/移除监控文件及运行错误
+type Event struct {
+	Type    EventType `json:"type"`
+	Rule    string    `json:"rule"`
+	File    string    `json:"file,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Listener 接收工作进程事件, 不能阻塞
+type Listener interface {
+	Notify(e *Event)
+}
+
+// RegisterListener 注册工作进程事件接收者
+func RegisterListener(l Listener) {
+	defaultPipeline.mu.Lock()
+	defer defaultPipeline.mu.Unlock()
+	defaultPipeline.listeners = append(defaultPipeline.listeners, l)
+}
+
+// Emit 发布工作进程事件
+func Emit(typ EventType, rule, file, message string) {
+	defaultPipeline.notify(&Event{Type: typ, Rule: rule, File: file, Message: message, Time: time.Now()})
+}
+
+func (p *pipeline) notify(e *Event) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, l := range p.listeners {
+		l.Notify(e)
+	}
+}
@@ -1,40 +1,39 @@
 package logmining
 
 import (
+	"context"
 	in "logauditer/internal"
 	"path/filepath"
 	"regexp"
 
 	log "github.com/laik/logger"
+	"golang.org/x/sync/errgroup"
 )
 
 // file : 10.10.2.104_2018-12-04_DianXin-route.log => host = 10.10.2.104
 
 type file struct {
 	name           string
-	closeCh        chan struct{}
 	runtimeOptions *in.RuntimeOptions
 	tail           *Tailfollower
 	lastPosition   *LastPosition
 	dw             *DBWrite
+
+	cancel context.CancelFunc
+	// 读取与入库的 goroutine
+	g *errgroup.Group
 }
 
-func newFile(runtimeOptions *in.RuntimeOptions, lastPosition *LastPosition, dw *DBWrite) (*file, error) {
+// newFile 跟踪文件并入库, 直到 ctx 结束或调用 close
+func newFile(ctx context.Context, runtimeOptions *in.RuntimeOptions, lastPosition *LastPosition, dw *DBWrite) (*file, error) {
 	log.Debug("runtimeops = %#v\n", runtimeOptions)
 	f := &file{
 		name:           lastPosition.Name,
 		runtimeOptions: runtimeOptions,
 		lastPosition:   lastPosition,
 		dw:             dw,
+		g:              &errgroup.Group{},
 	}
-	f.closeCh = make(chan struct{})
-
-	tail, err := NewTailfollower(f.lastPosition)
-	if err != nil {
-		log.Error("new tail follower error:%s last position %#v\n", err, f.lastPosition)
-		return nil, err
-	}
-	f.tail = tail
 
 	var host string
 	var date string
@@ -64,8 +63,27 @@ func newFile(runtimeOptions *in.RuntimeOptions, lastPosition *LastPosition, dw *
 		log.Debug("parse logDate list %#v\n", dlist)
 	}
 
-	go func() {
-		for out := range f.tailing() {
+	poll, err := runtimeOptions.Poll()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, f.cancel = context.WithCancel(ctx)
+	tail, err := NewTailfollower(ctx, f.lastPosition, poll)
+	if err != nil {
+		f.cancel()
+		log.Error("new tail follower error:%s last position %#v\n", err, f.lastPosition)
+		return nil, err
+	}
+	f.tail = tail
+
+	buf := make(chan []byte)
+	f.g.Go(func() error {
+		f.tailing(buf)
+		return nil
+	})
+	f.g.Go(func() error {
+		for out := range buf {
 			log.Debug(`
 parse: (%s)
 filename: (%s)
@@ -75,51 +93,44 @@ date: (%s)
 `, out, fileName, host, date)
 			if err := dw.Write(host, date, out); err != nil {
 				log.Error("dw write error %s\n", err)
+				Emit(ERROR, dw.rule, dw.file, err.Error())
 			}
 		}
-	}()
+		return nil
+	})
 
 	return f, nil
 }
 
-func (f *file) tailing() chan []byte {
-	buf := make(chan []byte)
-	go func() {
-		defer close(buf)
-		logParts := in.NewLogParts()
-		for {
-			select {
-			case line, ok := <-f.tail.Lines():
-				if !ok {
-					return
-				}
-				lineData := line.Bytes()
-				resp := in.NewResponse()
-				var _err error
-				in.VisitLogsAudit2(
-					logParts,
-					lineData,
-					resp,
-					f.runtimeOptions,
-					&_err,
-				)
-				if resp.Err == nil && _err == nil {
-					buf <- []byte(resp.Data)
-				} else {
-					log.Error("%s\n", _err)
-				}
-				f.lastPosition.Offset = f.tail.Offset()
-				log.Debug("file (%s) offset (%d) data (%s)\n", f.name, f.lastPosition.Offset, lineData)
-			case <-f.closeCh:
-				log.Debug("close file tail %s\n", f.name)
-				f.tail.Close()
-				return
-			}
+// tailing 解析读取的行, 跟踪结束后关闭 buf
+func (f *file) tailing(buf chan<- []byte) {
+	defer close(buf)
+	logParts := in.NewLogParts()
+	for line := range f.tail.Lines() {
+		lineData := line.Bytes()
+		resp := in.NewResponse()
+		var _err error
+		in.VisitLogsAudit2(
+			logParts,
+			lineData,
+			resp,
+			f.runtimeOptions,
+			&_err,
+		)
+		if resp.Err == nil && _err == nil {
+			buf <- []byte(resp.Data)
+		} else {
+			log.Error("%s\n", _err)
 		}
-	}()
-	return buf
+		f.lastPosition.Offset = line.Offset()
+		log.Debug("file (%s) offset (%d) data (%s)\n", f.name, f.lastPosition.Offset, lineData)
+	}
+	log.Debug("close file tail %s\n", f.name)
 }
 
+// close 停止读取并等待已读取的行入库, 之后 lastPosition 为最后入库的位置; 可重复调用
 func (f *file) close() {
-	f.closeCh <- struct{}{}
+	f.cancel()
+	f.g.Wait()
+	f.tail.Close()
 }
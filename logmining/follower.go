@@ -3,13 +3,14 @@ package logmining
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/globalsign/mgo/bson"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -22,6 +23,8 @@ const (
 type Line struct {
 	bytes     []byte
 	discarded int
+	// 读完该行后的文件位置
+	offset int64
 }
 
 func (l *Line) Bytes() []byte {
@@ -36,11 +39,17 @@ func (l *Line) Discarded() int {
 	return l.discarded
 }
 
+func (l *Line) Offset() int64 {
+	return l.offset
+}
+
 type LastPosition struct {
 	Name   string `bson:"_id" json:"_id"`
 	Offset int64  `bson:"offset" json:"offset"`
 	Whence int    `bson:"whence" json:"whence"`
 	Reopen bool   `bson:"reopen" json:"reopen"`
+	// 匹配文件的 include 或 filePattern, 不保存
+	Pattern string `bson:"-" json:"pattern,omitempty"`
 }
 
 func (l *LastPosition) Query() bson.M {
@@ -57,24 +66,30 @@ func (l *LastPosition) String() string {
 
 // excerpt from github.com/papertrail/go-tail/follower.go
 type Tailfollower struct {
-	once     sync.Once
 	file     *os.File
 	filename string
 	lines    chan Line
 	err      error
 	config   *LastPosition
 	reader   *bufio.Reader
-	watcher  *fsnotify.Watcher
+	watch    *Watch
 	offset   int64
-	closeCh  chan struct{}
+	// 轮询文件状态的间隔, 0 使用 inotify
+	poll time.Duration
+
+	// ctx 结束时停止读取
+	ctx    context.Context
+	cancel context.CancelFunc
+	g      *errgroup.Group
 }
 
-func NewTailfollower(cfg *LastPosition) (*Tailfollower, error) {
+// NewTailfollower 跟踪文件直到 ctx 结束或调用 Close, poll > 0 时按该间隔比较文件状态而不使用 inotify
+func NewTailfollower(ctx context.Context, cfg *LastPosition, poll time.Duration) (*Tailfollower, error) {
 	t := &Tailfollower{
 		filename: cfg.Name,
 		lines:    make(chan Line),
 		config:   cfg,
-		closeCh:  make(chan struct{}),
+		poll:     poll,
 	}
 
 	err := t.reopen()
@@ -82,7 +97,9 @@ func NewTailfollower(cfg *LastPosition) (*Tailfollower, error) {
 		return nil, err
 	}
 
-	go t.once.Do(t.run)
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.g, t.ctx = errgroup.WithContext(t.ctx)
+	t.g.Go(t.run)
 
 	return t, nil
 }
@@ -95,12 +112,17 @@ func (t *Tailfollower) Err() error {
 	return t.err
 }
 
+// Close 停止读取并等待全部 goroutine 退出, 可重复调用; 正在发送的行不再发送, 读取位置停在上一行
 func (t *Tailfollower) Close() {
-	t.closeCh <- struct{}{}
+	t.cancel()
+	t.g.Wait()
 }
 
-func (t *Tailfollower) run() {
-	t.close(t.follow())
+func (t *Tailfollower) run() error {
+	defer t.cancel()
+	err := t.follow()
+	t.close(err)
+	return err
 }
 
 func (t *Tailfollower) Offset() int64 {
@@ -108,25 +130,16 @@ func (t *Tailfollower) Offset() int64 {
 }
 
 func (t *Tailfollower) follow() error {
-	_, err := t.file.Seek(t.config.Offset, t.config.Whence)
-	if err != nil {
+	var err error
+	if t.offset, err = t.file.Seek(t.config.Offset, t.config.Whence); err != nil {
 		return err
 	}
 
-	var (
-		eventChan = make(chan fsnotify.Event)
-		errChan   = make(chan error, 1)
-	)
-
-	t.watcher, err = fsnotify.NewWatcher()
+	t.watch, err = defaultWatches.Add(t.filename, t.poll)
 	if err != nil {
 		return err
 	}
-
-	defer t.watcher.Close()
-	go t.watchFileEvents(eventChan, errChan)
-
-	t.watcher.Add(t.filename)
+	defer t.watch.Close()
 
 	for {
 		for {
@@ -140,6 +153,7 @@ func (t *Tailfollower) follow() error {
 				if i > 0 {
 					n, _ := t.reader.Discard(i + 1)
 					discarded += n
+					t.offset += int64(n)
 				}
 
 				if i+1 < peekSize {
@@ -163,12 +177,18 @@ func (t *Tailfollower) follow() error {
 				break
 			}
 
-			t.sendLine(s, discarded)
+			t.offset += int64(len(s))
+			if !t.sendLine(s, discarded) {
+				return nil
+			}
 		}
 
 		// we're now at EOF, so wait for changes
 		select {
-		case evt := <-eventChan:
+		case evt, ok := <-t.watch.Events:
+			if !ok {
+				return nil
+			}
 			switch evt.Op {
 
 			// as soon as something is written, go back and read until EOF.
@@ -215,13 +235,8 @@ func (t *Tailfollower) follow() error {
 				continue
 			}
 
-		// any errors that come from fsnotify
-		case err := <-errChan:
-			return err
-
 		// a request to stop
-		case <-t.closeCh:
-			t.watcher.Remove(t.filename)
+		case <-t.ctx.Done():
 			return nil
 
 		case <-time.After(10 * time.Second):
@@ -249,13 +264,17 @@ func (t *Tailfollower) follow() error {
 }
 
 func (t *Tailfollower) rewatch() error {
-	t.watcher.Remove(t.filename)
+	// 同一变化可能经由文件与所在目录收到多次, 路径仍是当前文件时不重新打开, 避免重复读取
+	if fi1, err := t.file.Stat(); err == nil {
+		if fi2, err := os.Stat(t.filename); err == nil && os.SameFile(fi1, fi2) {
+			return nil
+		}
+	}
 	if err := t.reopen(); err != nil {
 		return err
 	}
 
-	t.watcher.Add(t.filename)
-	return nil
+	return t.watch.Rewatch()
 }
 
 func (t *Tailfollower) reopen() error {
@@ -269,7 +288,8 @@ func (t *Tailfollower) reopen() error {
 		return err
 	}
 
-	t.file = file
+	// 重新打开的文件从头读取
+	t.file, t.offset = file, 0
 	t.reader = bufio.NewReaderSize(t.file, bufSize)
 
 	return nil
@@ -285,39 +305,12 @@ func (t *Tailfollower) close(err error) {
 	close(t.lines)
 }
 
-func (t *Tailfollower) sendLine(l []byte, d int) {
-	t.lines <- Line{l[:len(l)-1], d}
-}
-
-func (t *Tailfollower) watchFileEvents(eventChan chan fsnotify.Event, errChan chan error) {
-	for {
-		select {
-		case evt, ok := <-t.watcher.Events:
-			if !ok {
-				return
-			}
-
-			// debounce write events, but send all others
-			switch evt.Op {
-			case fsnotify.Write:
-				select {
-				case eventChan <- evt:
-				default:
-				}
-
-			default:
-				select {
-				case eventChan <- evt:
-				case err := <-t.watcher.Errors:
-					errChan <- err
-					return
-				}
-			}
-
-		// die on a file watching error
-		case err := <-t.watcher.Errors:
-			errChan <- err
-			return
-		}
+// sendLine 关闭后返回 false
+func (t *Tailfollower) sendLine(l []byte, d int) bool {
+	select {
+	case t.lines <- Line{l[:len(l)-1], d, t.offset}:
+		return true
+	case <-t.ctx.Done():
+		return false
 	}
 }
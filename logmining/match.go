@@ -0,0 +1,308 @@
+package logmining
+
+import (
+	"fmt"
+	in "logauditer/internal"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Matcher 规则的目录与文件匹配: 根目录、include/exclude glob、filePattern、最大深度与符号链接方式
+type Matcher struct {
+	roots       []string
+	filePattern *regexp.Regexp
+	include     []*glob
+	exclude     []*glob
+	maxDepth    int
+	symlinks    string
+}
+
+// NewMatcher 编译规则中的匹配选项
+func NewMatcher(ro *in.RuntimeOptions) (*Matcher, error) {
+	m := &Matcher{maxDepth: ro.MaxDepth, symlinks: ro.Symlinks}
+	if m.maxDepth < 0 {
+		return nil, fmt.Errorf("invalid maxDepth (%d).", ro.MaxDepth)
+	}
+	switch m.symlinks {
+	case "":
+		m.symlinks = in.SYMLINK_FOLLOW
+	case in.SYMLINK_FILE, in.SYMLINK_FOLLOW, in.SYMLINK_IGNORE:
+	default:
+		return nil, fmt.Errorf("invalid symlinks (%s), expect file/follow/ignore.", ro.Symlinks)
+	}
+	for _, p := range ro.Include {
+		g, err := newGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		m.include = append(m.include, g)
+	}
+	for _, p := range ro.Exclude {
+		g, err := newGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		m.exclude = append(m.exclude, g)
+	}
+	if len(m.include) == 0 {
+		var err error
+		if m.filePattern, err = regexp.Compile(ro.FilePattern); err != nil {
+			return nil, err
+		}
+	}
+
+	var roots []string
+	if ro.Dir != "" {
+		roots = append(roots, ro.Dir)
+	}
+	roots = append(roots, ro.Roots...)
+	if len(roots) == 0 {
+		for _, g := range m.include {
+			if !g.abs {
+				continue
+			}
+			// 没有固定目录时不能监听整个文件系统
+			p := g.prefix()
+			if p == string(filepath.Separator) {
+				return nil, fmt.Errorf("include (%s) has no fixed directory, dir or roots is required.", g.pattern)
+			}
+			roots = append(roots, p)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, r := range roots {
+		if r == "" {
+			return nil, fmt.Errorf("root directory is empty.")
+		}
+		r = filepath.Clean(r)
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		m.roots = append(m.roots, r)
+	}
+	if len(m.roots) == 0 {
+		return nil, fmt.Errorf("dir, roots or absolute include is required.")
+	}
+	// 嵌套的根目录会重复跟踪同一文件; include 的固定前缀嵌套时只保留上层
+	var outer []string
+	for _, r := range m.roots {
+		nested := false
+		for _, o := range m.roots {
+			if o != r && within(o, r) {
+				nested = true
+				break
+			}
+		}
+		switch {
+		case !nested:
+			outer = append(outer, r)
+		case len(ro.Roots) > 0 || ro.Dir != "":
+			return nil, fmt.Errorf("root directory (%s) is nested in another root.", r)
+		}
+	}
+	m.roots = outer
+	return m, nil
+}
+
+// Roots 跟踪的根目录
+func (m *Matcher) Roots() []string {
+	return m.roots
+}
+
+// File 文件是否跟踪, 返回匹配的 include 或 filePattern
+func (m *Matcher) File(root, name string) (string, bool) {
+	if m.excluded(root, name) {
+		return "", false
+	}
+	if len(m.include) == 0 {
+		if m.filePattern.MatchString(filepath.Base(name)) {
+			return m.filePattern.String(), true
+		}
+		return "", false
+	}
+	rel := relSegments(root, name)
+	abs := segments(name)
+	for _, g := range m.include {
+		if g.match(rel, abs) {
+			return g.pattern, true
+		}
+	}
+	return "", false
+}
+
+// Dir 是否进入 level 层目录下的子目录: 未超过最大深度, 未被排除, 且其中可能有 include 匹配的文件
+func (m *Matcher) Dir(root, name string, level int) bool {
+	if m.maxDepth > 0 && level+1 >= m.maxDepth {
+		return false
+	}
+	if m.excluded(root, name) {
+		return false
+	}
+	if len(m.include) == 0 {
+		return true
+	}
+	rel := relSegments(root, name)
+	abs := segments(name)
+	for _, g := range m.include {
+		if g.within(rel, abs) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded 路径或其在根目录下的上层目录是否被排除
+func (m *Matcher) excluded(root, name string) bool {
+	if len(m.exclude) == 0 {
+		return false
+	}
+	for p := name; ; p = filepath.Dir(p) {
+		rel := relSegments(root, p)
+		if len(rel) == 0 {
+			return false
+		}
+		abs := segments(p)
+		for _, g := range m.exclude {
+			if g.match(rel, abs) {
+				return true
+			}
+		}
+	}
+}
+
+// kind 按符号链接方式判断目录项类型, fi 为 Lstat 的结果
+func (m *Matcher) kind(name string, fi os.FileInfo) FileType {
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if fi.IsDir() {
+			return DIR
+		}
+		return FILE
+	}
+	if m.symlinks == in.SYMLINK_IGNORE {
+		return UNKNOW
+	}
+	target, err := os.Stat(name)
+	if err != nil {
+		return UNKNOW
+	}
+	if !target.IsDir() {
+		return FILE
+	}
+	if m.symlinks == in.SYMLINK_FOLLOW {
+		return DIR
+	}
+	return UNKNOW
+}
+
+// glob 按 / 分段匹配, ** 段匹配任意层目录, 其它段使用 filepath.Match
+type glob struct {
+	pattern string
+	abs     bool
+	segs    []string
+}
+
+func newGlob(pattern string) (*glob, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("glob is empty.")
+	}
+	g := &glob{pattern: pattern, abs: filepath.IsAbs(pattern), segs: segments(pattern)}
+	for _, s := range g.segs {
+		if _, err := filepath.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob (%s): %s", pattern, err)
+		}
+	}
+	return g, nil
+}
+
+func (g *glob) match(rel, abs []string) bool {
+	if g.abs {
+		return matchSegments(g.segs, abs)
+	}
+	return rel != nil && matchSegments(g.segs, rel)
+}
+
+// within 目录下是否可能有匹配的路径
+func (g *glob) within(rel, abs []string) bool {
+	if g.abs {
+		return matchPrefix(g.segs, abs)
+	}
+	return rel != nil && matchPrefix(g.segs, rel)
+}
+
+// prefix 不含通配符的上层目录
+func (g *glob) prefix() string {
+	var r []string
+	for _, s := range g.segs[:len(g.segs)-1] {
+		if strings.ContainsAny(s, `*?[\`) {
+			break
+		}
+		r = append(r, s)
+	}
+	return string(filepath.Separator) + filepath.Join(r...)
+}
+
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchPrefix(pat, name []string) bool {
+	for len(name) > 0 {
+		if len(pat) == 0 {
+			return false
+		}
+		if pat[0] == "**" {
+			return true
+		}
+		if ok, _ := filepath.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(pat) > 0
+}
+
+func segments(name string) []string {
+	name = strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+	if name == "" || name == "." {
+		return []string{}
+	}
+	return strings.Split(name, "/")
+}
+
+// relSegments 不在 root 下时返回 nil
+func relSegments(root, name string) []string {
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	return segments(rel)
+}
+
+// within name 是否为 dir 或其下的路径
+func within(dir, name string) bool {
+	return relSegments(dir, name) != nil
+}
@@ -0,0 +1,226 @@
+package logmining
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	in "logauditer/internal"
+)
+
+func TestMatchSegments(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		match, within bool
+	}{
+		{"*.log", "a.log", true, false},
+		{"*.log", "a/b.log", false, false},
+		{"**/*.log", "a.log", true, true},
+		{"**/*.log", "a/b/c.log", true, true},
+		{"**", "a/b/c", true, true},
+		{"a/**", "a", true, true},
+		{"a/**/b/*.log", "a/b/c.log", true, true},
+		{"a/**/b/*.log", "a/x/y/b/c.log", true, true},
+		{"a/**/b/*.log", "a/x/y/c.log", false, true},
+		{"a/*/sshd/*.log", "a/x/sshd/1.log", true, false},
+		{"a/*/sshd/*.log", "a/x", false, true},
+		{"a/*/sshd/*.log", "a/x/y", false, false},
+		{"a/*/sshd/*.log", "a/x/sshd", false, true},
+		{"a/**/**/c", "a/c", true, true},
+		{"[ab].lo?", "b.log", true, false},
+		{"**/archive", "x/archive", true, true},
+	}
+	for _, c := range cases {
+		pat, name := segments(c.pattern), segments(c.name)
+		if got := matchSegments(pat, name); got != c.match {
+			t.Errorf("match(%s, %s) = %v, want %v", c.pattern, c.name, got, c.match)
+		}
+		if got := matchPrefix(pat, name); got != c.within {
+			t.Errorf("within(%s, %s) = %v, want %v", c.pattern, c.name, got, c.within)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	type check struct {
+		name    string
+		dir     bool
+		level   int
+		pattern string
+		ok      bool
+	}
+	cases := []struct {
+		desc   string
+		ro     in.RuntimeOptions
+		checks []check
+	}{
+		{"file pattern", in.RuntimeOptions{Dir: "/logs", FilePattern: `\.log$`}, []check{
+			{"/logs/a.log", false, 0, `\.log$`, true},
+			{"/logs/a/b/c.log", false, 2, `\.log$`, true},
+			{"/logs/a.gz", false, 0, "", false},
+			{"/logs/a/b/c", true, 5, "", true},
+		}},
+		{"include", in.RuntimeOptions{Dir: "/logs", Include: []string{"*/sshd/*.log", "/data/**/*.log"}}, []check{
+			{"/logs/a/sshd/1.log", false, 1, "*/sshd/*.log", true},
+			{"/logs/1.log", false, 0, "", false},
+			{"/logs/a", true, 0, "", true},
+			{"/logs/a/b", true, 1, "", false},
+			{"/data/x/y/1.log", false, 0, "/data/**/*.log", true},
+		}},
+		// 排除优先于 include 与 filePattern
+		{"exclude", in.RuntimeOptions{Dir: "/logs", Include: []string{"**/*.log"}, Exclude: []string{"**/archive", "**/debug-*.log"}}, []check{
+			{"/logs/a/1.log", false, 1, "**/*.log", true},
+			{"/logs/a/debug-1.log", false, 1, "", false},
+			{"/logs/a/archive", true, 0, "", false},
+			{"/logs/a/archive/1.log", false, 2, "", false},
+			{"/logs/a/archived", true, 0, "", true},
+		}},
+		{"exclude file pattern", in.RuntimeOptions{Dir: "/logs", FilePattern: `\.log$`, Exclude: []string{"/logs/tmp"}}, []check{
+			{"/logs/tmp", true, 0, "", false},
+			{"/logs/a/tmp", true, 1, "", true},
+			{"/logs/tmp.log", false, 0, `\.log$`, true},
+		}},
+		// 根目录下的文件深度为 1, 目录的 level 为所在目录的层级
+		{"max depth", in.RuntimeOptions{Dir: "/logs", FilePattern: `\.log$`, MaxDepth: 2}, []check{
+			{"/logs/a", true, 0, "", true},
+			{"/logs/a/b", true, 1, "", false},
+		}},
+		{"max depth 1", in.RuntimeOptions{Dir: "/logs", FilePattern: `\.log$`, MaxDepth: 1}, []check{
+			{"/logs/a", true, 0, "", false},
+			{"/logs/a.log", false, 0, `\.log$`, true},
+		}},
+	}
+	for _, c := range cases {
+		m, err := NewMatcher(&c.ro)
+		if err != nil {
+			t.Errorf("%s: %s", c.desc, err)
+			continue
+		}
+		for _, k := range c.checks {
+			root := m.Roots()[0]
+			if k.dir {
+				if got := m.Dir(root, k.name, k.level); got != k.ok {
+					t.Errorf("%s: Dir(%s, %d) = %v, want %v", c.desc, k.name, k.level, got, k.ok)
+				}
+				continue
+			}
+			pattern, ok := m.File(root, k.name)
+			if ok != k.ok || pattern != k.pattern {
+				t.Errorf("%s: File(%s) = %s %v, want %s %v", c.desc, k.name, pattern, ok, k.pattern, k.ok)
+			}
+		}
+	}
+}
+
+func TestMatcherRoots(t *testing.T) {
+	cases := []struct {
+		ro    in.RuntimeOptions
+		roots []string
+		err   bool
+	}{
+		{in.RuntimeOptions{Dir: "/logs/", Roots: []string{"/data", "/logs"}, FilePattern: "."}, []string{"/logs", "/data"}, false},
+		{in.RuntimeOptions{Include: []string{"/logs/*/sshd/*.log", "/data/a.log", "/logs/x/**"}}, []string{"/logs", "/data"}, false},
+		{in.RuntimeOptions{Dir: "/logs", Roots: []string{"/logs/a"}, FilePattern: "."}, nil, true},
+		// 没有固定目录的 include 不能作为根目录
+		{in.RuntimeOptions{Include: []string{"/*.log"}}, nil, true},
+		{in.RuntimeOptions{Include: []string{"/**/sshd/*.log"}}, nil, true},
+		{in.RuntimeOptions{Include: []string{"*.log"}}, nil, true},
+		{in.RuntimeOptions{Dir: "/logs", Include: []string{"/*.log"}}, []string{"/logs"}, false},
+		{in.RuntimeOptions{Dir: "/logs", FilePattern: "."}, []string{"/logs"}, false},
+		{in.RuntimeOptions{Dir: "/logs", FilePattern: "("}, nil, true},
+		{in.RuntimeOptions{Dir: "/logs", Include: []string{"[a"}}, nil, true},
+		{in.RuntimeOptions{Dir: "/logs", FilePattern: ".", MaxDepth: -1}, nil, true},
+		{in.RuntimeOptions{Dir: "/logs", FilePattern: ".", Symlinks: "yes"}, nil, true},
+	}
+	for _, c := range cases {
+		m, err := NewMatcher(&c.ro)
+		if (err != nil) != c.err {
+			t.Errorf("%+v: err %v, want error %v", c.ro, err, c.err)
+			continue
+		}
+		if err == nil && !equalStrings(m.Roots(), c.roots) {
+			t.Errorf("%+v: roots %v, want %v", c.ro, m.Roots(), c.roots)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMatcherSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "real", "a.log"), "a\n")
+	if err := os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "real", "a.log"), filepath.Join(dir, "b.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		symlinks   string
+		link, file FileType
+	}{
+		// 默认与 os.Stat 一样进入链接的目录
+		{"", DIR, FILE},
+		{in.SYMLINK_FOLLOW, DIR, FILE},
+		{in.SYMLINK_FILE, UNKNOW, FILE},
+		{in.SYMLINK_IGNORE, UNKNOW, UNKNOW},
+	}
+	for _, c := range cases {
+		m, err := NewMatcher(&in.RuntimeOptions{Dir: dir, FilePattern: ".", Symlinks: c.symlinks})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]FileType{"link": c.link, "b.log": c.file, "real": DIR} {
+			fn := filepath.Join(dir, name)
+			fi, err := os.Lstat(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.kind(fn, fi); got != want {
+				t.Errorf("symlinks (%s) kind(%s) = %v, want %v", c.symlinks, name, got, want)
+			}
+		}
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	cases := []struct {
+		include []string
+		name    string
+		expired bool
+	}{
+		{nil, todayLog(), false},
+		{nil, "10.0.0.1_2019-02-25.log", true},
+		{nil, "secure.log", true},
+		// 使用 include 时不带日期的文件不过期
+		{[]string{"*.log"}, "secure.log", false},
+		{[]string{"*.log"}, todayLog(), false},
+		{[]string{"*.log"}, "10.0.0.1_2019-02-25.log", true},
+	}
+	for _, c := range cases {
+		m, err := NewMatcher(&in.RuntimeOptions{Dir: "/logs", FilePattern: ".", Include: c.include})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &Directory{matcher: m}
+		if got := d.isExpired(filepath.Join("/logs", c.name)); got != c.expired {
+			t.Errorf("include %v isExpired(%s) = %v, want %v", c.include, c.name, got, c.expired)
+		}
+	}
+}
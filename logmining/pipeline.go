@@ -0,0 +1,66 @@
+package logmining
+
+import (
+	in "logauditer/internal"
+	"sync"
+)
+
+// Entry 一条解析完成、等待入库的审计记录
+type Entry struct {
+	Rule    string
+	File    string
+	Options *in.RuntimeOptions
+	Log     *in.AuditLog
+}
+
+// Filter 入库前处理记录, 返回错误时该记录不入库
+type Filter interface {
+	Filter(e *Entry) error
+}
+
+// Hook 记录入库成功后回调
+type Hook interface {
+	Fire(e *Entry)
+}
+
+type pipeline struct {
+	mu        sync.RWMutex
+	filters   []Filter
+	hooks     []Hook
+	listeners []Listener
+}
+
+var defaultPipeline = &pipeline{}
+
+// RegisterFilter 注册入库前处理, 按注册顺序执行
+func RegisterFilter(f Filter) {
+	defaultPipeline.mu.Lock()
+	defer defaultPipeline.mu.Unlock()
+	defaultPipeline.filters = append(defaultPipeline.filters, f)
+}
+
+// RegisterHook 注册入库后回调
+func RegisterHook(h Hook) {
+	defaultPipeline.mu.Lock()
+	defer defaultPipeline.mu.Unlock()
+	defaultPipeline.hooks = append(defaultPipeline.hooks, h)
+}
+
+func (p *pipeline) filter(e *Entry) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, f := range p.filters {
+		if err := f.Filter(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) fire(e *Entry) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, h := range p.hooks {
+		h.Fire(e)
+	}
+}
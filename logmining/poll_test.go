@@ -0,0 +1,172 @@
+package logmining
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const testPoll = 20 * time.Millisecond
+
+// 修改时间精度不足时用大小区分写入
+func TestScan(t *testing.T) {
+	dir := tempDir(t)
+	fn := filepath.Join(dir, "a.log")
+	writeFile(t, fn, "a\n")
+
+	f := &watchedPath{key: watchKey{name: fn, poll: testPoll}}
+	d := &watchedPath{key: watchKey{name: dir, poll: testPoll}}
+	if e := f.scan(); e != nil {
+		t.Fatalf("first scan %v", e)
+	}
+	if e := d.scan(); e != nil {
+		t.Fatalf("first scan %v", e)
+	}
+
+	steps := []struct {
+		desc   string
+		change func()
+		file   []fsnotify.Event
+		dir    []fsnotify.Event
+	}{
+		{"unchanged", func() {}, nil, nil},
+		{"append", func() { appendFile(t, fn, "b\n") },
+			[]fsnotify.Event{{Name: fn, Op: fsnotify.Write}}, nil},
+		{"truncate", func() {
+			if err := os.Truncate(fn, 0); err != nil {
+				t.Fatal(err)
+			}
+		}, []fsnotify.Event{{Name: fn, Op: fsnotify.Write}}, nil},
+		{"replace", func() {
+			if err := os.Rename(fn, fn+".1"); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, fn, "c\n")
+		}, []fsnotify.Event{{Name: fn, Op: fsnotify.Remove}, {Name: fn, Op: fsnotify.Create}},
+			[]fsnotify.Event{{Name: fn, Op: fsnotify.Remove}, {Name: fn, Op: fsnotify.Create}, {Name: fn + ".1", Op: fsnotify.Create}}},
+		{"remove", func() {
+			if err := os.Remove(fn); err != nil {
+				t.Fatal(err)
+			}
+		}, []fsnotify.Event{{Name: fn, Op: fsnotify.Remove}}, []fsnotify.Event{{Name: fn, Op: fsnotify.Remove}}},
+		{"missing", func() {}, nil, nil},
+		// 删除后重新出现
+		{"recreate", func() { writeFile(t, fn, "d\n") },
+			[]fsnotify.Event{{Name: fn, Op: fsnotify.Create}}, []fsnotify.Event{{Name: fn, Op: fsnotify.Create}}},
+	}
+	for _, s := range steps {
+		s.change()
+		if got := f.scan(); !sameEvents(got, s.file) {
+			t.Errorf("%s: file events %v, want %v", s.desc, got, s.file)
+		}
+		if got := d.scan(); !sameEvents(got, s.dir) {
+			t.Errorf("%s: dir events %v, want %v", s.desc, got, s.dir)
+		}
+	}
+}
+
+// sameEvents 比较事件, 目录中不同文件的事件顺序不确定
+func sameEvents(a, b []fsnotify.Event) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[fsnotify.Event]int)
+	for i := range a {
+		count[a[i]]++
+		count[b[i]]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func readLine(t *testing.T, tf *Tailfollower, want string) {
+	t.Helper()
+	select {
+	case l, ok := <-tf.Lines():
+		if !ok {
+			t.Fatalf("lines closed: %v, want %s", tf.Err(), want)
+		}
+		if l.String() != want {
+			t.Fatalf("line %q, want %q", l.String(), want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no line, want %s", want)
+	}
+}
+
+func TestTailfollowerPoll(t *testing.T) {
+	dir := tempDir(t)
+	fn := filepath.Join(dir, "a.log")
+	writeFile(t, fn, "a\n")
+	tf, err := NewTailfollower(context.Background(), &LastPosition{Name: fn, Reopen: true}, testPoll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+	readLine(t, tf, "a")
+
+	// 增长
+	appendFile(t, fn, "bb\n")
+	readLine(t, tf, "bb")
+
+	// 截断后从头读取
+	if err := os.Truncate(fn, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, fn, "c\n")
+	readLine(t, tf, "c")
+
+	// 替换后打开新文件, 旧文件的写入不再读取
+	if err := os.Rename(fn, fn+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fn, "d\n")
+	readLine(t, tf, "d")
+	appendFile(t, fn+".1", "old\n")
+	appendFile(t, fn, "e\n")
+	readLine(t, tf, "e")
+}
+
+func TestDirectoryPoll(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, filepath.Join(dir, todayLog()), "a\n")
+	ops := testOptions(dir)
+	ops.WatchMode, ops.PollInterval = in.WATCH_POLL, testPoll.String()
+
+	d, err := NewDirectory(context.Background(), ops, ROOT, dbapi.NewStorageParts(), "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if s := defaultWatches.stats(); s.Polled == 0 {
+		t.Errorf("stats %+v, want polled paths", s)
+	}
+
+	// 轮询的目录中新建的文件与子目录被发现
+	sub := filepath.Join(dir, "sub")
+	writeFile(t, filepath.Join(dir, "10.0.0.2_"+time.Now().Format("2006-01-02")+".log"), "b\n")
+	writeFile(t, filepath.Join(sub, todayLog()), "c\n")
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		var r []LastPosition
+		d.Files(&r)
+		if len(r) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("files %v, want 3", r)
+		}
+		time.Sleep(testPoll)
+	}
+}
@@ -0,0 +1,450 @@
+package logmining
+
+import (
+	"errors"
+	"io/ioutil"
+	in "logauditer/internal"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/laik/logger"
+)
+
+// DefaultPollInterval inotify 达到系统上限后轮询的间隔
+const DefaultPollInterval = in.DefaultPollInterval
+
+// 全部规则的目录与文件共享一个 inotify 实例
+var defaultWatches = newWatchManager(DefaultPollInterval)
+
+// WatchStats 文件系统监听统计
+type WatchStats struct {
+	// inotify 实例数, 没有监听的路径时为 0
+	Instances int `json:"instances"`
+	// 使用 inotify 监听的路径数
+	Watched int `json:"watched"`
+	// 规则指定轮询及因系统上限改为轮询的路径数
+	Polled int `json:"polled"`
+	// 订阅数, 同一路径可以被多个目录或文件订阅
+	Subscribers int `json:"subscribers"`
+	// 收到的事件数与错误数
+	Events uint64 `json:"events"`
+	Errors uint64 `json:"errors"`
+}
+
+// Watches 当前的监听统计
+func Watches() WatchStats {
+	return defaultWatches.stats()
+}
+
+type watchManager struct {
+	// 原子计数, 放在开头保证 32 位平台上对齐
+	events uint64
+	errors uint64
+
+	mu       sync.RWMutex
+	interval time.Duration
+	watcher  *fsnotify.Watcher
+	paths    map[watchKey]*watchedPath
+	watched  int
+	polled   int
+	// 每个轮询间隔一个 goroutine, 没有该间隔的路径时退出
+	pollers map[time.Duration]*poller
+
+	// 加入 inotify 监听, 为空时使用 watcher.Add; 测试时替换
+	add func(name string) error
+}
+
+// 同一路径按 inotify 与不同的轮询间隔分别订阅
+type watchKey struct {
+	name string
+	// 规则指定的轮询间隔, 0 为 inotify
+	poll time.Duration
+}
+
+type poller struct {
+	n    int
+	stop chan struct{}
+}
+
+type watchedPath struct {
+	key    watchKey
+	polled bool
+	// 实际的轮询间隔
+	every time.Duration
+	subs  map[*Watch]struct{}
+
+	// 轮询时上一次的状态, 只在轮询 goroutine 中访问
+	info    os.FileInfo
+	entries map[string]os.FileInfo
+	// 路径已删除, 重新出现时为新建
+	removed bool
+}
+
+func newWatchManager(interval time.Duration) *watchManager {
+	return &watchManager{
+		interval: interval,
+		paths:    make(map[watchKey]*watchedPath),
+		pollers:  make(map[time.Duration]*poller),
+	}
+}
+
+// Add 订阅路径的事件, 目录同时收到子文件的事件; poll > 0 时按该间隔比较文件状态, 不使用 inotify
+func (m *watchManager) Add(name string, poll time.Duration) (*Watch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := watchKey{name: name, poll: poll}
+	p, ok := m.paths[key]
+	if !ok {
+		p = &watchedPath{key: key, subs: make(map[*Watch]struct{})}
+		var err error
+		if poll > 0 {
+			err = m.poll(p, poll)
+		} else {
+			err = m.watch(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.paths[key] = p
+	}
+	w := newWatch(m, key)
+	p.subs[w] = struct{}{}
+	return w, nil
+}
+
+// watch 使用 inotify 监听, 无法创建实例或达到系统上限时改为轮询
+func (m *watchManager) watch(p *watchedPath) error {
+	if m.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Warn("create inotify instance error: %s, poll (%s) instead.\n", err, p.key.name)
+			return m.poll(p, m.interval)
+		}
+		m.watcher = w
+		go m.dispatch(w)
+	}
+	err := m.addWatch(p.key.name)
+	switch {
+	case err == nil:
+		m.watched++
+		return nil
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EMFILE):
+		log.Warn("inotify watch limit reached: %s, poll (%s) instead.\n", err, p.key.name)
+		m.closeIdle()
+		return m.poll(p, m.interval)
+	}
+	m.closeIdle()
+	return err
+}
+
+// poll 记录当前状态并加入该间隔的轮询
+func (m *watchManager) poll(p *watchedPath, every time.Duration) error {
+	if _, err := os.Stat(p.key.name); err != nil {
+		return err
+	}
+	p.polled, p.every = true, every
+	p.scan()
+	m.polled++
+	pl, ok := m.pollers[every]
+	if !ok {
+		pl = &poller{stop: make(chan struct{})}
+		m.pollers[every] = pl
+		go m.pollLoop(every, pl.stop)
+	}
+	pl.n++
+	return nil
+}
+
+// closeIdle 没有 inotify 路径时关闭实例
+func (m *watchManager) closeIdle() {
+	if m.watched == 0 && m.watcher != nil {
+		m.watcher.Close()
+		m.watcher = nil
+	}
+}
+
+func (m *watchManager) remove(w *Watch) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.paths[w.key]
+	if !ok {
+		return
+	}
+	delete(p.subs, w)
+	if len(p.subs) > 0 {
+		return
+	}
+	delete(m.paths, w.key)
+	if !p.polled {
+		m.watched--
+		m.watcher.Remove(w.key.name)
+		m.closeIdle()
+		return
+	}
+	m.polled--
+	if pl := m.pollers[p.every]; pl != nil {
+		if pl.n--; pl.n == 0 {
+			close(pl.stop)
+			delete(m.pollers, p.every)
+		}
+	}
+}
+
+// rewatch 文件被替换后重新监听同名的新文件, 轮询的路径按状态比较不需要处理
+func (m *watchManager) rewatch(key watchKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.paths[key]
+	if !ok || p.polled {
+		return nil
+	}
+	return m.addWatch(key.name)
+}
+
+func (m *watchManager) addWatch(name string) error {
+	if m.add != nil {
+		return m.add(name)
+	}
+	return m.watcher.Add(name)
+}
+
+func (m *watchManager) dispatch(w *fsnotify.Watcher) {
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			atomic.AddUint64(&m.events, 1)
+			m.mu.RLock()
+			m.notify(e, 0)
+			m.mu.RUnlock()
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			atomic.AddUint64(&m.errors, 1)
+			log.Error("inotify error: %s.\n", err)
+		}
+	}
+}
+
+// notify 发给同一方式订阅的路径本身及其所在目录的订阅者, 须持有锁
+func (m *watchManager) notify(e fsnotify.Event, poll time.Duration) {
+	if p, ok := m.paths[watchKey{e.Name, poll}]; ok {
+		for w := range p.subs {
+			w.push(e)
+		}
+	}
+	if dir := filepath.Dir(e.Name); dir != e.Name {
+		if p, ok := m.paths[watchKey{dir, poll}]; ok {
+			for w := range p.subs {
+				w.push(e)
+			}
+		}
+	}
+}
+
+func (m *watchManager) pollLoop(every time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.pollOnce(every)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pollOnce 不持有锁比较状态, 网络文件系统上 stat 可能较慢
+func (m *watchManager) pollOnce(every time.Duration) {
+	m.mu.RLock()
+	var paths []*watchedPath
+	for _, p := range m.paths {
+		if p.polled && p.every == every {
+			paths = append(paths, p)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, p := range paths {
+		events := p.scan()
+		if len(events) == 0 {
+			continue
+		}
+		atomic.AddUint64(&m.events, uint64(len(events)))
+		m.mu.RLock()
+		for _, e := range events {
+			m.notify(e, p.key.poll)
+		}
+		m.mu.RUnlock()
+	}
+}
+
+// scan 与上一次的状态比较, 生成与 inotify 相同的事件: 新建、删除、写入, 被替换时为删除后新建.
+// 第一次扫描只记录状态
+func (p *watchedPath) scan() []fsnotify.Event {
+	fi, err := os.Stat(p.key.name)
+	if err != nil {
+		if p.info != nil && os.IsNotExist(err) {
+			p.info, p.entries, p.removed = nil, nil, true
+			return []fsnotify.Event{{Name: p.key.name, Op: fsnotify.Remove}}
+		}
+		return nil
+	}
+	var events []fsnotify.Event
+	if p.removed {
+		p.removed = false
+		events = append(events, fsnotify.Event{Name: p.key.name, Op: fsnotify.Create})
+	}
+	if p.info != nil {
+		switch {
+		case !os.SameFile(p.info, fi):
+			events = append(events,
+				fsnotify.Event{Name: p.key.name, Op: fsnotify.Remove},
+				fsnotify.Event{Name: p.key.name, Op: fsnotify.Create},
+			)
+		case !fi.IsDir() && (fi.Size() != p.info.Size() || !fi.ModTime().Equal(p.info.ModTime())):
+			events = append(events, fsnotify.Event{Name: p.key.name, Op: fsnotify.Write})
+		}
+	}
+	p.info = fi
+	if !fi.IsDir() {
+		return events
+	}
+
+	fis, err := ioutil.ReadDir(p.key.name)
+	if err != nil {
+		return events
+	}
+	entries := make(map[string]os.FileInfo, len(fis))
+	for _, c := range fis {
+		entries[c.Name()] = c
+		if p.entries == nil {
+			continue
+		}
+		name := filepath.Join(p.key.name, c.Name())
+		old, ok := p.entries[c.Name()]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Create})
+		case !os.SameFile(old, c):
+			events = append(events,
+				fsnotify.Event{Name: name, Op: fsnotify.Remove},
+				fsnotify.Event{Name: name, Op: fsnotify.Create},
+			)
+		}
+	}
+	for name := range p.entries {
+		if _, ok := entries[name]; !ok {
+			events = append(events, fsnotify.Event{Name: filepath.Join(p.key.name, name), Op: fsnotify.Remove})
+		}
+	}
+	p.entries = entries
+	return events
+}
+
+func (m *watchManager) stats() WatchStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := WatchStats{
+		Watched: m.watched,
+		Polled:  m.polled,
+		Events:  atomic.LoadUint64(&m.events),
+		Errors:  atomic.LoadUint64(&m.errors),
+	}
+	if m.watcher != nil {
+		s.Instances = 1
+	}
+	for _, p := range m.paths {
+		s.Subscribers += len(p.subs)
+	}
+	return s
+}
+
+// Watch 路径的事件订阅, 事件按顺序缓存不丢弃, 连续相同的写事件合并
+type Watch struct {
+	Events <-chan fsnotify.Event
+
+	key       watchKey
+	m         *watchManager
+	events    chan fsnotify.Event
+	mu        sync.Mutex
+	queue     []fsnotify.Event
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWatch(m *watchManager, key watchKey) *Watch {
+	c := make(chan fsnotify.Event)
+	w := &Watch{
+		Events: c,
+		key:    key,
+		m:      m,
+		events: c,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go w.pump()
+	return w
+}
+
+// Close 取消订阅, 之后 Events 关闭; 可重复调用
+func (w *Watch) Close() {
+	w.closeOnce.Do(func() {
+		w.m.remove(w)
+		close(w.done)
+	})
+}
+
+// Rewatch 文件被替换后重新监听
+func (w *Watch) Rewatch() error {
+	return w.m.rewatch(w.key)
+}
+
+// push 不阻塞分发
+func (w *Watch) push(e fsnotify.Event) {
+	w.mu.Lock()
+	if n := len(w.queue); n > 0 && e.Op == fsnotify.Write && w.queue[n-1] == e {
+		w.mu.Unlock()
+		return
+	}
+	w.queue = append(w.queue, e)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watch) pump() {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		e := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+		select {
+		case w.events <- e:
+		case <-w.done:
+			return
+		}
+	}
+}
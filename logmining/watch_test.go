@@ -0,0 +1,249 @@
+package logmining
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "logmining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// waitEvent 等待指定的事件, 跳过其它事件
+func waitEvent(t *testing.T, w *Watch, name string, op fsnotify.Op) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				t.Fatalf("events closed, want %s %s", op, name)
+			}
+			if e.Name == name && e.Op&op == op {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event %s %s", op, name)
+		}
+	}
+}
+
+func checkStats(t *testing.T, m *watchManager, want WatchStats) {
+	t.Helper()
+	got := m.stats()
+	got.Events, got.Errors = 0, 0
+	if got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if want.Polled == 0 && len(m.pollers) != 0 {
+		t.Errorf("pollers %d, want 0", len(m.pollers))
+	}
+}
+
+func TestWatchDispatch(t *testing.T) {
+	dir := tempDir(t)
+	fn := filepath.Join(dir, "a.log")
+	writeFile(t, fn, "a\n")
+
+	m := newWatchManager(time.Hour)
+	d1, err := m.Add(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := m.Add(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.Add(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一路径只监听一次, 共享一个实例
+	checkStats(t, m, WatchStats{Instances: 1, Watched: 2, Subscribers: 3})
+
+	// 文件的事件同时发给文件与所在目录的订阅者
+	appendFile(t, fn, "b\n")
+	for _, w := range []*Watch{d1, d2, f} {
+		waitEvent(t, w, fn, fsnotify.Write)
+	}
+	created := filepath.Join(dir, "b.log")
+	writeFile(t, created, "")
+	waitEvent(t, d1, created, fsnotify.Create)
+	waitEvent(t, d2, created, fsnotify.Create)
+	if m.stats().Events == 0 {
+		t.Error("events not counted")
+	}
+
+	// 最后一个订阅者取消后停止监听并关闭实例
+	d1.Close()
+	checkStats(t, m, WatchStats{Instances: 1, Watched: 2, Subscribers: 2})
+	d2.Close()
+	d2.Close()
+	checkStats(t, m, WatchStats{Instances: 1, Watched: 1, Subscribers: 1})
+	f.Close()
+	checkStats(t, m, WatchStats{})
+	if _, ok := <-f.Events; ok {
+		t.Error("events not closed")
+	}
+
+	// 关闭后重新订阅创建新的实例
+	w, err := m.Add(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, m, WatchStats{Instances: 1, Watched: 1, Subscribers: 1})
+	w.Close()
+	checkStats(t, m, WatchStats{})
+
+	if _, err := m.Add(filepath.Join(dir, "missing"), 0); err == nil {
+		t.Error("watch missing path expect error")
+	}
+	checkStats(t, m, WatchStats{})
+}
+
+func TestWatchPollers(t *testing.T) {
+	dir := tempDir(t)
+	m := newWatchManager(time.Hour)
+	a, err := m.Add(dir, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.Add(dir, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := m.Add(dir, 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不同间隔分别轮询, 不使用 inotify
+	checkStats(t, m, WatchStats{Polled: 2, Subscribers: 3})
+	m.mu.RLock()
+	if len(m.pollers) != 2 {
+		t.Errorf("pollers %d, want 2", len(m.pollers))
+	}
+	m.mu.RUnlock()
+
+	fn := filepath.Join(dir, "a.log")
+	writeFile(t, fn, "a\n")
+	for _, w := range []*Watch{a, b, c} {
+		waitEvent(t, w, fn, fsnotify.Create)
+	}
+
+	a.Close()
+	b.Close()
+	checkStats(t, m, WatchStats{Polled: 1, Subscribers: 1})
+	m.mu.RLock()
+	if _, ok := m.pollers[20*time.Millisecond]; ok || len(m.pollers) != 1 {
+		t.Errorf("pollers %v", m.pollers)
+	}
+	m.mu.RUnlock()
+	c.Close()
+	checkStats(t, m, WatchStats{})
+}
+
+func TestWatchFallback(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EMFILE} {
+		dir := tempDir(t)
+		m := newWatchManager(20 * time.Millisecond)
+		m.add = func(name string) error {
+			return fmt.Errorf("add (%s): %w", name, errno)
+		}
+		w, err := m.Add(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 达到上限后按默认间隔轮询, 没有 inotify 路径时关闭实例
+		checkStats(t, m, WatchStats{Polled: 1, Subscribers: 1})
+		fn := filepath.Join(dir, "a.log")
+		writeFile(t, fn, "a\n")
+		waitEvent(t, w, fn, fsnotify.Create)
+		w.Close()
+		checkStats(t, m, WatchStats{})
+	}
+
+	// 其它错误直接返回
+	m := newWatchManager(20 * time.Millisecond)
+	m.add = func(name string) error { return syscall.EACCES }
+	if _, err := m.Add(tempDir(t), 0); err != syscall.EACCES {
+		t.Errorf("err %v, want EACCES", err)
+	}
+	checkStats(t, m, WatchStats{})
+}
+
+func TestWatchPush(t *testing.T) {
+	w := &Watch{wake: make(chan struct{}, 1)}
+	write := fsnotify.Event{Name: "a", Op: fsnotify.Write}
+	for _, e := range []fsnotify.Event{
+		write, write, write,
+		{Name: "b", Op: fsnotify.Write},
+		write,
+		{Name: "a", Op: fsnotify.Create},
+		{Name: "a", Op: fsnotify.Create},
+		write, write,
+	} {
+		w.push(e)
+	}
+	// 只合并连续相同的写事件
+	want := []fsnotify.Event{
+		write,
+		{Name: "b", Op: fsnotify.Write},
+		write,
+		{Name: "a", Op: fsnotify.Create},
+		{Name: "a", Op: fsnotify.Create},
+		write,
+	}
+	if len(w.queue) != len(want) {
+		t.Fatalf("queue %v, want %v", w.queue, want)
+	}
+	for i := range want {
+		if w.queue[i] != want[i] {
+			t.Errorf("queue[%d] = %v, want %v", i, w.queue[i], want[i])
+		}
+	}
+
+	// 缓存的事件按顺序送出, 不丢弃
+	m := newWatchManager(time.Hour)
+	pw := newWatch(m, watchKey{name: "x"})
+	for i := 0; i < 100; i++ {
+		pw.push(fsnotify.Event{Name: fmt.Sprint(i), Op: fsnotify.Create})
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case e := <-pw.Events:
+			if e.Name != fmt.Sprint(i) {
+				t.Fatalf("event %d = %v", i, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	pw.Close()
+}
+
+func appendFile(t *testing.T, name, data string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"logauditer/alert"
+	"os/exec"
+	"time"
+)
+
+// command 执行本地脚本, 告警以json格式写入标准输入
+type command struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+func newExec(c *Config, timeout time.Duration) (*command, error) {
+	if c.Command == "" {
+		return nil, fmt.Errorf("notifier (%s) command is empty.", c.Name)
+	}
+	return &command{path: c.Command, args: c.Args, timeout: timeout}, nil
+}
+
+func (c *command) Notify(a *alert.Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Stdin = bytes.NewReader(b)
+	out := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("exec (%s) error: %s output: %s", c.path, err, out.String())
+	}
+	return nil
+}
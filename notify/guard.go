@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"fmt"
+	"logauditer/alert"
+	"sync"
+	"time"
+)
+
+// guard 为通知渠道增加限流与失败重试
+type guard struct {
+	name     string
+	n        Notifier
+	retry    int
+	interval time.Duration
+	limiter  *limiter
+}
+
+func (g *guard) Notify(a *alert.Alert) error {
+	if !g.limiter.allow() {
+		return fmt.Errorf("notifier (%s) rate limited.", g.name)
+	}
+	var err error
+	wait := g.interval
+	for i := 0; i <= g.retry; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = g.n.Notify(a); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// limiter 令牌桶, 每分钟补充 rate 个令牌
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(perMinute int) *limiter {
+	return &limiter{
+		rate:   float64(perMinute),
+		tokens: float64(perMinute),
+		last:   time.Now(),
+	}
+}
+
+func (l *limiter) allow() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Minutes() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
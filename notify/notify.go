@@ -0,0 +1,445 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"logauditer/alert"
+	"logauditer/dbapi"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	log "github.com/laik/logger"
+)
+
+const (
+	// 通知渠道配置与规则存放在同一个库
+	NOTIFIER_DATABASE = "audit_rule"
+	NOTIFIER          = "notifier"
+)
+
+// 通知渠道类型
+const (
+	WEBHOOK  = "webhook"
+	SMTP     = "smtp"
+	DINGTALK = "dingtalk"
+	WECOM    = "wecom"
+	EXEC     = "exec"
+)
+
+// 每个通知渠道的队列长度
+const queueSize = 1024
+
+// Masked 查看配置时代替密钥与密码, 更新时保留原值
+const Masked = "***"
+
+// Notifier 告警通知渠道
+type Notifier interface {
+	Notify(a *alert.Alert) error
+}
+
+// Config 通知渠道配置
+type Config struct {
+	Name string `bson:"_id" json:"name"`
+	Type string `bson:"type" json:"type"`
+
+	// webhook/dingtalk/wecom
+	URL     string            `bson:"url,omitempty" json:"url,omitempty"`
+	Method  string            `bson:"method,omitempty" json:"method,omitempty"`
+	Headers map[string]string `bson:"headers,omitempty" json:"headers,omitempty"`
+	// 请求体/邮件正文/机器人消息模板(text/template), 为空时使用默认格式
+	Body string `bson:"body,omitempty" json:"body,omitempty"`
+	// 钉钉机器人加签密钥
+	Secret string `bson:"secret,omitempty" json:"secret,omitempty"`
+
+	// smtp
+	Addr     string   `bson:"addr,omitempty" json:"addr,omitempty"`
+	Username string   `bson:"username,omitempty" json:"username,omitempty"`
+	Password string   `bson:"password,omitempty" json:"password,omitempty"`
+	From     string   `bson:"from,omitempty" json:"from,omitempty"`
+	To       []string `bson:"to,omitempty" json:"to,omitempty"`
+	Subject  string   `bson:"subject,omitempty" json:"subject,omitempty"`
+
+	// exec, 告警以json格式写入标准输入
+	Command string   `bson:"command,omitempty" json:"command,omitempty"`
+	Args    []string `bson:"args,omitempty" json:"args,omitempty"`
+
+	Timeout string `bson:"timeout,omitempty" json:"timeout,omitempty"`
+	// 失败重试次数及间隔(指数退避)
+	Retry         int    `bson:"retry,omitempty" json:"retry,omitempty"`
+	RetryInterval string `bson:"retryInterval,omitempty" json:"retryInterval,omitempty"`
+	// 每分钟最多发送条数, 0 不限制
+	RatePerMinute int `bson:"ratePerMinute,omitempty" json:"ratePerMinute,omitempty"`
+}
+
+// Redacted 隐藏密钥、密码、请求头与 URL 参数值的副本, 用于查看配置
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Secret != "" {
+		r.Secret = Masked
+	}
+	if r.Password != "" {
+		r.Password = Masked
+	}
+	if len(c.Headers) > 0 {
+		r.Headers = make(map[string]string, len(c.Headers))
+		for k := range c.Headers {
+			r.Headers[k] = Masked
+		}
+	}
+	r.URL = redactURL(c.URL)
+	return &r
+}
+
+// restore 更新时仍为 Masked 的值沿用 old 的原值
+func (c *Config) restore(old *Config) {
+	if c.Secret == Masked {
+		c.Secret = old.Secret
+	}
+	if c.Password == Masked {
+		c.Password = old.Password
+	}
+	for k, v := range c.Headers {
+		if ov, ok := old.Headers[k]; ok && v == Masked {
+			c.Headers[k] = ov
+		}
+	}
+	if c.URL != "" && c.URL == redactURL(old.URL) {
+		c.URL = old.URL
+	}
+}
+
+// redactURL 机器人的 access_token 等凭据在 URL 参数中
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.RawQuery == "" {
+		return s
+	}
+	keys := make([]string, 0)
+	for k := range u.Query() {
+		keys = append(keys, url.QueryEscape(k)+"="+Masked)
+	}
+	sort.Strings(keys)
+	u.RawQuery = strings.Join(keys, "&")
+	return u.String()
+}
+
+// ParseConfig 解析并校验通知渠道配置
+func ParseConfig(name string, data []byte) (*Config, error) {
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("notifier unmarshal err: %s", err)
+	}
+	c.Name = name
+	if _, err := New(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// New 按配置创建通知渠道, 已包装重试与限流
+func New(c *Config) (Notifier, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("notifier name is empty.")
+	}
+	timeout, err := duration(c.Timeout, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("notifier (%s) invalid timeout (%s).", c.Name, c.Timeout)
+	}
+	interval, err := duration(c.RetryInterval, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("notifier (%s) invalid retry interval (%s).", c.Name, c.RetryInterval)
+	}
+	tmpl, err := parseTemplate(c.Name, c.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var n Notifier
+	switch c.Type {
+	case WEBHOOK:
+		n, err = newWebhook(c, tmpl, timeout)
+	case DINGTALK, WECOM:
+		n, err = newRobot(c, tmpl, timeout)
+	case SMTP:
+		n, err = newMail(c, tmpl, timeout)
+	case EXEC:
+		n, err = newExec(c, timeout)
+	default:
+		err = fmt.Errorf("notifier (%s) unsupported type (%s).", c.Name, c.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &guard{
+		name:     c.Name,
+		n:        n,
+		retry:    c.Retry,
+		interval: interval,
+		limiter:  newLimiter(c.RatePerMinute),
+	}, nil
+}
+
+// sender 通知渠道的队列, 每个渠道一个 goroutine, 一个渠道重试时不阻塞其它渠道
+type sender struct {
+	name  string
+	n     Notifier
+	queue chan *alert.Alert
+	// 队列中的告警发送完后关闭
+	done chan struct{}
+	once sync.Once
+}
+
+func newSender(name string, n Notifier) *sender {
+	s := &sender{name: name, n: n, queue: make(chan *alert.Alert, queueSize), done: make(chan struct{})}
+	go s.loop()
+	return s
+}
+
+// send 队列满时丢弃
+func (s *sender) send(a *alert.Alert) {
+	select {
+	case s.queue <- a:
+	default:
+		log.Warn("notifier (%s) queue is full, drop alert (%s).\n", s.name, a.Name)
+	}
+}
+
+// close 发送完队列中的告警后退出, 可重复调用
+func (s *sender) close() {
+	s.once.Do(func() { close(s.queue) })
+}
+
+func (s *sender) loop() {
+	defer close(s.done)
+	for a := range s.queue {
+		if err := s.n.Notify(a); err != nil {
+			log.Error("notifier (%s) send alert (%s) error: %s\n", s.name, a.Name, err)
+		}
+	}
+}
+
+// Manager 管理通知渠道并异步投递告警, 实现 alert.Dispatcher
+type Manager struct {
+	mu        sync.RWMutex
+	configs   map[string]*Config
+	notifiers map[string]*sender
+	// Close 之后不再投递告警
+	closed bool
+
+	sp          *dbapi.StorageParts
+	persistType dbapi.DBType
+}
+
+func NewManager(sp *dbapi.StorageParts, persistType dbapi.DBType) *Manager {
+	return &Manager{
+		configs:     make(map[string]*Config),
+		notifiers:   make(map[string]*sender),
+		sp:          sp,
+		persistType: persistType,
+	}
+}
+
+// put 替换通知渠道, 须持有锁
+func (m *Manager) put(c *Config, n Notifier) {
+	if old, ok := m.notifiers[c.Name]; ok {
+		old.close()
+	}
+	s := newSender(c.Name, n)
+	if m.closed {
+		s.close()
+	}
+	m.configs[c.Name], m.notifiers[c.Name] = c, s
+}
+
+// Load 从持久化存储加载通知渠道
+func (m *Manager) Load() error {
+	var _err error
+	var _list []*Config
+	dbapi.AccessDatabase(m.sp, NOTIFIER_DATABASE, NOTIFIER, nil, &_list, dbapi.KEYS, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range _list {
+		n, err := New(c)
+		if err != nil {
+			log.Error("load notifier error: %s\n", err)
+			continue
+		}
+		m.put(c, n)
+	}
+	return nil
+}
+
+// Set 新增或更新通知渠道并持久化, 值为 Masked 的密钥等沿用原配置
+func (m *Manager) Set(c *Config) error {
+	if old, ok := m.Get(c.Name); ok {
+		c.restore(old)
+	}
+	n, err := New(c)
+	if err != nil {
+		return err
+	}
+	var _err error
+	dbapi.AccessDatabase(m.sp, NOTIFIER_DATABASE, NOTIFIER, bson.M{"_id": c.Name}, c, dbapi.SET, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(c, n)
+	return nil
+}
+
+// Del 删除通知渠道
+func (m *Manager) Del(name string) error {
+	if _, ok := m.Get(name); !ok {
+		return fmt.Errorf("notifier (%s) not found.", name)
+	}
+	var _err error
+	dbapi.AccessDatabase(m.sp, NOTIFIER_DATABASE, NOTIFIER, bson.M{"_id": name}, nil, dbapi.DEL, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.notifiers[name]; ok {
+		s.close()
+	}
+	delete(m.configs, name)
+	delete(m.notifiers, name)
+	return nil
+}
+
+// Get 获取通知渠道配置
+func (m *Manager) Get(name string) (*Config, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.configs[name]
+	return c, ok
+}
+
+// List 通知渠道名称列表
+func (m *Manager) List() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := make([]string, 0, len(m.configs))
+	for name := range m.configs {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Test 同步发送一条测试告警
+func (m *Manager) Test(name string) error {
+	m.mu.RLock()
+	s, ok := m.notifiers[name]
+	m.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("notifier (%s) not found.", name)
+	}
+	now := time.Now()
+	return s.n.Notify(&alert.Alert{
+		Id:      bson.NewObjectId().Hex(),
+		Name:    "test",
+		Level:   "info",
+		Message: fmt.Sprintf("logauditer test message from notifier (%s).", name),
+		Count:   1,
+		FirstAt: now,
+		LastAt:  now,
+	})
+}
+
+// Dispatch 实现 alert.Dispatcher, 放入各通知渠道的队列, 队列满时丢弃
+func (m *Manager) Dispatch(a *alert.Alert) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		log.Warn("notifiers closed, drop alert (%s).\n", a.Name)
+		return
+	}
+	for _, name := range a.Notifiers {
+		s, ok := m.notifiers[name]
+		if !ok {
+			log.Warn("alert (%s) notifier (%s) not found.\n", a.Name, name)
+			continue
+		}
+		s.send(a)
+	}
+}
+
+// Close 停止投递告警, 等待各通知渠道发送完队列中的告警, ctx 结束时不再等待
+func (m *Manager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	senders := make([]*sender, 0, len(m.notifiers))
+	for _, s := range m.notifiers {
+		s.close()
+		senders = append(senders, s)
+	}
+	m.mu.Unlock()
+
+	for _, s := range senders {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return fmt.Errorf("notifier (%s) drain queue error: %s.", s.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseTemplate(name, body string) (*template.Template, error) {
+	if body == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(funcs).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("notifier (%s) parse body template error: %s", name, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, a *alert.Alert, def func(*alert.Alert) ([]byte, error)) ([]byte, error) {
+	if t == nil {
+		return def(a)
+	}
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, a); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func text(a *alert.Alert) string {
+	return fmt.Sprintf("[%s] %s\nhost: %s\nuser: %s\nipaddr: %s\noperation: %s\ntime: %s",
+		a.Level, a.Message, a.Record.Host, a.Record.UserName, a.Record.IpAddr, a.Record.Operation,
+		a.LastAt.Format("2006-01-02 15:04:05"))
+}
+
+func duration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,390 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"logauditer/alert"
+	"logauditer/dbapi"
+	in "logauditer/internal"
+)
+
+func testAlert() *alert.Alert {
+	now := time.Now()
+	return &alert.Alert{
+		Id:      "1",
+		Name:    "dangerous-op",
+		Level:   "critical",
+		Message: "rm -rf detected",
+		Count:   1,
+		FirstAt: now,
+		LastAt:  now,
+		Record:  in.AuditLog{Host: "10.0.0.1", UserName: "root", Operation: "rm -rf /"},
+	}
+}
+
+type request struct {
+	method string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+// recorder 记录收到的请求, status 依次作为响应码, 用完后返回 200
+func recorder(t *testing.T, status ...int) (*httptest.Server, chan request) {
+	c := make(chan request, 16)
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		c <- request{method: r.Method, query: r.URL.RawQuery, header: r.Header, body: b}
+		if i := int(atomic.AddInt32(&n, 1)) - 1; i < len(status) {
+			w.WriteHeader(status[i])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, c
+}
+
+func TestWebhook(t *testing.T) {
+	srv, c := recorder(t)
+	n, err := New(&Config{Name: "hook", Type: WEBHOOK, URL: srv.URL, Method: http.MethodPut, Headers: map[string]string{"X-Token": "t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-c
+	if r.method != http.MethodPut || r.header.Get("X-Token") != "t" || r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("request %s %v", r.method, r.header)
+	}
+	a := &alert.Alert{}
+	if err := json.Unmarshal(r.body, a); err != nil || a.Name != "dangerous-op" || a.Record.UserName != "root" {
+		t.Errorf("body %s: %v", r.body, err)
+	}
+
+	n, err = New(&Config{Name: "hook", Type: WEBHOOK, URL: srv.URL, Body: `{"text": {{json .Message}}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-c; string(r.body) != `{"text": "rm -rf detected"}` {
+		t.Errorf("template body %s", r.body)
+	}
+}
+
+func TestRobot(t *testing.T) {
+	srv, c := recorder(t)
+	n, err := New(&Config{Name: "robot", Type: DINGTALK, URL: srv.URL + "/robot/send?access_token=x", Secret: "SEC1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-c
+	q, _ := url.ParseQuery(r.query)
+	h := hmac.New(sha256.New, []byte("SEC1"))
+	h.Write([]byte(q.Get("timestamp") + "\nSEC1"))
+	if q.Get("access_token") != "x" || q.Get("sign") != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+		t.Errorf("query %s", r.query)
+	}
+	var msg struct {
+		Msgtype string
+		Text    struct{ Content string }
+	}
+	if err := json.Unmarshal(r.body, &msg); err != nil || msg.Msgtype != "text" || !strings.Contains(msg.Text.Content, "rm -rf detected") {
+		t.Errorf("body %s: %v", r.body, err)
+	}
+
+	// 企业微信不加签
+	n, err = New(&Config{Name: "robot", Type: WECOM, URL: srv.URL + "/cgi-bin/webhook/send?key=k", Secret: "SEC1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-c; r.query != "key=k" {
+		t.Errorf("query %s", r.query)
+	}
+}
+
+type mailMsg struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP 只实现发送一封邮件所需命令的 SMTP 服务
+func fakeSMTP(t *testing.T) (string, chan mailMsg) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c := make(chan mailMsg, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, c)
+		}
+	}()
+	return l.Addr().String(), c
+}
+
+func serveSMTP(conn net.Conn, c chan mailMsg) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var m mailMsg
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			m.auth = string(b)
+			reply("235 2.7.0 ok")
+		case "MAIL":
+			m.from = line
+			reply("250 ok")
+		case "RCPT":
+			m.to = append(m.to, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data = append(data, l)
+			}
+			m.data = strings.Join(data, "")
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			c <- m
+			return
+		default:
+			reply("502 unknown")
+		}
+	}
+}
+
+func TestMail(t *testing.T) {
+	addr, c := fakeSMTP(t)
+	n, err := New(&Config{Name: "mail", Type: SMTP, Addr: addr, From: "audit@example.com", To: []string{"a@example.com", "b@example.com"},
+		Username: "audit", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-c:
+		if m.auth != "\x00audit\x00pw" || !strings.Contains(m.from, "audit@example.com") || len(m.to) != 2 {
+			t.Errorf("envelope %q %q %q", m.auth, m.from, m.to)
+		}
+		if !strings.Contains(m.data, "To: a@example.com, b@example.com\r\n") || !strings.Contains(m.data, "operation: rm -rf /\r\n") {
+			t.Errorf("data %q", m.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail")
+	}
+
+	if _, err := New(&Config{Name: "mail", Type: SMTP, Addr: addr}); err == nil {
+		t.Error("expect error without from/to")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		retry  int
+		status []int
+		calls  int
+		ok     bool
+	}{
+		{0, []int{500}, 1, false},
+		{2, []int{500, 502}, 3, true},
+		{1, []int{500, 500, 500}, 2, false},
+	}
+	for _, c := range cases {
+		srv, reqs := recorder(t, c.status...)
+		n, err := New(&Config{Name: "hook", Type: WEBHOOK, URL: srv.URL, Retry: c.retry, RetryInterval: "1ms"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Notify(testAlert())
+		if (err == nil) != c.ok || len(reqs) != c.calls {
+			t.Errorf("retry %d status %v: err %v calls %d, want ok %v calls %d", c.retry, c.status, err, len(reqs), c.ok, c.calls)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv, reqs := recorder(t)
+	n, err := New(&Config{Name: "hook", Type: WEBHOOK, URL: srv.URL, RatePerMinute: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ok := range []bool{true, true, false, false} {
+		if err := n.Notify(testAlert()); (err == nil) != ok {
+			t.Errorf("send %d: err %v", i, err)
+		}
+	}
+	if len(reqs) != 2 {
+		t.Errorf("calls %d, want 2", len(reqs))
+	}
+}
+
+func TestDispatchIsolation(t *testing.T) {
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+	fast, reqs := recorder(t)
+
+	m := NewManager(dbapi.NewStorageParts(), dbapi.KV)
+	for _, c := range []*Config{
+		{Name: "slow", Type: WEBHOOK, URL: slow.URL, Timeout: "5s", Retry: 3},
+		{Name: "fast", Type: WEBHOOK, URL: fast.URL},
+	} {
+		if err := m.Set(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer m.Del("slow")
+	defer m.Del("fast")
+	for i := 0; i < 3; i++ {
+		a := testAlert()
+		a.Notifiers = []string{"slow", "fast"}
+		m.Dispatch(a)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-reqs:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("fast notifier blocked by slow one, got %d alerts", i)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv, reqs := recorder(t)
+	m := NewManager(dbapi.NewStorageParts(), dbapi.KV)
+	if err := m.Set(&Config{Name: "hook", Type: WEBHOOK, URL: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		a := testAlert()
+		a.Notifiers = []string{"hook"}
+		m.Dispatch(a)
+	}
+	// 关闭时发送完队列中的告警, 之后的告警丢弃
+	if err := m.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 3 {
+		t.Errorf("drained %d alerts, want 3", len(reqs))
+	}
+	a := testAlert()
+	a.Notifiers = []string{"hook"}
+	m.Dispatch(a)
+	if err := m.Close(context.Background()); err != nil {
+		t.Errorf("close twice %v", err)
+	}
+	if len(reqs) != 3 {
+		t.Errorf("alert dispatched after close")
+	}
+	if err := m.Del("hook"); err != nil {
+		t.Errorf("del after close %v", err)
+	}
+
+	// ctx 结束时不再等待
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+	m = NewManager(dbapi.NewStorageParts(), dbapi.KV)
+	if err := m.Set(&Config{Name: "slow", Type: WEBHOOK, URL: slow.URL, Timeout: "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	a = testAlert()
+	a.Notifiers = []string{"slow"}
+	m.Dispatch(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Close(ctx); err == nil || !strings.Contains(err.Error(), "slow") {
+		t.Errorf("close with slow notifier %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	m := NewManager(dbapi.NewStorageParts(), dbapi.KV)
+	c := &Config{Name: "robot", Type: DINGTALK, URL: "https://oapi.dingtalk.com/robot/send?access_token=tok123", Secret: "SEC1",
+		Headers: map[string]string{"Authorization": "Bearer x"}}
+	if err := m.Set(c); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Del("robot")
+
+	got, _ := m.Get("robot")
+	b, _ := json.Marshal(got.Redacted())
+	for _, secret := range []string{"SEC1", "tok123", "Bearer"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("redacted config %s contains %s", b, secret)
+		}
+	}
+
+	// 查看后原样更新, 密钥不变; 修改的值生效
+	update, err := ParseConfig("robot", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update.Headers["X-New"] = "v"
+	if err := m.Set(update); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = m.Get("robot")
+	if got.Secret != "SEC1" || got.URL != c.URL || got.Headers["Authorization"] != "Bearer x" || got.Headers["X-New"] != "v" {
+		t.Errorf("restored config %+v", got)
+	}
+}
@@ -0,0 +1,69 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"logauditer/alert"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// robot 钉钉/企业微信群机器人, 两者文本消息格式一致
+type robot struct {
+	typ    string
+	url    string
+	secret string
+	tmpl   *template.Template
+	client *http.Client
+}
+
+func newRobot(c *Config, tmpl *template.Template, timeout time.Duration) (*robot, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("notifier (%s) url is empty.", c.Name)
+	}
+	return &robot{
+		typ:    c.Type,
+		url:    c.URL,
+		secret: c.Secret,
+		tmpl:   tmpl,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (r *robot) Notify(a *alert.Alert) error {
+	content, err := render(r.tmpl, a, func(a *alert.Alert) ([]byte, error) { return []byte(text(a)), nil })
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]string{"content": string(content)},
+	})
+	if err != nil {
+		return err
+	}
+	return post(r.client, http.MethodPost, r.sign(time.Now()), nil, body)
+}
+
+// sign 钉钉加签: base64(hmac_sha256(timestamp + "\n" + secret))
+func (r *robot) sign(now time.Time) string {
+	if r.typ != DINGTALK || r.secret == "" {
+		return r.url
+	}
+	ts := fmt.Sprintf("%d", now.UnixNano()/int64(time.Millisecond))
+	h := hmac.New(sha256.New, []byte(r.secret))
+	h.Write([]byte(ts + "\n" + r.secret))
+	sign := url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+
+	sep := "?"
+	if strings.Contains(r.url, "?") {
+		sep = "&"
+	}
+	return r.url + sep + "timestamp=" + ts + "&sign=" + sign
+}
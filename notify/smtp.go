@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"logauditer/alert"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// mail 通过smtp发送告警邮件
+type mail struct {
+	addr    string
+	auth    smtp.Auth
+	from    string
+	to      []string
+	subject string
+	tmpl    *template.Template
+	timeout time.Duration
+}
+
+func newMail(c *Config, tmpl *template.Template, timeout time.Duration) (*mail, error) {
+	if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+		return nil, fmt.Errorf("notifier (%s) smtp addr/from/to is required.", c.Name)
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("notifier (%s) invalid smtp addr (%s).", c.Name, c.Addr)
+	}
+	m := &mail{
+		addr:    c.Addr,
+		from:    c.From,
+		to:      c.To,
+		subject: c.Subject,
+		tmpl:    tmpl,
+		timeout: timeout,
+	}
+	if c.Username != "" {
+		m.auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return m, nil
+}
+
+func (m *mail) Notify(a *alert.Alert) error {
+	body, err := render(m.tmpl, a, func(a *alert.Alert) ([]byte, error) { return []byte(text(a)), nil })
+	if err != nil {
+		return err
+	}
+	subject := m.subject
+	if subject == "" {
+		subject = fmt.Sprintf("[logauditer][%s] %s", a.Level, a.Name)
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.Write(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1))
+
+	return m.send(msg.Bytes())
+}
+
+func (m *mail) send(msg []byte) error {
+	return SendMail(m.addr, m.auth, m.from, m.to, msg, m.timeout)
+}
+
+// SendMail 与 smtp.SendMail 一致, 增加连接超时, 服务端支持时使用 STARTTLS
+func SendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"logauditer/alert"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// webhook 通用http回调, 默认以json格式发送告警
+type webhook struct {
+	url     string
+	method  string
+	headers map[string]string
+	tmpl    *template.Template
+	client  *http.Client
+}
+
+func newWebhook(c *Config, tmpl *template.Template, timeout time.Duration) (*webhook, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("notifier (%s) url is empty.", c.Name)
+	}
+	method := c.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	return &webhook{
+		url:     c.URL,
+		method:  method,
+		headers: c.Headers,
+		tmpl:    tmpl,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *webhook) Notify(a *alert.Alert) error {
+	body, err := render(w.tmpl, a, func(a *alert.Alert) ([]byte, error) { return json.Marshal(a) })
+	if err != nil {
+		return err
+	}
+	return post(w.client, w.method, w.url, w.headers, body)
+}
+
+func post(client *http.Client, method, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s response status %d: %s", method, url, resp.StatusCode, b)
+	}
+	return nil
+}
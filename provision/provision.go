@@ -0,0 +1,250 @@
+package provision
+
+import (
+	"fmt"
+	"io/ioutil"
+	"logauditer/config"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/laik/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// 目录变化后等待一段时间再同步, 合并编辑器的多次写入
+const DefaultDebounce = time.Second
+
+// Reconciler 按规则文件创建、更新、启停规则, prune 时删除文件中已不存在的规则
+type Reconciler interface {
+	Reconcile(rules []config.Rule, prune bool) *Result
+}
+
+// Result 一次同步的结果
+type Result struct {
+	Time      time.Time
+	Created   []string
+	Updated   []string
+	Deleted   []string
+	Started   []string
+	Stopped   []string
+	Unchanged []string
+	// 由文件管理但已从目录删除, prune 关闭时保留
+	Orphaned []string
+	// 规则名或文件名 => 错误
+	Errors map[string]string
+}
+
+func NewResult() *Result {
+	return &Result{Time: time.Now(), Errors: make(map[string]string)}
+}
+
+func (r *Result) Error(name string, err error) {
+	r.Errors[name] = err.Error()
+}
+
+// Lines 每类一行, 没有内容的不输出
+func (r *Result) Lines() []string {
+	lines := []string{fmt.Sprintf("sync at %s", r.Time.Format("2006-01-02 15:04:05"))}
+	for _, kv := range []struct {
+		k string
+		v []string
+	}{
+		{"created", r.Created},
+		{"updated", r.Updated},
+		{"deleted", r.Deleted},
+		{"started", r.Started},
+		{"stopped", r.Stopped},
+		{"unchanged", r.Unchanged},
+		{"orphaned", r.Orphaned},
+	} {
+		if len(kv.v) > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", kv.k, strings.Join(kv.v, ",")))
+		}
+	}
+	names := make([]string, 0, len(r.Errors))
+	for name := range r.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("error: %s: %s", name, r.Errors[name]))
+	}
+	return lines
+}
+
+// 规则文件扩展名
+func ruleFile(fn string) bool {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// Load 读取目录下的规则文件, 每个文件为一条规则或规则列表; 单条规则没有 name 时使用文件名.
+// 任一文件有错误时返回全部错误, 不返回规则
+func Load(dir string) ([]config.Rule, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var rules []config.Rule
+	var errs []string
+	from := make(map[string]string)
+	for _, fi := range fis {
+		if fi.IsDir() || !ruleFile(fi.Name()) || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		fn := filepath.Join(dir, fi.Name())
+		rs, err := loadFile(fn)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for i := range rs {
+			r := &rs[i]
+			switch {
+			case r.Name == "":
+				errs = append(errs, fmt.Sprintf("%s: rules[%d] name is empty", fn, i))
+			case from[r.Name] != "":
+				errs = append(errs, fmt.Sprintf("%s: rule (%s) is already defined in %s", fn, r.Name, from[r.Name]))
+			case r.Options == nil:
+				errs = append(errs, fmt.Sprintf("%s: rule (%s) options is empty", fn, r.Name))
+			default:
+				from[r.Name] = fn
+				r.Source = fn
+				rules = append(rules, *r)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return rules, nil
+}
+
+func loadFile(fn string) ([]config.Rule, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var list []config.Rule
+	if err := yaml.UnmarshalStrict(b, &list); err == nil {
+		return list, nil
+	}
+	r := config.Rule{}
+	if err := yaml.UnmarshalStrict(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	if r.Name == "" {
+		r.Name = strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+	}
+	return []config.Rule{r}, nil
+}
+
+// Provisioner 从目录同步规则, 记录最近一次的结果
+type Provisioner struct {
+	dir      string
+	prune    bool
+	debounce time.Duration
+	r        Reconciler
+
+	mu   sync.Mutex
+	last *Result
+
+	watcher *fsnotify.Watcher
+	// Close 之后开始的 Watch 立即返回
+	closed bool
+}
+
+func New(dir string, prune bool, debounce time.Duration, r Reconciler) *Provisioner {
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	return &Provisioner{dir: dir, prune: prune, debounce: debounce, r: r}
+}
+
+// Sync 读取目录并同步, 规则文件有错误时不做任何修改
+func (p *Provisioner) Sync() *Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rules, err := Load(p.dir)
+	var res *Result
+	if err != nil {
+		res = NewResult()
+		res.Error(p.dir, err)
+	} else {
+		res = p.r.Reconcile(rules, p.prune)
+	}
+	for _, line := range res.Lines() {
+		if len(res.Errors) > 0 {
+			log.Warn("provision rules from (%s) %s\n", p.dir, line)
+		} else {
+			log.Info("provision rules from (%s) %s\n", p.dir, line)
+		}
+	}
+	p.last = res
+	return res
+}
+
+// Last 最近一次同步的结果, 未同步时为 nil
+func (p *Provisioner) Last() *Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+// Watch 监听目录, 规则文件变化后同步, 调用 Close 后返回
+func (p *Provisioner) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(p.dir); err != nil {
+		w.Close()
+		return err
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return w.Close()
+	}
+	p.watcher = w
+	p.mu.Unlock()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ruleFile(e.Name) && e.Op != fsnotify.Chmod {
+				timer = time.After(p.debounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error("watch rules dir (%s) error: %s\n", p.dir, err)
+		case <-timer:
+			timer = nil
+			p.Sync()
+		}
+	}
+}
+
+// Close 停止监听目录, 之后调用的 Watch 不再监听
+func (p *Provisioner) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.watcher == nil {
+		return nil
+	}
+	return p.watcher.Close()
+}
@@ -0,0 +1,225 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"logauditer/config"
+)
+
+func tempDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := tempDir(t, map[string]string{
+		"nginx.yaml":    "options:\n  dir: /var/log/nginx\n  watchMode: poll\nstart: true\n",
+		"list.yml":      "- name: a\n  options: {dir: /a}\n- name: b\n  options: '{\"dir\":\"/b\"}'\n",
+		"sshd.json":     `{"name": "ssh", "options": {"dir": "/var/log/ssh"}}`,
+		".hidden.yaml":  "{",
+		"README.md":     "not a rule",
+		"sub/skip.yaml": "{",
+		"backup.yaml~":  "{",
+	})
+	rules, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]config.Rule)
+	for _, r := range rules {
+		got[r.Name] = r
+	}
+	if len(got) != 4 {
+		t.Fatalf("rules %+v", rules)
+	}
+	// 单条规则没有 name 时使用文件名
+	if r := got["nginx"]; !r.Start || r.Source != filepath.Join(dir, "nginx.yaml") {
+		t.Errorf("nginx %+v", r)
+	}
+	if js, _ := (&config.Rule{Options: got["nginx"].Options}).JSON(); js != `{"dir":"/var/log/nginx","watchMode":"poll"}` {
+		t.Errorf("nginx options %s", js)
+	}
+	if r := got["b"]; r.Options != `{"dir":"/b"}` || r.Source != filepath.Join(dir, "list.yml") || r.Start {
+		t.Errorf("b %+v", r)
+	}
+	if r := got["ssh"]; r.Source != filepath.Join(dir, "sshd.json") {
+		t.Errorf("ssh %+v", r)
+	}
+
+	for name, files := range map[string]map[string]string{
+		"syntax":    {"a.yaml": "name: [", "b.yaml": "options: {dir: /b}"},
+		"unknown":   {"a.yaml": "options: {dir: /a}\nstrat: true\n"},
+		"duplicate": {"a.yaml": "options: {dir: /a}", "b.yaml": "- name: a\n  options: {dir: /b}\n"},
+		"no name":   {"a.yaml": "- options: {dir: /a}\n"},
+		"options":   {"a.yaml": "start: true\n"},
+	} {
+		if rules, err := Load(tempDir(t, files)); err == nil {
+			t.Errorf("%s: expect error, got %+v", name, rules)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing dir expect error")
+	}
+}
+
+func TestResultLines(t *testing.T) {
+	r := NewResult()
+	r.Time = time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)
+	r.Created = []string{"a", "b"}
+	r.Stopped = []string{"c"}
+	r.Orphaned = []string{"d"}
+	r.Error("z", os.ErrNotExist)
+	r.Error("e", os.ErrPermission)
+	want := []string{
+		"sync at 2019-02-25 10:00:00",
+		"created: a,b",
+		"stopped: c",
+		"orphaned: d",
+		"error: e: permission denied",
+		"error: z: file does not exist",
+	}
+	if got := r.Lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines %q, want %q", got, want)
+	}
+}
+
+// recorder 记录每次同步收到的规则
+type recorder struct {
+	mu    sync.Mutex
+	calls [][]string
+	prune []bool
+	c     chan struct{}
+}
+
+func (r *recorder) Reconcile(rules []config.Rule, prune bool) *Result {
+	r.mu.Lock()
+	var names []string
+	for _, rule := range rules {
+		names = append(names, rule.Name)
+	}
+	r.calls = append(r.calls, names)
+	r.prune = append(r.prune, prune)
+	r.mu.Unlock()
+	if r.c != nil {
+		r.c <- struct{}{}
+	}
+	res := NewResult()
+	res.Unchanged = names
+	return res
+}
+
+func TestSync(t *testing.T) {
+	dir := tempDir(t, map[string]string{"a.yaml": "options: {dir: /a}"})
+	r := &recorder{}
+	p := New(dir, true, 0, r)
+	if p.debounce != DefaultDebounce || p.Last() != nil {
+		t.Errorf("new provisioner %+v", p)
+	}
+	res := p.Sync()
+	if !reflect.DeepEqual(res.Unchanged, []string{"a"}) || p.Last() != res || !reflect.DeepEqual(r.prune, []bool{true}) {
+		t.Errorf("sync %+v", res)
+	}
+
+	// 规则文件有错误时不调用 Reconcile
+	ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("{"), 0644)
+	res = p.Sync()
+	if len(r.calls) != 1 || len(res.Errors) != 1 || !strings.Contains(res.Errors[dir], "b.yaml") || p.Last() != res {
+		t.Errorf("sync with bad file %+v calls %v", res, r.calls)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := tempDir(t, nil)
+	r := &recorder{c: make(chan struct{}, 4)}
+	p := New(dir, false, 50*time.Millisecond, r)
+	done := make(chan error, 1)
+	go func() { done <- p.Watch() }()
+
+	// 等待开始监听
+	for i := 0; ; i++ {
+		p.mu.Lock()
+		w := p.watcher
+		p.mu.Unlock()
+		if w != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("watch not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 非规则文件不触发同步, 连续的写入合并为一次同步
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644)
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte("options: {dir: /a}"), 0644)
+	}
+	select {
+	case <-r.c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sync after rule file changed")
+	}
+	select {
+	case <-r.c:
+		t.Error("writes not merged into one sync")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if last := p.Last(); last == nil || !reflect.DeepEqual(last.Unchanged, []string{"a"}) {
+		t.Errorf("last %+v", last)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watch returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not return after close")
+	}
+}
+
+func TestWatchAfterClose(t *testing.T) {
+	p := New(tempDir(t, nil), false, 0, &recorder{})
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- p.Watch() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watch after close %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch started after close did not return")
+	}
+	if p.watcher != nil {
+		t.Error("watcher installed after close")
+	}
+
+	if err := New(filepath.Join(os.TempDir(), "provision-missing-dir"), false, 0, &recorder{}).Watch(); err == nil {
+		t.Error("watch missing dir expect error")
+	}
+}
@@ -0,0 +1,97 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 条件类型
+const (
+	EQ       = "eq"
+	WILDCARD = "wildcard"
+	REGEX    = "regex"
+	RANGE    = "range"
+	GT       = "gt"
+	GTE      = "gte"
+	LT       = "lt"
+	LTE      = "lte"
+	// 无字段名的词, 在 Operation 中全文检索
+	TEXT = "text"
+)
+
+// Node 查询语法树节点
+type Node interface {
+	String() string
+}
+
+type And struct {
+	Left, Right Node
+}
+
+func (n *And) String() string { return fmt.Sprintf("(%s AND %s)", n.Left, n.Right) }
+
+type Or struct {
+	Left, Right Node
+}
+
+func (n *Or) String() string { return fmt.Sprintf("(%s OR %s)", n.Left, n.Right) }
+
+type Not struct {
+	X Node
+}
+
+func (n *Not) String() string { return fmt.Sprintf("NOT %s", n.X) }
+
+// Term 字段条件, RANGE 时 Value/To 为两端(包含)
+type Term struct {
+	Field string
+	Op    string
+	Value string
+	To    string
+}
+
+func (t *Term) String() string {
+	switch t.Op {
+	case TEXT:
+		return fmt.Sprintf("%q", t.Value)
+	case REGEX:
+		return fmt.Sprintf("%s:~%q", t.Field, t.Value)
+	case RANGE:
+		return fmt.Sprintf("%s:[%q TO %q]", t.Field, t.Value, t.To)
+	case GT, GTE, LT, LTE:
+		op := map[string]string{GT: ">", GTE: ">=", LT: "<", LTE: "<="}[t.Op]
+		return fmt.Sprintf("%s:%s%q", t.Field, op, t.Value)
+	}
+	return fmt.Sprintf("%s:%q", t.Field, t.Value)
+}
+
+// 字段别名
+var aliases = map[string]string{
+	"user":     "UserName",
+	"username": "UserName",
+	"ip":       "IpAddr",
+	"ipaddr":   "IpAddr",
+	"host":     "Host",
+	"op":       "Operation",
+	"cmd":      "Operation",
+	"state":    "State",
+	"rule":     "Rule",
+	"device":   "Device",
+	"type":     "SystemType",
+	"category": "Categories",
+	"risk":     "RiskScore",
+}
+
+// TIME 记录入库时间, 由 _id 中的时间戳得出
+const TIME = "time"
+
+// Canonical 字段别名对应的记录字段名, 不是别名时原样返回
+func Canonical(field string) string {
+	if a, ok := aliases[strings.ToLower(field)]; ok {
+		return a
+	}
+	if strings.ToLower(field) == TIME {
+		return TIME
+	}
+	return field
+}
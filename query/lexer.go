@@ -0,0 +1,134 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tEOF tokenType = iota
+	tWord
+	tString
+	tColon
+	tTilde
+	tLParen
+	tRParen
+	tLBracket
+	tRBracket
+	tAnd
+	tOr
+	tNot
+	tTo
+	tGT
+	tGTE
+	tLT
+	tLTE
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tEOF:
+		return "end of query"
+	case tString:
+		return fmt.Sprintf("%q", t.val)
+	}
+	return fmt.Sprintf("'%s'", t.val)
+}
+
+// SyntaxError 查询语法错误
+type SyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query syntax error at %d: %s", e.Pos, e.Message)
+}
+
+func isSpecial(r rune) bool {
+	return strings.ContainsRune(`:~()[]"<>`, r) || unicode.IsSpace(r)
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == ':':
+			tokens = append(tokens, token{tColon, ":", i})
+			i++
+		case r == '~':
+			tokens = append(tokens, token{tTilde, "~", i})
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tRParen, ")", i})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{tLBracket, "[", i})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{tRBracket, "]", i})
+			i++
+		case r == '>' || r == '<':
+			typ, val := tGT, ">"
+			if r == '<' {
+				typ, val = tLT, "<"
+			}
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				typ, val = typ+1, val+"="
+				i++
+			}
+			tokens = append(tokens, token{typ, val, i})
+			i++
+		case r == '"':
+			start := i
+			var b strings.Builder
+			i++
+			for ; i < len(rs) && rs[i] != '"'; i++ {
+				if rs[i] == '\\' && i+1 < len(rs) && (rs[i+1] == '"' || rs[i+1] == '\\') {
+					i++
+				}
+				b.WriteRune(rs[i])
+			}
+			if i >= len(rs) {
+				return nil, &SyntaxError{Pos: start, Message: "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, token{tString, b.String(), start})
+		default:
+			start := i
+			for i < len(rs) && !isSpecial(rs[i]) {
+				i++
+			}
+			w := string(rs[start:i])
+			typ := tWord
+			switch w {
+			case "AND", "&&":
+				typ = tAnd
+			case "OR", "||":
+				typ = tOr
+			case "NOT":
+				typ = tNot
+			case "TO":
+				typ = tTo
+			}
+			tokens = append(tokens, token{typ, w, start})
+		}
+	}
+	return append(tokens, token{tEOF, "", len(rs)}), nil
+}
@@ -0,0 +1,122 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+
+	in "logauditer/internal"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ToMongo 转换为mongo查询条件. time 条件按 _id 中的时间戳比较
+func ToMongo(n Node) (bson.M, error) {
+	switch n := n.(type) {
+	case *And:
+		return mongoList("$and", n)
+	case *Or:
+		return mongoList("$or", n)
+	case *Not:
+		x, err := ToMongo(n.X)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": []bson.M{x}}, nil
+	case *Term:
+		return mongoTerm(n)
+	}
+	return nil, fmt.Errorf("unknown query node (%T).", n)
+}
+
+// mongoList 合并相同的 AND/OR 节点
+func mongoList(op string, n Node) (bson.M, error) {
+	var list []bson.M
+	var walk func(n Node) error
+	walk = func(n Node) error {
+		var l, r Node
+		switch x := n.(type) {
+		case *And:
+			if op != "$and" {
+				break
+			}
+			l, r = x.Left, x.Right
+		case *Or:
+			if op != "$or" {
+				break
+			}
+			l, r = x.Left, x.Right
+		}
+		if l == nil {
+			m, err := ToMongo(n)
+			if err != nil {
+				return err
+			}
+			list = append(list, m)
+			return nil
+		}
+		if err := walk(l); err != nil {
+			return err
+		}
+		return walk(r)
+	}
+	if err := walk(n); err != nil {
+		return nil, err
+	}
+	return bson.M{op: list}, nil
+}
+
+func mongoTerm(t *Term) (bson.M, error) {
+	if t.Field == TIME {
+		b, err := timeBound(t)
+		if err != nil {
+			return nil, err
+		}
+		cond := bson.M{}
+		if !b.from.IsZero() {
+			cond["$gte"] = bson.NewObjectIdWithTime(b.from)
+		}
+		if !b.to.IsZero() {
+			cond["$lt"] = bson.NewObjectIdWithTime(b.to)
+		}
+		return bson.M{"_id": cond}, nil
+	}
+	if t.Op == TEXT {
+		return bson.M{in.Operation: bson.M{"$regex": regexp.QuoteMeta(t.Value), "$options": "i"}}, nil
+	}
+
+	f, err := field(t)
+	if err != nil {
+		return nil, err
+	}
+	v, err := value(f, t.Value)
+	if err != nil {
+		return nil, err
+	}
+	switch t.Op {
+	case EQ:
+		if f.Name == in.IpAddr {
+			return bson.M{f.Name: bson.M{"$in": []string{t.Value, "(" + t.Value + ")"}}}, nil
+		}
+		return bson.M{f.Name: v}, nil
+	case WILDCARD:
+		return bson.M{f.Name: bson.M{"$regex": glob(f, t.Value)}}, nil
+	case REGEX:
+		return bson.M{f.Name: bson.M{"$regex": t.Value}}, nil
+	case GT, GTE, LT, LTE:
+		return bson.M{f.Name: bson.M{"$" + t.Op: v}}, nil
+	case RANGE:
+		to, err := value(f, t.To)
+		if err != nil {
+			return nil, err
+		}
+		cond := bson.M{}
+		if t.Value != "*" {
+			cond["$gte"] = v
+		}
+		if t.To != "*" {
+			cond["$lte"] = to
+		}
+		return bson.M{f.Name: cond}, nil
+	}
+	return nil, fmt.Errorf("unsupported op (%s) on field (%s).", t.Op, f.Name)
+}
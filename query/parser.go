@@ -0,0 +1,196 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parse 解析查询语句, 例如 user:root AND ip:10.10.3.* AND op:~"scp .*" AND time:[2019-02-25 TO 2019-02-28]
+// 相邻条件之间省略 AND 时默认为 AND, NOT 或 - 前缀取反, 括号分组.
+// 不带字段名的词在 Operation 中全文检索.
+func Parse(s string) (Node, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().typ == tEOF {
+		return nil, &SyntaxError{Pos: 0, Message: "empty query"}
+	}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return n, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, v ...interface{}) error {
+	return &SyntaxError{Pos: t.pos, Message: fmt.Sprintf(format, v...)}
+}
+
+func (p *parser) expect(typ tokenType, what string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.errorf(t, "expect %s but %s", what, t)
+	}
+	return t, nil
+}
+
+func (p *parser) or() (Node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == tOr {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().typ {
+		case tAnd:
+			p.next()
+		case tWord, tString, tNot, tLParen:
+		default:
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+}
+
+func (p *parser) unary() (Node, error) {
+	t := p.peek()
+	switch {
+	case t.typ == tNot:
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{X: x}, nil
+	case t.typ == tWord && strings.HasPrefix(t.val, "-") && len(t.val) > 1:
+		p.tokens[p.pos].val = t.val[1:]
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{X: x}, nil
+	case t.typ == tLParen:
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return p.term()
+}
+
+func (p *parser) term() (Node, error) {
+	t := p.next()
+	switch t.typ {
+	case tString:
+		return &Term{Field: "Operation", Op: TEXT, Value: t.val}, nil
+	case tWord:
+	default:
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	if p.peek().typ != tColon {
+		return &Term{Field: "Operation", Op: TEXT, Value: t.val}, nil
+	}
+	p.next()
+	term := &Term{Field: Canonical(t.val)}
+
+	v := p.next()
+	switch v.typ {
+	case tTilde:
+		term.Op = REGEX
+	case tGT, tGTE, tLT, tLTE:
+		term.Op = map[tokenType]string{tGT: GT, tGTE: GTE, tLT: LT, tLTE: LTE}[v.typ]
+	case tLBracket:
+		term.Op = RANGE
+		from, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		// State 等取值本身带有方括号, 例如 state:[1]
+		if p.peek().typ == tRBracket {
+			p.next()
+			term.Op, term.Value = EQ, "["+from.val+"]"
+			return term, nil
+		}
+		if _, err := p.expect(tTo, "TO"); err != nil {
+			return nil, err
+		}
+		to, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tRBracket, "']'"); err != nil {
+			return nil, err
+		}
+		term.Value, term.To = from.val, to.val
+		return term, nil
+	case tString:
+		term.Op, term.Value = EQ, v.val
+		return term, nil
+	case tWord:
+		term.Op, term.Value = EQ, v.val
+		if strings.ContainsAny(v.val, "*?") {
+			term.Op = WILDCARD
+		}
+		return term, nil
+	default:
+		return nil, p.errorf(v, "expect value of field (%s) but %s", t.val, v)
+	}
+	val, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	term.Value = val.val
+	return term, nil
+}
+
+func (p *parser) value() (token, error) {
+	t := p.next()
+	if t.typ != tWord && t.typ != tString {
+		return t, p.errorf(t, "expect value but %s", t)
+	}
+	return t, nil
+}
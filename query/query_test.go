@@ -0,0 +1,279 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"logauditer/search"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestLex(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []token
+	}{
+		{`user:root`, []token{{tWord, "user", 0}, {tColon, ":", 4}, {tWord, "root", 5}, {tEOF, "", 9}}},
+		{`a&&b || NOT c`, []token{{tWord, "a&&b", 0}, {tOr, "||", 5}, {tNot, "NOT", 8}, {tWord, "c", 12}, {tEOF, "", 13}}},
+		{`risk:>=50`, []token{{tWord, "risk", 0}, {tColon, ":", 4}, {tGTE, ">=", 6}, {tWord, "50", 7}, {tEOF, "", 9}}},
+		{`op:~"say \"hi\" \\"`, []token{{tWord, "op", 0}, {tColon, ":", 2}, {tTilde, "~", 3}, {tString, `say "hi" \`, 4}, {tEOF, "", 19}}},
+		{`[1 TO 2]`, []token{{tLBracket, "[", 0}, {tWord, "1", 1}, {tTo, "TO", 3}, {tWord, "2", 6}, {tRBracket, "]", 7}, {tEOF, "", 8}}},
+		// 关键字区分大小写, 小写时为普通词
+		{`a and b`, []token{{tWord, "a", 0}, {tWord, "and", 2}, {tWord, "b", 6}, {tEOF, "", 7}}},
+		{`用户:张三`, []token{{tWord, "用户", 0}, {tColon, ":", 2}, {tWord, "张三", 3}, {tEOF, "", 5}}},
+	}
+	for _, c := range cases {
+		got, err := lex(c.in)
+		if err != nil {
+			t.Errorf("lex(%s): %s", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("lex(%s) = %v, want %v", c.in, got, c.want)
+		}
+	}
+
+	if _, err := lex(`op:"abc`); err == nil || err.(*SyntaxError).Pos != 3 {
+		t.Errorf("unterminated string: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{`user:root`, `UserName:"root"`},
+		{`user:root ip:10.10.3.*`, `(UserName:"root" AND IpAddr:"10.10.3.*")`},
+		// AND 优先于 OR, 左结合
+		{`a OR b AND c`, `("a" OR ("b" AND "c"))`},
+		{`a AND b OR c`, `(("a" AND "b") OR "c")`},
+		{`a OR b OR c`, `(("a" OR "b") OR "c")`},
+		{`user:root && host:a || host:b`, `((UserName:"root" AND Host:"a") OR Host:"b")`},
+		{`(a OR b) c`, `(("a" OR "b") AND "c")`},
+		{`NOT user:root OR -host:h1`, `(NOT UserName:"root" OR NOT Host:"h1")`},
+		{`NOT (a OR b)`, `NOT ("a" OR "b")`},
+		{`op:~"scp .*"`, `Operation:~"scp .*"`},
+		{`op:"rm -rf"`, `Operation:"rm -rf"`},
+		{`"rm -rf" root`, `("rm -rf" AND "root")`},
+		{`time:[2019-02-25 TO 2019-02-28]`, `time:["2019-02-25" TO "2019-02-28"]`},
+		{`risk:[* TO 50]`, `RiskScore:["*" TO "50"]`},
+		{`state:[1]`, `State:"[1]"`},
+		{`risk:>=50 risk:<90`, `(RiskScore:>="50" AND RiskScore:<"90")`},
+		{`time:<"2019-02-28 12:00"`, `time:<"2019-02-28 12:00"`},
+		{`Custom:x`, `Custom:"x"`},
+	}
+	for _, c := range cases {
+		n, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("Parse(%s): %s", c.in, err)
+			continue
+		}
+		if got := n.String(); got != c.want {
+			t.Errorf("Parse(%s) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		in  string
+		pos int
+	}{
+		{``, 0},
+		{`   `, 0},
+		{`user:`, 5},
+		{`user:)`, 5},
+		{`(a OR b`, 7},
+		{`a)`, 1},
+		{`a OR`, 4},
+		{`time:[2019-02-25 2019-02-28]`, 17},
+		{`time:[2019-02-25 TO`, 19},
+		{`time:[2019-02-25 TO 2019-02-28`, 30},
+		{`risk:>`, 6},
+		{`op:"abc`, 3},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.in)
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Parse(%s) error %v, want syntax error", c.in, err)
+			continue
+		}
+		if se.Pos != c.pos {
+			t.Errorf("Parse(%s) error at %d (%s), want %d", c.in, se.Pos, se.Message, c.pos)
+		}
+	}
+}
+
+func day(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestToMongo(t *testing.T) {
+	cases := []struct {
+		in   string
+		want bson.M
+	}{
+		{`user:root`, bson.M{"UserName": "root"}},
+		{`ip:10.0.0.1`, bson.M{"IpAddr": bson.M{"$in": []string{"10.0.0.1", "(10.0.0.1)"}}}},
+		{`ip:10.0.*`, bson.M{"IpAddr": bson.M{"$regex": `^\(?10\.0\..*\)?$`}}},
+		{`host:web-?`, bson.M{"Host": bson.M{"$regex": `^web-.$`}}},
+		{`op:~"^scp"`, bson.M{"Operation": bson.M{"$regex": "^scp"}}},
+		{`rm.`, bson.M{"Operation": bson.M{"$regex": `rm\.`, "$options": "i"}}},
+		{`risk:>=50`, bson.M{"RiskScore": bson.M{"$gte": int64(50)}}},
+		{`risk:[10 TO *]`, bson.M{"RiskScore": bson.M{"$gte": int64(10)}}},
+		{`risk:[10 TO 20]`, bson.M{"RiskScore": bson.M{"$gte": int64(10), "$lte": int64(20)}}},
+		{`NOT user:root`, bson.M{"$nor": []bson.M{{"UserName": "root"}}}},
+		// 相同的 AND/OR 合并为一个列表
+		{`a OR b OR c`, bson.M{"$or": []bson.M{
+			{"Operation": bson.M{"$regex": "a", "$options": "i"}},
+			{"Operation": bson.M{"$regex": "b", "$options": "i"}},
+			{"Operation": bson.M{"$regex": "c", "$options": "i"}},
+		}}},
+		{`user:root (host:a OR host:b)`, bson.M{"$and": []bson.M{
+			{"UserName": "root"},
+			{"$or": []bson.M{{"Host": "a"}, {"Host": "b"}}},
+		}}},
+		{`time:[2019-02-25 TO 2019-02-28]`, bson.M{"_id": bson.M{
+			"$gte": bson.NewObjectIdWithTime(day("2019-02-25")),
+			"$lt":  bson.NewObjectIdWithTime(day("2019-03-01")),
+		}}},
+		{`time:2019-02-25`, bson.M{"_id": bson.M{
+			"$gte": bson.NewObjectIdWithTime(day("2019-02-25")),
+			"$lt":  bson.NewObjectIdWithTime(day("2019-02-26")),
+		}}},
+		{`time:>2019-02-25`, bson.M{"_id": bson.M{"$gte": bson.NewObjectIdWithTime(day("2019-02-26"))}}},
+		{`time:<="2019-02-25 10:00"`, bson.M{"_id": bson.M{"$lt": bson.NewObjectIdWithTime(day("2019-02-25").Add(10 * time.Hour))}}},
+	}
+	for _, c := range cases {
+		n, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("Parse(%s): %s", c.in, err)
+			continue
+		}
+		got, err := ToMongo(n)
+		if err != nil {
+			t.Errorf("ToMongo(%s): %s", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ToMongo(%s) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTranslateError(t *testing.T) {
+	for _, in := range []string{
+		`foo:bar`,
+		`risk:~x`,
+		`risk:1*`,
+		`risk:abc`,
+		`op:~"("`,
+		`time:abc`,
+		`time:~2019`,
+		`time:[2019-03-01 TO 2019-02-01]`,
+	} {
+		n, err := Parse(in)
+		if err != nil {
+			t.Errorf("Parse(%s): %s", in, err)
+			continue
+		}
+		_, merr := ToMongo(n)
+		_, _, serr := ToSQL(n)
+		if merr == nil || serr == nil {
+			t.Errorf("%s: mongo error %v, sql error %v", in, merr, serr)
+		}
+	}
+}
+
+func TestToSQL(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		args []interface{}
+	}{
+		{`user:root`, `UserName = ?`, []interface{}{"root"}},
+		{`user:root OR NOT host:a`, `(UserName = ? OR NOT Host = ?)`, []interface{}{"root", "a"}},
+		{`ip:10.0.*`, `(IpAddr LIKE ? OR IpAddr LIKE ?)`, []interface{}{"10.0.%", "(10.0.%)"}},
+		{`op:"100%_done"`, `Operation = ?`, []interface{}{"100%_done"}},
+		{`100%`, `Operation LIKE ?`, []interface{}{`%100\%%`}},
+		{`risk:[10 TO *]`, `RiskScore >= ?`, []interface{}{int64(10)}},
+		{`risk:[10 TO 20]`, `RiskScore BETWEEN ? AND ?`, []interface{}{int64(10), int64(20)}},
+		{`time:[2019-02-25 TO 2019-02-28]`, `(CreatedAt >= ? AND CreatedAt < ?)`, []interface{}{day("2019-02-25"), day("2019-03-01")}},
+	}
+	for _, c := range cases {
+		n, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("Parse(%s): %s", c.in, err)
+			continue
+		}
+		got, args, err := ToSQL(n)
+		if err != nil {
+			t.Errorf("ToSQL(%s): %s", c.in, err)
+			continue
+		}
+		if got != c.want || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("ToSQL(%s) = %s %v, want %s %v", c.in, got, args, c.want, c.args)
+		}
+	}
+	n, _ := Parse(`category:danger`)
+	if _, _, err := ToSQL(n); err == nil {
+		t.Error("multi value field should not be supported in sql")
+	}
+}
+
+func TestApply(t *testing.T) {
+	today := time.Now().Format("2006-01-02")
+	cases := []struct {
+		in       string
+		from, to string
+		want     [2]string
+	}{
+		{`user:root`, "", "", [2]string{"", ""}},
+		{`time:[2019-02-25 TO 2019-02-28]`, "", "", [2]string{"2019-02-25", "2019-02-28"}},
+		{`time:2019-02-25`, "", "", [2]string{"2019-02-25", "2019-02-25"}},
+		{`user:root time:>=2019-02-25 time:<2019-03-01`, "", "", [2]string{"2019-02-25", "2019-02-28"}},
+		{`time:>=2019-02-25`, "", "", [2]string{"2019-02-25", today}},
+		// 只有上限时检索之前 MaxDays 天, 不是只检索上限当天
+		{`time:<2019-02-28`, "", "", [2]string{"2018-02-27", "2019-02-27"}},
+		{`time:<=2019-02-28`, "", "", [2]string{"2018-02-28", "2019-02-28"}},
+		// OR 中的 time 条件不确定日期范围
+		{`user:root OR time:2019-02-25`, "", "", [2]string{"", ""}},
+		// 请求已指定日期时不修改
+		{`time:<2019-02-28`, "2019-01-01", "", [2]string{"2019-01-01", ""}},
+	}
+	for _, c := range cases {
+		r := &search.Request{From: c.from, To: c.to}
+		if err := Apply(r, c.in); err != nil {
+			t.Errorf("Apply(%s): %s", c.in, err)
+			continue
+		}
+		if r.From != c.want[0] || r.To != c.want[1] {
+			t.Errorf("Apply(%s) = %s ~ %s, want %s ~ %s", c.in, r.From, r.To, c.want[0], c.want[1])
+		}
+		if r.Query == nil {
+			t.Errorf("Apply(%s) query is empty", c.in)
+		}
+	}
+
+	r := &search.Request{}
+	if err := Apply(r, `time:<2019-02-28`); err != nil {
+		t.Fatal(err)
+	}
+	days, err := r.Days()
+	if err != nil || len(days) != search.MaxDays || days[len(days)-1] != "2019-02-27" {
+		t.Errorf("days %d %v", len(days), err)
+	}
+
+	if err := Apply(&search.Request{}, `user:`); err == nil {
+		t.Error("expect syntax error")
+	} else if _, ok := err.(*search.Error); !ok {
+		t.Errorf("error type %T", err)
+	}
+}
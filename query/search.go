@@ -0,0 +1,49 @@
+package query
+
+import (
+	"logauditer/search"
+	"time"
+)
+
+// Apply 解析查询语句并写入检索请求. 请求未指定日期时由 time 条件确定检索的日期范围,
+// 没有下限时为上限之前 MaxDays 天, 没有上限时到当天
+func Apply(r *search.Request, q string) error {
+	n, err := Parse(q)
+	if err != nil {
+		return &search.Error{Message: err.Error()}
+	}
+	m, err := ToMongo(n)
+	if err != nil {
+		return &search.Error{Message: err.Error()}
+	}
+	r.Query = m
+
+	if r.From != "" || r.To != "" {
+		return nil
+	}
+	from, to, ok, err := TimeRange(n)
+	if err != nil {
+		return &search.Error{Message: err.Error()}
+	}
+	if !ok {
+		return nil
+	}
+	if !from.IsZero() {
+		r.From = from.Format("2006-01-02")
+	}
+	if !to.IsZero() {
+		r.To = to.Add(-1).Format("2006-01-02")
+	}
+	if r.To == "" {
+		r.To = time.Now().Format("2006-01-02")
+	}
+	// 只有上限时检索上限之前 MaxDays 天
+	if r.From == "" {
+		t, err := time.ParseInLocation("2006-01-02", r.To, time.Local)
+		if err != nil {
+			return &search.Error{Message: err.Error()}
+		}
+		r.From = t.AddDate(0, 0, 1-search.MaxDays).Format("2006-01-02")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	in "logauditer/internal"
+)
+
+// SQL_TIME_COLUMN 关系型存储中记录入库时间的列
+const SQL_TIME_COLUMN = "CreatedAt"
+
+// ToSQL 转换为 WHERE 子句, 参数以 ? 占位. 列名与 AuditLog 字段名一致
+func ToSQL(n Node) (string, []interface{}, error) {
+	switch n := n.(type) {
+	case *And:
+		return sqlBinary("AND", n.Left, n.Right)
+	case *Or:
+		return sqlBinary("OR", n.Left, n.Right)
+	case *Not:
+		s, args, err := ToSQL(n.X)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + s, args, nil
+	case *Term:
+		return sqlTerm(n)
+	}
+	return "", nil, fmt.Errorf("unknown query node (%T).", n)
+}
+
+func sqlBinary(op string, left, right Node) (string, []interface{}, error) {
+	l, largs, err := ToSQL(left)
+	if err != nil {
+		return "", nil, err
+	}
+	r, rargs, err := ToSQL(right)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("(%s %s %s)", l, op, r), append(largs, rargs...), nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func sqlTerm(t *Term) (string, []interface{}, error) {
+	if t.Field == TIME {
+		b, err := timeBound(t)
+		if err != nil {
+			return "", nil, err
+		}
+		var conds []string
+		var args []interface{}
+		if !b.from.IsZero() {
+			conds, args = append(conds, SQL_TIME_COLUMN+" >= ?"), append(args, b.from)
+		}
+		if !b.to.IsZero() {
+			conds, args = append(conds, SQL_TIME_COLUMN+" < ?"), append(args, b.to)
+		}
+		if len(conds) == 0 {
+			return "1 = 1", nil, nil
+		}
+		return "(" + strings.Join(conds, " AND ") + ")", args, nil
+	}
+	if t.Op == TEXT {
+		return in.Operation + " LIKE ?", []interface{}{"%" + likeEscaper.Replace(t.Value) + "%"}, nil
+	}
+
+	f, err := field(t)
+	if err != nil {
+		return "", nil, err
+	}
+	if f.Multi {
+		return "", nil, fmt.Errorf("field (%s) not supported in sql.", f.Name)
+	}
+	v, err := value(f, t.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	switch t.Op {
+	case EQ:
+		if f.Name == in.IpAddr {
+			return f.Name + " IN (?, ?)", []interface{}{t.Value, "(" + t.Value + ")"}, nil
+		}
+		return f.Name + " = ?", []interface{}{v}, nil
+	case WILDCARD:
+		like := strings.NewReplacer("*", "%", "?", "_").Replace(likeEscaper.Replace(t.Value))
+		if f.Name == in.IpAddr {
+			return fmt.Sprintf("(%s LIKE ? OR %s LIKE ?)", f.Name, f.Name), []interface{}{like, "(" + like + ")"}, nil
+		}
+		return f.Name + " LIKE ?", []interface{}{like}, nil
+	case REGEX:
+		return f.Name + " REGEXP ?", []interface{}{t.Value}, nil
+	case GT, GTE, LT, LTE:
+		op := map[string]string{GT: ">", GTE: ">=", LT: "<", LTE: "<="}[t.Op]
+		return fmt.Sprintf("%s %s ?", f.Name, op), []interface{}{v}, nil
+	case RANGE:
+		to, err := value(f, t.To)
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case t.Value == "*" && t.To == "*":
+			return "1 = 1", nil, nil
+		case t.Value == "*":
+			return f.Name + " <= ?", []interface{}{to}, nil
+		case t.To == "*":
+			return f.Name + " >= ?", []interface{}{v}, nil
+		}
+		return f.Name + " BETWEEN ? AND ?", []interface{}{v, to}, nil
+	}
+	return "", nil, fmt.Errorf("unsupported op (%s) on field (%s).", t.Op, f.Name)
+}
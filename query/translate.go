@@ -0,0 +1,172 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	in "logauditer/internal"
+	"logauditer/search"
+)
+
+var timeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime 解析时间, 只有日期时 end 为当天结束(次日零点)
+func parseTime(s string, end bool) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if end && layout == "2006-01-02" {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time (%s).", s)
+}
+
+// bound 时间条件的区间 [from, to), 零值表示不限
+type bound struct {
+	from, to time.Time
+}
+
+func timeBound(t *Term) (*bound, error) {
+	b := &bound{}
+	var err error
+	switch t.Op {
+	case EQ:
+		if b.from, err = parseTime(t.Value, false); err != nil {
+			return nil, err
+		}
+		b.to, err = parseTime(t.Value, true)
+	case RANGE:
+		if t.Value != "*" {
+			if b.from, err = parseTime(t.Value, false); err != nil {
+				return nil, err
+			}
+		}
+		if t.To != "*" {
+			b.to, err = parseTime(t.To, true)
+		}
+	case GT:
+		b.from, err = parseTime(t.Value, true)
+	case GTE:
+		b.from, err = parseTime(t.Value, false)
+	case LT:
+		b.to, err = parseTime(t.Value, false)
+	case LTE:
+		b.to, err = parseTime(t.Value, true)
+	default:
+		return nil, fmt.Errorf("field (%s) not support %s.", TIME, t.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !b.from.IsZero() && !b.to.IsZero() && !b.from.Before(b.to) {
+		return nil, fmt.Errorf("empty time range (%s).", t)
+	}
+	return b, nil
+}
+
+// field 校验字段并转换取值
+func field(t *Term) (*search.Field, error) {
+	f, ok := search.LookupField(t.Field)
+	if !ok {
+		return nil, fmt.Errorf("unknown field (%s).", t.Field)
+	}
+	switch t.Op {
+	case WILDCARD, REGEX, TEXT:
+		if f.Numeric() {
+			return nil, fmt.Errorf("field (%s) not support %s.", f.Name, t.Op)
+		}
+	}
+	if t.Op == REGEX {
+		if _, err := regexp.Compile(t.Value); err != nil {
+			return nil, fmt.Errorf("field (%s) invalid regex: %s", f.Name, err)
+		}
+	}
+	return f, nil
+}
+
+func value(f *search.Field, v string) (interface{}, error) {
+	if !f.Numeric() || v == "*" {
+		return v, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("field (%s) expect number but (%s).", f.Name, v)
+	}
+	return n, nil
+}
+
+// glob 通配符转正则, * 任意字符, ? 单个字符.
+// IpAddr 由列表达式截取时带有括号, 匹配时忽略括号.
+func glob(f *search.Field, v string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	if f.Name == in.IpAddr {
+		b.WriteString(`\(?`)
+	}
+	for _, r := range v {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if f.Name == in.IpAddr {
+		b.WriteString(`\)?`)
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// TimeRange 顶层 AND 连接的 time 条件的交集, 用于确定检索的日期范围
+func TimeRange(n Node) (from, to time.Time, ok bool, err error) {
+	switch n := n.(type) {
+	case *And:
+		lf, lt, lok, err := TimeRange(n.Left)
+		if err != nil {
+			return from, to, false, err
+		}
+		rf, rt, rok, err := TimeRange(n.Right)
+		if err != nil {
+			return from, to, false, err
+		}
+		if !lok {
+			return rf, rt, rok, nil
+		}
+		if !rok {
+			return lf, lt, lok, nil
+		}
+		from, to = lf, lt
+		if rf.After(from) {
+			from = rf
+		}
+		if to.IsZero() || (!rt.IsZero() && rt.Before(to)) {
+			to = rt
+		}
+		return from, to, true, nil
+	case *Term:
+		if n.Field != TIME {
+			return
+		}
+		b, err := timeBound(n)
+		if err != nil {
+			return from, to, false, err
+		}
+		return b.from, b.to, true, nil
+	}
+	return
+}
@@ -0,0 +1,250 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
+
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+)
+
+// 可脱敏字段
+var fields = map[string]func(*in.AuditLog) *string{
+	in.Operation: func(al *in.AuditLog) *string { return &al.Operation },
+	in.UserName:  func(al *in.AuditLog) *string { return &al.UserName },
+	in.IpAddr:    func(al *in.AuditLog) *string { return &al.IpAddr },
+	in.State:     func(al *in.AuditLog) *string { return &al.State },
+}
+
+// Rule 脱敏规则, Pattern 命中的内容替换为 Replace(支持 $1 引用分组)
+type Rule struct {
+	Name    string `bson:"name" json:"name"`
+	Pattern string `bson:"pattern,omitempty" json:"pattern,omitempty"`
+	Replace string `bson:"replace,omitempty" json:"replace,omitempty"`
+	// 作用字段, 为空时仅处理 Operation
+	Fields []string `bson:"fields,omitempty" json:"fields,omitempty"`
+
+	re *regexp.Regexp
+	// 内置检测器对命中内容的进一步校验, loc 为命中位置
+	valid func(s string, loc []int) bool
+}
+
+// Detectors 内置检测器, 规则只写 name 时引用
+var Detectors = map[string]*Rule{
+	// mysql -uroot -pSecret / --password=xx / sshpass -p xx
+	"password": {
+		Pattern: `(?i)((?:^|\s)(?:-p|--password[=\s]|--passwd[=\s]|-password[=\s]|sshpass\s+-p\s*|PASSWORD=|passwd=|pwd=))(?:'[^']*'|"[^"]*"|\S+)`,
+		Replace: `${1}******`,
+	},
+	// Authorization: Bearer xx / token=xx / access_key / api-key
+	"token": {
+		Pattern: `(?i)((?:authorization:\s*(?:bearer|basic|token)?\s*|(?:access_?token|api[_-]?key|secret[_-]?key|access[_-]?key|token)\s*[=:]\s*))['"]?[A-Za-z0-9._~+/=-]{6,}`,
+		Replace: `${1}******`,
+	},
+	"privatekey": {
+		Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z ]*PRIVATE KEY-----|$)`,
+		Replace: `-----PRIVATE KEY REDACTED-----`,
+	},
+	// 18位身份证号: 地区码、出生日期与校验码都有效
+	"idcard": {
+		Pattern: `\b([1-8]\d{5})(?:18|19|20)\d{2}(?:0[1-9]|1[0-2])(?:0[1-9]|[12]\d|3[01])(\d{3}[\dXx])\b`,
+		Replace: `${1}********${2}`,
+		valid: func(s string, loc []int) bool {
+			return standalone(s, loc) && idChecksum(s[loc[0]:loc[1]])
+		},
+	},
+	// 11位手机号, 只匹配已分配的号段
+	"phone": {
+		Pattern: `\b(1(?:3\d|4[5-9]|5[0-35-9]|6[2567]|7[0-8]|8\d|9[0-35-9]))\d{4}(\d{4})\b`,
+		Replace: `${1}****${2}`,
+		valid:   standalone,
+	},
+}
+
+// standalone 命中的数字不是小数、版本号、IP 或以 - 连接的编号的一部分
+func standalone(s string, loc []int) bool {
+	digit := func(i int) bool { return i >= 0 && i < len(s) && s[i] >= '0' && s[i] <= '9' }
+	if i := loc[0] - 1; i >= 0 && (s[i] == '.' || s[i] == '-' || s[i] == '/') && digit(i-1) {
+		return false
+	}
+	if i := loc[1]; i < len(s) && (s[i] == '.' || s[i] == '-' || s[i] == '/') && digit(i+1) {
+		return false
+	}
+	return true
+}
+
+var idWeights = []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+
+// idChecksum GB 11643 校验码
+func idChecksum(id string) bool {
+	sum := 0
+	for i, w := range idWeights {
+		sum += int(id[i]-'0') * w
+	}
+	check := "10X98765432"[sum%11]
+	last := id[17]
+	if last == 'x' {
+		last = 'X'
+	}
+	return last == check
+}
+
+// DefaultRules 全局默认脱敏规则
+func DefaultRules() []*Rule {
+	return []*Rule{{Name: "password"}, {Name: "token"}, {Name: "privatekey"}, {Name: "idcard"}, {Name: "phone"}}
+}
+
+// Compile 预编译规则, 未指定表达式的规则从内置检测器补全
+func (r *Rule) Compile() error {
+	if r.Pattern == "" {
+		d, ok := Detectors[r.Name]
+		if !ok {
+			return fmt.Errorf("redact rule (%s) without pattern and not a built-in detector.", r.Name)
+		}
+		r.Pattern = d.Pattern
+		if r.Replace == "" {
+			r.Replace = d.Replace
+		}
+		r.valid = d.valid
+	}
+	if r.Replace == "" {
+		r.Replace = "******"
+	}
+	for _, f := range r.Fields {
+		if _, ok := fields[f]; !ok {
+			return fmt.Errorf("redact rule (%s) unsupported field (%s).", r.Name, f)
+		}
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("redact rule (%s) compile pattern error: %s", r.Name, err)
+	}
+	r.re = re
+	return nil
+}
+
+// apply 对记录执行脱敏, 被修改的字段记录到 masked
+func (r *Rule) apply(al *in.AuditLog, masked map[string]struct{}) {
+	fs := r.Fields
+	if len(fs) == 0 {
+		fs = []string{in.Operation}
+	}
+	for _, f := range fs {
+		p := fields[f](al)
+		if s, ok := r.replace(*p); ok {
+			*p = s
+			masked[f] = struct{}{}
+		}
+	}
+}
+
+// replace 替换通过校验的命中内容, 没有替换时返回 false
+func (r *Rule) replace(s string) (string, bool) {
+	if r.valid == nil {
+		if !r.re.MatchString(s) {
+			return s, false
+		}
+		return r.re.ReplaceAllString(s, r.Replace), true
+	}
+	var b []byte
+	last := 0
+	for _, loc := range r.re.FindAllStringSubmatchIndex(s, -1) {
+		if !r.valid(s, loc) {
+			continue
+		}
+		b = append(b, s[last:loc[0]]...)
+		b = r.re.ExpandString(b, r.Replace, s, loc)
+		last = loc[1]
+	}
+	if b == nil {
+		return s, false
+	}
+	return string(b) + s[last:], true
+}
+
+// FromOptions 转换采集规则中定义的脱敏规则并校验
+func FromOptions(ro *in.RuntimeOptions) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(ro.Redact))
+	for _, r := range ro.Redact {
+		rule := &Rule{Name: r.Name, Pattern: r.Pattern, Replace: r.Replace, Fields: r.Fields}
+		if err := rule.Compile(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Redactor 在入库前对记录脱敏, 实现 logmining.Filter
+type Redactor struct {
+	global []*Rule
+	// 采集规则的脱敏规则编译缓存, 以规则内容为键
+	cache sync.Map
+}
+
+// Load 从json文件加载全局规则, 文件为空时使用内置检测器
+func Load(fn string) (*Redactor, error) {
+	rules := DefaultRules()
+	if fn != "" {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		rules = nil
+		if err := json.Unmarshal(b, &rules); err != nil {
+			return nil, fmt.Errorf("redact rules (%s) unmarshal err: %s", fn, err)
+		}
+	}
+	for _, r := range rules {
+		if err := r.Compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &Redactor{global: rules}, nil
+}
+
+// Filter 先执行全局规则, 再执行采集规则中定义的脱敏规则
+func (rd *Redactor) Filter(e *ll.Entry) error {
+	masked := make(map[string]struct{})
+	for _, r := range rd.global {
+		r.apply(e.Log, masked)
+	}
+	if e.Options != nil && len(e.Options.Redact) > 0 {
+		rules, err := rd.compiled(e.Options)
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			r.apply(e.Log, masked)
+		}
+	}
+	if len(masked) == 0 {
+		return nil
+	}
+	e.Log.Masked = make([]string, 0, len(masked))
+	for f := range masked {
+		e.Log.Masked = append(e.Log.Masked, f)
+	}
+	sort.Strings(e.Log.Masked)
+	return nil
+}
+
+func (rd *Redactor) compiled(ro *in.RuntimeOptions) ([]*Rule, error) {
+	key, err := json.Marshal(ro.Redact)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := rd.cache.Load(string(key)); ok {
+		return v.([]*Rule), nil
+	}
+	rules, err := FromOptions(ro)
+	if err != nil {
+		return nil, err
+	}
+	rd.cache.Store(string(key), rules)
+	return rules, nil
+}
@@ -0,0 +1,129 @@
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func at(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseSchedule(t *testing.T) {
+	cases := []struct {
+		spec string
+		// 满足与不满足的时间
+		match, miss []string
+	}{
+		{"@hourly", []string{"2019-02-25 10:00", "2019-02-25 11:00"}, []string{"2019-02-25 10:01"}},
+		{"@daily", []string{"2019-02-25 00:00"}, []string{"2019-02-25 08:00"}},
+		// 2019-02-24 周日
+		{"@weekly", []string{"2019-02-24 00:00"}, []string{"2019-02-25 00:00"}},
+		{"@monthly", []string{"2019-03-01 00:00"}, []string{"2019-02-25 00:00"}},
+		{" 0 8 * * * ", []string{"2019-02-25 08:00"}, []string{"2019-02-25 09:00"}},
+		{"*/15 * * * *", []string{"2019-02-25 10:00", "2019-02-25 10:45"}, []string{"2019-02-25 10:10"}},
+		{"5/20 * * * *", []string{"2019-02-25 10:05", "2019-02-25 10:25", "2019-02-25 10:45"}, []string{"2019-02-25 10:00", "2019-02-25 10:50"}},
+		{"0 9-17/4 * * *", []string{"2019-02-25 09:00", "2019-02-25 13:00", "2019-02-25 17:00"}, []string{"2019-02-25 10:00", "2019-02-25 21:00"}},
+		{"0 8,20 * * *", []string{"2019-02-25 08:00", "2019-02-25 20:00"}, []string{"2019-02-25 12:00"}},
+		{"0 0 * 1-3 *", []string{"2019-03-31 00:00"}, []string{"2019-04-01 00:00"}},
+		// 周日可以写作 0 或 7
+		{"0 0 * * 7", []string{"2019-02-24 00:00"}, []string{"2019-02-23 00:00"}},
+		{"0 0 * * 5-7", []string{"2019-02-22 00:00", "2019-02-23 00:00", "2019-02-24 00:00"}, []string{"2019-02-25 00:00"}},
+		{"0 0 * * 1-5", []string{"2019-02-25 00:00"}, []string{"2019-02-24 00:00"}},
+		// 日与周都限定时满足其一
+		{"0 0 1 * 1", []string{"2019-03-01 00:00", "2019-02-25 00:00"}, []string{"2019-02-26 00:00"}},
+		// 只限定其一时只看该字段
+		{"0 0 1 * *", []string{"2019-03-01 00:00"}, []string{"2019-02-25 00:00"}},
+		{"0 0 * * 1", []string{"2019-02-25 00:00"}, []string{"2019-03-01 00:00"}},
+		// 以 * 开头的步长与另一字段同时满足
+		{"0 0 */2 * 1", []string{"2019-03-11 00:00", "2019-02-25 00:00"}, []string{"2019-03-04 00:00", "2019-03-01 00:00"}},
+		// */7 即周日, 2019-01-13 为周日
+		{"0 0 13 * */7", []string{"2019-01-13 00:00"}, []string{"2019-02-13 00:00", "2019-02-10 00:00"}},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%s): %s", c.spec, err)
+			continue
+		}
+		for _, m := range c.match {
+			if !s.Match(at(m)) {
+				t.Errorf("%s should match %s", c.spec, m)
+			}
+		}
+		for _, m := range c.miss {
+			if s.Match(at(m)) {
+				t.Errorf("%s should not match %s", c.spec, m)
+			}
+		}
+	}
+}
+
+func TestParseScheduleError(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"@yearly",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) expect error", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	cases := []struct {
+		spec, from, next string
+	}{
+		{"0 8 * * *", "2019-02-25 07:59", "2019-02-25 08:00"},
+		// 当前分钟不计入
+		{"0 8 * * *", "2019-02-25 08:00", "2019-02-26 08:00"},
+		{"*/15 * * * *", "2019-02-25 10:14", "2019-02-25 10:15"},
+		// 跨月与跨年
+		{"0 0 1 * *", "2019-02-25 10:00", "2019-03-01 00:00"},
+		{"30 23 31 * *", "2019-02-01 00:00", "2019-03-31 23:30"},
+		{"0 0 1 1 *", "2019-02-25 10:00", "2020-01-01 00:00"},
+		{"0 0 * 12 *", "2019-02-25 10:00", "2019-12-01 00:00"},
+		{"0 0 * 3 *", "2019-12-31 23:59", "2020-03-01 00:00"},
+		{"@weekly", "2019-02-25 10:00", "2019-03-03 00:00"},
+		// 2020-02-29 在一年内
+		{"0 0 29 2 *", "2019-03-01 00:00", "2020-02-29 00:00"},
+		// 一年内没有时返回零值
+		{"0 0 29 2 *", "2021-03-01 00:00", ""},
+		{"0 0 31 4 *", "2019-02-25 10:00", ""},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := s.Next(at(c.from))
+		if c.next == "" {
+			if !got.IsZero() {
+				t.Errorf("Next(%s, %s) = %s, want zero", c.spec, c.from, got)
+			}
+			continue
+		}
+		if !got.Equal(at(c.next)) {
+			t.Errorf("Next(%s, %s) = %s, want %s", c.spec, c.from, got, c.next)
+		}
+	}
+}
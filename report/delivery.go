@@ -0,0 +1,247 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"logauditer/notify"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 投递方式
+const (
+	DIR  = "dir"
+	SMTP = "smtp"
+	EXEC = "exec"
+)
+
+// Deliverer 报表投递, files 为报表目录下的文件绝对路径
+type Deliverer interface {
+	Deliver(s *Summary, files []string) error
+}
+
+// Delivery 投递配置
+type Delivery struct {
+	Type string `bson:"type" json:"type"`
+
+	// dir, 复制到该目录下的 {报表名}/{运行时间}
+	Dir string `bson:"dir,omitempty" json:"dir,omitempty"`
+
+	// smtp, 摘要为正文, 明细为附件
+	Addr     string   `bson:"addr,omitempty" json:"addr,omitempty"`
+	Username string   `bson:"username,omitempty" json:"username,omitempty"`
+	Password string   `bson:"password,omitempty" json:"password,omitempty"`
+	From     string   `bson:"from,omitempty" json:"from,omitempty"`
+	To       []string `bson:"to,omitempty" json:"to,omitempty"`
+	Subject  string   `bson:"subject,omitempty" json:"subject,omitempty"`
+
+	// exec, 摘要以json格式写入标准输入, 文件路径追加在参数之后
+	Command string   `bson:"command,omitempty" json:"command,omitempty"`
+	Args    []string `bson:"args,omitempty" json:"args,omitempty"`
+
+	Timeout string `bson:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// NewDeliverer 按配置创建投递方式
+func NewDeliverer(d *Delivery) (Deliverer, error) {
+	timeout := time.Minute
+	if d.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(d.Timeout); err != nil {
+			return nil, fmt.Errorf("delivery invalid timeout (%s).", d.Timeout)
+		}
+	}
+	switch d.Type {
+	case DIR:
+		if d.Dir == "" {
+			return nil, fmt.Errorf("delivery dir is empty.")
+		}
+		return &dirDelivery{dir: d.Dir}, nil
+	case SMTP:
+		if d.Addr == "" || d.From == "" || len(d.To) == 0 {
+			return nil, fmt.Errorf("delivery smtp addr/from/to is required.")
+		}
+		host, _, err := net.SplitHostPort(d.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("delivery invalid smtp addr (%s).", d.Addr)
+		}
+		m := &mailDelivery{Delivery: d, timeout: timeout}
+		if d.Username != "" {
+			m.auth = smtp.PlainAuth("", d.Username, d.Password, host)
+		}
+		return m, nil
+	case EXEC:
+		if d.Command == "" {
+			return nil, fmt.Errorf("delivery command is empty.")
+		}
+		return &execDelivery{path: d.Command, args: d.Args, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("unsupported delivery type (%s).", d.Type)
+}
+
+type dirDelivery struct {
+	dir string
+}
+
+func (d *dirDelivery) Deliver(s *Summary, files []string) error {
+	dir := filepath.Join(d.dir, s.Name, s.Run)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := copyFile(f, filepath.Join(dir, filepath.Base(f))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type mailDelivery struct {
+	*Delivery
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+func (m *mailDelivery) Deliver(s *Summary, files []string) error {
+	body, err := s.Text()
+	if err != nil {
+		return err
+	}
+	subject := m.Subject
+	if subject == "" {
+		subject = fmt.Sprintf("[logauditer] report %s %s ~ %s", s.Name, s.From, s.To)
+	}
+
+	msg := new(bytes.Buffer)
+	mw := multipart.NewWriter(msg)
+	fmt.Fprintf(msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1))
+
+	for _, f := range files {
+		name := filepath.Base(f)
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.TypeByExtension(filepath.Ext(name))},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		})
+		if err != nil {
+			return err
+		}
+		if err := attach(part, f); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return notify.SendMail(m.Addr, m.auth, m.From, m.To, msg.Bytes(), m.timeout)
+}
+
+// attach 以76字符换行的base64写入附件
+func attach(w io.Writer, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lw := &lineWriter{w: w}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	if _, err := io.Copy(enc, f); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\r\n")
+	return err
+}
+
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if l.col == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return n, err
+			}
+			l.col = 0
+		}
+		k := 76 - l.col
+		if k > len(p) {
+			k = len(p)
+		}
+		m, err := l.w.Write(p[:k])
+		n, l.col, p = n+m, l.col+m, p[k:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+type execDelivery struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+func (e *execDelivery) Deliver(s *Summary, files []string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.path, append(append([]string{}, e.args...), files...)...)
+	cmd.Stdin = bytes.NewReader(b)
+	out := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("exec (%s) error: %s output: %s", e.path, err, out.String())
+	}
+	return nil
+}
@@ -0,0 +1,624 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"logauditer/dbapi"
+	"logauditer/export"
+	"logauditer/query"
+	"logauditer/search"
+	"logauditer/stats"
+
+	"github.com/globalsign/mgo/bson"
+	log "github.com/laik/logger"
+)
+
+const (
+	// 报表定义与规则存放在同一个库
+	REPORT_DATABASE = "audit_rule"
+	REPORT          = "report"
+
+	SUMMARY_JSON = "summary.json"
+	SUMMARY_TEXT = "summary.txt"
+
+	runLayout  = "20060102_150405"
+	dateLayout = "2006-01-02"
+)
+
+// DefaultFailedLogin 登录失败的默认匹配语句
+const DefaultFailedLogin = `op:~"(?i)(failed password|authentication failure|login failed|invalid user)"`
+
+// SavedQuery 保存的查询, 每个查询生成一份明细附件
+type SavedQuery struct {
+	Name  string `bson:"name" json:"name"`
+	Query string `bson:"query" json:"query"`
+}
+
+// Definition 报表定义
+type Definition struct {
+	Name string `bson:"_id" json:"name"`
+	// cron 表达式, 例如 "0 8 * * *" 每天8点, "0 8 * * 1" 每周一8点
+	Schedule string `bson:"schedule" json:"schedule"`
+	// 覆盖运行日之前的天数, 默认1即前一天
+	Days int `bson:"days,omitempty" json:"days,omitempty"`
+	// 摘要的过滤条件(查询语言), 为空时为全部记录
+	Query string `bson:"query,omitempty" json:"query,omitempty"`
+	// 明细查询, 为空时按 Query 导出一份 records
+	Queries []*SavedQuery `bson:"queries,omitempty" json:"queries,omitempty"`
+	// 明细格式 xlsx/csv, 默认 xlsx
+	Formats []string `bson:"formats,omitempty" json:"formats,omitempty"`
+	Columns string   `bson:"columns,omitempty" json:"columns,omitempty"`
+	Lang    string   `bson:"lang,omitempty" json:"lang,omitempty"`
+	// 排行条数, 默认10
+	Top int `bson:"top,omitempty" json:"top,omitempty"`
+	// 高风险操作的最低分值, 默认50
+	MinRisk int `bson:"minRisk,omitempty" json:"minRisk,omitempty"`
+	// 登录失败的匹配语句, 默认 DefaultFailedLogin
+	FailedLogin string `bson:"failedLogin,omitempty" json:"failedLogin,omitempty"`
+	// 投递方式, 报表总是保存在报表目录下
+	Delivery []*Delivery `bson:"delivery,omitempty" json:"delivery,omitempty"`
+	// 保留最近的份数, 0 不清理
+	Keep     int  `bson:"keep,omitempty" json:"keep,omitempty"`
+	Disabled bool `bson:"disabled,omitempty" json:"disabled,omitempty"`
+
+	schedule   *Schedule
+	deliverers []Deliverer
+}
+
+// ParseDefinition 解析并校验报表定义
+func ParseDefinition(name string, data []byte) (*Definition, error) {
+	d := &Definition{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("report unmarshal err: %s", err)
+	}
+	d.Name = name
+	return d, d.Compile()
+}
+
+// Compile 校验并补全默认值
+func (d *Definition) Compile() error {
+	if d.Name == "" || strings.ContainsAny(d.Name, `/\`) || strings.HasPrefix(d.Name, ".") {
+		return fmt.Errorf("invalid report name (%s).", d.Name)
+	}
+	s, err := ParseSchedule(d.Schedule)
+	if err != nil {
+		return err
+	}
+	d.schedule = s
+	if d.Days <= 0 {
+		d.Days = 1
+	}
+	if d.Days > search.MaxDays {
+		return fmt.Errorf("report (%s) days (%d) exceeds %d.", d.Name, d.Days, search.MaxDays)
+	}
+	if d.Top <= 0 {
+		d.Top = stats.DefaultTop
+	}
+	if d.MinRisk <= 0 {
+		d.MinRisk = 50
+	}
+	if d.FailedLogin == "" {
+		d.FailedLogin = DefaultFailedLogin
+	}
+	if len(d.Formats) == 0 {
+		d.Formats = []string{export.XLSX}
+	}
+	for _, f := range d.Formats {
+		if f != export.XLSX && f != export.CSV && f != export.JSONL {
+			return fmt.Errorf("report (%s) unsupported format (%s).", d.Name, f)
+		}
+	}
+	if _, err := export.Columns(d.Columns, d.Lang); err != nil {
+		return err
+	}
+	for _, q := range append([]string{d.Query, d.FailedLogin}, d.queries()...) {
+		if q == "" {
+			continue
+		}
+		if _, err := query.Parse(q); err != nil {
+			return fmt.Errorf("report (%s) query (%s): %s", d.Name, q, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, q := range d.Queries {
+		if q.Name == "" || strings.ContainsAny(q.Name, `/\`) || strings.HasPrefix(q.Name, ".") || names[q.Name] {
+			return fmt.Errorf("report (%s) invalid or duplicate query name (%s).", d.Name, q.Name)
+		}
+		names[q.Name] = true
+	}
+	d.deliverers = d.deliverers[:0]
+	for _, dl := range d.Delivery {
+		dd, err := NewDeliverer(dl)
+		if err != nil {
+			return fmt.Errorf("report (%s) %s", d.Name, err)
+		}
+		d.deliverers = append(d.deliverers, dd)
+	}
+	return nil
+}
+
+func (d *Definition) queries() []string {
+	var r []string
+	for _, q := range d.Queries {
+		r = append(r, q.Query)
+	}
+	return r
+}
+
+// Next 下次运行时间
+func (d *Definition) Next(t time.Time) time.Time {
+	return d.schedule.Next(t)
+}
+
+// QueryResult 明细查询结果
+type QueryResult struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query,omitempty"`
+	Rows  int      `json:"rows"`
+	Files []string `json:"files"`
+}
+
+// Summary 报表摘要
+type Summary struct {
+	Name        string    `json:"name"`
+	Run         string    `json:"run"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Query       string    `json:"query,omitempty"`
+	GeneratedAt time.Time `json:"generatedAt"`
+
+	Total        int               `json:"total"`
+	TopUsers     []stats.Bucket    `json:"topUsers"`
+	TopIps       []stats.Bucket    `json:"topIps"`
+	TopHosts     []stats.Bucket    `json:"topHosts"`
+	States       *stats.StateRatio `json:"states"`
+	FailedLogins int               `json:"failedLogins"`
+	Risky        []search.Record   `json:"risky"`
+	Queries      []*QueryResult    `json:"queries"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+var summaryTmpl = template.Must(template.New("summary").Parse(`报表 {{.Name}} ({{.From}} ~ {{.To}}) 生成于 {{.GeneratedAt.Format "2006-01-02 15:04:05"}}
+{{if .Query}}过滤条件: {{.Query}}
+{{end}}
+记录总数: {{.Total}}
+失败操作: {{.States.Failed}} ({{printf "%.2f" .Percent}}%)
+登录失败: {{.FailedLogins}}
+
+用户 Top:
+{{range .TopUsers}}  {{.Key}}	{{.Count}}
+{{end}}
+来源IP Top:
+{{range .TopIps}}  {{.Key}}	{{.Count}}
+{{end}}
+主机 Top:
+{{range .TopHosts}}  {{.Key}}	{{.Count}}
+{{end}}
+高风险操作:
+{{range .Risky}}  [{{.RiskScore}}] {{.Host}} {{.UserName}} {{.IpAddr}} {{.Operation}}
+{{end}}
+明细:
+{{range .Queries}}  {{.Name}}: {{.Rows}} 行 {{range .Files}}{{.}} {{end}}
+{{end}}{{range .Errors}}错误: {{.}}
+{{end}}`))
+
+// Percent 失败率百分比
+func (s *Summary) Percent() float64 {
+	if s.States == nil {
+		return 0
+	}
+	return s.States.Ratio * 100
+}
+
+// Text 摘要文本, 也用作邮件正文
+func (s *Summary) Text() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := summaryTmpl.Execute(buf, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// File 报表文件
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Run 一次报表运行的结果
+type Run struct {
+	Name  string    `json:"name"`
+	Run   string    `json:"run"`
+	Time  time.Time `json:"time"`
+	Files []File    `json:"files"`
+}
+
+// Manager 管理报表定义, 按计划运行并保存到报表目录 {dir}/{报表名}/{运行时间}/
+type Manager struct {
+	mu      sync.RWMutex
+	defs    map[string]*Definition
+	running map[string]bool
+
+	dir         string
+	sp          *dbapi.StorageParts
+	persistType dbapi.DBType
+	maxRows     int
+}
+
+func NewManager(sp *dbapi.StorageParts, persistType dbapi.DBType, dir string, maxRows int) *Manager {
+	return &Manager{
+		defs:        make(map[string]*Definition),
+		running:     make(map[string]bool),
+		dir:         dir,
+		sp:          sp,
+		persistType: persistType,
+		maxRows:     maxRows,
+	}
+}
+
+// Load 从持久化存储加载报表定义
+func (m *Manager) Load() error {
+	var _err error
+	var _list []*Definition
+	dbapi.AccessDatabase(m.sp, REPORT_DATABASE, REPORT, nil, &_list, dbapi.KEYS, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range _list {
+		if err := d.Compile(); err != nil {
+			log.Error("load report error: %s\n", err)
+			continue
+		}
+		m.defs[d.Name] = d
+	}
+	return nil
+}
+
+// Set 新增或更新报表定义并持久化
+func (m *Manager) Set(d *Definition) error {
+	if err := d.Compile(); err != nil {
+		return err
+	}
+	var _err error
+	dbapi.AccessDatabase(m.sp, REPORT_DATABASE, REPORT, bson.M{"_id": d.Name}, d, dbapi.SET, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defs[d.Name] = d
+	return nil
+}
+
+// Del 删除报表定义, 已生成的报表保留
+func (m *Manager) Del(name string) error {
+	if _, ok := m.Get(name); !ok {
+		return fmt.Errorf("report (%s) not found.", name)
+	}
+	var _err error
+	dbapi.AccessDatabase(m.sp, REPORT_DATABASE, REPORT, bson.M{"_id": name}, nil, dbapi.DEL, m.persistType, &_err)
+	if _err != nil {
+		return _err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.defs, name)
+	return nil
+}
+
+// Get 获取报表定义
+func (m *Manager) Get(name string) (*Definition, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.defs[name]
+	return d, ok
+}
+
+// List 报表定义名称列表
+func (m *Manager) List() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := make([]string, 0, len(m.defs))
+	for name := range m.defs {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Start 每分钟检查一次计划, 到期的报表在后台运行
+func (m *Manager) Start() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		now = time.Now().Truncate(time.Minute)
+		m.mu.RLock()
+		for _, d := range m.defs {
+			if !d.Disabled && d.schedule.Match(now) {
+				go m.run(d, now)
+			}
+		}
+		m.mu.RUnlock()
+	}
+}
+
+// RunNow 立即运行报表, 同步返回摘要
+func (m *Manager) RunNow(name string) (*Summary, error) {
+	d, ok := m.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("report (%s) not found.", name)
+	}
+	return m.run(d, time.Now())
+}
+
+func (m *Manager) run(d *Definition, now time.Time) (*Summary, error) {
+	m.mu.Lock()
+	if m.running[d.Name] {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("report (%s) is running.", d.Name)
+	}
+	m.running[d.Name] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, d.Name)
+		m.mu.Unlock()
+	}()
+
+	log.Info("report (%s) start.\n", d.Name)
+	s, err := m.generate(d, now)
+	if err != nil {
+		log.Error("report (%s) error: %s\n", d.Name, err)
+		return nil, err
+	}
+	log.Info("report (%s) run (%s) done, total (%d).\n", d.Name, s.Run, s.Total)
+	if d.Keep > 0 {
+		m.prune(d.Name, d.Keep)
+	}
+	return s, nil
+}
+
+// and 用 AND 连接两个查询语句
+func and(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return "(" + a + ") AND (" + b + ")"
+}
+
+func (m *Manager) request(s *Summary, ql string) (*search.Request, error) {
+	r := &search.Request{From: s.From, To: s.To}
+	if ql != "" {
+		if err := query.Apply(r, ql); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (m *Manager) generate(d *Definition, now time.Time) (*Summary, error) {
+	s := &Summary{
+		Name:        d.Name,
+		Run:         now.Format(runLayout),
+		From:        now.AddDate(0, 0, -d.Days).Format(dateLayout),
+		To:          now.AddDate(0, 0, -1).Format(dateLayout),
+		Query:       d.Query,
+		GeneratedAt: now,
+	}
+	dir := filepath.Join(m.dir, d.Name, s.Run)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	searcher := &search.Service{SP: m.sp, PersistType: m.persistType}
+	statser := &stats.Service{SP: m.sp, PersistType: m.persistType}
+	exporter := &export.Service{SP: m.sp, PersistType: m.persistType, MaxRows: m.maxRows}
+
+	base, err := m.request(s, d.Query)
+	if err != nil {
+		return nil, err
+	}
+	res, err := searcher.Find(&search.Request{From: base.From, To: base.To, Query: base.Query, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	s.Total = res.Total
+	if s.TopUsers, err = statser.Top(base, "UserName", d.Top); err != nil {
+		return nil, err
+	}
+	if s.TopIps, err = statser.Top(base, "IpAddr", d.Top); err != nil {
+		return nil, err
+	}
+	if s.TopHosts, err = statser.Top(base, "Host", d.Top); err != nil {
+		return nil, err
+	}
+	if s.States, err = statser.States(base); err != nil {
+		return nil, err
+	}
+
+	failed, err := m.request(s, and(d.Query, d.FailedLogin))
+	if err != nil {
+		return nil, err
+	}
+	failed.Limit = 1
+	if res, err = searcher.Find(failed); err != nil {
+		return nil, err
+	}
+	s.FailedLogins = res.Total
+
+	risky, err := m.request(s, and(d.Query, fmt.Sprintf("risk:>=%d", d.MinRisk)))
+	if err != nil {
+		return nil, err
+	}
+	risky.Sort, risky.Desc, risky.Limit = "RiskScore", true, d.Top
+	if res, err = searcher.Find(risky); err != nil {
+		return nil, err
+	}
+	s.Risky = res.Records
+
+	queries := d.Queries
+	if len(queries) == 0 {
+		queries = []*SavedQuery{{Name: "records", Query: d.Query}}
+	}
+	cols, err := export.Columns(d.Columns, d.Lang)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, q := range queries {
+		qr := &QueryResult{Name: q.Name, Query: q.Query, Files: make([]string, 0)}
+		s.Queries = append(s.Queries, qr)
+		r, err := m.request(s, q.Query)
+		if err != nil {
+			return nil, err
+		}
+		for _, format := range d.Formats {
+			fn := q.Name + "." + format
+			n, err := m.export(exporter, r, cols, format, d.Lang, filepath.Join(dir, fn))
+			if err != nil {
+				s.Errors = append(s.Errors, fmt.Sprintf("export (%s) error: %s", fn, err))
+				continue
+			}
+			qr.Rows = n
+			qr.Files = append(qr.Files, fn)
+			files = append(files, filepath.Join(dir, fn))
+		}
+	}
+
+	text, err := s.Text()
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, SUMMARY_TEXT), text, 0644); err != nil {
+		return nil, err
+	}
+	for _, dd := range d.deliverers {
+		if err := dd.Deliver(s, append([]string{filepath.Join(dir, SUMMARY_TEXT)}, files...)); err != nil {
+			log.Error("report (%s) delivery error: %s\n", d.Name, err)
+			s.Errors = append(s.Errors, fmt.Sprintf("delivery error: %s", err))
+		}
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return s, ioutil.WriteFile(filepath.Join(dir, SUMMARY_JSON), b, 0644)
+}
+
+func (m *Manager) export(srv *export.Service, r *search.Request, cols []export.Column, format, lang, fn string) (int, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w, err := export.NewWriter(format, f, cols, lang == "zh")
+	if err != nil {
+		return 0, err
+	}
+	n, err := srv.Export(w, r, cols)
+	if err != nil {
+		return n, err
+	}
+	if err := w.Close(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// Runs 已生成的报表, name 为空时列出全部, 按运行时间倒序
+func (m *Manager) Runs(name string) ([]Run, error) {
+	names := []string{name}
+	if name == "" {
+		fis, err := ioutil.ReadDir(m.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		names = names[:0]
+		for _, fi := range fis {
+			if fi.IsDir() {
+				names = append(names, fi.Name())
+			}
+		}
+	} else if !valid(name) {
+		return nil, fmt.Errorf("invalid report name (%s).", name)
+	}
+
+	runs := make([]Run, 0)
+	for _, n := range names {
+		fis, err := ioutil.ReadDir(filepath.Join(m.dir, n))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range fis {
+			t, err := time.ParseInLocation(runLayout, fi.Name(), time.Local)
+			if !fi.IsDir() || err != nil {
+				continue
+			}
+			run := Run{Name: n, Run: fi.Name(), Time: t, Files: make([]File, 0)}
+			files, _ := ioutil.ReadDir(filepath.Join(m.dir, n, fi.Name()))
+			for _, f := range files {
+				if !f.IsDir() {
+					run.Files = append(run.Files, File{Name: f.Name(), Size: f.Size()})
+				}
+			}
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if !runs[i].Time.Equal(runs[j].Time) {
+			return runs[i].Time.After(runs[j].Time)
+		}
+		return runs[i].Name < runs[j].Name
+	})
+	return runs, nil
+}
+
+func valid(part string) bool {
+	return part != "" && part == filepath.Base(part) && !strings.HasPrefix(part, ".")
+}
+
+// Path 报表文件路径, 校验各段不能跳出报表目录
+func (m *Manager) Path(name, run, file string) (string, error) {
+	for _, p := range []string{name, run, file} {
+		if !valid(p) {
+			return "", fmt.Errorf("invalid report file (%s/%s/%s).", name, run, file)
+		}
+	}
+	fn := filepath.Join(m.dir, name, run, file)
+	if _, err := os.Stat(fn); err != nil {
+		return "", fmt.Errorf("report file (%s/%s/%s) not found.", name, run, file)
+	}
+	return fn, nil
+}
+
+func (m *Manager) prune(name string, keep int) {
+	runs, err := m.Runs(name)
+	if err != nil {
+		log.Error("report (%s) list runs error: %s\n", name, err)
+		return
+	}
+	for i := keep; i < len(runs); i++ {
+		if err := os.RemoveAll(filepath.Join(m.dir, name, runs[i].Run)); err != nil {
+			log.Error("report (%s) remove run (%s) error: %s\n", name, runs[i].Run, err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"logauditer/export"
+	in "logauditer/internal"
+	"logauditer/search"
+	"logauditer/stats"
+)
+
+func TestParseDefinition(t *testing.T) {
+	d, err := ParseDefinition("daily", []byte(`{"name":"other","schedule":"0 8 * * *"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "daily" || d.Days != 1 || d.Top != stats.DefaultTop || d.MinRisk != 50 ||
+		d.FailedLogin != DefaultFailedLogin || !reflect.DeepEqual(d.Formats, []string{export.XLSX}) {
+		t.Errorf("defaults %+v", d)
+	}
+	if next := d.Next(at("2019-02-25 09:00")); !next.Equal(at("2019-02-26 08:00")) {
+		t.Errorf("next %s", next)
+	}
+
+	d, err = ParseDefinition("weekly", []byte(`{"schedule":"@weekly","days":7,"top":5,"minRisk":80,
+		"formats":["csv","jsonl"],"queries":[{"name":"root","query":"user:root"}],
+		"delivery":[{"type":"dir","dir":"/tmp"},{"type":"exec","command":"true"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Days != 7 || d.Top != 5 || d.MinRisk != 80 || len(d.deliverers) != 2 {
+		t.Errorf("definition %+v", d)
+	}
+
+	for _, c := range []struct {
+		name, data string
+	}{
+		{"", `{"schedule":"@daily"}`},
+		{"a/b", `{"schedule":"@daily"}`},
+		{".hidden", `{"schedule":"@daily"}`},
+		{"x", `{`},
+		{"x", `{}`},
+		{"x", `{"schedule":"0 25 * * *"}`},
+		{"x", `{"schedule":"@daily","days":367}`},
+		{"x", `{"schedule":"@daily","formats":["pdf"]}`},
+		{"x", `{"schedule":"@daily","columns":"nope"}`},
+		{"x", `{"schedule":"@daily","query":"user:("}`},
+		{"x", `{"schedule":"@daily","failedLogin":"user:("}`},
+		{"x", `{"schedule":"@daily","queries":[{"name":"a","query":"user:root"},{"name":"a","query":"user:bin"}]}`},
+		{"x", `{"schedule":"@daily","queries":[{"name":"../a","query":"user:root"}]}`},
+		{"x", `{"schedule":"@daily","queries":[{"name":"","query":"user:root"}]}`},
+		{"x", `{"schedule":"@daily","delivery":[{"type":"ftp"}]}`},
+		{"x", `{"schedule":"@daily","delivery":[{"type":"dir"}]}`},
+		{"x", `{"schedule":"@daily","delivery":[{"type":"exec"}]}`},
+		{"x", `{"schedule":"@daily","delivery":[{"type":"smtp","addr":"localhost:25","from":"a@b"}]}`},
+		{"x", `{"schedule":"@daily","delivery":[{"type":"smtp","addr":"localhost","from":"a@b","to":["c@d"]}]}`},
+		{"x", `{"schedule":"@daily","delivery":[{"type":"exec","command":"true","timeout":"1x"}]}`},
+	} {
+		if _, err := ParseDefinition(c.name, []byte(c.data)); err == nil {
+			t.Errorf("ParseDefinition(%s, %s) expect error", c.name, c.data)
+		}
+	}
+}
+
+func TestAnd(t *testing.T) {
+	cases := [][3]string{
+		{"", "", ""},
+		{"a", "", "a"},
+		{"", "b", "b"},
+		{"a OR b", "c", "(a OR b) AND (c)"},
+	}
+	for _, c := range cases {
+		if r := and(c[0], c[1]); r != c[2] {
+			t.Errorf("and(%q, %q) = %q, want %q", c[0], c[1], r, c[2])
+		}
+	}
+}
+
+func summary() *Summary {
+	return &Summary{
+		Name:        "daily",
+		Run:         "20190226_080000",
+		From:        "2019-02-25",
+		To:          "2019-02-25",
+		Query:       "host:web1",
+		GeneratedAt: at("2019-02-26 08:00"),
+		Total:       200,
+		TopUsers:    []stats.Bucket{{Key: "root", Count: 120}, {Key: "bin", Count: 80}},
+		TopIps:      []stats.Bucket{{Key: "10.0.0.1", Count: 200}},
+		TopHosts:    []stats.Bucket{{Key: "web1", Count: 200}},
+		States:      &stats.StateRatio{Total: 200, Failed: 25, Ratio: 0.125},
+		Risky: []search.Record{{AuditLog: in.AuditLog{Host: "web1", UserName: "root", IpAddr: "10.0.0.1",
+			Operation: "rm -rf /data", RiskScore: 90}}},
+		FailedLogins: 3,
+		Queries:      []*QueryResult{{Name: "records", Rows: 200, Files: []string{"records.xlsx"}}},
+		Errors:       []string{"export (records.csv) error: disk full"},
+	}
+}
+
+func TestSummaryText(t *testing.T) {
+	s := summary()
+	if p := s.Percent(); p != 12.5 {
+		t.Errorf("percent %f", p)
+	}
+	if p := (&Summary{}).Percent(); p != 0 {
+		t.Errorf("percent without states %f", p)
+	}
+	b, err := s.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(b)
+	for _, want := range []string{
+		"报表 daily (2019-02-25 ~ 2019-02-25) 生成于 2019-02-26 08:00:00",
+		"过滤条件: host:web1",
+		"记录总数: 200",
+		"失败操作: 25 (12.50%)",
+		"登录失败: 3",
+		"  root\t120\n  bin\t80\n",
+		"  10.0.0.1\t200\n",
+		"  [90] web1 root 10.0.0.1 rm -rf /data",
+		"  records: 200 行 records.xlsx",
+		"错误: export (records.csv) error: disk full",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("summary text missing %q:\n%s", want, text)
+		}
+	}
+	s.Query = ""
+	if b, _ = s.Text(); strings.Contains(string(b), "过滤条件") {
+		t.Errorf("summary without query:\n%s", b)
+	}
+}
+
+// reportFiles 在临时目录下生成摘要与明细文件
+func reportFiles(t *testing.T) (string, []string) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var files []string
+	for name, data := range map[string]string{
+		SUMMARY_TEXT:  "summary",
+		"records.csv": strings.Repeat("host,user,op\n", 20),
+	} {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	return dir, files
+}
+
+func TestDirDelivery(t *testing.T) {
+	src, files := reportFiles(t)
+	dst := filepath.Join(src, "out")
+	d, err := NewDeliverer(&Delivery{Type: DIR, Dir: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(summary(), files); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		want, _ := ioutil.ReadFile(f)
+		got, err := ioutil.ReadFile(filepath.Join(dst, "daily", "20190226_080000", filepath.Base(f)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("copy of %s: %q %v", f, got, err)
+		}
+	}
+	if err := d.Deliver(summary(), []string{filepath.Join(src, "missing")}); err == nil {
+		t.Error("deliver missing file expect error")
+	}
+}
+
+func TestExecDelivery(t *testing.T) {
+	dir, files := reportFiles(t)
+	out := filepath.Join(dir, "out")
+	d, err := NewDeliverer(&Delivery{Type: EXEC, Command: "sh", Args: []string{"-c", `cat > "$0"; echo >> "$0"; echo "$@" >> "$0"`, out}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(summary(), files); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(b), "\n", 2)
+	var s Summary
+	if err := json.Unmarshal([]byte(lines[0]), &s); err != nil || s.Name != "daily" || s.Total != 200 {
+		t.Errorf("stdin %s %v", lines[0], err)
+	}
+	if args := strings.TrimSpace(lines[1]); args != strings.Join(files, " ") {
+		t.Errorf("args %s", args)
+	}
+
+	d, _ = NewDeliverer(&Delivery{Type: EXEC, Command: "sh", Args: []string{"-c", "echo boom; exit 3"}})
+	if err := d.Deliver(summary(), nil); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("exec failure %v", err)
+	}
+	d, _ = NewDeliverer(&Delivery{Type: EXEC, Command: "sleep", Args: []string{"5"}, Timeout: "100ms"})
+	start := time.Now()
+	if err := d.Deliver(summary(), nil); err == nil || time.Since(start) > 3*time.Second {
+		t.Errorf("exec timeout %v after %s", err, time.Since(start))
+	}
+}
+
+// fakeSMTP 只实现发送一封邮件所需命令的 SMTP 服务, 返回收到的邮件内容
+func fakeSMTP(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.SplitN(strings.TrimSpace(line), " ", 2)[0]) {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT":
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				var data []string
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data = append(data, strings.TrimPrefix(l, "."))
+				}
+				c <- strings.Join(data, "")
+				reply("250 ok")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown")
+			}
+		}
+	}()
+	return l.Addr().String(), c
+}
+
+func TestMailDelivery(t *testing.T) {
+	_, files := reportFiles(t)
+	addr, c := fakeSMTP(t)
+	d, err := NewDeliverer(&Delivery{Type: SMTP, Addr: addr, From: "audit@example.com", To: []string{"a@example.com"}, Timeout: "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(summary(), files); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(<-c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "[logauditer] report daily 2019-02-25 ~ 2019-02-25" {
+		t.Errorf("subject %s", subject)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	body, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(body); !strings.Contains(string(b), "记录总数: 200\r\n") {
+		t.Errorf("body %s", b)
+	}
+	for _, f := range files {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.FileName() != filepath.Base(f) {
+			t.Errorf("attachment name %s, want %s", p.FileName(), filepath.Base(f))
+		}
+		raw, _ := ioutil.ReadAll(p)
+		for _, line := range strings.Split(strings.TrimRight(string(raw), "\r\n"), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("attachment line too long (%d)", len(line))
+			}
+		}
+		got, err := base64.StdEncoding.DecodeString(strings.Replace(string(raw), "\r\n", "", -1))
+		want, _ := ioutil.ReadFile(f)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("attachment %s: %q %v", f, got, err)
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Error("unexpected extra part")
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	lw := &lineWriter{w: buf}
+	for _, n := range []int{10, 70, 100, 0, 4} {
+		if k, err := lw.Write(bytes.Repeat([]byte("a"), n)); k != n || err != nil {
+			t.Fatalf("write %d: %d %v", n, k, err)
+		}
+	}
+	want := strings.Repeat("a", 76) + "\r\n" + strings.Repeat("a", 76) + "\r\n" + strings.Repeat("a", 32)
+	if buf.String() != want {
+		t.Errorf("lineWriter output %q", buf.String())
+	}
+}
+
+func TestRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewManager(nil, 0, dir, 0)
+	if runs, err := m.Runs(""); err != nil || len(runs) != 0 {
+		t.Fatalf("empty runs %v %v", runs, err)
+	}
+
+	for _, p := range []string{
+		"daily/20190224_080000/summary.txt",
+		"daily/20190225_080000/summary.txt",
+		"daily/20190226_080000/summary.txt",
+		"daily/tmp/summary.txt",
+		"weekly/20190225_080000/records.csv",
+	} {
+		fn := filepath.Join(dir, p)
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := m.Runs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range runs {
+		got = append(got, r.Name+"/"+r.Run)
+	}
+	want := []string{"daily/20190226_080000", "daily/20190225_080000", "weekly/20190225_080000", "daily/20190224_080000"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runs %v, want %v", got, want)
+	}
+	if f := runs[2].Files; len(f) != 1 || f[0].Name != "records.csv" || f[0].Size != 4 {
+		t.Errorf("files %+v", f)
+	}
+	if runs, err := m.Runs("daily"); err != nil || len(runs) != 3 {
+		t.Errorf("daily runs %v %v", runs, err)
+	}
+	if runs, err := m.Runs("none"); err != nil || len(runs) != 0 {
+		t.Errorf("missing report runs %v %v", runs, err)
+	}
+	if _, err := m.Runs("../daily"); err == nil {
+		t.Error("invalid name expect error")
+	}
+
+	if fn, err := m.Path("weekly", "20190225_080000", "records.csv"); err != nil || fn != filepath.Join(dir, "weekly/20190225_080000/records.csv") {
+		t.Errorf("path %s %v", fn, err)
+	}
+	for _, p := range [][3]string{
+		{"weekly", "20190225_080000", "missing.csv"},
+		{"weekly", "..", "daily"},
+		{"..", "daily", "20190224_080000"},
+		{"daily", "20190224_080000", "../../weekly"},
+		{"daily", "", "summary.txt"},
+	} {
+		if _, err := m.Path(p[0], p[1], p[2]); err == nil {
+			t.Errorf("path %v expect error", p)
+		}
+	}
+
+	m.prune("daily", 1)
+	if runs, _ := m.Runs("daily"); len(runs) != 1 || runs[0].Run != "20190226_080000" {
+		t.Errorf("prune keep 1: %+v", runs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "daily", "tmp")); err != nil {
+		t.Errorf("prune removed non-run dir: %v", err)
+	}
+	if runs, _ := m.Runs("weekly"); len(runs) != 1 {
+		t.Errorf("prune touched other report: %+v", runs)
+	}
+}
@@ -0,0 +1,135 @@
+package retention
+
+import (
+	"logauditer/dbapi"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/laik/logger"
+)
+
+// Policy 按天分集合的数据保留天数, 集合名为 ${Prefix}YYYY_MM_DD
+type Policy struct {
+	Database string
+	Prefix   string
+	// 0 永久保留
+	Days int
+}
+
+// Cleaner 定期删除超过保留天数的集合
+type Cleaner struct {
+	sp          *dbapi.StorageParts
+	persistType dbapi.DBType
+
+	mu       sync.Mutex
+	interval time.Duration
+	policies []Policy
+	// 策略变化后唤醒 Run 立即执行
+	reset chan struct{}
+	stop  chan struct{}
+	once  sync.Once
+
+	// 访问数据库, 为空时使用 dbapi; 测试时替换
+	access func(db, coll string, res interface{}, op dbapi.OPType) error
+}
+
+func New(sp *dbapi.StorageParts, persistType dbapi.DBType, interval time.Duration, policies ...Policy) *Cleaner {
+	return &Cleaner{
+		sp:          sp,
+		persistType: persistType,
+		interval:    interval,
+		policies:    policies,
+		reset:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Set 替换清理间隔与保留策略, 运行中时立即按新策略执行一次
+func (c *Cleaner) Set(interval time.Duration, policies ...Policy) {
+	c.mu.Lock()
+	c.interval, c.policies = interval, policies
+	c.mu.Unlock()
+	select {
+	case c.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Run 启动时执行一次, 之后每隔 interval 执行, 直到 Close
+func (c *Cleaner) Run() {
+	for {
+		c.Clean(time.Now())
+		c.mu.Lock()
+		interval := c.interval
+		c.mu.Unlock()
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-c.reset:
+			timer.Stop()
+		case <-c.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Close 停止 Run, 可以重复调用
+func (c *Cleaner) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+// Clean 删除 now 所在日期 Days 天之前的集合, 当天与保留期内的集合不删除
+func (c *Cleaner) Clean(now time.Time) {
+	c.mu.Lock()
+	policies := c.policies
+	c.mu.Unlock()
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	for _, p := range policies {
+		if p.Days <= 0 {
+			continue
+		}
+		before := today.AddDate(0, 0, -p.Days)
+		for _, coll := range c.expired(p, before) {
+			err := c.database(p.Database, coll, nil, dbapi.DROP)
+			if err != nil && !strings.Contains(err.Error(), "ns not found") {
+				log.Error("drop expired collection (%s.%s) error: %s\n", p.Database, coll, err)
+				continue
+			}
+			log.Info("drop expired collection (%s.%s), retention %d days.\n", p.Database, coll, p.Days)
+		}
+	}
+}
+
+func (c *Cleaner) database(db, coll string, res interface{}, op dbapi.OPType) error {
+	if c.access != nil {
+		return c.access(db, coll, res, op)
+	}
+	var _err error
+	dbapi.AccessDatabase(c.sp, db, coll, nil, res, op, c.persistType, &_err)
+	return _err
+}
+
+func (c *Cleaner) expired(p Policy, before time.Time) []string {
+	names := make([]string, 0)
+	if err := c.database(p.Database, "", &names, dbapi.LIST); err != nil {
+		log.Error("list collections of (%s) error: %s\n", p.Database, err)
+		return nil
+	}
+	r := make([]string, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, p.Prefix) {
+			continue
+		}
+		date, err := time.ParseInLocation("2006_01_02", strings.TrimPrefix(name, p.Prefix), time.Local)
+		if err != nil {
+			continue
+		}
+		if date.Before(before) {
+			r = append(r, name)
+		}
+	}
+	return r
+}
@@ -0,0 +1,81 @@
+package retention
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+)
+
+func TestClean(t *testing.T) {
+	collections := map[string][]string{
+		"logrecord":   {"log_2019_02_20", "log_2019_02_21", "log_2019_02_22", "log_2019_02_25", "log_x", "other_2019_01_01"},
+		"audit_alert": {"alert_2019_01_01", "alert_2019_02_25"},
+		"audit_trail": {"trail_2018_01_01"},
+	}
+	var dropped []string
+	c := New(nil, dbapi.KV, time.Hour,
+		Policy{Database: "logrecord", Prefix: "log_", Days: 3},
+		Policy{Database: "audit_alert", Prefix: "alert_", Days: 30},
+		// 0 永久保留
+		Policy{Database: "audit_trail", Prefix: "trail_"},
+	)
+	c.access = func(db, coll string, res interface{}, op dbapi.OPType) error {
+		switch op {
+		case dbapi.LIST:
+			*res.(*[]string) = collections[db]
+		case dbapi.DROP:
+			dropped = append(dropped, db+"."+coll)
+		}
+		return nil
+	}
+	c.Clean(time.Date(2019, 2, 25, 23, 0, 0, 0, time.Local))
+	sort.Strings(dropped)
+	want := []string{"audit_alert.alert_2019_01_01", "logrecord.log_2019_02_20", "logrecord.log_2019_02_21"}
+	if !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped %v, want %v", dropped, want)
+	}
+
+	// 新策略立即生效
+	dropped = nil
+	c.Set(time.Hour, Policy{Database: "audit_trail", Prefix: "trail_", Days: 365})
+	c.Clean(time.Date(2019, 2, 25, 23, 0, 0, 0, time.Local))
+	if want := []string{"audit_trail.trail_2018_01_01"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped %v, want %v", dropped, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	runs := make(chan struct{}, 10)
+	c := New(nil, dbapi.KV, time.Hour, Policy{Database: "logrecord", Prefix: "log_", Days: 1})
+	c.access = func(db, coll string, res interface{}, op dbapi.OPType) error {
+		if op == dbapi.LIST {
+			runs <- struct{}{}
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		c.Run()
+		close(done)
+	}()
+	wait := func(what string) {
+		select {
+		case <-runs:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no clean %s", what)
+		}
+	}
+	wait("on start")
+	c.Set(time.Hour, Policy{Database: "logrecord", Prefix: "log_", Days: 2})
+	wait("after Set")
+	c.Close()
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run not stopped by Close")
+	}
+}
@@ -0,0 +1,62 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// cursor 游标记录上一页最后一条记录所在集合、排序字段值及_id, 以及第一页统计的总数
+type cursor struct {
+	Date  string      `json:"d"`
+	Value interface{} `json:"v,omitempty"`
+	Id    string      `json:"i"`
+	Total int         `json:"t,omitempty"`
+}
+
+func (c *cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errorf("invalid cursor.")
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(b, c); err != nil || !bson.IsObjectIdHex(c.Id) {
+		return nil, errorf("invalid cursor.")
+	}
+	return c, nil
+}
+
+// after 排在游标之后的记录条件, 缺失字段(null)在升序时排在最前
+func (c *cursor) after(key string, desc bool) bson.M {
+	op := "$gt"
+	if desc {
+		op = "$lt"
+	}
+	id := bson.M{"_id": bson.M{op: bson.ObjectIdHex(c.Id)}}
+	if key == "_id" {
+		return id
+	}
+	if c.Value == nil {
+		if desc {
+			return bson.M{key: nil, "_id": bson.M{op: bson.ObjectIdHex(c.Id)}}
+		}
+		return bson.M{"$or": []bson.M{
+			{key: nil, "_id": bson.M{op: bson.ObjectIdHex(c.Id)}},
+			{key: bson.M{"$ne": nil}},
+		}}
+	}
+	or := []bson.M{
+		{key: bson.M{op: c.Value}},
+		{key: c.Value, "_id": bson.M{op: bson.ObjectIdHex(c.Id)}},
+	}
+	if desc {
+		or = append(or, bson.M{key: nil})
+	}
+	return bson.M{"$or": or}
+}
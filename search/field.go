@@ -0,0 +1,61 @@
+package search
+
+import (
+	"reflect"
+	"strings"
+
+	in "logauditer/internal"
+)
+
+// Field 可检索的审计记录字段
+type Field struct {
+	// 存储字段名, 与 AuditLog 的 bson 名一致
+	Name string
+	Kind reflect.Kind
+	// 数组字段(Categories/Masked), 条件匹配任一元素
+	Multi bool
+	// 零值时不入库(bson omitempty), 检索时为缺失字段
+	omitempty bool
+}
+
+var fields = make(map[string]*Field)
+
+func init() {
+	rt := reflect.TypeOf(in.AuditLog{})
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		f := &Field{Name: sf.Name, Kind: sf.Type.Kind(), omitempty: strings.Contains(sf.Tag.Get("bson"), ",omitempty")}
+		if f.Kind == reflect.Slice {
+			f.Kind, f.Multi = sf.Type.Elem().Kind(), true
+		}
+		fields[strings.ToLower(sf.Name)] = f
+	}
+}
+
+// LookupField 按名称(不区分大小写)查找字段
+func LookupField(name string) (*Field, bool) {
+	f, ok := fields[strings.ToLower(name)]
+	return f, ok
+}
+
+// Numeric 是否数值字段
+func (f *Field) Numeric() bool {
+	switch f.Kind {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// fieldValue 记录中字段的存储值, 零值且 omitempty 未入库的字段为 nil, 其余零值(如 DateTime 为 "")照常返回
+func fieldValue(al *in.AuditLog, name string) interface{} {
+	f, ok := LookupField(name)
+	if !ok || f.Multi {
+		return nil
+	}
+	v := reflect.ValueOf(al).Elem().FieldByName(f.Name)
+	if f.omitempty && v.IsZero() {
+		return nil
+	}
+	return v.Interface()
+}
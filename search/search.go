@@ -0,0 +1,318 @@
+package search
+
+import (
+	"fmt"
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+	// 单次检索最多跨越的天数(集合数)
+	MaxDays = 366
+
+	dateLayout = "2006-01-02"
+)
+
+// 条件操作符
+const (
+	EQ     = "eq"
+	PREFIX = "prefix"
+	REGEX  = "regex"
+	GT     = "gt"
+	GTE    = "gte"
+	LT     = "lt"
+	LTE    = "lte"
+)
+
+// Error 请求参数错误
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(format string, v ...interface{}) error {
+	return &Error{Message: fmt.Sprintf(format, v...)}
+}
+
+// Filter 字段条件
+type Filter struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+	Not   bool   `json:"not,omitempty"`
+}
+
+// Request 检索请求
+type Request struct {
+	// 日期范围 yyyy-mm-dd, 包含两端, 为空时为当天
+	From string
+	To   string
+
+	Filters []*Filter
+	// Operation 全文检索(不区分大小写)
+	Text string
+	// 额外的查询条件, 由查询语言生成
+	Query bson.M
+
+	// 排序字段, 为空时按入库顺序
+	Sort  string
+	Desc  bool
+	Limit int
+	// 上一页返回的游标
+	Cursor string
+}
+
+// Record 检索结果记录
+type Record struct {
+	Id          bson.ObjectId `bson:"_id" json:"id"`
+	in.AuditLog `bson:",inline"`
+}
+
+// Result 检索结果
+type Result struct {
+	Records []Record `json:"records"`
+	// 第一页检索时的记录总数, 之后的页由游标带回, 不再重复统计
+	Total int `json:"total"`
+	// 下一页游标, 为空时没有更多记录
+	Next string `json:"next,omitempty"`
+}
+
+// Service 跨天检索审计记录
+type Service struct {
+	SP          *dbapi.StorageParts
+	PersistType dbapi.DBType
+
+	// 访问某天的记录集合, 为空时使用 dbapi; 测试时替换
+	access func(day string, query, res interface{}, op dbapi.OPType) error
+}
+
+func (s *Service) collection(day string, query, res interface{}, op dbapi.OPType) error {
+	if s.access != nil {
+		return s.access(day, query, res, op)
+	}
+	var _err error
+	dbapi.AccessDatabase(s.SP, ll.LOG_RECORD, ll.Collection(day), query, res, op, s.PersistType, &_err)
+	return _err
+}
+
+// Days 日期范围内的日期列表, desc 时倒序
+func (r *Request) Days() ([]string, error) {
+	today := time.Now().Format(dateLayout)
+	from, to := r.From, r.To
+	if from == "" && to == "" {
+		from, to = today, today
+	} else if from == "" {
+		from = to
+	} else if to == "" {
+		to = from
+	}
+	f, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return nil, errorf("invalid from date (%s).", from)
+	}
+	t, err := time.Parse(dateLayout, to)
+	if err != nil {
+		return nil, errorf("invalid to date (%s).", to)
+	}
+	if t.Before(f) {
+		return nil, errorf("to date (%s) before from date (%s).", to, from)
+	}
+	if n := int(t.Sub(f).Hours()/24) + 1; n > MaxDays {
+		return nil, errorf("date range (%d days) exceeds %d days.", n, MaxDays)
+	}
+	var days []string
+	for d := f; !d.After(t); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(dateLayout))
+	}
+	if r.Desc {
+		for i, j := 0, len(days)-1; i < j; i, j = i+1, j-1 {
+			days[i], days[j] = days[j], days[i]
+		}
+	}
+	return days, nil
+}
+
+// Match 生成mongo查询条件
+func (r *Request) Match() (bson.M, error) {
+	var and []bson.M
+	for _, f := range r.Filters {
+		c, err := f.condition()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, c)
+	}
+	if r.Text != "" {
+		and = append(and, bson.M{in.Operation: bson.M{"$regex": regexp.QuoteMeta(r.Text), "$options": "i"}})
+	}
+	if len(r.Query) > 0 {
+		and = append(and, r.Query)
+	}
+	switch len(and) {
+	case 0:
+		return bson.M{}, nil
+	case 1:
+		return and[0], nil
+	}
+	return bson.M{"$and": and}, nil
+}
+
+func (f *Filter) condition() (bson.M, error) {
+	field, ok := LookupField(f.Field)
+	if !ok {
+		return nil, errorf("unknown field (%s).", f.Field)
+	}
+	var value interface{} = f.Value
+	if field.Numeric() {
+		n, err := strconv.ParseInt(f.Value, 10, 64)
+		if err != nil {
+			return nil, errorf("field (%s) expect number but (%s).", field.Name, f.Value)
+		}
+		value = n
+	}
+
+	var expr interface{}
+	switch f.Op {
+	case EQ, "":
+		if f.Not {
+			return bson.M{field.Name: bson.M{"$ne": value}}, nil
+		}
+		return bson.M{field.Name: value}, nil
+	case PREFIX, REGEX:
+		if field.Numeric() {
+			return nil, errorf("field (%s) not support %s.", field.Name, f.Op)
+		}
+		pattern := "^" + regexp.QuoteMeta(f.Value)
+		if f.Op == REGEX {
+			if _, err := regexp.Compile(f.Value); err != nil {
+				return nil, errorf("field (%s) invalid regex: %s", field.Name, err)
+			}
+			pattern = f.Value
+		}
+		expr = bson.RegEx{Pattern: pattern}
+		if !f.Not {
+			return bson.M{field.Name: bson.M{"$regex": pattern}}, nil
+		}
+	case GT, GTE, LT, LTE:
+		expr = bson.M{"$" + f.Op: value}
+	default:
+		return nil, errorf("unsupported op (%s) on field (%s).", f.Op, field.Name)
+	}
+	if f.Not {
+		return bson.M{field.Name: bson.M{"$not": expr}}, nil
+	}
+	return bson.M{field.Name: expr}, nil
+}
+
+func (r *Request) sortKeys() (string, []string, error) {
+	key := "_id"
+	if r.Sort != "" {
+		f, ok := LookupField(r.Sort)
+		if !ok {
+			return "", nil, errorf("unknown sort field (%s).", r.Sort)
+		}
+		if f.Multi {
+			return "", nil, errorf("can not sort by field (%s).", f.Name)
+		}
+		key = f.Name
+	}
+	prefix := ""
+	if r.Desc {
+		prefix = "-"
+	}
+	if key == "_id" {
+		return key, []string{prefix + "_id"}, nil
+	}
+	return key, []string{prefix + key, prefix + "_id"}, nil
+}
+
+// Find 按日期顺序逐个集合检索, 集合内按排序字段分页
+func (s *Service) Find(r *Request) (*Result, error) {
+	days, err := r.Days()
+	if err != nil {
+		return nil, err
+	}
+	match, err := r.Match()
+	if err != nil {
+		return nil, err
+	}
+	key, sort, err := r.sortKeys()
+	if err != nil {
+		return nil, err
+	}
+	limit := r.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	var cur *cursor
+	start := 0
+	if r.Cursor != "" {
+		if cur, err = decodeCursor(r.Cursor); err != nil {
+			return nil, err
+		}
+		start = -1
+		for i, d := range days {
+			if d == cur.Date {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			return nil, errorf("cursor out of date range.")
+		}
+	}
+
+	res := &Result{Records: make([]Record, 0)}
+	if cur != nil {
+		res.Total = cur.Total
+	} else {
+		for _, day := range days {
+			n := 0
+			if err := s.collection(day, match, &n, dbapi.COUNT); err != nil {
+				return nil, err
+			}
+			res.Total += n
+		}
+	}
+
+	for i := start; i < len(days) && len(res.Records) < limit; i++ {
+		query := match
+		if cur != nil && i == start {
+			query = bson.M{"$and": []bson.M{match, cur.after(key, r.Desc)}}
+		}
+		var records []Record
+		fq := &dbapi.FindQuery{Query: query, Sort: sort, Limit: limit - len(res.Records) + 1}
+		if err := s.collection(days[i], fq, &records, dbapi.FIND); err != nil {
+			return nil, err
+		}
+		for j := range records {
+			if len(res.Records) == limit {
+				break
+			}
+			res.Records = append(res.Records, records[j])
+			cur = &cursor{Date: days[i], Id: records[j].Id.Hex(), Total: res.Total}
+			if key != "_id" {
+				cur.Value = fieldValue(&records[j].AuditLog, key)
+			}
+		}
+	}
+	if len(res.Records) == limit && cur != nil {
+		res.Next = cur.encode()
+	}
+	return res, nil
+}
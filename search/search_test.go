@@ -0,0 +1,387 @@
+package search
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestCursor(t *testing.T) {
+	id := bson.NewObjectIdWithTime(time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)).Hex()
+	for _, c := range []*cursor{
+		{Date: "2019-02-25", Id: id},
+		{Date: "2019-02-25", Id: id, Value: "root", Total: 12},
+		{Date: "2019-02-25", Id: id, Value: float64(80)},
+		// 空字符串是字段值, 与缺失字段不同
+		{Date: "2019-02-25", Id: id, Value: ""},
+	} {
+		got, err := decodeCursor(c.encode())
+		if err != nil {
+			t.Errorf("decode %+v: %s", c, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("decode = %+v, want %+v", got, c)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"!!!",
+		(&cursor{Date: "2019-02-25", Id: "x"}).encode(),
+		"eyJkIjoi",
+	} {
+		if _, err := decodeCursor(s); err == nil {
+			t.Errorf("decode (%s) expect error", s)
+		} else if _, ok := err.(*Error); !ok {
+			t.Errorf("decode (%s) error type %T", s, err)
+		}
+	}
+}
+
+func TestCursorAfter(t *testing.T) {
+	id := bson.NewObjectIdWithTime(time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local))
+	cases := []struct {
+		c    cursor
+		key  string
+		desc bool
+		want bson.M
+	}{
+		{cursor{Id: id.Hex()}, "_id", false, bson.M{"_id": bson.M{"$gt": id}}},
+		{cursor{Id: id.Hex()}, "_id", true, bson.M{"_id": bson.M{"$lt": id}}},
+		{cursor{Id: id.Hex(), Value: "root"}, "UserName", false, bson.M{"$or": []bson.M{
+			{"UserName": bson.M{"$gt": "root"}},
+			{"UserName": "root", "_id": bson.M{"$gt": id}},
+		}}},
+		// 倒序时缺失字段排在最后
+		{cursor{Id: id.Hex(), Value: "root"}, "UserName", true, bson.M{"$or": []bson.M{
+			{"UserName": bson.M{"$lt": "root"}},
+			{"UserName": "root", "_id": bson.M{"$lt": id}},
+			{"UserName": nil},
+		}}},
+		{cursor{Id: id.Hex()}, "UserName", false, bson.M{"$or": []bson.M{
+			{"UserName": nil, "_id": bson.M{"$gt": id}},
+			{"UserName": bson.M{"$ne": nil}},
+		}}},
+		{cursor{Id: id.Hex()}, "UserName", true, bson.M{"UserName": nil, "_id": bson.M{"$lt": id}}},
+		{cursor{Id: id.Hex(), Value: ""}, "DateTime", false, bson.M{"$or": []bson.M{
+			{"DateTime": bson.M{"$gt": ""}},
+			{"DateTime": "", "_id": bson.M{"$gt": id}},
+		}}},
+	}
+	for _, c := range cases {
+		if got := c.c.after(c.key, c.desc); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("after(%+v, %s, %v) = %v, want %v", c.c, c.key, c.desc, got, c.want)
+		}
+	}
+}
+
+// memory 按天保存记录, 按 mongo 的规则排序与匹配 $and/$or/$gt/$lt/$ne 及相等条件, 缺失字段(null)小于任何值
+type memory struct {
+	days   map[string][]Record
+	counts int
+}
+
+func newMemory(days map[string][]string) *memory {
+	m := &memory{days: make(map[string][]Record)}
+	for day, users := range days {
+		d, _ := time.ParseInLocation(dateLayout, day, time.Local)
+		for i, u := range users {
+			id := bson.NewObjectIdWithTime(d.Add(time.Duration(i) * time.Second))
+			m.days[day] = append(m.days[day], Record{Id: id, AuditLog: in.AuditLog{UserName: u, Date: day}})
+		}
+	}
+	return m
+}
+
+func (m *memory) access(day string, query, res interface{}, op dbapi.OPType) error {
+	switch op {
+	case dbapi.COUNT:
+		m.counts++
+		n := 0
+		for _, r := range m.days[day] {
+			if matches(r, query.(bson.M)) {
+				n++
+			}
+		}
+		*res.(*int) = n
+	case dbapi.FIND:
+		fq := query.(*dbapi.FindQuery)
+		var records []Record
+		for _, r := range m.days[day] {
+			if matches(r, fq.Query.(bson.M)) {
+				records = append(records, r)
+			}
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			for _, k := range fq.Sort {
+				desc := k[0] == '-'
+				if desc {
+					k = k[1:]
+				}
+				if c := compare(value(records[i], k), value(records[j], k)); c != 0 {
+					return (c < 0) != desc
+				}
+			}
+			return false
+		})
+		if fq.Limit > 0 && len(records) > fq.Limit {
+			records = records[:fq.Limit]
+		}
+		*res.(*[]Record) = records
+	default:
+		return fmt.Errorf("unsupported op (%d)", op)
+	}
+	return nil
+}
+
+// value 按 bson 标签入库后的字段值, omitempty 的零值未入库为 nil
+func value(r Record, key string) interface{} {
+	if key == "_id" {
+		return string(r.Id)
+	}
+	sf, _ := reflect.TypeOf(r.AuditLog).FieldByName(key)
+	v := reflect.ValueOf(r.AuditLog).FieldByName(key)
+	if strings.HasSuffix(sf.Tag.Get("bson"), ",omitempty") && v.IsZero() {
+		return nil
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// compare 比较两个存储值, nil 小于任何值
+func compare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	case a.(string) < b.(string):
+		return -1
+	case a.(string) > b.(string):
+		return 1
+	}
+	return 0
+}
+
+func matches(r Record, q bson.M) bool {
+	for k, v := range q {
+		switch k {
+		case "$and", "$or":
+			n := 0
+			for _, c := range v.([]bson.M) {
+				if matches(r, c) {
+					n++
+				}
+			}
+			if k == "$and" && n < len(v.([]bson.M)) || k == "$or" && n == 0 {
+				return false
+			}
+			continue
+		}
+		field := value(r, k)
+		cond, ok := v.(bson.M)
+		if !ok {
+			cond = bson.M{"$eq": v}
+		}
+		for op, x := range cond {
+			if id, ok := x.(bson.ObjectId); ok {
+				x = string(id)
+			}
+			c := compare(field, x)
+			switch op {
+			case "$eq":
+				ok = c == 0
+			case "$ne":
+				ok = c != 0
+			// 比较不跨类型, null 不大于或小于任何字符串
+			case "$gt":
+				ok = field != nil && x != nil && c > 0
+			case "$lt":
+				ok = field != nil && x != nil && c < 0
+			default:
+				panic("unsupported query " + op)
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pages 依次读取全部页, 返回每页的记录与总数
+func pages(t *testing.T, s *Service, r *Request) ([][]string, []int) {
+	t.Helper()
+	var records [][]string
+	var totals []int
+	for i := 0; i < 20; i++ {
+		res, err := s.Find(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		for _, rec := range res.Records {
+			page = append(page, rec.Date[8:]+rec.UserName)
+		}
+		records = append(records, page)
+		totals = append(totals, res.Total)
+		if res.Next == "" {
+			return records, totals
+		}
+		r.Cursor = res.Next
+	}
+	t.Fatal("too many pages")
+	return nil, nil
+}
+
+func TestFindPaging(t *testing.T) {
+	days := map[string][]string{
+		"2019-02-25": {"a", "b", "c"},
+		"2019-02-26": {},
+		"2019-02-27": {"d", "e"},
+		"2019-02-28": {"f"},
+	}
+	cases := []struct {
+		req   Request
+		pages [][]string
+		total int
+	}{
+		// 页在日期之间衔接, 跳过空集合
+		{Request{From: "2019-02-25", To: "2019-02-28", Limit: 2},
+			[][]string{{"25a", "25b"}, {"25c", "27d"}, {"27e", "28f"}, nil}, 6},
+		{Request{From: "2019-02-25", To: "2019-02-28", Limit: 3},
+			[][]string{{"25a", "25b", "25c"}, {"27d", "27e", "28f"}, nil}, 6},
+		{Request{From: "2019-02-25", To: "2019-02-28", Limit: 4},
+			[][]string{{"25a", "25b", "25c", "27d"}, {"27e", "28f"}}, 6},
+		{Request{From: "2019-02-25", To: "2019-02-28", Limit: 2, Desc: true},
+			[][]string{{"28f", "27e"}, {"27d", "25c"}, {"25b", "25a"}, nil}, 6},
+		{Request{From: "2019-02-26", To: "2019-02-27", Limit: 1},
+			[][]string{{"27d"}, {"27e"}, nil}, 2},
+		{Request{From: "2019-02-25", To: "2019-02-28", Limit: 2, Filters: []*Filter{{Field: "UserName", Value: "e"}}},
+			[][]string{{"27e"}}, 1},
+	}
+	for _, c := range cases {
+		m := newMemory(days)
+		s := &Service{access: m.access}
+		req := c.req
+		got, totals := pages(t, s, &req)
+		if !reflect.DeepEqual(got, c.pages) {
+			t.Errorf("%+v pages %v, want %v", c.req, got, c.pages)
+		}
+		// 只在第一页统计总数
+		for _, n := range totals {
+			if n != c.total {
+				t.Errorf("%+v totals %v, want %d", c.req, totals, c.total)
+				break
+			}
+		}
+		if want, _ := c.req.Days(); m.counts != len(want) {
+			t.Errorf("%+v counted %d collections, want %d", c.req, m.counts, len(want))
+		}
+	}
+}
+
+func TestFindCursorRange(t *testing.T) {
+	s := &Service{access: newMemory(map[string][]string{"2019-02-25": {"a", "b"}}).access}
+	res, err := s.Find(&Request{From: "2019-02-25", To: "2019-02-25", Limit: 1})
+	if err != nil || res.Next == "" {
+		t.Fatalf("first page %+v %v", res, err)
+	}
+	// 游标所在日期不在检索范围内
+	_, err = s.Find(&Request{From: "2019-02-26", To: "2019-02-27", Limit: 1, Cursor: res.Next})
+	if _, ok := err.(*Error); !ok {
+		t.Errorf("error %v, want request error", err)
+	}
+}
+
+func TestFieldValue(t *testing.T) {
+	al := &in.AuditLog{UserName: "root", RiskScore: 80, Categories: []string{"shell"}}
+	cases := []struct {
+		name string
+		want interface{}
+	}{
+		{"UserName", "root"},
+		{"username", "root"},
+		{"RiskScore", 80},
+		// omitempty 的零值不入库
+		{"IpAddr", nil},
+		{"Seq", nil},
+		// DateTime 总是入库, 空字符串是真实的值
+		{"DateTime", ""},
+		{"Categories", nil},
+		{"Nope", nil},
+	}
+	for _, c := range cases {
+		if got := fieldValue(al, c.name); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("fieldValue(%s) = %#v, want %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFindSortedPaging(t *testing.T) {
+	rec := func(day string, i int, host, dt, user string) Record {
+		d, _ := time.ParseInLocation(dateLayout, day, time.Local)
+		id := bson.NewObjectIdWithTime(d.Add(time.Duration(i) * time.Second))
+		return Record{Id: id, AuditLog: in.AuditLog{Host: host, DateTime: dt, UserName: user, Date: day}}
+	}
+	m := &memory{days: map[string][]Record{
+		"2019-02-25": {
+			rec("2019-02-25", 0, "1", "2019-02-25 10:02", "bob"),
+			rec("2019-02-25", 1, "2", "", ""),
+			rec("2019-02-25", 2, "3", "2019-02-25 10:01", "alice"),
+			rec("2019-02-25", 3, "4", "", "bob"),
+		},
+		"2019-02-26": {
+			rec("2019-02-26", 0, "5", "", "alice"),
+			rec("2019-02-26", 1, "6", "2019-02-26 09:00", ""),
+		},
+	}}
+	cases := []struct {
+		sort string
+		desc bool
+		want string
+	}{
+		// 升序时空字符串排在有值的记录之前, 同值按 _id
+		{"DateTime", false, "243156"},
+		{"DateTime", true, "651342"},
+		// 缺失的 UserName 排在最前
+		{"UserName", false, "231465"},
+		{"UserName", true, "564132"},
+	}
+	s := &Service{access: m.access}
+	for _, c := range cases {
+		for limit := 1; limit <= 4; limit++ {
+			r := &Request{From: "2019-02-25", To: "2019-02-26", Sort: c.sort, Desc: c.desc, Limit: limit}
+			got := ""
+			for i := 0; i < 10; i++ {
+				res, err := s.Find(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Total != 6 {
+					t.Errorf("%s desc %v limit %d total %d", c.sort, c.desc, limit, res.Total)
+				}
+				for _, rec := range res.Records {
+					got += rec.Host
+				}
+				if res.Next == "" {
+					break
+				}
+				r.Cursor = res.Next
+			}
+			if got != c.want {
+				t.Errorf("%s desc %v limit %d records %s, want %s", c.sort, c.desc, limit, got, c.want)
+			}
+		}
+	}
+}
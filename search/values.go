@@ -0,0 +1,80 @@
+package search
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 非字段的请求参数
+var reserved = map[string]bool{
+	"from":   true,
+	"to":     true,
+	"date":   true,
+	"q":      true,
+	"ql":     true,
+	"sort":   true,
+	"limit":  true,
+	"cursor": true,
+}
+
+// FromValues 解析http参数. from/to/date 日期范围, q Operation全文检索, ql 查询语句(由调用方解析), sort 排序字段(-表示倒序),
+// limit 每页条数, cursor 游标; 其余参数为字段条件 <field>=<expr>, expr: value 精确, value* 前缀,
+// ~regex 正则, >=n/<=n/>n/<n 数值比较, 以 ! 开头取反.
+func FromValues(form url.Values) (*Request, error) {
+	r := &Request{
+		From:   form.Get("from"),
+		To:     form.Get("to"),
+		Text:   form.Get("q"),
+		Cursor: form.Get("cursor"),
+	}
+	if date := form.Get("date"); date != "" {
+		r.From, r.To = date, date
+	}
+	if sort := form.Get("sort"); sort != "" {
+		r.Sort, r.Desc = strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+	}
+	if limit := form.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, errorf("invalid limit (%s).", limit)
+		}
+		r.Limit = n
+	}
+	for name, values := range form {
+		if reserved[strings.ToLower(name)] {
+			continue
+		}
+		if _, ok := LookupField(name); !ok {
+			return nil, errorf("unknown field (%s).", name)
+		}
+		for _, v := range values {
+			r.Filters = append(r.Filters, ParseFilter(name, v))
+		}
+	}
+	return r, nil
+}
+
+// ParseFilter 解析字段条件表达式
+func ParseFilter(field, expr string) *Filter {
+	f := &Filter{Field: field, Op: EQ}
+	if strings.HasPrefix(expr, "!") {
+		f.Not, expr = true, expr[1:]
+	}
+	switch {
+	case strings.HasPrefix(expr, "~"):
+		f.Op, expr = REGEX, expr[1:]
+	case strings.HasPrefix(expr, ">="):
+		f.Op, expr = GTE, expr[2:]
+	case strings.HasPrefix(expr, "<="):
+		f.Op, expr = LTE, expr[2:]
+	case strings.HasPrefix(expr, ">"):
+		f.Op, expr = GT, expr[1:]
+	case strings.HasPrefix(expr, "<"):
+		f.Op, expr = LT, expr[1:]
+	case strings.HasSuffix(expr, "*"):
+		f.Op, expr = PREFIX, strings.TrimSuffix(expr, "*")
+	}
+	f.Value = expr
+	return f
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"logauditer/api"
+	"logauditer/auth"
+	"logauditer/certs"
+	"logauditer/command"
+	"strings"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const methodPrefix = "/api.LogAuditer/"
+
+var anyRole = []string{auth.ADMIN, auth.AUDITOR, auth.OPERATOR}
+
+// 接口所需角色, nil 表示无需登录, 未列出的接口只允许 admin
+var methodRoles = map[string][]string{
+	"Login":        nil,
+	"Logout":       anyRole,
+	"TailRecords":  {auth.AUDITOR},
+	"WatchWorkers": anyRole,
+	"CreateRule":   {auth.ADMIN},
+	"GetRule":      anyRole,
+	"ListRules":    anyRole,
+	"TestRule":     {auth.ADMIN},
+	"CommitRule":   {auth.ADMIN},
+	"StartRule":    {auth.OPERATOR},
+	"StopRule":     {auth.OPERATOR},
+	"DropRule":     {auth.ADMIN},
+	"ListWorkers":  anyRole,
+	"ListFiles":    anyRole,
+}
+
+// SetAuth 启用认证与角色检查, 须在 Run 之前调用
+func (s *Server) SetAuth(m *auth.Manager) {
+	s.auth = m
+}
+
+// Login 校验用户名密码, 返回的令牌放在 authorization metadata 中
+func (s *Server) Login(ctx context.Context, req *api.LoginRequest) (*api.LoginResponse, error) {
+	if s.auth == nil {
+		return nil, status.Error(codes.Unimplemented, "authentication not enabled.")
+	}
+	sess, err := s.auth.Login(req.User, req.Password)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return &api.LoginResponse{
+		Token:   sess.Token,
+		User:    sess.User,
+		Roles:   sess.Roles,
+		Expires: sess.Expire.Unix(),
+	}, nil
+}
+
+// Logout 使当前令牌失效
+func (s *Server) Logout(ctx context.Context, req *api.LogoutRequest) (*api.LogoutResponse, error) {
+	if sess, ok := auth.FromContext(ctx); ok && s.auth != nil {
+		s.auth.Logout(sess.Token)
+	}
+	return &api.LogoutResponse{}, nil
+}
+
+// 未登录返回 Unauthenticated, 角色不满足返回 PermissionDenied, 令牌有效时总是返回会话
+func (s *Server) authorize(ctx context.Context, method string, req interface{}) (context.Context, *auth.Session, error) {
+	if s.auth == nil {
+		return ctx, nil, nil
+	}
+	name := strings.TrimPrefix(method, methodPrefix)
+	roles, ok := methodRoles[name]
+	if ok && roles == nil {
+		return ctx, nil, nil
+	}
+	if !ok {
+		roles = []string{auth.ADMIN}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if v := md.Get("authorization"); len(v) > 0 {
+		token = auth.BearerToken(v[0])
+	}
+	var sess *auth.Session
+	var err error
+	switch name := peerIdentity(ctx); {
+	case token != "":
+		sess, err = s.auth.Verify(token)
+	case name != "":
+		// 没有令牌时使用客户端证书对应的用户
+		sess, err = s.auth.CertSession(name)
+	default:
+		err = fmt.Errorf("missing token, login first.")
+	}
+	if err != nil {
+		return nil, nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if r, ok := req.(*api.ExecuteRequest); ok {
+		roles = s.commandRoles(string(r.Command))
+	}
+	if !sess.Allow(roles...) {
+		return nil, sess, status.Errorf(codes.PermissionDenied, "user (%s) roles (%s) not allowed to call %s.",
+			sess.User, strings.Join(sess.Roles, ","), name)
+	}
+	return auth.NewContext(ctx, sess), sess, nil
+}
+
+// peerIdentity 已校验的客户端证书对应的用户名
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return certs.Identity(info.State.VerifiedChains)
+}
+
+// Execute 按命令检查角色, USER 在执行时检查子命令
+func (s *Server) commandRoles(line string) []string {
+	cmd, args, err := s.parser.Parse(line)
+	if err != nil {
+		// 由 Execute 返回命令不存在
+		return anyRole
+	}
+	switch cmd.(type) {
+	case *command.Help, *command.Get, *command.Keys, *command.Top, *command.List, *command.Follow, *command.User:
+		return anyRole
+	case *command.Start, *command.Stop:
+		return []string{auth.OPERATOR}
+	case *command.Search, *command.Verify:
+		return []string{auth.AUDITOR}
+	case *command.Trail:
+		if len(args) > 0 && strings.ToUpper(args[0]) == command.TRAIL_PURGE {
+			return []string{auth.ADMIN}
+		}
+		return []string{auth.AUDITOR}
+	}
+	return []string{auth.ADMIN}
+}
+
+// 先认证, 再执行, 最后记录操作审计
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	actx, sess, err := s.authorize(ctx, info.FullMethod, req)
+	var resp interface{}
+	if err == nil {
+		ctx = actx
+		resp, err = handler(ctx, req)
+	}
+	s.trace(ctx, start, info.FullMethod, req, resp, sess, err)
+	return resp, err
+}
+
+// authStream 替换 context 并保留第一条请求用于操作审计
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	req interface{}
+}
+
+func (a *authStream) Context() context.Context {
+	return a.ctx
+}
+
+func (a *authStream) RecvMsg(m interface{}) error {
+	err := a.ServerStream.RecvMsg(m)
+	if err == nil && a.req == nil {
+		a.req = m
+	}
+	return err
+}
+
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, sess, err := s.authorize(ss.Context(), info.FullMethod, nil)
+	if err != nil {
+		s.trace(ss.Context(), start, info.FullMethod, nil, nil, sess, err)
+		return err
+	}
+	as := &authStream{ServerStream: ss, ctx: ctx}
+	err = handler(srv, as)
+	s.trace(ctx, start, info.FullMethod, as.req, nil, sess, err)
+	return err
+}
+
+func (s *Server) userCommand(ctx context.Context, op *command.UserOp, res *api.ExecuteCommandResponse) {
+	if s.auth == nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = "authentication not enabled."
+		return
+	}
+	sess, _ := auth.FromContext(ctx)
+	// WHOAMI 允许所有角色, 其余子命令只允许 admin
+	if op.Op != command.USER_WHO && (sess == nil || !sess.Allow(auth.ADMIN)) {
+		res.Reply = api.ErrCommandReply
+		res.Item = "permission denied."
+		return
+	}
+
+	var err error
+	switch op.Op {
+	case command.USER_SET, command.USER_ROLE:
+		err = s.auth.Set(op.Name, op.Password, op.Roles)
+
+	case command.USER_DEL:
+		if op.Name == sess.User {
+			err = fmt.Errorf("can not delete current user (%s).", op.Name)
+			break
+		}
+		err = s.auth.Del(op.Name)
+
+	case command.USER_WHO:
+		res.Reply = api.StringCommandReply
+		res.Item = fmt.Sprintf("%s [%s]", sess.User, strings.Join(sess.Roles, ","))
+		return
+
+	case command.USER_LIST:
+		res.Reply = api.SliceCommandReply
+		for _, name := range s.auth.List() {
+			u, _ := s.auth.Get(name)
+			res.Items = append(res.Items, fmt.Sprintf("%s [%s]", name, strings.Join(u.Roles, ",")))
+		}
+		if len(res.Items) == 0 {
+			res.Items = []string{"(noitems)"}
+		}
+		return
+	}
+	if err != nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = err.Error()
+		return
+	}
+	res.Reply = api.OkCommandReply
+}
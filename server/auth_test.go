@@ -0,0 +1,210 @@
+package server
+
+import (
+	"testing"
+
+	"logauditer/api"
+	"logauditer/auth"
+	"logauditer/command"
+	"logauditer/dbapi"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// 测试用户与角色同名, anonymous 不带令牌
+var testUsers = []string{auth.ADMIN, auth.AUDITOR, auth.OPERATOR}
+
+// authServer 启用认证的服务, 返回各用户的令牌
+func authServer(t *testing.T) (*Server, map[string]string) {
+	t.Helper()
+	m := auth.NewManager(dbapi.NewStorageParts(), dbapi.KV, 0)
+	tokens := make(map[string]string)
+	for _, name := range testUsers {
+		if err := m.Set(name, "pw-"+name, []string{name}); err != nil {
+			t.Fatal(err)
+		}
+		sess, err := m.Login(name, "pw-"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = sess.Token
+	}
+	return &Server{auth: m, parser: command.NewParser()}, tokens
+}
+
+func userContext(token string) context.Context {
+	ctx := context.Background()
+	if token == "" {
+		return ctx
+	}
+	return metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+}
+
+// allowed 各用户是否允许调用, 依次为 admin/auditor/operator/anonymous
+type allowed [4]bool
+
+var (
+	public    = allowed{true, true, true, true}
+	loggedIn  = allowed{true, true, true, false}
+	adminOnly = allowed{true, false, false, false}
+	auditor   = allowed{true, true, false, false}
+	operator  = allowed{true, false, true, false}
+)
+
+// check 调用 authorize, 未登录应返回 Unauthenticated, 角色不足返回 PermissionDenied
+func check(t *testing.T, s *Server, tokens map[string]string, method string, req interface{}, want allowed, desc string) {
+	t.Helper()
+	for i, name := range append(testUsers, "") {
+		_, _, err := s.authorize(userContext(tokens[name]), methodPrefix+method, req)
+		if (err == nil) != want[i] {
+			t.Errorf("%s by (%s): err %v, want allowed %v", desc, name, err, want[i])
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		code := codes.PermissionDenied
+		if name == "" {
+			code = codes.Unauthenticated
+		}
+		if status.Code(err) != code {
+			t.Errorf("%s by (%s): code %s, want %s", desc, name, status.Code(err), code)
+		}
+	}
+}
+
+func TestMethodRoles(t *testing.T) {
+	s, tokens := authServer(t)
+	cases := map[string]allowed{
+		"Login":        public,
+		"Logout":       loggedIn,
+		"Execute":      adminOnly,
+		"TailRecords":  auditor,
+		"WatchWorkers": loggedIn,
+		"CreateRule":   adminOnly,
+		"GetRule":      loggedIn,
+		"ListRules":    loggedIn,
+		"TestRule":     adminOnly,
+		"CommitRule":   adminOnly,
+		"StartRule":    operator,
+		"StopRule":     operator,
+		"DropRule":     adminOnly,
+		"ListWorkers":  loggedIn,
+		"ListFiles":    loggedIn,
+		// 未列出的接口只允许 admin
+		"Unknown": adminOnly,
+	}
+
+	// 服务定义中的每个接口都要覆盖
+	gs := grpc.NewServer()
+	api.RegisterLogAuditerServer(gs, s)
+	for _, info := range gs.GetServiceInfo() {
+		for _, m := range info.Methods {
+			if _, ok := cases[m.Name]; !ok {
+				t.Errorf("method %s not covered", m.Name)
+			}
+		}
+	}
+
+	for method, want := range cases {
+		check(t, s, tokens, method, nil, want, method)
+	}
+}
+
+func TestCommandRoles(t *testing.T) {
+	s, tokens := authServer(t)
+	cases := []struct {
+		line string
+		want allowed
+	}{
+		{"HELP", loggedIn},
+		{"DESC r", loggedIn},
+		{"RULES", loggedIn},
+		{"TOP", loggedIn},
+		{"LIST r", loggedIn},
+		{"FOLLOW r", loggedIn},
+		// USER 在执行时检查子命令
+		{"USER WHOAMI", loggedIn},
+		{"USER SET u p admin", loggedIn},
+		{"START r", operator},
+		{"STOP r", operator},
+		{"SEARCH r", auditor},
+		{"VERIFY r", auditor},
+		{"TRAIL", auditor},
+		{"TRAIL 2019-02-25", auditor},
+		{"TRAIL PURGE 2019-02-25", adminOnly},
+		{"trail purge 2019-02-25", adminOnly},
+		{"SET r {}", adminOnly},
+		{"COMMIT r", adminOnly},
+		{"TEST r", adminOnly},
+		{"DROP r", adminOnly},
+		{"ALERT LIST", adminOnly},
+		{"NOTIFIER LIST", adminOnly},
+		{"REPORT LIST", adminOnly},
+		{"PROVISION", adminOnly},
+		// 命令不存在时由 Execute 返回错误
+		{"NOPE", loggedIn},
+	}
+	for _, c := range cases {
+		req := &api.ExecuteRequest{Command: []byte(c.line)}
+		check(t, s, tokens, "Execute", req, c.want, c.line)
+	}
+}
+
+func TestUserCommand(t *testing.T) {
+	s, tokens := authServer(t)
+	run := func(user, line string) *api.ExecuteCommandResponse {
+		t.Helper()
+		ctx, _, err := s.authorize(userContext(tokens[user]), methodPrefix+"Execute", &api.ExecuteRequest{Command: []byte(line)})
+		if err != nil {
+			t.Fatalf("%s by (%s): %s", line, user, err)
+		}
+		cmd, args, err := s.parser.Parse(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, ok := cmd.Execute(args...).(*command.UserReply)
+		if !ok {
+			t.Fatalf("%s: reply %T", line, cmd.Execute(args...))
+		}
+		res := &api.ExecuteCommandResponse{}
+		op := reply.Message
+		s.userCommand(ctx, &op, res)
+		return res
+	}
+
+	// 非 admin 只能执行 WHOAMI
+	for _, user := range []string{auth.AUDITOR, auth.OPERATOR} {
+		if res := run(user, "USER WHOAMI"); res.Reply != api.StringCommandReply || res.Item != user+" ["+user+"]" {
+			t.Errorf("WHOAMI by (%s) = %+v", user, res)
+		}
+		for _, line := range []string{"USER LIST", "USER SET x pw admin", "USER ROLE " + user + " admin", "USER DEL admin"} {
+			if res := run(user, line); res.Reply != api.ErrCommandReply || res.Item != "permission denied." {
+				t.Errorf("%s by (%s) = %+v", line, user, res)
+			}
+		}
+	}
+	if _, ok := s.auth.Get("x"); ok {
+		t.Fatal("user created by non-admin")
+	}
+
+	if res := run(auth.ADMIN, "USER SET x pw auditor,operator"); res.Reply != api.OkCommandReply {
+		t.Errorf("USER SET = %+v", res)
+	}
+	if u, ok := s.auth.Get("x"); !ok || len(u.Roles) != 2 {
+		t.Errorf("user x %+v", u)
+	}
+	if res := run(auth.ADMIN, "USER LIST"); res.Reply != api.SliceCommandReply || len(res.Items) != 4 {
+		t.Errorf("USER LIST = %+v", res)
+	}
+	if res := run(auth.ADMIN, "USER DEL admin"); res.Reply != api.ErrCommandReply {
+		t.Errorf("delete current user = %+v", res)
+	}
+	if res := run(auth.ADMIN, "USER DEL x"); res.Reply != api.OkCommandReply {
+		t.Errorf("USER DEL = %+v", res)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"logauditer/api"
+	"logauditer/command"
+	"logauditer/config"
+	"logauditer/dbapi"
+	"logauditer/provision"
+	"sort"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/status"
+)
+
+// SetProvisioner 设置规则目录同步, 用于 PROVISION 命令
+func (s *Server) SetProvisioner(p *provision.Provisioner) {
+	s.provisioner = p
+}
+
+// Reconcile 按规则文件创建、更新、启停规则, 实现 provision.Reconciler.
+// 选项变化的运行中规则重启后生效; 只删除由文件创建的规则, 手工创建的规则不受影响
+func (s *Server) Reconcile(rules []config.Rule, prune bool) *provision.Result {
+	res := provision.NewResult()
+	stored, err := s.persistedAll()
+	if err != nil {
+		res.Error(AUDIT_LOG_RULE, err)
+		return res
+	}
+	ctx := context.Background()
+	desired := make(map[string]bool, len(rules))
+	for i := range rules {
+		r := &rules[i]
+		desired[r.Name] = true
+		options, err := r.JSON()
+		if err != nil {
+			res.Error(r.Name, err)
+			continue
+		}
+		p := stored[r.Name]
+		cached, _ := s.stge.Get(r.Name)
+		running := s.scheduler.Exists(&Worker{name: r.Name})
+		changed := p == nil || p.Value != options || cached != options
+
+		if changed || p.Source != r.Source {
+			if _, err := s.CreateRule(ctx, &api.CreateRuleRequest{Name: r.Name, Options: options}); err != nil {
+				res.Error(r.Name, statusError(err))
+				continue
+			}
+			if p == nil {
+				p = &command.Persist{Id: r.Name}
+			}
+			p.Value, p.Source = options, r.Source
+			if err := s.persist(p); err != nil {
+				res.Error(r.Name, err)
+				continue
+			}
+		}
+		switch {
+		case stored[r.Name] == nil:
+			res.Created = append(res.Created, r.Name)
+		case changed:
+			res.Updated = append(res.Updated, r.Name)
+		default:
+			res.Unchanged = append(res.Unchanged, r.Name)
+		}
+
+		switch {
+		case running && (!r.Start || changed):
+			if _, err := s.StopRule(ctx, &api.StopRuleRequest{Name: r.Name}); err != nil {
+				res.Error(r.Name, statusError(err))
+				continue
+			}
+			if !r.Start {
+				res.Stopped = append(res.Stopped, r.Name)
+				continue
+			}
+			// 使用新选项重启
+			if _, err := s.StartRule(ctx, &api.StartRuleRequest{Name: r.Name}); err != nil {
+				res.Error(r.Name, statusError(err))
+			}
+		case !running && r.Start:
+			if _, err := s.StartRule(ctx, &api.StartRuleRequest{Name: r.Name}); err != nil {
+				res.Error(r.Name, statusError(err))
+				continue
+			}
+			res.Started = append(res.Started, r.Name)
+		}
+	}
+
+	names := make([]string, 0, len(stored))
+	for name, p := range stored {
+		if p.Source != "" && !desired[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !prune {
+			res.Orphaned = append(res.Orphaned, name)
+			continue
+		}
+		if s.scheduler.Exists(&Worker{name: name}) {
+			if _, err := s.StopRule(ctx, &api.StopRuleRequest{Name: name}); err != nil {
+				res.Error(name, statusError(err))
+				continue
+			}
+		}
+		if _, err := s.DropRule(ctx, &api.DropRuleRequest{Name: name}); err != nil {
+			res.Error(name, statusError(err))
+			continue
+		}
+		res.Deleted = append(res.Deleted, name)
+	}
+	return res
+}
+
+// persistedAll 全部已提交的规则
+func (s *Server) persistedAll() (map[string]*command.Persist, error) {
+	var _list []*command.Persist
+	if err := s.database(AUDIT_LOG_DATABASE, AUDIT_LOG_RULE, nil, &_list, dbapi.KEYS); err != nil {
+		return nil, err
+	}
+	r := make(map[string]*command.Persist, len(_list))
+	for _, p := range _list {
+		r[p.Id] = p
+	}
+	return r, nil
+}
+
+// gRPC 状态错误只保留描述
+func statusError(err error) error {
+	return errors.New(status.Convert(err).Message())
+}
+
+func (s *Server) provisionCommand(op *command.ProvisionOp, res *api.ExecuteCommandResponse) {
+	if s.provisioner == nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = "rules dir is not configured."
+		return
+	}
+	var r *provision.Result
+	if op.Op == command.PROVISION_SYNC {
+		r = s.provisioner.Sync()
+	} else if r = s.provisioner.Last(); r == nil {
+		res.Reply = api.StringCommandReply
+		res.Item = "(not synced)"
+		return
+	}
+	res.Reply = api.SliceCommandReply
+	res.Items = r.Lines()
+}
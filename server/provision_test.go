@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"logauditer/api"
+	"logauditer/command"
+	"logauditer/config"
+	"logauditer/dbapi"
+	"logauditer/provision"
+
+	context "golang.org/x/net/context"
+)
+
+func worker(s *Server, name string) *Worker {
+	s.scheduler.mu.Lock()
+	defer s.scheduler.mu.Unlock()
+	return s.scheduler.workers[name]
+}
+
+func TestReconcile(t *testing.T) {
+	s, db, dir := ruleServer(t)
+	ctx := context.Background()
+	if err := ioutil.WriteFile(filepath.Join(dir, todayLog()), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "rules.yaml")
+	nginx := options(dir)
+	sshd := `{"dir":"` + dir + `","watchMode":"poll"}`
+
+	// 手工创建的规则
+	if _, err := s.CreateRule(ctx, &api.CreateRuleRequest{Name: "manual", Options: sshd}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CommitRule(ctx, &api.CommitRuleRequest{Name: "manual"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := s.Reconcile([]config.Rule{
+		{Name: "nginx", Options: nginx, Start: true, Source: src},
+		{Name: "sshd", Options: sshd, Source: src},
+	}, true)
+	if !reflect.DeepEqual(res.Created, []string{"nginx", "sshd"}) || !reflect.DeepEqual(res.Started, []string{"nginx"}) ||
+		len(res.Updated)+len(res.Deleted)+len(res.Orphaned)+len(res.Errors) != 0 {
+		t.Fatalf("create %+v", res)
+	}
+	if p := db.rules["nginx"]; p.Value != nginx || p.Source != src || !p.Isopen {
+		t.Errorf("persisted nginx %+v", p)
+	}
+	if p := db.rules["sshd"]; p.Source != src || p.Isopen {
+		t.Errorf("persisted sshd %+v", p)
+	}
+	first := worker(s, "nginx")
+	if first == nil {
+		t.Fatal("nginx not running")
+	}
+
+	// 未变化的规则不重启
+	res = s.Reconcile([]config.Rule{
+		{Name: "nginx", Options: nginx, Start: true, Source: src},
+		{Name: "sshd", Options: sshd, Source: src},
+	}, true)
+	if !reflect.DeepEqual(res.Unchanged, []string{"nginx", "sshd"}) || len(res.Created)+len(res.Updated)+len(res.Started)+len(res.Errors) != 0 {
+		t.Errorf("unchanged %+v", res)
+	}
+	if worker(s, "nginx") != first {
+		t.Error("unchanged rule restarted")
+	}
+
+	// 选项变化时运行中的规则使用新选项重启
+	changed := `{"dir":"` + dir + `","filePattern":"\\.log$","logDate":"\\d+-\\d+-\\d+","watchMode":"poll","pollInterval":"2s"}`
+	res = s.Reconcile([]config.Rule{
+		{Name: "nginx", Options: changed, Start: true, Source: src},
+		{Name: "sshd", Options: sshd, Start: true, Source: src},
+	}, true)
+	if !reflect.DeepEqual(res.Updated, []string{"nginx"}) || !reflect.DeepEqual(res.Started, []string{"sshd"}) || len(res.Errors) != 0 {
+		t.Errorf("update %+v", res)
+	}
+	if w := worker(s, "nginx"); w == nil || w == first {
+		t.Error("changed rule not restarted")
+	}
+	if p := db.rules["nginx"]; p.Value != changed || !p.Isopen {
+		t.Errorf("persisted changed %+v", p)
+	}
+	if v, _ := s.stge.Get("nginx"); v != changed {
+		t.Errorf("cached %s", v)
+	}
+
+	// start 为 false 时停止
+	res = s.Reconcile([]config.Rule{
+		{Name: "nginx", Options: changed, Source: src},
+		{Name: "sshd", Options: sshd, Start: true, Source: src},
+	}, true)
+	if !reflect.DeepEqual(res.Stopped, []string{"nginx"}) || worker(s, "nginx") != nil || db.rules["nginx"].Isopen {
+		t.Errorf("stop %+v", res)
+	}
+
+	// 不清理时只报告文件中已删除的规则
+	res = s.Reconcile([]config.Rule{{Name: "nginx", Options: changed, Source: src}}, false)
+	if !reflect.DeepEqual(res.Orphaned, []string{"sshd"}) || len(res.Deleted) != 0 || worker(s, "sshd") == nil {
+		t.Errorf("orphaned %+v", res)
+	}
+
+	// 清理时停止并删除文件创建的规则, 保留手工创建的规则
+	res = s.Reconcile(nil, true)
+	if !reflect.DeepEqual(res.Deleted, []string{"nginx", "sshd"}) || len(res.Errors) != 0 {
+		t.Errorf("prune %+v", res)
+	}
+	if worker(s, "sshd") != nil {
+		t.Error("pruned rule still running")
+	}
+	if _, ok := db.rules["manual"]; !ok || len(db.rules) != 1 {
+		t.Errorf("rules after prune %+v", db.rules)
+	}
+	if _, err := s.stge.Get("manual"); err != nil {
+		t.Error("manual rule removed from cache")
+	}
+
+	// 同名的手工规则写入文件后归文件管理
+	res = s.Reconcile([]config.Rule{{Name: "manual", Options: sshd, Source: src}}, true)
+	if !reflect.DeepEqual(res.Unchanged, []string{"manual"}) || db.rules["manual"].Source != src {
+		t.Errorf("adopt %+v %+v", res, db.rules["manual"])
+	}
+}
+
+func TestReconcileErrors(t *testing.T) {
+	s, db, dir := ruleServer(t)
+	src := filepath.Join(dir, "rules.yaml")
+	res := s.Reconcile([]config.Rule{
+		{Name: "bad", Options: "{", Source: src},
+		{Name: "ok", Options: options(dir), Source: src},
+	}, true)
+	if !reflect.DeepEqual(res.Created, []string{"ok"}) || res.Errors["bad"] == "" {
+		t.Errorf("invalid options %+v", res)
+	}
+	if _, ok := db.rules["bad"]; ok {
+		t.Error("invalid rule persisted")
+	}
+
+	db.fail[dbapi.KEYS] = errors.New("db down")
+	res = s.Reconcile(nil, true)
+	if res.Errors[AUDIT_LOG_RULE] != "db down" || len(db.rules) != 1 {
+		t.Errorf("storage error %+v", res)
+	}
+}
+
+func TestProvisionCommand(t *testing.T) {
+	s, _, dir := ruleServer(t)
+	res := &api.ExecuteCommandResponse{}
+	s.provisionCommand(&command.ProvisionOp{Op: command.PROVISION_STATUS}, res)
+	if res.Reply != api.ErrCommandReply {
+		t.Errorf("without provisioner %+v", res)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "nginx.yaml"), []byte("options:\n  dir: "+dir+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.SetProvisioner(provision.New(dir, true, 0, s))
+	res = &api.ExecuteCommandResponse{}
+	s.provisionCommand(&command.ProvisionOp{Op: command.PROVISION_STATUS}, res)
+	if res.Reply != api.StringCommandReply || res.Item != "(not synced)" {
+		t.Errorf("status before sync %+v", res)
+	}
+	res = &api.ExecuteCommandResponse{}
+	s.provisionCommand(&command.ProvisionOp{Op: command.PROVISION_SYNC}, res)
+	if res.Reply != api.SliceCommandReply || len(res.Items) != 2 || res.Items[1] != "created: nginx" {
+		t.Errorf("sync %+v", res)
+	}
+	res = &api.ExecuteCommandResponse{}
+	s.provisionCommand(&command.ProvisionOp{Op: command.PROVISION_STATUS}, res)
+	if res.Reply != api.SliceCommandReply || len(res.Items) != 2 {
+		t.Errorf("status after sync %+v", res)
+	}
+}
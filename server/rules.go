@@ -0,0 +1,437 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"logauditer/api"
+	"logauditer/command"
+	"logauditer/dbapi"
+	"logauditer/redact"
+	"regexp"
+	"sort"
+	"strings"
+
+	ii "logauditer/internal"
+	ll "logauditer/logmining"
+
+	"github.com/globalsign/mgo"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/mgo.v2/bson"
+
+	log "github.com/laik/logger"
+)
+
+// 规则管理接口, 文本命令通过 ruleCommand 转换为这些调用
+
+// CreateRule 校验并缓存规则, COMMIT 之后才持久化
+func (s *Server) CreateRule(ctx context.Context, req *api.CreateRuleRequest) (*api.Rule, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "rule name is empty.")
+	}
+	rops := &ii.RuntimeOptions{}
+	if err := rops.Unmarshal([]byte(req.Options), json.Unmarshal); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "rule unmarshal err: %s", err)
+	}
+	if _, err := redact.FromOptions(rops); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := rops.Poll(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := ll.NewMatcher(rops); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.stge.Set(req.Name, req.Options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return s.rule(req.Name)
+}
+
+// LoadRule 加载配置中的规则: 创建并提交, start 为 true 且未运行时启动;
+// 已运行的规则不重启, 修改后的选项在下次 START 时生效
+func (s *Server) LoadRule(name, options string, start bool) error {
+	ctx := context.Background()
+	if _, err := s.CreateRule(ctx, &api.CreateRuleRequest{Name: name, Options: options}); err != nil {
+		return err
+	}
+	if _, err := s.CommitRule(ctx, &api.CommitRuleRequest{Name: name}); err != nil {
+		return err
+	}
+	if !start || s.scheduler.Exists(&Worker{name: name}) {
+		return nil
+	}
+	_, err := s.StartRule(ctx, &api.StartRuleRequest{Name: name})
+	return err
+}
+
+// GetRule 查询缓存中的规则
+func (s *Server) GetRule(ctx context.Context, req *api.GetRuleRequest) (*api.Rule, error) {
+	return s.rule(req.Name)
+}
+
+// ListRules 按名称排序列出规则
+func (s *Server) ListRules(ctx context.Context, req *api.ListRulesRequest) (*api.ListRulesResponse, error) {
+	var pattern *regexp.Regexp
+	if req.Pattern != "" {
+		var err error
+		if pattern, err = regexp.CompilePOSIX(req.Pattern); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid pattern (%s).", req.Pattern)
+		}
+	}
+	names, err := s.stge.Keys()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	committed, err := s.committed()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	sort.Strings(names)
+
+	res := &api.ListRulesResponse{}
+	for _, name := range names {
+		if pattern != nil && !pattern.MatchString(name) {
+			continue
+		}
+		options, err := s.stge.Get(name)
+		if err != nil {
+			continue
+		}
+		res.Rules = append(res.Rules, &api.Rule{
+			Name:      name,
+			Options:   options,
+			Committed: committed[name],
+			Running:   s.scheduler.Exists(&Worker{name: name}),
+		})
+	}
+	return res, nil
+}
+
+// TestRule 用规则解析一行日志, 不入库
+func (s *Server) TestRule(ctx context.Context, req *api.TestRuleRequest) (*api.TestRuleResponse, error) {
+	rule, err := s.stge.Get(req.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "rule (%s) not found.", req.Name)
+	}
+	runtimeOptions := &ii.RuntimeOptions{
+		ColumnPattern: &ii.ColumnPattern{},
+	}
+	if err := runtimeOptions.Unmarshal([]byte(rule), json.Unmarshal); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "test rule error unmarshal to runtimeOptions error: %s.", err)
+	}
+	var _err error
+	resp := ii.NewResponse()
+	ii.VisitLogsAudit2(s.logParts, []byte(req.Data), resp, runtimeOptions, &_err)
+
+	if resp.Err != nil || len(strings.Trim(resp.Data, " ")) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "with rule (%s) test faild. rule runtime options[%#v].test data:(%s). error:(%s)",
+			rule,
+			runtimeOptions,
+			req.Data,
+			_err,
+		)
+	}
+	record := &ii.AuditLog{}
+	if err := json.Unmarshal([]byte(resp.Data), record); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	r := auditRecord(record)
+	r.Rule = req.Name
+	return &api.TestRuleResponse{Record: r}, nil
+}
+
+// CommitRule 持久化缓存中的规则, 保留运行状态
+func (s *Server) CommitRule(ctx context.Context, req *api.CommitRuleRequest) (*api.Rule, error) {
+	value, err := s.stge.Get(req.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "rule (%s) not found in cache.", req.Name)
+	}
+	p, err := s.persisted(req.Name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if p == nil {
+		p = &command.Persist{Id: req.Name}
+	}
+	p.Value = value
+	if err := s.persist(p); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Debug("commit rule (%s) success.\n", req.Name)
+	return s.rule(req.Name)
+}
+
+// StartRule 启动工作进程并记录运行状态, 规则需先 COMMIT
+func (s *Server) StartRule(ctx context.Context, req *api.StartRuleRequest) (*api.Rule, error) {
+	p, err := s.committedRule(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	w := &Worker{
+		name:     req.Name,
+		stge:     s.stge,
+		persists: s.persists,
+	}
+	switch err := s.scheduler.Add(w, true); err {
+	case nil:
+	case ErrWorkerExists:
+		return nil, status.Errorf(codes.AlreadyExists, "worker process (%s) already running.", req.Name)
+	case ErrWorkerLimit:
+		return nil, status.Errorf(codes.ResourceExhausted, "running workers reach the limit (%d).", s.scheduler.Max())
+	case ErrShuttingDown:
+		return nil, status.Errorf(codes.Unavailable, "server is shutting down, worker process (%s) not started.", req.Name)
+	default:
+		return nil, status.Errorf(codes.Internal, "start worker process apply rule (%s) not success.", req.Name)
+	}
+	p.Isopen = true
+	if err := s.persist(p); err != nil {
+		if ok := s.scheduler.Del(w); !ok {
+			return nil, status.Errorf(codes.Internal, "del (%s) not start success worker error,status brokens.", w.name)
+		}
+		return nil, status.Errorf(codes.Internal, "start worker persists status error(%s).", req.Name)
+	}
+	return s.rule(req.Name)
+}
+
+// StopRule 停止工作进程并记录运行状态
+func (s *Server) StopRule(ctx context.Context, req *api.StopRuleRequest) (*api.Rule, error) {
+	p, err := s.committedRule(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	w := &Worker{name: req.Name}
+	if !s.scheduler.Exists(w) {
+		return nil, status.Errorf(codes.FailedPrecondition, "worker process (%s) rule already stop.", req.Name)
+	}
+	if !s.scheduler.Del(w) {
+		return nil, status.Errorf(codes.Internal, "stop worker process rule (%s) not success.", req.Name)
+	}
+	p.Isopen = false
+	if err := s.persist(p); err != nil {
+		return nil, status.Errorf(codes.Internal, "stop worker persists status error(%s).", req.Name)
+	}
+	return s.rule(req.Name)
+}
+
+// DropRule 删除规则及其文件读取位置, 运行中的规则需先 STOP
+func (s *Server) DropRule(ctx context.Context, req *api.DropRuleRequest) (*api.DropRuleResponse, error) {
+	if s.scheduler.Exists(&Worker{name: req.Name}) {
+		return nil, status.Errorf(codes.FailedPrecondition, "worker (%s) is running.", req.Name)
+	}
+	_s, err := s.stge.Get(req.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "get rule error:(%s) on cache.", req.Name)
+	}
+	if err := s.stge.Del(req.Name); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Debug("remove all on cache (%s.%s).\n", ll.LIBDB, req.Name)
+	if _err := s.database(ll.LIBDB, req.Name, nil, nil, dbapi.REMOVEALL); _err != nil {
+		log.Error("clean (%s) ns error:%s.\n", req.Name, _err)
+		if err := s.stge.Set(req.Name, _s); err != nil {
+			log.Error("rollback on drop rule ns.")
+		}
+		return nil, status.Error(codes.Internal, _err.Error())
+	}
+	// clean persists rule
+	_err2 := s.database(AUDIT_LOG_DATABASE, AUDIT_LOG_RULE, bson.M{"_id": req.Name}, nil, dbapi.DEL)
+	if _err2 != nil && _err2 != mgo.ErrNotFound {
+		log.Error("can not rollback drop rule (%s) error (%s).\n", req.Name, _err2)
+		return nil, status.Error(codes.Internal, _err2.Error())
+	}
+	return &api.DropRuleResponse{}, nil
+}
+
+// ListWorkers 按规则名排序列出运行中的工作进程
+func (s *Server) ListWorkers(ctx context.Context, req *api.ListWorkersRequest) (*api.ListWorkersResponse, error) {
+	names := s.scheduler.List()
+	sort.Strings(names)
+	res := &api.ListWorkersResponse{}
+	for _, name := range names {
+		w, ok := s.scheduler.Get(name)
+		if !ok {
+			continue
+		}
+		res.Workers = append(res.Workers, &api.Worker{Rule: name, Files: int32(len(w.files()))})
+	}
+	return res, nil
+}
+
+// ListFiles 列出工作进程跟踪的文件及读取位置
+func (s *Server) ListFiles(ctx context.Context, req *api.ListFilesRequest) (*api.ListFilesResponse, error) {
+	if _, err := s.stge.Get(req.Rule); err != nil {
+		return nil, status.Errorf(codes.NotFound, "rule (%s) not found.", req.Rule)
+	}
+	w, ok := s.scheduler.Get(req.Rule)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "not start work %v", req.Rule)
+	}
+	res := &api.ListFilesResponse{}
+	for _, f := range w.files() {
+		res.Files = append(res.Files, &api.WatchedFile{Name: f.Name, Offset: f.Offset, Pattern: f.Pattern})
+	}
+	return res, nil
+}
+
+func (s *Server) rule(name string) (*api.Rule, error) {
+	options, err := s.stge.Get(name)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "rule (%s) not found.", name)
+	}
+	p, err := s.persisted(name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &api.Rule{
+		Name:      name,
+		Options:   options,
+		Committed: p != nil,
+		Running:   s.scheduler.Exists(&Worker{name: name}),
+	}, nil
+}
+
+// committedRule 返回已提交的规则, 未定义或未提交时返回对应的状态码
+func (s *Server) committedRule(name string) (*command.Persist, error) {
+	if _, err := s.stge.Get(name); err != nil {
+		return nil, status.Errorf(codes.NotFound, "not define rule (%s).", name)
+	}
+	p, err := s.persisted(name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if p == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "rule (%s) not committed.", name)
+	}
+	return p, nil
+}
+
+// persisted 查询持久化的规则, 未提交时返回 nil
+func (s *Server) persisted(name string) (*command.Persist, error) {
+	p := &command.Persist{}
+	_err := s.database(AUDIT_LOG_DATABASE, AUDIT_LOG_RULE, bson.M{"_id": name}, p, dbapi.GET)
+	if _err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if _err != nil {
+		return nil, _err
+	}
+	return p, nil
+}
+
+// committed 已提交的规则名
+func (s *Server) committed() (map[string]bool, error) {
+	stored, err := s.persistedAll()
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]bool, len(stored))
+	for name := range stored {
+		r[name] = true
+	}
+	return r, nil
+}
+
+func (s *Server) persist(p *command.Persist) error {
+	return s.database(AUDIT_LOG_DATABASE, AUDIT_LOG_RULE, bson.M{"_id": p.Id}, p, dbapi.SET)
+}
+
+// ruleCommand 文本命令基于规则管理接口实现
+func (s *Server) ruleCommand(ctx context.Context, op *command.RuleOp, res *api.ExecuteCommandResponse) {
+	var err error
+	switch op.Op {
+	case command.RULE_SET:
+		if _, err = s.CreateRule(ctx, &api.CreateRuleRequest{Name: op.Name, Options: op.Options}); err == nil {
+			res.Reply = api.OkCommandReply
+		}
+
+	case command.RULE_DESC:
+		var r *api.Rule
+		if r, err = s.GetRule(ctx, &api.GetRuleRequest{Name: op.Name}); err == nil {
+			res.Reply = api.StringCommandReply
+			res.Item = r.Options
+		}
+
+	case command.RULE_KEYS:
+		var r *api.ListRulesResponse
+		if r, err = s.ListRules(ctx, &api.ListRulesRequest{Pattern: op.Pattern}); err == nil {
+			res.Reply = api.SliceCommandReply
+			for _, rule := range r.Rules {
+				res.Items = append(res.Items, rule.Name)
+			}
+			if len(res.Items) == 0 {
+				res.Items = []string{"(noitems)"}
+			}
+		}
+
+	case command.RULE_TEST:
+		var r *api.TestRuleResponse
+		if r, err = s.TestRule(ctx, &api.TestRuleRequest{Name: op.Name, Data: op.Data}); err == nil {
+			b, _ := json.Marshal(r.Record)
+			res.Reply = api.StringCommandReply
+			res.Item = string(b)
+		}
+
+	case command.RULE_COMMIT:
+		if _, err = s.CommitRule(ctx, &api.CommitRuleRequest{Name: op.Name}); err == nil {
+			res.Reply = api.OkCommandReply
+		}
+
+	case command.RULE_START:
+		_, err = s.StartRule(ctx, &api.StartRuleRequest{Name: op.Name})
+		if status.Code(err) == codes.AlreadyExists {
+			err = nil
+			res.Item = fmt.Sprintf("worker process (%s) already running.", op.Name)
+		} else if err == nil {
+			res.Item = fmt.Sprintf("start worker process apply rule (%s).", op.Name)
+		}
+		res.Reply = api.StringCommandReply
+
+	case command.RULE_STOP:
+		res.Reply = api.StringCommandReply
+		if _, perr := s.committedRule(op.Name); perr == nil && !s.scheduler.Exists(&Worker{name: op.Name}) {
+			res.Item = fmt.Sprintf("worker process (%s) rule already stop.", op.Name)
+			break
+		}
+		if _, err = s.StopRule(ctx, &api.StopRuleRequest{Name: op.Name}); err == nil {
+			res.Item = fmt.Sprintf("stop worker process rule (%s).", op.Name)
+		}
+
+	case command.RULE_DROP:
+		if _, err = s.DropRule(ctx, &api.DropRuleRequest{Name: op.Name}); err == nil {
+			res.Reply = api.OkCommandReply
+		}
+
+	case command.RULE_TOP:
+		var r *api.ListWorkersResponse
+		if r, err = s.ListWorkers(ctx, &api.ListWorkersRequest{}); err == nil {
+			res.Reply = api.SliceCommandReply
+			for _, w := range r.Workers {
+				res.Items = append(res.Items, w.Rule)
+			}
+			if len(res.Items) == 0 {
+				res.Items = []string{"not worker running."}
+			}
+		}
+
+	case command.RULE_LIST:
+		var r *api.ListFilesResponse
+		if r, err = s.ListFiles(ctx, &api.ListFilesRequest{Rule: op.Name}); err == nil {
+			if len(r.Files) == 0 {
+				res.Reply = api.StringCommandReply
+				res.Item = "not monitor file."
+				break
+			}
+			res.Reply = api.SliceCommandReply
+			for _, f := range r.Files {
+				res.Items = append(res.Items, fmt.Sprintf("name:%s,offset:%d,pattern:%s", f.Name, f.Offset, f.Pattern))
+			}
+		}
+	}
+	if err != nil {
+		res.Reply = api.ErrCommandReply
+		res.Items = nil
+		res.Item = status.Convert(err).Message()
+	}
+}
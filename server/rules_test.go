@@ -0,0 +1,409 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"logauditer/api"
+	"logauditer/command"
+	"logauditer/dbapi"
+	ii "logauditer/internal"
+	ll "logauditer/logmining"
+
+	"github.com/globalsign/mgo"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memStore 内存中的规则缓存
+type memStore map[string]string
+
+func (m memStore) Set(k, v string) error { m[k] = v; return nil }
+
+func (m memStore) Get(k string) (string, error) {
+	v, ok := m[k]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return v, nil
+}
+
+func (m memStore) Del(k string) error { delete(m, k); return nil }
+
+func (m memStore) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// memDB 内存中的已提交规则, 记录清理过的文件位置集合
+type memDB struct {
+	rules   map[string]command.Persist
+	removed []string
+	// 不为空时对应操作返回该错误
+	fail map[dbapi.OPType]error
+}
+
+func (m *memDB) access(db, coll string, query, res interface{}, op dbapi.OPType) error {
+	if err := m.fail[op]; err != nil {
+		return err
+	}
+	if db == ll.LIBDB && op == dbapi.REMOVEALL {
+		m.removed = append(m.removed, coll)
+		return nil
+	}
+	if db != AUDIT_LOG_DATABASE || coll != AUDIT_LOG_RULE {
+		return errors.New("unexpected collection " + db + "." + coll)
+	}
+	switch op {
+	case dbapi.GET:
+		p, ok := m.rules[query.(bson.M)["_id"].(string)]
+		if !ok {
+			return mgo.ErrNotFound
+		}
+		*res.(*command.Persist) = p
+	case dbapi.SET:
+		m.rules[query.(bson.M)["_id"].(string)] = *res.(*command.Persist)
+	case dbapi.DEL:
+		id := query.(bson.M)["_id"].(string)
+		if _, ok := m.rules[id]; !ok {
+			return mgo.ErrNotFound
+		}
+		delete(m.rules, id)
+	case dbapi.KEYS:
+		list := res.(*[]*command.Persist)
+		for _, p := range m.rules {
+			p := p
+			*list = append(*list, &p)
+		}
+	default:
+		return errors.New("unexpected op")
+	}
+	return nil
+}
+
+// ruleServer 使用内存存储的服务, 返回规则的日志目录
+func ruleServer(t *testing.T) (*Server, *memDB, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &memDB{rules: make(map[string]command.Persist), fail: make(map[dbapi.OPType]error)}
+	s := &Server{
+		logParts:  ii.NewLogParts(),
+		parser:    command.NewParser(),
+		persists:  dbapi.NewStorageParts(),
+		scheduler: &Scheduler{workers: make(map[string]*Worker)},
+		stge:      memStore{},
+		access:    db.access,
+	}
+	t.Cleanup(func() {
+		s.scheduler.Shutdown(context.Background())
+		os.RemoveAll(dir)
+	})
+	return s, db, dir
+}
+
+func options(dir string) string {
+	return `{"dir":"` + dir + `","filePattern":"\\.log$","logDate":"\\d+-\\d+-\\d+","watchMode":"poll"}`
+}
+
+// todayLog 带当天日期的文件名, 其它日期的文件不跟踪
+func todayLog() string {
+	return "10.0.0.1_" + time.Now().Format("2006-01-02") + ".log"
+}
+
+func code(t *testing.T, err error, want codes.Code, desc string) {
+	t.Helper()
+	if status.Code(err) != want {
+		t.Errorf("%s: code %s (%v), want %s", desc, status.Code(err), err, want)
+	}
+}
+
+func TestRuleLifecycle(t *testing.T) {
+	s, db, dir := ruleServer(t)
+	ctx := context.Background()
+	if err := ioutil.WriteFile(filepath.Join(dir, todayLog()), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.CreateRule(ctx, &api.CreateRuleRequest{Name: "", Options: options(dir)})
+	code(t, err, codes.InvalidArgument, "create without name")
+	_, err = s.CreateRule(ctx, &api.CreateRuleRequest{Name: "x", Options: "{"})
+	code(t, err, codes.InvalidArgument, "create invalid json")
+	_, err = s.CreateRule(ctx, &api.CreateRuleRequest{Name: "x", Options: `{"dir":"/logs","watchMode":"poll","pollInterval":"soon"}`})
+	code(t, err, codes.InvalidArgument, "create invalid poll interval")
+	_, err = s.CreateRule(ctx, &api.CreateRuleRequest{Name: "x", Options: `{"dir":"/logs","redact":[{"pattern":"("}]}`})
+	code(t, err, codes.InvalidArgument, "create invalid redact")
+	if len(s.stge.(memStore)) != 0 {
+		t.Fatalf("invalid rules cached %v", s.stge)
+	}
+
+	r, err := s.CreateRule(ctx, &api.CreateRuleRequest{Name: "nginx", Options: options(dir)})
+	if err != nil || r.Name != "nginx" || r.Options != options(dir) || r.Committed || r.Running {
+		t.Fatalf("create %+v %v", r, err)
+	}
+	_, err = s.GetRule(ctx, &api.GetRuleRequest{Name: "none"})
+	code(t, err, codes.NotFound, "get missing")
+
+	// 未提交不能启动
+	_, err = s.StartRule(ctx, &api.StartRuleRequest{Name: "nginx"})
+	code(t, err, codes.FailedPrecondition, "start uncommitted")
+	_, err = s.StartRule(ctx, &api.StartRuleRequest{Name: "none"})
+	code(t, err, codes.NotFound, "start missing")
+	_, err = s.CommitRule(ctx, &api.CommitRuleRequest{Name: "none"})
+	code(t, err, codes.NotFound, "commit missing")
+
+	if r, err = s.CommitRule(ctx, &api.CommitRuleRequest{Name: "nginx"}); err != nil || !r.Committed || r.Running {
+		t.Fatalf("commit %+v %v", r, err)
+	}
+	if p := db.rules["nginx"]; p.Value != options(dir) || p.Isopen {
+		t.Errorf("persisted %+v", p)
+	}
+
+	_, err = s.ListFiles(ctx, &api.ListFilesRequest{Rule: "nginx"})
+	code(t, err, codes.FailedPrecondition, "list files of stopped rule")
+	_, err = s.StopRule(ctx, &api.StopRuleRequest{Name: "nginx"})
+	code(t, err, codes.FailedPrecondition, "stop stopped rule")
+
+	if r, err = s.StartRule(ctx, &api.StartRuleRequest{Name: "nginx"}); err != nil || !r.Running {
+		t.Fatalf("start %+v %v", r, err)
+	}
+	if !db.rules["nginx"].Isopen {
+		t.Error("running state not persisted")
+	}
+	_, err = s.StartRule(ctx, &api.StartRuleRequest{Name: "nginx"})
+	code(t, err, codes.AlreadyExists, "start running rule")
+
+	// 重新提交保留运行状态
+	s.stge.Set("nginx", options(dir)+" ")
+	if r, err = s.CommitRule(ctx, &api.CommitRuleRequest{Name: "nginx"}); err != nil || !db.rules["nginx"].Isopen {
+		t.Errorf("recommit %+v %v %+v", r, err, db.rules["nginx"])
+	}
+	s.stge.Set("nginx", options(dir))
+
+	files, err := s.ListFiles(ctx, &api.ListFilesRequest{Rule: "nginx"})
+	if err != nil || len(files.Files) != 1 || files.Files[0].Name != filepath.Join(dir, todayLog()) {
+		t.Errorf("list files %+v %v", files, err)
+	}
+	_, err = s.ListFiles(ctx, &api.ListFilesRequest{Rule: "none"})
+	code(t, err, codes.NotFound, "list files of missing rule")
+	workers, err := s.ListWorkers(ctx, &api.ListWorkersRequest{})
+	if err != nil || len(workers.Workers) != 1 || workers.Workers[0].Rule != "nginx" || workers.Workers[0].Files != 1 {
+		t.Errorf("list workers %+v %v", workers, err)
+	}
+
+	_, err = s.DropRule(ctx, &api.DropRuleRequest{Name: "nginx"})
+	code(t, err, codes.FailedPrecondition, "drop running rule")
+
+	if r, err = s.StopRule(ctx, &api.StopRuleRequest{Name: "nginx"}); err != nil || r.Running || db.rules["nginx"].Isopen {
+		t.Fatalf("stop %+v %v %+v", r, err, db.rules["nginx"])
+	}
+
+	// 清理文件位置失败时恢复缓存
+	db.fail[dbapi.REMOVEALL] = errors.New("db down")
+	_, err = s.DropRule(ctx, &api.DropRuleRequest{Name: "nginx"})
+	code(t, err, codes.Internal, "drop with storage error")
+	if _, err := s.stge.Get("nginx"); err != nil {
+		t.Error("cache not rolled back")
+	}
+	delete(db.fail, dbapi.REMOVEALL)
+
+	if _, err = s.DropRule(ctx, &api.DropRuleRequest{Name: "nginx"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.rules["nginx"]; ok || !reflect.DeepEqual(db.removed, []string{"nginx"}) {
+		t.Errorf("drop left %+v removed %v", db.rules, db.removed)
+	}
+	_, err = s.DropRule(ctx, &api.DropRuleRequest{Name: "nginx"})
+	code(t, err, codes.NotFound, "drop missing")
+
+	// 只在缓存中的规则也可以删除
+	s.CreateRule(ctx, &api.CreateRuleRequest{Name: "draft", Options: options(dir)})
+	if _, err = s.DropRule(ctx, &api.DropRuleRequest{Name: "draft"}); err != nil {
+		t.Errorf("drop uncommitted %v", err)
+	}
+}
+
+func TestListRules(t *testing.T) {
+	s, _, dir := ruleServer(t)
+	ctx := context.Background()
+	for _, name := range []string{"nginx", "sshd", "app"} {
+		if _, err := s.CreateRule(ctx, &api.CreateRuleRequest{Name: name, Options: options(dir)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.CommitRule(ctx, &api.CommitRuleRequest{Name: "sshd"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartRule(ctx, &api.StartRuleRequest{Name: "sshd"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ListRules(ctx, &api.ListRulesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range res.Rules {
+		got = append(got, r.Name)
+		if r.Committed != (r.Name == "sshd") || r.Running != (r.Name == "sshd") {
+			t.Errorf("rule %+v", r)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"app", "nginx", "sshd"}) {
+		t.Errorf("rules %v", got)
+	}
+	if res, err = s.ListRules(ctx, &api.ListRulesRequest{Pattern: "^s"}); err != nil || len(res.Rules) != 1 || res.Rules[0].Name != "sshd" {
+		t.Errorf("rules matching ^s %+v %v", res, err)
+	}
+	_, err = s.ListRules(ctx, &api.ListRulesRequest{Pattern: "("})
+	code(t, err, codes.InvalidArgument, "invalid pattern")
+}
+
+func TestWorkerLimit(t *testing.T) {
+	s, _, dir := ruleServer(t)
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "c"} {
+		s.CreateRule(ctx, &api.CreateRuleRequest{Name: name, Options: options(dir)})
+		if _, err := s.CommitRule(ctx, &api.CommitRuleRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.scheduler.SetMax(1); n != 0 {
+		t.Errorf("running %d", n)
+	}
+	if _, err := s.StartRule(ctx, &api.StartRuleRequest{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.StartRule(ctx, &api.StartRuleRequest{Name: "b"})
+	code(t, err, codes.ResourceExhausted, "start over limit")
+	if s.scheduler.Exists(&Worker{name: "b"}) {
+		t.Error("worker started over limit")
+	}
+	// 恢复运行不检查上限
+	if err := s.scheduler.Add(&Worker{name: "b", stge: s.stge, persists: s.persists}, false); err != nil {
+		t.Errorf("add without limit %v", err)
+	}
+	s.scheduler.SetMax(0)
+	if _, err := s.StartRule(ctx, &api.StartRuleRequest{Name: "c"}); err != nil {
+		t.Errorf("start without limit %v", err)
+	}
+
+	if err := s.scheduler.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StartRule(ctx, &api.StartRuleRequest{Name: "a"})
+	code(t, err, codes.Unavailable, "start after shutdown")
+}
+
+func TestRuleStorageError(t *testing.T) {
+	s, db, dir := ruleServer(t)
+	ctx := context.Background()
+	s.CreateRule(ctx, &api.CreateRuleRequest{Name: "nginx", Options: options(dir)})
+	db.fail[dbapi.GET] = errors.New("db down")
+	_, err := s.GetRule(ctx, &api.GetRuleRequest{Name: "nginx"})
+	code(t, err, codes.Internal, "get with storage error")
+	_, err = s.StartRule(ctx, &api.StartRuleRequest{Name: "nginx"})
+	code(t, err, codes.Internal, "start with storage error")
+	delete(db.fail, dbapi.GET)
+
+	db.fail[dbapi.SET] = errors.New("db down")
+	_, err = s.CommitRule(ctx, &api.CommitRuleRequest{Name: "nginx"})
+	code(t, err, codes.Internal, "commit with storage error")
+	db.fail[dbapi.KEYS] = errors.New("db down")
+	_, err = s.ListRules(ctx, &api.ListRulesRequest{})
+	code(t, err, codes.Internal, "list with storage error")
+}
+
+func TestTestRule(t *testing.T) {
+	s, _, _ := ruleServer(t)
+	ctx := context.Background()
+	_, err := s.TestRule(ctx, &api.TestRuleRequest{Name: "none", Data: "x"})
+	code(t, err, codes.NotFound, "test missing rule")
+	s.stge.Set("broken", "{")
+	_, err = s.TestRule(ctx, &api.TestRuleRequest{Name: "broken", Data: "x"})
+	code(t, err, codes.FailedPrecondition, "test broken rule")
+}
+
+func TestRuleCommands(t *testing.T) {
+	s, _, dir := ruleServer(t)
+	execute := func(line string) *api.ExecuteCommandResponse {
+		t.Helper()
+		res, err := s.Execute(context.Background(), &api.ExecuteRequest{Command: []byte(line)})
+		if err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+		return res
+	}
+	cases := []struct {
+		line  string
+		reply api.CommandExecutionReply
+		item  string
+		items []string
+	}{
+		{"RULES", api.SliceCommandReply, "", []string{"(noitems)"}},
+		{"SET nginx `" + options(dir) + "`", api.OkCommandReply, "", nil},
+		{"SET bad `{`", api.ErrCommandReply, "rule unmarshal err: unexpected end of JSON input", nil},
+		{"DESC nginx", api.StringCommandReply, options(dir), nil},
+		{"DESC none", api.ErrCommandReply, "rule (none) not found.", nil},
+		{"START nginx", api.ErrCommandReply, "rule (nginx) not committed.", nil},
+		{"COMMIT nginx", api.OkCommandReply, "", nil},
+		{"TOP", api.SliceCommandReply, "", []string{"not worker running."}},
+		{"LIST nginx", api.ErrCommandReply, "not start work nginx", nil},
+		{"STOP nginx", api.StringCommandReply, "worker process (nginx) rule already stop.", nil},
+		{"START nginx", api.StringCommandReply, "start worker process apply rule (nginx).", nil},
+		{"START nginx", api.StringCommandReply, "worker process (nginx) already running.", nil},
+		{"START none", api.ErrCommandReply, "not define rule (none).", nil},
+		{"TOP", api.SliceCommandReply, "", []string{"nginx"}},
+		{"LIST nginx", api.StringCommandReply, "not monitor file.", nil},
+		{"RULES ^ng", api.SliceCommandReply, "", []string{"nginx"}},
+		{"RULES (", api.ErrCommandReply, "invalid pattern (().", nil},
+		{"DROP nginx", api.ErrCommandReply, "worker (nginx) is running.", nil},
+		{"STOP nginx", api.StringCommandReply, "stop worker process rule (nginx).", nil},
+		{"STOP none", api.ErrCommandReply, "not define rule (none).", nil},
+		{"DROP nginx", api.OkCommandReply, "", nil},
+		{"DROP nginx", api.ErrCommandReply, "get rule error:(nginx) on cache.", nil},
+	}
+	for _, c := range cases {
+		res := execute(c.line)
+		if res.Reply != c.reply || res.Item != c.item || !reflect.DeepEqual(res.Items, c.items) {
+			t.Errorf("%s = %v %q %q, want %v %q %q", c.line, res.Reply, res.Item, res.Items, c.reply, c.item, c.items)
+		}
+	}
+
+	// 工作进程数达到上限
+	for _, name := range []string{"a", "b"} {
+		execute("SET " + name + " `" + options(dir) + "`")
+		execute("COMMIT " + name)
+	}
+	s.scheduler.SetMax(1)
+	if res := execute("START a"); res.Reply != api.StringCommandReply {
+		t.Errorf("start a %+v", res)
+	}
+	if res := execute("START b"); res.Reply != api.ErrCommandReply || res.Item != "running workers reach the limit (1)." {
+		t.Errorf("start over limit %+v", res)
+	}
+
+	res, err := s.Execute(context.Background(), &api.ExecuteRequest{Command: []byte("NOPE")})
+	if err != command.ErrCommandNotFound || res.Reply != api.ErrCommandReply || !strings.Contains(res.Item, "not found") {
+		t.Errorf("unknown command %+v %v", res, err)
+	}
+	names, _ := s.stge.Keys()
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("cached rules %v", names)
+	}
+}
@@ -1,12 +1,25 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"logauditer/alert"
 	"logauditer/api"
+	"logauditer/auth"
+	"logauditer/chain"
 	"logauditer/command"
+	"logauditer/live"
+	"logauditer/notify"
+	"logauditer/provision"
+	"logauditer/query"
+	"logauditer/report"
+	"logauditer/search"
+	"logauditer/trail"
 	"sort"
 	"strings"
+	"time"
 
 	"logauditer/dbapi"
 	ii "logauditer/internal"
@@ -16,12 +29,11 @@ import (
 	"sync"
 	"unsafe"
 
-	"github.com/gogo/grpc-example/insecure"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/validator"
 	context "golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"gopkg.in/mgo.v2/bson"
 
 	log "github.com/laik/logger"
 )
@@ -35,9 +47,22 @@ const (
 type Scheduler struct {
 	mu      sync.Mutex
 	workers map[string]*Worker
+	// 停止服务后不再启动工作进程
+	closed bool
+	// 同时运行的规则数上限, 0 不限制
+	max int
 }
 
+// Add 的错误
+var (
+	ErrWorkerExists = errors.New("worker already running")
+	ErrWorkerLimit  = errors.New("running workers reach the limit")
+	ErrShuttingDown = errors.New("server is shutting down")
+)
+
 func (s *Scheduler) List() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	result := make([]string, 0, len(s.workers))
 	for name, _ := range s.workers {
 		result = append(result, name)
@@ -46,22 +71,63 @@ func (s *Scheduler) List() []string {
 }
 
 func (s *Scheduler) Exists(w *Worker) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if _, ok := s.workers[w.name]; ok {
 		return true
 	}
 	return false
 }
 
-func (s *Scheduler) Add(w *Worker) bool {
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.workers)
+}
+
+func (s *Scheduler) Get(name string) (*Worker, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.workers[name]
+	return w, ok
+}
+
+// SetMax 修改同时运行的规则数上限, 返回正在运行的规则数
+func (s *Scheduler) SetMax(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max = n
+	return len(s.workers)
+}
+
+func (s *Scheduler) Max() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+// Add 启动并加入工作进程, 同名进程已运行或 limit 为 true 且运行数达到 max(> 0)时不启动
+func (s *Scheduler) Add(w *Worker, limit bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		log.Warn("server is shutting down, worker (%s) not started\n", w.name)
+		return ErrShuttingDown
+	}
+	if _, ok := s.workers[w.name]; ok {
+		return ErrWorkerExists
+	}
+	if limit && s.max > 0 && len(s.workers) >= s.max {
+		return ErrWorkerLimit
+	}
 	if err := w.run(); err != nil {
 		log.Error("run worker error %s\n", err)
-		return false
+		ll.Emit(ll.ERROR, w.name, "", err.Error())
+		return err
 	}
 	s.workers[w.name] = w
-	return true
+	return nil
 }
 
 func (s *Scheduler) Del(w *Worker) bool {
@@ -77,9 +143,41 @@ func (s *Scheduler) Del(w *Worker) bool {
 	return true
 }
 
+// Shutdown 并行停止全部工作进程, 不修改持久化的运行状态, 重启后按原状态恢复
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	workers := make([]*Worker, 0, len(s.workers))
+	for _, w := range s.workers {
+		workers = append(workers, w)
+	}
+	s.workers = make(map[string]*Worker)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			w.stop()
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop workers: %s", ctx.Err())
+	}
+}
+
 type Worker struct {
 	name string
-	d    *ll.Directory
+	d    ll.Roots
 	// runtime options stge
 	stge command.DataStore
 
@@ -97,25 +195,27 @@ func (w *Worker) run() error {
 		return err
 	}
 	log.Debug("runtimeops = %#v\n", rops)
-	w.d, err = ll.NewDirectory(rops, ll.ROOT, w.persists, w.name)
+	w.d, err = ll.NewRoots(context.Background(), rops, w.persists, w.name)
 
 	if err != nil {
 		return err
 	}
 	log.Info("start worker (%s)\n", w.name)
+	ll.Emit(ll.STARTED, w.name, "", "")
 	return nil
 }
 
 func (w *Worker) stop() (err error) {
 	defer log.Info("stop worker (%s) error:(%v)\n", w.name, err)
 	w.d.Close()
+	ll.Emit(ll.STOPPED, w.name, "", "")
 	return
 }
 
-func (w *Worker) list() []string {
-	r := make([]string, 0)
-	w.d.List(&r)
-	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+func (w *Worker) files() []ll.LastPosition {
+	r := make([]ll.LastPosition, 0)
+	w.d.Files(&r)
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
 	return r
 }
 
@@ -126,6 +226,30 @@ type Server struct {
 	persistType dbapi.DBType
 	scheduler   *Scheduler
 	stge        command.DataStore
+	alerts      *alert.Engine
+	notifiers   *notify.Manager
+	chain       *chain.Chain
+	reports     *report.Manager
+	live        *live.Hub
+	auth        *auth.Manager
+	trail       *trail.Recorder
+	tls         *tls.Config
+	provisioner *provision.Provisioner
+
+	mu         sync.Mutex
+	grpcServer *grpc.Server
+
+	// 访问规则等持久化数据, 为空时使用 dbapi; 测试时替换
+	access func(db, coll string, query, res interface{}, op dbapi.OPType) error
+}
+
+func (s *Server) database(db, coll string, query, res interface{}, op dbapi.OPType) error {
+	if s.access != nil {
+		return s.access(db, coll, query, res, op)
+	}
+	var _err error
+	dbapi.AccessDatabase(s.persists, db, coll, query, res, op, s.persistType, &_err)
+	return _err
 }
 
 func NewServer(parser *command.Parser, stge command.DataStore, persists *dbapi.StorageParts, persistType dbapi.DBType) (*Server, error) {
@@ -138,22 +262,24 @@ func NewServer(parser *command.Parser, stge command.DataStore, persists *dbapi.S
 		scheduler: &Scheduler{
 			workers: make(map[string]*Worker),
 		},
-		stge: stge,
+		stge:      stge,
+		alerts:    alert.NewEngine(persists, persistType),
+		notifiers: notify.NewManager(persists, persistType),
 	}
 
-	var _err error
+	if err := server.notifiers.Load(); err != nil {
+		log.Error("load notifiers error: %s.\n", err)
+		return nil, err
+	}
+	if err := server.alerts.Load(); err != nil {
+		log.Error("load alert rules error: %s.\n", err)
+		return nil, err
+	}
+	server.alerts.AddDispatcher(server.notifiers)
+	ll.RegisterHook(server.alerts)
+
 	var _list []*command.Persist
-	dbapi.AccessDatabase(
-		server.persists,
-		AUDIT_LOG_DATABASE,
-		AUDIT_LOG_RULE,
-		nil,
-		&_list,
-		dbapi.KEYS,
-		server.persistType,
-		&_err,
-	)
-	if _err != nil {
+	if _err := server.database(AUDIT_LOG_DATABASE, AUDIT_LOG_RULE, nil, &_list, dbapi.KEYS); _err != nil {
 		log.Error("get persists (%s) not found.\n.", ll.LIBDB)
 		return nil, _err
 	}
@@ -165,9 +291,7 @@ func NewServer(parser *command.Parser, stge command.DataStore, persists *dbapi.S
 				stge:     server.stge,
 				persists: server.persists,
 			}
-			if !server.scheduler.Exists(w) {
-				server.scheduler.Add(w)
-			}
+			server.scheduler.Add(w, false)
 		}
 		if err != nil {
 			return nil, fmt.Errorf("%s", "from persist obtain rule set cache error maybe cache is not initialize.")
@@ -177,6 +301,16 @@ func NewServer(parser *command.Parser, stge command.DataStore, persists *dbapi.S
 	return server, nil
 }
 
+// SetChain 设置记录哈希链, 用于 VERIFY 校验签名检查点
+func (s *Server) SetChain(c *chain.Chain) {
+	s.chain = c
+}
+
+// SetReports 设置报表管理, 用于 REPORT 命令
+func (s *Server) SetReports(m *report.Manager) {
+	s.reports = m
+}
+
 func (s *Server) Execute(ctx context.Context, req *api.ExecuteRequest) (*api.ExecuteCommandResponse, error) {
 	cmdStr := *(*string)(unsafe.Pointer(&req.Command))
 
@@ -191,10 +325,10 @@ func (s *Server) Execute(ctx context.Context, req *api.ExecuteRequest) (*api.Exe
 		return nil, fmt.Errorf("could not parse command: %v", err)
 	}
 
-	return s.createExecuteCommandResponse(cmd.Execute(args...))
+	return s.createExecuteCommandResponse(ctx, cmd.Execute(args...))
 }
 
-func (s *Server) createExecuteCommandResponse(reply command.Reply) (
+func (s *Server) createExecuteCommandResponse(ctx context.Context, reply command.Reply) (
 	*api.ExecuteCommandResponse,
 	error,
 ) {
@@ -219,258 +353,341 @@ func (s *Server) createExecuteCommandResponse(reply command.Reply) (
 		}
 		res.Items = []string{"(noitems)"}
 
-	case *command.PersistReply:
-		var _err error
-		dbapi.AccessDatabase(
-			s.persists,
-			AUDIT_LOG_DATABASE,
-			AUDIT_LOG_RULE,
-			bson.M{"_id": &t.Message.Id},
-			&t.Message,
-			dbapi.SET,
-			s.persistType,
-			&_err,
-		)
-		if _err == nil {
-			res.Reply = api.OkCommandReply
-			log.Debug("commit rule (%s) success.\n", t.Message.Id)
-			break
-		}
-		res.Reply = api.ErrCommandReply
-		res.Item = _err.Error()
+	case *command.RuleReply:
+		s.ruleCommand(ctx, &t.Message, res)
 
-	case *command.TestReply:
-		tester := t.Message
+	case *command.AlertReply:
+		s.alertCommand(&t.Message, res)
 
-		runtimeOptions := &ii.RuntimeOptions{
-			ColumnPattern: &ii.ColumnPattern{},
-		}
+	case *command.NotifierReply:
+		s.notifierCommand(&t.Message, res)
 
-		if err := runtimeOptions.Unmarshal(
-			[]byte(tester.Rule),
-			json.Unmarshal,
-		); err != nil {
+	case *command.VerifyReply:
+		if _, err := s.stge.Get(t.Message.Rule); err != nil {
 			res.Reply = api.ErrCommandReply
-			res.Item = fmt.Sprintf(
-				"test rule error unmarshal to runtimeOptions error: %s.",
-				err,
-			)
-			return res, nil
+			res.Item = "rule is not exists."
+			break
+		}
+		var pub []byte
+		if s.chain != nil {
+			pub = s.chain.PublicKey()
 		}
-		var _err error
-		resp := ii.NewResponse()
-		ii.VisitLogsAudit2(s.logParts, tester.Data, resp, runtimeOptions, &_err)
-
-		if resp.Err != nil || len(strings.Trim(resp.Data, " ")) == 0 {
-			res.Item = fmt.Sprintf(`with rule (%s) test faild. rule runtime options[%#v].test data:(%s). error:(%s)`,
-				tester.Rule,
-				runtimeOptions,
-				tester.Data,
-				_err,
-			)
+		report, err := chain.Verify(s.persists, s.persistType, t.Message.Rule, t.Message.Date, pub)
+		if err != nil {
 			res.Reply = api.ErrCommandReply
-			return res, nil
+			res.Item = err.Error()
+			break
 		}
-
-		res.Item = resp.Data
-		res.Reply = api.StringCommandReply
-
-	case *command.DropReply:
-		if s.scheduler.Exists(&Worker{name: t.Message}) {
+		if report.Broken != nil {
 			res.Reply = api.ErrCommandReply
-			res.Item = fmt.Sprintf("worker (%s) is running.", t.Message)
+			res.Item = fmt.Sprintf("rule (%s) date (%s) chain broken: %s", report.Rule, report.Date, report.Broken)
 			break
 		}
+		res.Reply = api.SliceCommandReply
+		res.Items = append(res.Items, fmt.Sprintf("rule (%s) date (%s) records (%d) unchained (%d) verified.",
+			report.Rule, report.Date, report.Records, report.Unchained))
+		for _, sr := range report.Streams {
+			res.Items = append(res.Items, fmt.Sprintf("stream (%s) seq [%d-%d] records (%d) checkpoints (%d) ok.",
+				sr.Stream, sr.First, sr.Last, sr.Records, sr.Checkpoints))
+		}
 
-		_s, err := s.stge.Get(t.Message)
-		if err != nil {
+	case *command.SearchReply:
+		s.searchCommand(&t.Message, res)
+
+	case *command.ReportReply:
+		s.reportCommand(&t.Message, res)
+
+	case *command.UserReply:
+		s.userCommand(ctx, &t.Message, res)
+
+	case *command.TrailReply:
+		s.trailCommand(&t.Message, res)
+
+	case *command.ProvisionReply:
+		s.provisionCommand(&t.Message, res)
+
+	case *command.FollowReply:
+		res.Reply = api.ErrCommandReply
+		res.Item = "FOLLOW streams records, run it from the terminal client or call TailRecords/WatchWorkers."
+
+	case *command.ErrReply:
+		res.Reply = api.ErrCommandReply
+		res.Item = fmt.Sprintf("%v", t.Message)
+
+	default:
+		return nil, fmt.Errorf("unsupported type %T", reply)
+	}
+
+	return res, nil
+}
+
+func (s *Server) searchCommand(op *command.SearchOp, res *api.ExecuteCommandResponse) {
+	req := &search.Request{Limit: op.Limit, Cursor: op.Cursor}
+	if err := query.Apply(req, op.Query); err != nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = err.Error()
+		return
+	}
+	srv := &search.Service{SP: s.persists, PersistType: s.persistType}
+	result, err := srv.Find(req)
+	if err != nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = err.Error()
+		return
+	}
+	res.Reply = api.SliceCommandReply
+	for _, r := range result.Records {
+		res.Items = append(res.Items, fmt.Sprintf("%s %s %s %s %s %s %s",
+			r.Id.Time().Format("2006-01-02 15:04:05"), r.Rule, r.Host, r.UserName, r.IpAddr, r.State, r.Operation))
+	}
+	summary := fmt.Sprintf("total (%d) returned (%d).", result.Total, len(result.Records))
+	if result.Next != "" {
+		summary += fmt.Sprintf(" next: SEARCH `%s` LIMIT %d CURSOR %s", op.Query, op.Limit, result.Next)
+	}
+	res.Items = append(res.Items, summary)
+}
+
+func (s *Server) alertCommand(op *command.AlertOp, res *api.ExecuteCommandResponse) {
+	switch op.Op {
+	case command.ALERT_SET:
+		if err := s.alerts.Set(op.Rule); err != nil {
 			res.Reply = api.ErrCommandReply
-			res.Item = fmt.Sprintf("get rule error:(%s) on cache.", t.Message)
-			break
+			res.Item = err.Error()
+			return
 		}
+		res.Reply = api.OkCommandReply
 
-		if err := s.stge.Del(t.Message); err != nil {
-			log.Debug("drop rule (%s) on cache.\n", t.Message)
-			break
+	case command.ALERT_DESC:
+		r, ok := s.alerts.Get(op.Name)
+		if !ok {
+			res.Reply = api.ErrCommandReply
+			res.Item = fmt.Sprintf("alert rule (%s) not found.", op.Name)
+			return
 		}
-		var _err error
-		log.Debug("remove all on cache (%s.%s).\n", ll.LIBDB, t.Message)
-		dbapi.AccessDatabase(s.persists, ll.LIBDB, t.Message, nil, nil, dbapi.REMOVEALL, s.persistType, &_err)
-		if _err != nil {
-			log.Error("clean (%s) ns error:%s.\n", t.Message, _err)
+		b, err := json.Marshal(r)
+		if err != nil {
 			res.Reply = api.ErrCommandReply
-			res.Item = _err.Error()
-			if err := s.stge.Set(t.Message, _s); err != nil {
-				log.Error("rollback on drop rule ns.")
-			}
-			break
+			res.Item = err.Error()
+			return
 		}
-		// clean persists rule
-		var _err2 error
-		dbapi.AccessDatabase(
-			s.persists,
-			AUDIT_LOG_DATABASE,
-			AUDIT_LOG_RULE,
-			bson.M{"_id": t.Message},
-			nil,
-			dbapi.DEL,
-			s.persistType,
-			&_err2,
-		)
-		if _err2 != nil {
+		res.Reply = api.StringCommandReply
+		res.Item = string(b)
+
+	case command.ALERT_DEL:
+		if err := s.alerts.Del(op.Name); err != nil {
 			res.Reply = api.ErrCommandReply
-			res.Item = _err2.Error()
-			log.Error("can not rollback drop rule (%s) error (%s).\n", t.Message, _err2)
-			break
+			res.Item = err.Error()
+			return
 		}
 		res.Reply = api.OkCommandReply
-		_ = _s
-
-	case *command.RunnerReply:
-		var _err error
-		p := &command.Persist{}
-		dbapi.AccessDatabase(
-			s.persists,
-			AUDIT_LOG_DATABASE,
-			AUDIT_LOG_RULE,
-			bson.M{"_id": t.Message.Rule},
-			p,
-			dbapi.GET,
-			s.persistType,
-			&_err,
-		)
-		if _err != nil {
-			log.Warn("query persists not exists:(%s) error:(%s).\n", t.Message.Rule, _err)
+
+	case command.ALERT_RULES:
+		res.Reply = api.SliceCommandReply
+		res.Items = s.alerts.List()
+		if len(res.Items) == 0 {
+			res.Items = []string{"(noitems)"}
+		}
+
+	case command.ALERT_LIST:
+		alerts, err := s.alerts.Alerts(op.Date)
+		if err != nil {
 			res.Reply = api.ErrCommandReply
-			res.Item = "not persists the rule."
-			break
+			res.Item = err.Error()
+			return
 		}
-		w := &Worker{
-			name:     t.Message.Rule,
-			stge:     s.stge,
-			persists: s.persists,
+		res.Reply = api.SliceCommandReply
+		if len(alerts) == 0 {
+			res.Items = []string{"(noitems)"}
+			return
 		}
+		for _, a := range alerts {
+			res.Items = append(res.Items, fmt.Sprintf("%s [%s] %s", a.LastAt.Format("15:04:05"), a.Level, a.Message))
+		}
+	}
+}
 
-		switch t.Message.State {
-		case command.START:
-			if !s.scheduler.Exists(w) {
-				ok := s.scheduler.Add(w)
-				if !ok {
-					res.Item = fmt.Sprintf("start worker process apply rule (%s) not success.", t.Message.Rule)
-					res.Reply = api.ErrCommandReply
-					break
-				}
-				p.Isopen = true
-				dbapi.AccessDatabase(
-					s.persists,
-					AUDIT_LOG_DATABASE,
-					AUDIT_LOG_RULE,
-					bson.M{"_id": t.Message.Rule},
-					p,
-					dbapi.SET,
-					s.persistType,
-					&_err,
-				)
-				if _err != nil {
-					if ok := s.scheduler.Del(w); !ok {
-						res.Item = fmt.Sprintf("del (%s) not start success worker error,status brokens.", w.name)
-						res.Reply = api.ErrCommandReply
-						break
-					}
-					res.Item = fmt.Sprintf("start worker persists status error(%s).", t.Message.Rule)
-					res.Reply = api.ErrCommandReply
-					break
-				}
-				res.Item = fmt.Sprintf("start worker process apply rule (%s).", t.Message.Rule)
-				res.Reply = api.StringCommandReply
-
-			} else {
-				res.Item = fmt.Sprintf("worker process (%s) already running.", t.Message.Rule)
-				res.Reply = api.StringCommandReply
-			}
+func (s *Server) notifierCommand(op *command.NotifierOp, res *api.ExecuteCommandResponse) {
+	var err error
+	switch op.Op {
+	case command.NOTIFIER_SET:
+		err = s.notifiers.Set(op.Config)
 
-		case command.STOP:
-			if s.scheduler.Exists(w) {
-				ok := s.scheduler.Del(w)
-				if !ok {
-					res.Item = fmt.Sprintf("stop worker process rule (%s) not success.", t.Message.Rule)
-					res.Reply = api.ErrCommandReply
-					break
-				}
-				p.Isopen = false
-				dbapi.AccessDatabase(
-					s.persists,
-					AUDIT_LOG_DATABASE,
-					AUDIT_LOG_RULE,
-					bson.M{"_id": t.Message.Rule},
-					p,
-					dbapi.SET,
-					s.persistType,
-					&_err,
-				)
-				if _err != nil {
-					res.Item = fmt.Sprintf("stop worker persists status error(%s).", t.Message.Rule)
-					res.Reply = api.ErrCommandReply
-					break
-				}
-				res.Item = fmt.Sprintf("stop worker process rule (%s).", t.Message.Rule)
-				res.Reply = api.StringCommandReply
-				break
-			}
-			res.Item = fmt.Sprintf("worker process (%s) rule already stop.", t.Message.Rule)
+	case command.NOTIFIER_DEL:
+		err = s.notifiers.Del(op.Name)
+
+	case command.NOTIFIER_TEST:
+		err = s.notifiers.Test(op.Name)
+
+	case command.NOTIFIER_DESC:
+		c, ok := s.notifiers.Get(op.Name)
+		if !ok {
+			err = fmt.Errorf("notifier (%s) not found.", op.Name)
+			break
+		}
+		var b []byte
+		if b, err = json.Marshal(c.Redacted()); err == nil {
 			res.Reply = api.StringCommandReply
+			res.Item = string(b)
+			return
 		}
 
-	case *command.TopReply:
-		ss := s.scheduler.List()
+	case command.NOTIFIER_LIST:
 		res.Reply = api.SliceCommandReply
-		if len(ss) == 0 {
-			res.Items = []string{"not worker running."}
+		res.Items = s.notifiers.List()
+		if len(res.Items) == 0 {
+			res.Items = []string{"(noitems)"}
+		}
+		return
+	}
+	if err != nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = err.Error()
+		return
+	}
+	res.Reply = api.OkCommandReply
+}
+
+func (s *Server) reportCommand(op *command.ReportOp, res *api.ExecuteCommandResponse) {
+	if s.reports == nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = "report is not enabled."
+		return
+	}
+	var err error
+	switch op.Op {
+	case command.REPORT_SET:
+		err = s.reports.Set(op.Definition)
+
+	case command.REPORT_DEL:
+		err = s.reports.Del(op.Name)
+
+	case command.REPORT_RUN:
+		if _, ok := s.reports.Get(op.Name); !ok {
+			err = fmt.Errorf("report (%s) not found.", op.Name)
 			break
 		}
-		res.Items = ss
+		// 导出可能耗时较长, 后台运行, 结果通过 REPORT RUNS 查看
+		go s.reports.RunNow(op.Name)
+		res.Reply = api.StringCommandReply
+		res.Item = fmt.Sprintf("report (%s) started.", op.Name)
+		return
 
-	case *command.ListRuleReply:
-		if !s.scheduler.Exists(&Worker{name: t.Message}) {
-			res.Reply = api.ErrCommandReply
-			res.Item = fmt.Sprintf("not start work %v", t.Message)
+	case command.REPORT_DESC:
+		d, ok := s.reports.Get(op.Name)
+		if !ok {
+			err = fmt.Errorf("report (%s) not found.", op.Name)
 			break
 		}
-		w := s.scheduler.workers[t.Message]
-		rs := w.list()
-		if len(rs) == 0 {
+		var b []byte
+		if b, err = json.Marshal(d); err == nil {
 			res.Reply = api.StringCommandReply
-			res.Item = "not monitor file."
-			break
+			res.Item = fmt.Sprintf("%s next run: %s", b, d.Next(time.Now()).Format("2006-01-02 15:04"))
+			return
 		}
+
+	case command.REPORT_LIST:
 		res.Reply = api.SliceCommandReply
-		res.Items = rs
+		res.Items = s.reports.List()
+		if len(res.Items) == 0 {
+			res.Items = []string{"(noitems)"}
+		}
+		return
 
-	case *command.ErrReply:
+	case command.REPORT_RUNS:
+		var runs []report.Run
+		if runs, err = s.reports.Runs(op.Name); err != nil {
+			break
+		}
+		res.Reply = api.SliceCommandReply
+		for _, r := range runs {
+			var files []string
+			for _, f := range r.Files {
+				files = append(files, fmt.Sprintf("%s(%d)", f.Name, f.Size))
+			}
+			res.Items = append(res.Items, fmt.Sprintf("%s %s %s", r.Name, r.Run, strings.Join(files, " ")))
+		}
+		if len(res.Items) == 0 {
+			res.Items = []string{"(noitems)"}
+		}
+		return
+	}
+	if err != nil {
 		res.Reply = api.ErrCommandReply
-		res.Item = fmt.Sprintf("%v", t.Message)
+		res.Item = err.Error()
+		return
+	}
+	res.Reply = api.OkCommandReply
+}
 
-	default:
-		return nil, fmt.Errorf("unsupported type %T", reply)
+// SetMaxWorkers 限制同时运行的规则数, 只对之后的 START 生效
+func (s *Server) SetMaxWorkers(n int) {
+	if running := s.scheduler.SetMax(n); n > 0 && running > n {
+		log.Warn("running workers (%d) exceed max workers (%d).\n", running, n)
 	}
+}
 
-	return res, nil
+// SetTLS 设置 gRPC 服务的证书配置, 须在 Run 之前调用
+func (s *Server) SetTLS(c *tls.Config) {
+	s.tls = c
 }
 
 func (s *Server) Run(grpcAddr string) error {
+	if s.tls == nil {
+		return fmt.Errorf("tls config is not set.")
+	}
 	l, err := net.Listen("tcp", grpcAddr)
 
 	if err != nil {
 		return fmt.Errorf("could not listen on %s: %v", grpcAddr, err)
 	}
 
+	unary := []grpc.UnaryServerInterceptor{grpc_validator.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{grpc_validator.StreamServerInterceptor()}
+	// 先认证与记录操作审计, 再校验参数
+	if s.auth != nil || s.trail != nil {
+		unary = append([]grpc.UnaryServerInterceptor{s.unaryInterceptor}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{s.streamInterceptor}, stream...)
+	}
+
 	srv := grpc.NewServer(
-		grpc.Creds(credentials.NewServerTLSFromCert(&insecure.Cert)),
-		grpc.UnaryInterceptor(grpc_validator.UnaryServerInterceptor()),
-		grpc.StreamInterceptor(grpc_validator.StreamServerInterceptor()),
+		grpc.Creds(credentials.NewTLS(s.tls)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unary...)),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(stream...)),
 	)
 	//registry current server
 	api.RegisterLogAuditerServer(srv, s)
 
+	s.mu.Lock()
+	s.grpcServer = srv
+	s.mu.Unlock()
 	return srv.Serve(l)
 }
+
+// Shutdown 停止接受请求并等待处理中的请求, ctx 结束时断开剩余连接; 之后停止全部工作进程, 等待告警入库和通知发送.
+// 实时推送在调用前由 live.Hub.Close 结束, 否则会一直等待
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.grpcServer
+	s.mu.Unlock()
+	if srv != nil {
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Warn("grpc graceful stop timeout, close connections\n")
+			srv.Stop()
+		}
+	}
+	err := s.scheduler.Shutdown(ctx)
+	// 工作进程停止后不再产生告警, 等待已产生的告警入库
+	s.alerts.Close()
+	// 告警入库后不再投递, 等待通知渠道发送完队列中的告警
+	if nerr := s.notifiers.Close(ctx); err == nil {
+		err = nerr
+	}
+	return err
+}
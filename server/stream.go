@@ -0,0 +1,111 @@
+package server
+
+import (
+	"logauditer/api"
+	"logauditer/live"
+	"regexp"
+
+	ii "logauditer/internal"
+	ll "logauditer/logmining"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var workerEventTypes = map[ll.EventType]api.WorkerEvent_Type{
+	ll.STARTED:      api.WorkerEvent_STARTED,
+	ll.STOPPED:      api.WorkerEvent_STOPPED,
+	ll.FILE_ADDED:   api.WorkerEvent_FILE_ADDED,
+	ll.FILE_REMOVED: api.WorkerEvent_FILE_REMOVED,
+	ll.ERROR:        api.WorkerEvent_ERROR,
+}
+
+// SetLive 设置实时记录发布订阅, 用于 TailRecords 与 WatchWorkers
+func (s *Server) SetLive(h *live.Hub) {
+	s.live = h
+}
+
+// TailRecords 推送入库成功且满足过滤条件的记录, 直到客户端断开
+func (s *Server) TailRecords(req *api.AuditRecordFilter, stream api.LogAuditer_TailRecordsServer) error {
+	if s.live == nil {
+		return status.Error(codes.Unavailable, "live records not enabled.")
+	}
+	f := &live.Filter{Rule: req.Rule, Host: req.Host, User: req.User}
+	if req.Op != "" {
+		re, err := regexp.Compile(req.Op)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid op regexp (%s).", req.Op)
+		}
+		f.Op = re
+	}
+	if req.Buffer < 0 || req.Buffer > live.MaxBuffer {
+		return status.Errorf(codes.InvalidArgument, "invalid buffer (%d).", req.Buffer)
+	}
+
+	sub := s.live.Subscribe(f, int(req.Buffer))
+	defer sub.Close()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case m, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			r := auditRecord(&m.Record)
+			r.Rule, r.File, r.Time = m.Rule, m.File, m.Time.UnixNano()
+			r.Dropped = sub.Dropped()
+			if err := stream.Send(r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// WatchWorkers 推送工作进程事件, 直到客户端断开
+func (s *Server) WatchWorkers(req *api.WatchWorkersRequest, stream api.LogAuditer_WatchWorkersServer) error {
+	if s.live == nil {
+		return status.Error(codes.Unavailable, "live records not enabled.")
+	}
+	w := s.live.Watch(req.Rule, 0)
+	defer w.Close()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-w.C:
+			if !ok {
+				return nil
+			}
+			ev := &api.WorkerEvent{
+				Type:    workerEventTypes[e.Type],
+				Rule:    e.Rule,
+				File:    e.File,
+				Message: e.Message,
+				Time:    e.Time.UnixNano(),
+				Dropped: w.Dropped(),
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func auditRecord(l *ii.AuditLog) *api.AuditRecord {
+	return &api.AuditRecord{
+		Rule:       l.Rule,
+		Host:       l.Host,
+		Date:       l.Date,
+		Device:     l.Device,
+		SystemType: l.SystemType,
+		DateTime:   l.DateTime,
+		IpAddr:     l.IpAddr,
+		Operation:  l.Operation,
+		State:      l.State,
+		UserName:   l.UserName,
+		Categories: l.Categories,
+		RiskScore:  int32(l.RiskScore),
+		Masked:     l.Masked,
+	}
+}
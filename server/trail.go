@@ -0,0 +1,165 @@
+package server
+
+import (
+	"logauditer/api"
+	"logauditer/auth"
+	"logauditer/command"
+	"logauditer/trail"
+	"strings"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// 只读的状态查询成功时不记录
+var untracedMethods = map[string]bool{
+	"GetRule":      true,
+	"ListRules":    true,
+	"ListWorkers":  true,
+	"ListFiles":    true,
+	"WatchWorkers": true,
+}
+
+// SetTrail 设置操作审计记录, 须在 Run 之前调用
+func (s *Server) SetTrail(r *trail.Recorder) {
+	s.trail = r
+}
+
+// trace 记录一次调用
+func (s *Server) trace(ctx context.Context, start time.Time, method string, req, resp interface{}, sess *auth.Session, err error) {
+	if s.trail == nil {
+		return
+	}
+	if e := s.traceEntry(ctx, start, method, req, resp, sess, err); e != nil {
+		s.trail.Record(e)
+	}
+}
+
+// traceEntry 一次调用的操作审计记录, 不需要记录时为 nil; 被拒绝或失败的调用总是记录
+func (s *Server) traceEntry(ctx context.Context, start time.Time, method string, req, resp interface{}, sess *auth.Session, err error) *trail.Entry {
+	e := &trail.Entry{
+		Time:   start,
+		Source: trail.GRPC,
+		Action: strings.TrimPrefix(method, methodPrefix),
+		Result: trail.OK,
+	}
+	if sess != nil {
+		e.User = sess.User
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		e.Peer = p.Addr.String()
+	}
+
+	traced := !untracedMethods[e.Action]
+	switch r := req.(type) {
+	case *api.ExecuteRequest:
+		e.Action, e.Command, e.Rule, traced = s.commandTrace(string(r.Command))
+	case *api.LoginRequest:
+		e.User = r.User
+	case interface{ GetName() string }:
+		e.Rule = r.GetName()
+	case interface{ GetRule() string }:
+		e.Rule = r.GetRule()
+	}
+
+	switch code := status.Code(err); {
+	case code == codes.PermissionDenied || code == codes.Unauthenticated:
+		e.Result, e.Message = trail.DENIED, status.Convert(err).Message()
+	case err != nil:
+		e.Result, e.Message = trail.ERROR, status.Convert(err).Message()
+	default:
+		if res, ok := resp.(*api.ExecuteCommandResponse); ok && res.Reply == api.ErrCommandReply {
+			e.Result, e.Message = trail.ERROR, res.Item
+		}
+	}
+	if e.Result == trail.OK && !traced {
+		return nil
+	}
+	return e
+}
+
+// commandTrace 文本命令的操作名、脱敏后的命令与目标规则, 只读命令成功时不记录
+func (s *Server) commandTrace(line string) (action, cmdline, rule string, traced bool) {
+	fields := strings.Fields(line)
+	cmdline = line
+	if len(fields) == 0 {
+		return "", "", "", true
+	}
+	action = strings.ToUpper(fields[0])
+
+	cmd, args, err := s.parser.Parse(line)
+	if err != nil {
+		return action, cmdline, "", true
+	}
+	switch cmd.(type) {
+	case *command.Alert, *command.Notifier, *command.Report, *command.User, *command.Provision:
+		if len(fields) > 1 {
+			action += " " + strings.ToUpper(fields[1])
+		}
+	case *command.Trail:
+		if len(fields) > 1 && strings.ToUpper(fields[1]) == command.TRAIL_PURGE {
+			action += " " + command.TRAIL_PURGE
+		}
+	}
+	// USER SET ${NAME} ${PASSWORD} ${ROLES}, 按解析后的参数脱敏, 密码可以用 ` 包含空格
+	if _, ok := cmd.(*command.User); ok && len(args) > 2 && strings.ToUpper(args[0]) == command.USER_SET {
+		masked := append([]string{fields[0]}, args...)
+		masked[3] = "***"
+		cmdline = strings.Join(masked, " ")
+	}
+
+	switch t := cmd.Execute(args...).(type) {
+	case *command.RuleReply:
+		rule = t.Message.Name
+	case *command.VerifyReply:
+		rule = t.Message.Rule
+	case *command.FollowReply:
+		rule = t.Message.Rule
+	}
+
+	switch cmd.(type) {
+	case *command.Help, *command.Get, *command.Keys, *command.Top, *command.List:
+		return action, cmdline, rule, false
+	}
+	return action, cmdline, rule, action != "USER WHOAMI"
+}
+
+func (s *Server) trailCommand(op *command.TrailOp, res *api.ExecuteCommandResponse) {
+	if s.trail == nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = "trail is not enabled."
+		return
+	}
+	if op.Op == command.TRAIL_PURGE {
+		if err := s.trail.Purge(op.Date); err != nil {
+			res.Reply = api.ErrCommandReply
+			res.Item = err.Error()
+			return
+		}
+		res.Reply = api.OkCommandReply
+		return
+	}
+	entries, err := s.trail.Find(&trail.Query{
+		Date:   op.Date,
+		User:   op.User,
+		Rule:   op.Rule,
+		Action: op.Action,
+		Result: op.Result,
+		Limit:  op.Limit,
+	})
+	if err != nil {
+		res.Reply = api.ErrCommandReply
+		res.Item = err.Error()
+		return
+	}
+	res.Reply = api.SliceCommandReply
+	for i := range entries {
+		res.Items = append(res.Items, entries[i].String())
+	}
+	if len(res.Items) == 0 {
+		res.Items = []string{"(noitems)"}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"logauditer/api"
+	"logauditer/auth"
+	"logauditer/command"
+	"logauditer/dbapi"
+	"logauditer/trail"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestCommandTrace(t *testing.T) {
+	s := &Server{parser: command.NewParser()}
+	cases := []struct {
+		line, action, cmdline, rule string
+		traced                      bool
+	}{
+		{"START nginx", "START", "START nginx", "nginx", true},
+		{"stop nginx", "STOP", "stop nginx", "nginx", true},
+		{"RULES", "RULES", "RULES", "", false},
+		{"LIST", "LIST", "LIST", "", false},
+		{"ALERT DEL high", "ALERT DEL", "ALERT DEL high", "", true},
+		{"TRAIL USER alice", "TRAIL", "TRAIL USER alice", "", true},
+		{"TRAIL PURGE 2019-02-25", "TRAIL PURGE", "TRAIL PURGE 2019-02-25", "", true},
+		{"USER WHOAMI", "USER WHOAMI", "USER WHOAMI", "", false},
+		{"USER DEL bob", "USER DEL", "USER DEL bob", "", true},
+		// 密码按解析后的参数脱敏
+		{"USER SET bob s3cret admin", "USER SET", "USER SET bob *** admin", "", true},
+		{"user   set  bob  s3cret  admin,auditor", "USER SET", "user set bob *** admin,auditor", "", true},
+		{"USER SET bob `my s3cret pw` auditor", "USER SET", "USER SET bob *** auditor", "", true},
+		// 参数错误时也不记录密码
+		{"USER SET bob s3cret", "USER SET", "USER SET bob ***", "", true},
+		{"USER SET bob s3cret nope", "USER SET", "USER SET bob *** nope", "", true},
+		{"USER SET bob", "USER SET", "USER SET bob", "", true},
+		{"NOPE x", "NOPE", "NOPE x", "", true},
+		{"", "", "", "", true},
+	}
+	for _, c := range cases {
+		action, cmdline, rule, traced := s.commandTrace(c.line)
+		if action != c.action || cmdline != c.cmdline || rule != c.rule || traced != c.traced {
+			t.Errorf("commandTrace(%q) = %q %q %q %v, want %q %q %q %v",
+				c.line, action, cmdline, rule, traced, c.action, c.cmdline, c.rule, c.traced)
+		}
+	}
+}
+
+func TestTraceEntry(t *testing.T) {
+	s := &Server{parser: command.NewParser()}
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	sess := &auth.Session{User: "alice", Roles: []string{auth.OPERATOR}}
+	start := time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)
+	denied := status.Error(codes.PermissionDenied, "not allowed")
+
+	cases := []struct {
+		method string
+		req    interface{}
+		resp   interface{}
+		sess   *auth.Session
+		err    error
+		// nil 表示不记录
+		want *trail.Entry
+	}{
+		{"StartRule", &api.StartRuleRequest{Name: "nginx"}, nil, sess, nil,
+			&trail.Entry{Action: "StartRule", User: "alice", Rule: "nginx", Result: trail.OK}},
+		{"ListRules", &api.ListRulesRequest{}, nil, sess, nil, nil},
+		{"ListFiles", &api.ListFilesRequest{Rule: "nginx"}, nil, sess, denied,
+			&trail.Entry{Action: "ListFiles", User: "alice", Rule: "nginx", Result: trail.DENIED, Message: "not allowed"}},
+		{"GetRule", &api.GetRuleRequest{Name: "x"}, nil, sess, status.Error(codes.NotFound, "rule (x) not found."),
+			&trail.Entry{Action: "GetRule", User: "alice", Rule: "x", Result: trail.ERROR, Message: "rule (x) not found."}},
+		{"Login", &api.LoginRequest{User: "bob", Password: "pw"}, nil, nil, status.Error(codes.Unauthenticated, "bad password"),
+			&trail.Entry{Action: "Login", User: "bob", Result: trail.DENIED, Message: "bad password"}},
+		{"Execute", &api.ExecuteRequest{Command: []byte("USER SET bob s3cret admin")}, &api.ExecuteCommandResponse{Reply: api.OkCommandReply}, sess, nil,
+			&trail.Entry{Action: "USER SET", User: "alice", Command: "USER SET bob *** admin", Result: trail.OK}},
+		{"Execute", &api.ExecuteRequest{Command: []byte("START nginx")}, &api.ExecuteCommandResponse{Reply: api.ErrCommandReply, Item: "rule is not exists."}, sess, nil,
+			&trail.Entry{Action: "START", User: "alice", Command: "START nginx", Rule: "nginx", Result: trail.ERROR, Message: "rule is not exists."}},
+		{"Execute", &api.ExecuteRequest{Command: []byte("RULES")}, &api.ExecuteCommandResponse{Reply: api.SliceCommandReply}, sess, nil, nil},
+		{"Execute", &api.ExecuteRequest{Command: []byte("TRAIL PURGE 2019-02-25")}, nil, sess, denied,
+			&trail.Entry{Action: "TRAIL PURGE", User: "alice", Command: "TRAIL PURGE 2019-02-25", Result: trail.DENIED, Message: "not allowed"}},
+		// 流式接口未收到请求即被拒绝
+		{"WatchWorkers", nil, nil, nil, status.Error(codes.Unauthenticated, "missing token, login first."),
+			&trail.Entry{Action: "WatchWorkers", Result: trail.DENIED, Message: "missing token, login first."}},
+	}
+	for _, c := range cases {
+		e := s.traceEntry(ctx, start, methodPrefix+c.method, c.req, c.resp, c.sess, c.err)
+		if c.want == nil {
+			if e != nil {
+				t.Errorf("%s %+v recorded %+v", c.method, c.req, e)
+			}
+			continue
+		}
+		if e == nil {
+			t.Errorf("%s %+v not recorded", c.method, c.req)
+			continue
+		}
+		c.want.Time, c.want.Source, c.want.Peer = start, trail.GRPC, "10.0.0.1:5000"
+		if *e != *c.want {
+			t.Errorf("%s %+v entry %+v, want %+v", c.method, c.req, e, c.want)
+		}
+	}
+}
+
+func TestTrailCommand(t *testing.T) {
+	execute := func(s *Server, line string) *api.ExecuteCommandResponse {
+		res, err := s.Execute(context.Background(), &api.ExecuteRequest{Command: []byte(line)})
+		if err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+		return res
+	}
+	s := &Server{parser: command.NewParser()}
+	if res := execute(s, "TRAIL"); res.Reply != api.ErrCommandReply || res.Item != "trail is not enabled." {
+		t.Errorf("trail disabled %+v", res)
+	}
+
+	s.SetTrail(trail.New(dbapi.NewStorageParts(), dbapi.KV))
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	today := time.Now().Format("2006-01-02")
+	if res := execute(s, "TRAIL PURGE "+yesterday); res.Reply != api.OkCommandReply {
+		t.Errorf("purge yesterday %+v", res)
+	}
+	// 不能删除当天的记录
+	if res := execute(s, "TRAIL PURGE "+today); res.Reply != api.ErrCommandReply {
+		t.Errorf("purge today %+v", res)
+	}
+	if res := execute(s, "TRAIL PURGE 2019-02-30"); res.Reply != api.ErrCommandReply {
+		t.Errorf("purge invalid date %+v", res)
+	}
+	if res := execute(s, "TRAIL PURGE"); res.Reply != api.ErrCommandReply {
+		t.Errorf("purge without date %+v", res)
+	}
+	if res := execute(s, "TRAIL USER alice"); res.Reply != api.SliceCommandReply || len(res.Items) != 1 || res.Items[0] != "(noitems)" {
+		t.Errorf("find %+v", res)
+	}
+	if res := execute(s, "TRAIL LIMIT 100000"); res.Reply != api.ErrCommandReply {
+		t.Errorf("find over limit %+v", res)
+	}
+}
+
+func TestTrailPurgeRoles(t *testing.T) {
+	s, tokens := authServer(t)
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	check(t, s, tokens, "Execute", &api.ExecuteRequest{Command: []byte("TRAIL PURGE " + yesterday)}, adminOnly, "TRAIL PURGE")
+	check(t, s, tokens, "Execute", &api.ExecuteRequest{Command: []byte("trail purge " + yesterday)}, adminOnly, "trail purge")
+	check(t, s, tokens, "Execute", &api.ExecuteRequest{Command: []byte("TRAIL DATE " + yesterday)}, auditor, "TRAIL DATE")
+}
@@ -0,0 +1,270 @@
+package stats
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"logauditer/dbapi"
+	in "logauditer/internal"
+	ll "logauditer/logmining"
+	"logauditer/search"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// 时间粒度
+const (
+	MINUTE = "minute"
+	HOUR   = "hour"
+	DAY    = "day"
+)
+
+const (
+	DefaultTop = 10
+	MaxTop     = 100
+	// 按分钟统计最多跨越的天数
+	MaxMinuteDays = 7
+)
+
+var bucketFormats = map[string]string{
+	MINUTE: "%Y-%m-%d %H:%M",
+	HOUR:   "%Y-%m-%d %H:00",
+}
+
+// Bucket 分组计数
+type Bucket struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// StateRatio 按 State 统计的失败率
+type StateRatio struct {
+	Total  int      `json:"total"`
+	Failed int      `json:"failed"`
+	Ratio  float64  `json:"ratio"`
+	States []Bucket `json:"states"`
+}
+
+// RuleVolume 采集规则每天的入库量
+type RuleVolume struct {
+	Rule  string   `json:"rule"`
+	Total int      `json:"total"`
+	Days  []Bucket `json:"days"`
+}
+
+// Service 基于每天的 log_YYYY_MM_DD 集合做聚合统计
+type Service struct {
+	SP          *dbapi.StorageParts
+	PersistType dbapi.DBType
+
+	// 访问某天的记录集合, 为空时使用 dbapi; 测试时替换
+	access func(day string, query, res interface{}, op dbapi.OPType) error
+}
+
+func (s *Service) collection(day string, query, res interface{}, op dbapi.OPType) error {
+	if s.access != nil {
+		return s.access(day, query, res, op)
+	}
+	var _err error
+	dbapi.AccessDatabase(s.SP, ll.LOG_RECORD, ll.Collection(day), query, res, op, s.PersistType, &_err)
+	return _err
+}
+
+type group struct {
+	Id    interface{} `bson:"_id"`
+	Count int         `bson:"count"`
+}
+
+func key(id interface{}) string {
+	if s, ok := id.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// byField 按字段分组
+func byField(name string) func(day string) interface{} {
+	return func(string) interface{} { return "$" + name }
+}
+
+// timezone 按本地时区分桶: TZ 为时区名时使用时区名, 夏令时切换由 mongodb 处理;
+// 否则(未设置 TZ 时为 Local, 或为文件路径)使用当天零点的偏移
+func timezone(day string) string {
+	if name := time.Local.String(); name != "" && name != "Local" && !strings.HasPrefix(name, "/") {
+		return name
+	}
+	t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+	if err != nil {
+		t = time.Now()
+	}
+	return t.Format("-07:00")
+}
+
+// aggregate 对每天的集合执行 $match + pipeline + $group, 分组的 _id 由 id 按天生成, 结果按 _id 合并
+func (s *Service) aggregate(r *search.Request, pipeline []bson.M, id func(day string) interface{}, each func(day string, g *group)) error {
+	days, err := r.Days()
+	if err != nil {
+		return err
+	}
+	match, err := r.Match()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		p := append([]bson.M{{"$match": match}}, pipeline...)
+		p = append(p, bson.M{"$group": bson.M{"_id": id(day), "count": bson.M{"$sum": 1}}})
+		var groups []group
+		if err := s.collection(day, p, &groups, dbapi.AGGREGATE); err != nil {
+			return err
+		}
+		for i := range groups {
+			each(day, &groups[i])
+		}
+	}
+	return nil
+}
+
+// Timeline 按入库时间分桶计数, 时间取自 _id (需要 mongodb 4.0 以上的 $toDate)
+func (s *Service) Timeline(r *search.Request, bucket string) ([]Bucket, error) {
+	days, err := r.Days()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Bucket, 0)
+	if bucket == DAY || bucket == "" {
+		match, err := r.Match()
+		if err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			n := 0
+			if err := s.collection(day, match, &n, dbapi.COUNT); err != nil {
+				return nil, err
+			}
+			res = append(res, Bucket{Key: day, Count: n})
+		}
+		return res, nil
+	}
+	format, ok := bucketFormats[bucket]
+	if !ok {
+		return nil, &search.Error{Message: "invalid bucket (" + bucket + ")."}
+	}
+	if bucket == MINUTE && len(days) > MaxMinuteDays {
+		return nil, &search.Error{Message: "minute bucket only supports ranges up to 7 days."}
+	}
+	id := func(day string) interface{} {
+		return bson.M{"$dateToString": bson.M{
+			"format":   format,
+			"date":     bson.M{"$toDate": "$_id"},
+			"timezone": timezone(day),
+		}}
+	}
+	counts := make(map[string]int)
+	err = s.aggregate(r, nil, id, func(day string, g *group) { counts[key(g.Id)] += g.Count })
+	if err != nil {
+		return nil, err
+	}
+	for k, n := range counts {
+		res = append(res, Bucket{Key: k, Count: n})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res, nil
+}
+
+// Top 字段取值出现次数前 n 名, 数组字段按元素统计
+func (s *Service) Top(r *search.Request, field string, n int) ([]Bucket, error) {
+	f, ok := search.LookupField(field)
+	if !ok {
+		return nil, &search.Error{Message: "unknown field (" + field + ")."}
+	}
+	if n <= 0 {
+		n = DefaultTop
+	}
+	if n > MaxTop {
+		n = MaxTop
+	}
+	var pipeline []bson.M
+	if f.Multi {
+		pipeline = append(pipeline, bson.M{"$unwind": "$" + f.Name})
+	}
+	counts := make(map[string]int)
+	err := s.aggregate(r, pipeline, byField(f.Name), func(day string, g *group) { counts[key(g.Id)] += g.Count })
+	if err != nil {
+		return nil, err
+	}
+	return top(counts, n), nil
+}
+
+func top(counts map[string]int, n int) []Bucket {
+	res := make([]Bucket, 0, len(counts))
+	for k, c := range counts {
+		res = append(res, Bucket{Key: k, Count: c})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// Failed State 为空或 0 (可带方括号, 如 [0]) 时为成功, 其余为失败
+func Failed(state string) bool {
+	s := strings.Trim(strings.TrimSpace(state), "[]")
+	return s != "" && s != "0"
+}
+
+// States 按 State 计数及失败率
+func (s *Service) States(r *search.Request) (*StateRatio, error) {
+	counts := make(map[string]int)
+	err := s.aggregate(r, nil, byField(in.State), func(day string, g *group) { counts[key(g.Id)] += g.Count })
+	if err != nil {
+		return nil, err
+	}
+	res := &StateRatio{States: top(counts, 0)}
+	for k, c := range counts {
+		res.Total += c
+		if Failed(k) {
+			res.Failed += c
+		}
+	}
+	if res.Total > 0 {
+		res.Ratio = float64(res.Failed) / float64(res.Total)
+	}
+	return res, nil
+}
+
+// Rules 每个采集规则每天的入库量, 按总量倒序
+func (s *Service) Rules(r *search.Request) ([]RuleVolume, error) {
+	volumes := make(map[string]*RuleVolume)
+	err := s.aggregate(r, nil, byField("Rule"), func(day string, g *group) {
+		name := key(g.Id)
+		v, ok := volumes[name]
+		if !ok {
+			v = &RuleVolume{Rule: name, Days: make([]Bucket, 0)}
+			volumes[name] = v
+		}
+		v.Total += g.Count
+		v.Days = append(v.Days, Bucket{Key: day, Count: g.Count})
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RuleVolume, 0, len(volumes))
+	for _, v := range volumes {
+		sort.Slice(v.Days, func(i, j int) bool { return v.Days[i].Key < v.Days[j].Key })
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Total != res[j].Total {
+			return res[i].Total > res[j].Total
+		}
+		return res[i].Rule < res[j].Rule
+	})
+	return res, nil
+}
@@ -0,0 +1,200 @@
+package stats
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+	"logauditer/search"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestTop(t *testing.T) {
+	counts := map[string]int{"root": 5, "admin": 3, "bob": 3, "": 1, "eve": 7}
+	cases := []struct {
+		n    int
+		want []Bucket
+	}{
+		{2, []Bucket{{"eve", 7}, {"root", 5}}},
+		// 次数相同时按取值排序
+		{4, []Bucket{{"eve", 7}, {"root", 5}, {"admin", 3}, {"bob", 3}}},
+		{0, []Bucket{{"eve", 7}, {"root", 5}, {"admin", 3}, {"bob", 3}, {"", 1}}},
+		{10, []Bucket{{"eve", 7}, {"root", 5}, {"admin", 3}, {"bob", 3}, {"", 1}}},
+	}
+	for _, c := range cases {
+		if got := top(counts, c.n); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("top %d: %v, want %v", c.n, got, c.want)
+		}
+	}
+	if got := top(nil, 3); got == nil || len(got) != 0 {
+		t.Errorf("top of empty %v", got)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	for state, want := range map[string]bool{
+		"":      false,
+		"0":     false,
+		"[0]":   false,
+		" [0] ": false,
+		"[]":    false,
+		"1":     true,
+		"[1]":   true,
+		"127":   true,
+		"-1":    true,
+		"[00]":  true,
+		"fail":  true,
+	} {
+		if got := Failed(state); got != want {
+			t.Errorf("Failed(%q) = %v, want %v", state, got, want)
+		}
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	time.Local = shanghai
+	if tz := timezone("2019-02-25"); tz != "Asia/Shanghai" {
+		t.Errorf("named zone %s", tz)
+	}
+
+	// 没有时区名时使用当天的偏移, 夏令时前后不同
+	data, err := ioutil.ReadFile("/usr/share/zoneinfo/America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, name := range []string{"Local", "/usr/share/zoneinfo/America/New_York", ""} {
+		if time.Local, err = time.LoadLocationFromTZData(name, data); err != nil {
+			t.Fatal(err)
+		}
+		if tz := timezone("2019-02-25"); tz != "-05:00" {
+			t.Errorf("%q winter offset %s", name, tz)
+		}
+		if tz := timezone("2019-07-01"); tz != "-04:00" {
+			t.Errorf("%q summer offset %s", name, tz)
+		}
+	}
+}
+
+// memStats 每天的分组结果, 记录收到的 pipeline
+type memStats struct {
+	counts    map[string]int
+	groups    map[string][]group
+	pipelines map[string][]bson.M
+	fail      error
+}
+
+func (m *memStats) access(day string, query, res interface{}, op dbapi.OPType) error {
+	if m.fail != nil {
+		return m.fail
+	}
+	switch op {
+	case dbapi.COUNT:
+		*res.(*int) = m.counts[day]
+	case dbapi.AGGREGATE:
+		m.pipelines[day] = query.([]bson.M)
+		*res.(*[]group) = append([]group(nil), m.groups[day]...)
+	default:
+		return errors.New("unexpected op")
+	}
+	return nil
+}
+
+func memService() (*Service, *memStats) {
+	m := &memStats{counts: make(map[string]int), groups: make(map[string][]group), pipelines: make(map[string][]bson.M)}
+	return &Service{access: m.access}, m
+}
+
+func groupId(p []bson.M) interface{} {
+	return p[len(p)-1]["$group"].(bson.M)["_id"]
+}
+
+func TestTimeline(t *testing.T) {
+	s, m := memService()
+	r := &search.Request{From: "2019-02-25", To: "2019-02-26"}
+	m.counts["2019-02-25"], m.counts["2019-02-26"] = 3, 4
+	res, err := s.Timeline(r, DAY)
+	if err != nil || !reflect.DeepEqual(res, []Bucket{{"2019-02-25", 3}, {"2019-02-26", 4}}) {
+		t.Errorf("day %v %v", res, err)
+	}
+
+	m.groups["2019-02-25"] = []group{{Id: "2019-02-25 23:00", Count: 2}, {Id: "2019-02-25 10:00", Count: 1}}
+	m.groups["2019-02-26"] = []group{{Id: "2019-02-26 00:00", Count: 5}}
+	res, err = s.Timeline(r, HOUR)
+	if err != nil || !reflect.DeepEqual(res, []Bucket{{"2019-02-25 10:00", 1}, {"2019-02-25 23:00", 2}, {"2019-02-26 00:00", 5}}) {
+		t.Errorf("hour %v %v", res, err)
+	}
+	for _, day := range []string{"2019-02-25", "2019-02-26"} {
+		id := groupId(m.pipelines[day]).(bson.M)["$dateToString"].(bson.M)
+		if id["format"] != "%Y-%m-%d %H:00" || id["timezone"] != timezone(day) {
+			t.Errorf("%s group id %v", day, id)
+		}
+	}
+
+	if _, err := s.Timeline(r, "week"); err == nil {
+		t.Error("invalid bucket expect error")
+	}
+	if _, err := s.Timeline(&search.Request{From: "2019-02-01", To: "2019-02-08"}, MINUTE); err == nil {
+		t.Error("minute bucket over 7 days expect error")
+	}
+	m.fail = errors.New("db down")
+	if _, err := s.Timeline(r, DAY); err != m.fail {
+		t.Errorf("storage error %v", err)
+	}
+}
+
+func TestTopField(t *testing.T) {
+	s, m := memService()
+	r := &search.Request{From: "2019-02-25", To: "2019-02-26"}
+	m.groups["2019-02-25"] = []group{{Id: "root", Count: 2}, {Id: "bob", Count: 1}}
+	m.groups["2019-02-26"] = []group{{Id: "bob", Count: 4}, {Id: nil, Count: 1}}
+	res, err := s.Top(r, "UserName", 2)
+	if err != nil || !reflect.DeepEqual(res, []Bucket{{"bob", 5}, {"root", 2}}) {
+		t.Errorf("top %v %v", res, err)
+	}
+	if p := m.pipelines["2019-02-25"]; len(p) != 2 || groupId(p) != "$UserName" {
+		t.Errorf("pipeline %v", p)
+	}
+	if _, err := s.Top(r, "Nope", 2); err == nil {
+		t.Error("unknown field expect error")
+	}
+}
+
+func TestStates(t *testing.T) {
+	s, m := memService()
+	r := &search.Request{From: "2019-02-25"}
+	m.groups["2019-02-25"] = []group{{Id: "[0]", Count: 6}, {Id: "1", Count: 3}, {Id: "", Count: 1}}
+	res, err := s.States(r)
+	if err != nil || res.Total != 10 || res.Failed != 3 || res.Ratio != 0.3 || len(res.States) != 3 || res.States[0].Key != "[0]" {
+		t.Errorf("states %+v %v", res, err)
+	}
+	m.groups["2019-02-25"] = nil
+	if res, err := s.States(r); err != nil || res.Total != 0 || res.Ratio != 0 {
+		t.Errorf("empty states %+v %v", res, err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	s, m := memService()
+	r := &search.Request{From: "2019-02-25", To: "2019-02-26"}
+	m.groups["2019-02-25"] = []group{{Id: "ssh", Count: 2}, {Id: "nginx", Count: 1}}
+	m.groups["2019-02-26"] = []group{{Id: "nginx", Count: 4}}
+	res, err := s.Rules(r)
+	want := []RuleVolume{
+		{Rule: "nginx", Total: 5, Days: []Bucket{{"2019-02-25", 1}, {"2019-02-26", 4}}},
+		{Rule: "ssh", Total: 2, Days: []Bucket{{"2019-02-25", 2}}},
+	}
+	if err != nil || !reflect.DeepEqual(res, want) {
+		t.Errorf("rules %+v %v", res, err)
+	}
+}
@@ -0,0 +1,174 @@
+package trail
+
+import (
+	"fmt"
+	"logauditer/dbapi"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	log "github.com/laik/logger"
+)
+
+const (
+	// 操作审计记录按天分集合 trail_YYYY_MM_DD, 与审计记录、告警分开存放
+	TRAIL_DATABASE = "audit_trail"
+
+	DefaultLimit = 100
+	MaxLimit     = 10000
+)
+
+// 操作结果
+const (
+	OK     = "ok"
+	ERROR  = "error"
+	DENIED = "denied"
+)
+
+// 操作来源
+const (
+	GRPC = "grpc"
+	HTTP = "http"
+)
+
+// Entry 一次管理或数据访问操作
+type Entry struct {
+	Id   bson.ObjectId `bson:"_id" json:"id"`
+	Time time.Time     `bson:"time" json:"time"`
+	// 未启用认证时为空
+	User   string `bson:"user" json:"user"`
+	Peer   string `bson:"peer" json:"peer"`
+	Source string `bson:"source" json:"source"`
+	// 文本命令为命令名, gRPC 接口为方法名, HTTP 为 "${METHOD} ${PATH}"
+	Action  string `bson:"action" json:"action"`
+	Command string `bson:"command,omitempty" json:"command,omitempty"`
+	Rule    string `bson:"rule,omitempty" json:"rule,omitempty"`
+	Result  string `bson:"result" json:"result"`
+	Message string `bson:"message,omitempty" json:"message,omitempty"`
+}
+
+func (e *Entry) String() string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	s := fmt.Sprintf("%s %s@%s [%s] %s", e.Time.Format("2006-01-02 15:04:05"), user, e.Peer, e.Source, e.Action)
+	if e.Rule != "" {
+		s += " rule=" + e.Rule
+	}
+	if e.Command != "" {
+		s += " `" + e.Command + "`"
+	}
+	s += " " + e.Result
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// Query 查询条件, 为空的字段不过滤
+type Query struct {
+	Date   string
+	User   string
+	Rule   string
+	Action string
+	Result string
+	Limit  int
+}
+
+// Recorder 同步写入操作审计记录, 只提供按天清理, 没有单条删除
+type Recorder struct {
+	sp          *dbapi.StorageParts
+	persistType dbapi.DBType
+
+	// 访问某天的集合, 为空时使用 dbapi; 测试时替换
+	access func(coll string, query, res interface{}, op dbapi.OPType) error
+}
+
+func (r *Recorder) collection(coll string, query, res interface{}, op dbapi.OPType) error {
+	if r.access != nil {
+		return r.access(coll, query, res, op)
+	}
+	var _err error
+	dbapi.AccessDatabase(r.sp, TRAIL_DATABASE, coll, query, res, op, r.persistType, &_err)
+	return _err
+}
+
+func New(sp *dbapi.StorageParts, persistType dbapi.DBType) *Recorder {
+	return &Recorder{sp: sp, persistType: persistType}
+}
+
+// Record 写入失败只记录日志, 不影响操作本身
+func (r *Recorder) Record(e *Entry) {
+	if e.Id == "" {
+		e.Id = bson.NewObjectId()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := r.collection(Collection(e.Time.Format("2006-01-02")), nil, e, dbapi.INSERT); err != nil {
+		log.Error("record trail (%s) error: %s\n", e, err)
+	}
+}
+
+// Find 按时间倒序返回一天内满足条件的记录
+func (r *Recorder) Find(q *Query) ([]Entry, error) {
+	date := q.Date
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", date); err != nil {
+		return nil, fmt.Errorf("invalid date (%s).", date)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		return nil, fmt.Errorf("limit (%d) exceeds %d.", limit, MaxLimit)
+	}
+	query := bson.M{}
+	if q.User != "" {
+		query["user"] = q.User
+	}
+	if q.Rule != "" {
+		query["rule"] = q.Rule
+	}
+	if q.Action != "" {
+		query["action"] = q.Action
+	}
+	if q.Result != "" {
+		query["result"] = q.Result
+	}
+	res := make([]Entry, 0)
+	fq := &dbapi.FindQuery{Query: query, Sort: []string{"-time"}, Limit: limit}
+	if err := r.collection(Collection(date), fq, &res, dbapi.FIND); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Purge 删除一天的记录, 不允许删除当天
+func (r *Recorder) Purge(date string) error {
+	d, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid date (%s).", date)
+	}
+	if !d.Before(today()) {
+		return fmt.Errorf("can not purge trail of (%s), only days before today.", date)
+	}
+	err = r.collection(Collection(date), nil, nil, dbapi.DROP)
+	if err != nil && !strings.Contains(err.Error(), "ns not found") {
+		return err
+	}
+	return nil
+}
+
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// Collection 操作审计记录集合名
+func Collection(date string) string {
+	return "trail_" + strings.Replace(date, "-", "_", 2)
+}
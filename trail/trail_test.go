@@ -0,0 +1,162 @@
+package trail
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"logauditer/dbapi"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// call 一次数据库访问
+type call struct {
+	coll  string
+	query interface{}
+	op    dbapi.OPType
+}
+
+func recorder(err error, found ...Entry) (*Recorder, *[]call) {
+	calls := new([]call)
+	r := New(nil, dbapi.KV)
+	r.access = func(coll string, query, res interface{}, op dbapi.OPType) error {
+		*calls = append(*calls, call{coll, query, op})
+		if err != nil {
+			return err
+		}
+		switch op {
+		case dbapi.INSERT:
+			*calls = append(*calls, call{coll, *res.(*Entry), op})
+		case dbapi.FIND:
+			*res.(*[]Entry) = append(*res.(*[]Entry), found...)
+		}
+		return nil
+	}
+	return r, calls
+}
+
+func TestRecord(t *testing.T) {
+	r, calls := recorder(nil)
+	at := time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)
+	r.Record(&Entry{Time: at, User: "alice", Action: "START", Result: OK})
+	r.Record(&Entry{Action: "STOP", Result: DENIED})
+
+	if len(*calls) != 4 {
+		t.Fatalf("calls %+v", *calls)
+	}
+	if c := (*calls)[0]; c.coll != "trail_2019_02_25" || c.op != dbapi.INSERT {
+		t.Errorf("first insert %+v", c)
+	}
+	if e := (*calls)[1].query.(Entry); e.Id == "" || !e.Time.Equal(at) || e.User != "alice" {
+		t.Errorf("first entry %+v", e)
+	}
+	// 未指定时间时为当前时间
+	if c := (*calls)[2]; c.coll != Collection(time.Now().Format("2006-01-02")) {
+		t.Errorf("second insert %+v", c)
+	}
+	if e := (*calls)[3].query.(Entry); e.Id == "" || time.Since(e.Time) > time.Minute {
+		t.Errorf("second entry %+v", e)
+	}
+
+	// 写入失败不影响调用方
+	r, _ = recorder(errors.New("db down"))
+	r.Record(&Entry{Action: "START"})
+}
+
+func TestFind(t *testing.T) {
+	found := Entry{Id: bson.NewObjectId(), Action: "START", Result: OK}
+	r, calls := recorder(nil, found)
+	res, err := r.Find(&Query{Date: "2019-02-25", User: "alice", Rule: "nginx", Action: "START", Result: OK, Limit: 5})
+	if err != nil || len(res) != 1 || res[0].Id != found.Id {
+		t.Fatalf("find %+v %v", res, err)
+	}
+	c := (*calls)[0]
+	want := &dbapi.FindQuery{
+		Query: bson.M{"user": "alice", "rule": "nginx", "action": "START", "result": OK},
+		Sort:  []string{"-time"},
+		Limit: 5,
+	}
+	if c.coll != "trail_2019_02_25" || c.op != dbapi.FIND || !reflect.DeepEqual(c.query, want) {
+		t.Errorf("find call %+v", c)
+	}
+
+	*calls = nil
+	if _, err := r.Find(&Query{}); err != nil {
+		t.Fatal(err)
+	}
+	c = (*calls)[0]
+	if c.coll != Collection(time.Now().Format("2006-01-02")) || c.query.(*dbapi.FindQuery).Limit != DefaultLimit ||
+		len(c.query.(*dbapi.FindQuery).Query.(bson.M)) != 0 {
+		t.Errorf("default find call %+v", c)
+	}
+
+	for _, q := range []*Query{{Date: "2019-02-30"}, {Limit: MaxLimit + 1}} {
+		if _, err := r.Find(q); err == nil {
+			t.Errorf("find %+v expect error", q)
+		}
+	}
+	r, _ = recorder(errors.New("db down"))
+	if _, err := r.Find(&Query{}); err == nil {
+		t.Error("find storage error expect error")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	r, calls := recorder(nil)
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	if err := r.Purge(yesterday); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 1 || (*calls)[0].coll != Collection(yesterday) || (*calls)[0].op != dbapi.DROP {
+		t.Errorf("purge calls %+v", *calls)
+	}
+
+	// 当天及以后的记录不能删除
+	*calls = nil
+	for _, date := range []string{
+		time.Now().Format("2006-01-02"),
+		time.Now().AddDate(0, 0, 1).Format("2006-01-02"),
+		"2019-02-30",
+		"",
+	} {
+		if err := r.Purge(date); err == nil {
+			t.Errorf("purge (%s) expect error", date)
+		}
+	}
+	if len(*calls) != 0 {
+		t.Errorf("rejected purge accessed storage %+v", *calls)
+	}
+
+	// 集合不存在不是错误
+	r, _ = recorder(errors.New("ns not found"))
+	if err := r.Purge(yesterday); err != nil {
+		t.Errorf("purge missing collection %v", err)
+	}
+	r, _ = recorder(errors.New("db down"))
+	if err := r.Purge(yesterday); err == nil {
+		t.Error("purge storage error expect error")
+	}
+}
+
+func TestEntryString(t *testing.T) {
+	at := time.Date(2019, 2, 25, 10, 0, 0, 0, time.Local)
+	cases := []struct {
+		e    Entry
+		want string
+	}{
+		{Entry{Time: at, User: "alice", Peer: "10.0.0.1:5000", Source: GRPC, Action: "START", Command: "START nginx", Rule: "nginx", Result: OK},
+			"2019-02-25 10:00:00 alice@10.0.0.1:5000 [grpc] START rule=nginx `START nginx` ok"},
+		{Entry{Time: at, Peer: "10.0.0.2:80", Source: HTTP, Action: "GET /getDown", Result: DENIED, Message: "forbidden"},
+			"2019-02-25 10:00:00 -@10.0.0.2:80 [http] GET /getDown denied: forbidden"},
+	}
+	for _, c := range cases {
+		if got := c.e.String(); got != c.want {
+			t.Errorf("String() = %s, want %s", got, c.want)
+		}
+	}
+	if c := Collection("2019-02-25"); c != "trail_2019_02_25" {
+		t.Errorf("collection %s", c)
+	}
+}
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"encoding/json"
+	"logauditer/dbapi"
+	"logauditer/query"
+	"logauditer/search"
+	"net/http"
+
+	log "github.com/laik/logger"
+)
+
+// ApiError json格式错误
+type ApiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("write json response error:(%s).\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]*ApiError{"error": {Code: status, Message: message}})
+}
+
+// writeSearchError 参数错误返回400, 其余为500
+func writeSearchError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*search.Error); ok {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Error("search records error:(%s).\n", err)
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func (h *HttpService) searcher() *search.Service {
+	return &search.Service{SP: h.SP, PersistType: dbapi.KV}
+}
+
+// http://127.0.0.1/api/v1/records?ql=user:root%20AND%20op:~scp
+// http://127.0.0.1/api/v1/records?from=2019-02-25&to=2019-02-28&UserName=root&Operation=~scp&sort=-DateTime&limit=50
+func (h *HttpService) Records(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := search.FromValues(r.Form)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	if ql := r.Form.Get("ql"); ql != "" {
+		if err := query.Apply(req, ql); err != nil {
+			writeSearchError(w, err)
+			return
+		}
+	}
+	res, err := h.searcher().Find(req)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,193 @@
+package web
+
+import (
+	"encoding/json"
+	"logauditer/auth"
+	"logauditer/certs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 会话 cookie 名称, 值为登录令牌
+const SessionCookie = "logauditer_session"
+
+var anyRole = []string{auth.ADMIN, auth.AUDITOR, auth.OPERATOR}
+
+// 按前缀匹配, 先匹配到的生效
+var pathRoles = []struct {
+	prefix string
+	roles  []string
+}{
+	{"/getInfo", []string{auth.AUDITOR}},
+	{"/getDown", []string{auth.AUDITOR}},
+	{"/getAlerts", []string{auth.AUDITOR}},
+	{"/verify", []string{auth.AUDITOR}},
+	{"/api/v1/records", []string{auth.AUDITOR}},
+	{"/api/v1/stats/", []string{auth.AUDITOR}},
+	{"/api/v1/export", []string{auth.AUDITOR}},
+	{"/api/v1/reports", []string{auth.AUDITOR}},
+	{"/api/v1/live/", []string{auth.AUDITOR}},
+	{"/api/v1/openapi.json", anyRole},
+	{"/api/v1/whoami", anyRole},
+	{"/api/v1/trail", []string{auth.AUDITOR}},
+	{"/api/v1/metrics", []string{auth.OPERATOR}},
+	{"/rules", nil},
+	{"/api/v1/rules", nil},
+	{"/api/v1/workers", nil},
+}
+
+// 无需登录的路径
+var publicPaths = map[string]bool{
+	"/login":         true,
+	"/api/v1/login":  true,
+	"/api/v1/logout": true,
+	"/favicon.ico":   true,
+}
+
+// requiredRoles 请求所需角色, 规则管理网关按方法区分, 未列出的路径(如 /debug/pprof)只允许 admin
+func requiredRoles(r *http.Request) []string {
+	p := r.URL.Path
+	if p == "/" {
+		return anyRole
+	}
+	for _, pr := range pathRoles {
+		if !strings.HasPrefix(p, pr.prefix) {
+			continue
+		}
+		if pr.roles != nil {
+			return pr.roles
+		}
+		// 页面与规则/工作进程网关
+		switch {
+		case r.Method == "GET":
+			return anyRole
+		case strings.HasSuffix(p, "/start"), strings.HasSuffix(p, "/stop"):
+			return []string{auth.OPERATOR}
+		}
+		return []string{auth.ADMIN}
+	}
+	return []string{auth.ADMIN}
+}
+
+func isPublic(p string) bool {
+	return publicPaths[p] || strings.HasPrefix(p, "/static/")
+}
+
+func requestToken(r *http.Request) string {
+	if t := auth.BearerToken(r.Header.Get("Authorization")); t != "" {
+		return t
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Authenticate 校验会话与角色, 会话放入请求 context 供网关调用的 gRPC 实现获取
+func Authenticate(m *auth.Manager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var sess *auth.Session
+		var err error
+		if token := requestToken(r); token != "" || r.TLS == nil {
+			sess, err = m.Verify(token)
+		} else {
+			// 没有令牌时使用已校验的客户端证书对应的用户
+			sess, err = m.CertSession(certs.Identity(r.TLS.VerifiedChains))
+		}
+		if err != nil {
+			// 页面跳转到登录页, 接口返回 401
+			if r.Method == "GET" && (r.URL.Path == "/" || r.URL.Path == "/rules") {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+			http.Error(w, "unauthorized, login first.", http.StatusUnauthorized)
+			return
+		}
+		setRequestUser(r, sess.User)
+		if !sess.Allow(requiredRoles(r)...) {
+			http.Error(w, "forbidden, user ("+sess.User+") roles ("+strings.Join(sess.Roles, ",")+") not allowed.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), sess)))
+	})
+}
+
+type loginResult struct {
+	Token   string   `json:"token,omitempty"`
+	User    string   `json:"user"`
+	Roles   []string `json:"roles"`
+	Expires int64    `json:"expires"`
+}
+
+// Login 接收 json {"user": "", "password": ""} 或表单, 成功后设置会话 cookie
+func (h *HttpService) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json body.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.User, req.Password = r.PostFormValue("user"), r.PostFormValue("password")
+	}
+	setRequestUser(r, req.User)
+	sess, err := h.Auth.Login(req.User, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    sess.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&loginResult{Token: sess.Token, User: sess.User, Roles: sess.Roles, Expires: sess.Expire.Unix()})
+}
+
+// Logout 使会话失效并清除 cookie
+func (h *HttpService) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if t := requestToken(r); t != "" {
+		h.Auth.Logout(t)
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, Expires: time.Unix(0, 0)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WhoAmI 返回当前会话的用户与角色
+func (h *HttpService) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	sess, ok := auth.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "authentication not enabled.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&loginResult{User: sess.User, Roles: sess.Roles, Expires: sess.Expire.Unix()})
+}
+
+func srvLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	http.ServeFile(w, r, "login.html")
+}
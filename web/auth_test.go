@@ -0,0 +1,171 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"logauditer/auth"
+	"logauditer/dbapi"
+)
+
+// 各角色是否允许访问, 依次为 admin/auditor/operator
+type allowed [3]bool
+
+var (
+	anyone    = allowed{true, true, true}
+	adminOnly = allowed{true, false, false}
+	auditor   = allowed{true, true, false}
+	operator  = allowed{true, false, true}
+)
+
+// 网关直接调用服务端实现, 规则管理接口只由这里检查角色
+var routeCases = []struct {
+	method, path string
+	want         allowed
+}{
+	{"GET", "/", anyone},
+	{"GET", "/rules", anyone},
+	{"GET", "/getInfo", auditor},
+	{"GET", "/getDown", auditor},
+	{"GET", "/getAlerts", auditor},
+	{"GET", "/verify", auditor},
+	{"GET", "/api/v1/records", auditor},
+	{"GET", "/api/v1/stats/summary", auditor},
+	{"GET", "/api/v1/export", auditor},
+	{"GET", "/api/v1/reports", auditor},
+	{"GET", "/api/v1/reports/download", auditor},
+	{"GET", "/api/v1/live/sse", auditor},
+	{"GET", "/api/v1/live/ws", auditor},
+	{"GET", "/api/v1/openapi.json", anyone},
+	{"GET", "/api/v1/whoami", anyone},
+	{"GET", "/api/v1/trail", auditor},
+	{"GET", "/api/v1/metrics", operator},
+
+	{"GET", "/api/v1/rules", anyone},
+	{"POST", "/api/v1/rules", adminOnly},
+	{"GET", "/api/v1/rules/x", anyone},
+	{"DELETE", "/api/v1/rules/x", adminOnly},
+	{"POST", "/api/v1/rules/x/test", adminOnly},
+	{"POST", "/api/v1/rules/x/commit", adminOnly},
+	{"POST", "/api/v1/rules/x/start", operator},
+	{"POST", "/api/v1/rules/x/stop", operator},
+	{"PUT", "/api/v1/rules/x", adminOnly},
+	{"GET", "/api/v1/workers", anyone},
+	{"GET", "/api/v1/workers/x/files", anyone},
+	{"POST", "/api/v1/workers", adminOnly},
+
+	// 未列出的路径只允许 admin
+	{"GET", "/debug/pprof/", adminOnly},
+	{"GET", "/debug/pprof/heap", adminOnly},
+	{"GET", "/api/v1/stats", adminOnly},
+	{"GET", "/api/v1/unknown", adminOnly},
+}
+
+func TestRequiredRoles(t *testing.T) {
+	for _, c := range routeCases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		roles := requiredRoles(r)
+		for i, role := range []string{auth.ADMIN, auth.AUDITOR, auth.OPERATOR} {
+			if got := auth.Allow([]string{role}, roles...); got != c.want[i] {
+				t.Errorf("%s %s by (%s) = %v, want %v", c.method, c.path, role, got, c.want[i])
+			}
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	m := auth.NewManager(dbapi.NewStorageParts(), dbapi.KV, 0)
+	tokens := make(map[string]string)
+	for _, role := range []string{auth.ADMIN, auth.AUDITOR, auth.OPERATOR} {
+		if err := m.Set(role, "pw-"+role, []string{role}); err != nil {
+			t.Fatal(err)
+		}
+		sess, err := m.Login(role, "pw-"+role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[role] = sess.Token
+	}
+	var user string
+	h := Authenticate(m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sess, ok := auth.FromContext(r.Context()); ok {
+			user = sess.User
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, path string, set func(r *http.Request)) int {
+		user = ""
+		r := httptest.NewRequest(method, path, nil)
+		if set != nil {
+			set(r)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, c := range routeCases {
+		for i, role := range []string{auth.ADMIN, auth.AUDITOR, auth.OPERATOR} {
+			token := tokens[role]
+			code := serve(c.method, c.path, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) })
+			want := http.StatusForbidden
+			if c.want[i] {
+				want = http.StatusOK
+			}
+			if code != want {
+				t.Errorf("%s %s by (%s) = %d, want %d", c.method, c.path, role, code, want)
+			}
+			if code == http.StatusOK && user != role {
+				t.Errorf("%s %s by (%s) session user (%s)", c.method, c.path, role, user)
+			}
+		}
+	}
+
+	// cookie 与 Authorization 一样有效
+	if code := serve("POST", "/api/v1/rules/x/start", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: SessionCookie, Value: tokens[auth.OPERATOR]})
+	}); code != http.StatusOK {
+		t.Errorf("cookie session = %d", code)
+	}
+
+	cases := []struct {
+		method, path, token string
+		code                int
+	}{
+		// 页面跳转到登录页, 接口返回 401
+		{"GET", "/", "", http.StatusFound},
+		{"GET", "/rules", "", http.StatusFound},
+		{"GET", "/api/v1/rules", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/rules/x/test", "", http.StatusUnauthorized},
+		{"GET", "/debug/pprof/", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/records", "invalid", http.StatusUnauthorized},
+		// 无需登录的路径
+		{"GET", "/login", "", http.StatusOK},
+		{"POST", "/api/v1/login", "", http.StatusOK},
+		{"POST", "/api/v1/logout", "", http.StatusOK},
+		{"GET", "/static/app.js", "", http.StatusOK},
+		{"GET", "/favicon.ico", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		token := c.token
+		code := serve(c.method, c.path, func(r *http.Request) {
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		})
+		if code != c.code {
+			t.Errorf("%s %s token (%s) = %d, want %d", c.method, c.path, c.token, code, c.code)
+		}
+	}
+
+	// 用户删除后会话失效
+	if err := m.Del(auth.AUDITOR); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve("GET", "/api/v1/records", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+tokens[auth.AUDITOR])
+	}); code != http.StatusUnauthorized {
+		t.Errorf("deleted user = %d", code)
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"fmt"
+	"logauditer/dbapi"
+	"logauditer/export"
+	"logauditer/query"
+	"logauditer/search"
+	"net/http"
+	"net/url"
+
+	log "github.com/laik/logger"
+)
+
+// 导出接口自身的参数, 其余参数与 /api/v1/records 相同
+var exportParams = []string{"format", "columns", "lang"}
+
+func (h *HttpService) exporter() *export.Service {
+	return &export.Service{SP: h.SP, PersistType: dbapi.KV, MaxRows: h.ExportMaxRows}
+}
+
+// http://127.0.0.1/api/v1/export?format=xlsx&columns=CreatedAt,UserName,IpAddr,Operation&lang=zh&ql=user:root
+func (h *HttpService) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	form := make(url.Values)
+	for k, v := range r.Form {
+		form[k] = v
+	}
+	for _, k := range exportParams {
+		delete(form, k)
+	}
+	req, err := search.FromValues(form)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	if ql := form.Get("ql"); ql != "" {
+		if err := query.Apply(req, ql); err != nil {
+			writeSearchError(w, err)
+			return
+		}
+	}
+	h.export(w, req, r.Form.Get("format"), r.Form.Get("columns"), r.Form.Get("lang"))
+}
+
+// GetDown 首页下载, 兼容原有参数 ipaddr/date/type/category/minrisk, 导出 xlsx
+func (h *HttpService) GetDown(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	req := &search.Request{}
+	if date := r.Form.Get("date"); date != "" {
+		req.From, req.To = date, date
+		req.Filters = append(req.Filters, &search.Filter{Field: "Date", Op: search.EQ, Value: date})
+	}
+	legacy := []struct{ param, field, op string }{
+		{"ipaddr", "Host", search.EQ},
+		{"type", "SystemType", search.EQ},
+		{"category", "Categories", search.EQ},
+		{"minrisk", "RiskScore", search.GTE},
+	}
+	for _, p := range legacy {
+		if v := r.Form.Get(p.param); v != "" {
+			req.Filters = append(req.Filters, &search.Filter{Field: p.field, Op: p.op, Value: v})
+		}
+	}
+	h.export(w, req, export.XLSX, "", "zh")
+}
+
+func (h *HttpService) export(w http.ResponseWriter, req *search.Request, format, columns, lang string) {
+	if format == "" {
+		format = export.CSV
+	}
+	contentType, ok := export.ContentTypes[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format (%s).", format))
+		return
+	}
+	cols, err := export.Columns(columns, lang)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	srv := h.exporter()
+	if err := srv.Check(req); err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	days, _ := req.Days()
+	name := days[0]
+	if len(days) > 1 {
+		name = days[0] + "_" + days[len(days)-1]
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit_%s.%s"`, name, format))
+	ew, err := export.NewWriter(format, w, cols, lang == "zh")
+	if err != nil {
+		log.Error("export records error:(%s).\n", err)
+		return
+	}
+	n, err := srv.Export(ew, req, cols)
+	if err != nil {
+		// 响应已经开始写出, 不再关闭 writer, 客户端得到的是不完整的文件
+		log.Error("export records error after (%d) rows:(%s).\n", n, err)
+		return
+	}
+	if err := ew.Close(); err != nil {
+		log.Error("export records close error:(%s).\n", err)
+		return
+	}
+	log.Debug("export (%d) records format (%s).\n", n, format)
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"logauditer/dbapi"
+	"logauditer/export"
+)
+
+func TestExport(t *testing.T) {
+	h := &HttpService{SP: dbapi.NewStorageParts()}
+	cases := []struct {
+		method, url string
+		status      int
+		// 出错时为错误信息片段, 否则为 Content-Type
+		want string
+	}{
+		{"GET", "/api/v1/export?from=2019-02-25&to=2019-02-26&columns=Host,UserName&lang=zh", 200, export.ContentTypes[export.CSV]},
+		{"GET", "/api/v1/export?from=2019-02-25&format=jsonl", 200, export.ContentTypes[export.JSONL]},
+		{"GET", "/api/v1/export?from=2019-02-25&format=xlsx&ql=user:root", 200, export.ContentTypes[export.XLSX]},
+		{"POST", "/api/v1/export", 405, "method not allowed"},
+		{"GET", "/api/v1/export?format=pdf", 400, "unsupported format (pdf)"},
+		{"GET", "/api/v1/export?columns=Nope", 400, "unknown column (Nope)"},
+		{"GET", "/api/v1/export?lang=fr", 400, "unsupported lang (fr)"},
+		{"GET", "/api/v1/export?from=2019-02-30", 400, "invalid from date"},
+		{"GET", "/api/v1/export?ql=user:(", 400, ""},
+		{"GET", "/api/v1/export?RiskScore=x", 400, "expect number"},
+
+		{"GET", "/getDown?date=2019-02-25&ipaddr=web1&type=linux&category=shell&minrisk=50", 200, export.ContentTypes[export.XLSX]},
+		{"GET", "/getDown", 200, export.ContentTypes[export.XLSX]},
+		// 参数错误返回错误状态, 不再 panic
+		{"GET", "/getDown?date=20190225", 400, "invalid from date (20190225)"},
+		{"GET", "/getDown?date=x&ipaddr=web1", 400, "invalid from date (x)"},
+		{"GET", "/getDown?date=2019-02-25&minrisk=high", 400, "field (RiskScore) expect number but (high)"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, c.url, nil)
+		if strings.HasPrefix(c.url, "/getDown") {
+			h.GetDown(w, r)
+		} else {
+			h.Export(w, r)
+		}
+		if w.Code != c.status {
+			t.Errorf("%s %s status %d, want %d: %s", c.method, c.url, w.Code, c.status, w.Body)
+			continue
+		}
+		if c.status != http.StatusOK {
+			var res map[string]*ApiError
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res["error"] == nil {
+				t.Errorf("%s %s error body %s", c.method, c.url, w.Body)
+			} else if !strings.Contains(res["error"].Message, c.want) {
+				t.Errorf("%s %s error %s, want %s", c.method, c.url, res["error"].Message, c.want)
+			}
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != c.want {
+			t.Errorf("%s %s content type %s, want %s", c.method, c.url, ct, c.want)
+		}
+		if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="audit_`) {
+			t.Errorf("%s %s disposition %s", c.method, c.url, cd)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.Export(w, httptest.NewRequest("GET", "/api/v1/export?from=2019-02-25&to=2019-02-26&columns=Host,UserName&lang=zh", nil))
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="audit_2019-02-25_2019-02-26.csv"` {
+		t.Errorf("disposition %s", cd)
+	}
+	if body := w.Body.String(); body != "\xEF\xBB\xBF主机,用户\n" {
+		t.Errorf("csv body %q", body)
+	}
+	w = httptest.NewRecorder()
+	h.GetDown(w, httptest.NewRequest("GET", "/getDown?date=2019-02-25", nil))
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="audit_2019-02-25.xlsx"` {
+		t.Errorf("getDown disposition %s", cd)
+	}
+}
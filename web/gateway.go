@@ -0,0 +1,28 @@
+package web
+
+import (
+	"context"
+	"io"
+	"logauditer/api"
+	"net/http"
+
+	"github.com/gogo/gateway"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+)
+
+// Gateway 规则管理接口的 REST/JSON 网关, 直接调用 gRPC 服务的实现, 与其它 HTTP 接口共用监听端口
+func Gateway(srv api.LogAuditerServer) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &gateway.JSONPb{OrigName: true, EmitDefaults: true}),
+	)
+	if err := api.RegisterLogAuditerHandlerServer(context.Background(), mux, srv); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+// OpenAPI 返回由 api.proto 生成的 OpenAPI 文档
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, api.Swagger)
+}
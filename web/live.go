@@ -0,0 +1,152 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"logauditer/live"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/laik/logger"
+)
+
+const liveHeartbeat = 15 * time.Second
+
+// liveEvent 推送给客户端的事件, type 为 record 或 dropped(缓冲满被丢弃的条数)
+type liveEvent struct {
+	Type    string        `json:"type"`
+	Message *live.Message `json:"message,omitempty"`
+	Dropped uint64        `json:"dropped,omitempty"`
+}
+
+func liveSubscribe(hub *live.Hub, form url.Values) (*live.Subscription, error) {
+	f := &live.Filter{
+		Rule: form.Get("rule"),
+		Host: form.Get("host"),
+		User: form.Get("user"),
+	}
+	if op := form.Get("op"); op != "" {
+		re, err := regexp.Compile(op)
+		if err != nil {
+			return nil, fmt.Errorf("invalid op regex: %s", err)
+		}
+		f.Op = re
+	}
+	buffer := 0
+	if b := form.Get("buffer"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil || n <= 0 || n > live.MaxBuffer {
+			return nil, fmt.Errorf("invalid buffer (%s).", b)
+		}
+		buffer = n
+	}
+	return hub.Subscribe(f, buffer), nil
+}
+
+// liveEvents 依次取出订阅的事件, 先报告丢弃的条数
+func liveEvents(sub *live.Subscription, m *live.Message) []*liveEvent {
+	var events []*liveEvent
+	if n := sub.Dropped(); n > 0 {
+		events = append(events, &liveEvent{Type: "dropped", Dropped: n})
+	}
+	return append(events, &liveEvent{Type: "record", Message: m})
+}
+
+// http://127.0.0.1/api/v1/live/sse?rule=rule1&user=root&op=scp
+func (h *HttpService) LiveSSE(w http.ResponseWriter, r *http.Request) {
+	if h.Live == nil {
+		writeError(w, http.StatusNotFound, "live is not enabled.")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported.")
+		return
+	}
+	r.ParseForm()
+	sub, err := liveSubscribe(h.Live, r.Form)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case m, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			for _, e := range liveEvents(sub, m) {
+				b, _ := json.Marshal(e)
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// ws://127.0.0.1/api/v1/live/ws?rule=rule1&user=root&op=scp
+func (h *HttpService) LiveWS(w http.ResponseWriter, r *http.Request) {
+	if h.Live == nil {
+		writeError(w, http.StatusNotFound, "live is not enabled.")
+		return
+	}
+	r.ParseForm()
+	sub, err := liveSubscribe(h.Live, r.Form)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer sub.Close()
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-heartbeat.C:
+			if err := conn.writeFrame(wsPing, nil); err != nil {
+				return
+			}
+		case m, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			for _, e := range liveEvents(sub, m) {
+				b, _ := json.Marshal(e)
+				if err := conn.WriteText(b); err != nil {
+					log.Debug("live websocket write error:(%s).\n", err)
+					return
+				}
+			}
+		}
+	}
+}
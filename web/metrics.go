@@ -0,0 +1,18 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ll "logauditer/logmining"
+)
+
+type metrics struct {
+	Watches ll.WatchStats `json:"watches"`
+}
+
+// Metrics 运行指标, 包括文件系统监听数与轮询数
+func (h *HttpService) Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&metrics{Watches: ll.Watches()})
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+// http://127.0.0.1/api/v1/reports?name=daily
+func (h *HttpService) ReportRuns(w http.ResponseWriter, r *http.Request) {
+	if h.Reports == nil {
+		writeError(w, http.StatusNotFound, "report is not enabled.")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed.")
+		return
+	}
+	r.ParseForm()
+	runs, err := h.Reports.Runs(r.Form.Get("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// http://127.0.0.1/api/v1/reports/download?name=daily&run=20190226_080000&file=records.xlsx
+func (h *HttpService) ReportDownload(w http.ResponseWriter, r *http.Request) {
+	if h.Reports == nil {
+		writeError(w, http.StatusNotFound, "report is not enabled.")
+		return
+	}
+	r.ParseForm()
+	fn, err := h.Reports.Path(r.Form.Get("name"), r.Form.Get("run"), r.Form.Get("file"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(fn)+`"`)
+	http.ServeFile(w, r, fn)
+}
@@ -1,28 +1,36 @@
 package web
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"logauditer/alert"
+	"logauditer/auth"
+	"logauditer/chain"
 	"logauditer/dbapi"
 	"logauditer/internal"
+	"logauditer/live"
+	"logauditer/report"
+	"logauditer/trail"
 	"net/http"
 	"net/url"
-	"reflect"
-	"strings"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	ll "logauditer/logmining"
 
 	"github.com/globalsign/mgo/bson"
 	log "github.com/laik/logger"
-	"github.com/tealeg/xlsx"
 )
 
-var sf = fmt.Sprintf
-
 func NewHttpServer(addr string, httpSrv *HttpService) {
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	http.HandleFunc("/", srvHome)
+	http.HandleFunc("/rules", srvRules)
 
 	// http://127.0.0.1/getInfo?ipaddr=10.10.2.104&date=2019-02-26
 	http.HandleFunc("/getInfo",
@@ -41,22 +49,84 @@ func NewHttpServer(addr string, httpSrv *HttpService) {
 		},
 	)
 
-	http.HandleFunc("/getDown",
+	http.HandleFunc("/getDown", httpSrv.GetDown)
+
+	http.HandleFunc("/api/v1/records", httpSrv.Records)
+	http.HandleFunc("/api/v1/stats/", httpSrv.Stats)
+	http.HandleFunc("/api/v1/export", httpSrv.Export)
+	http.HandleFunc("/api/v1/reports", httpSrv.ReportRuns)
+	http.HandleFunc("/api/v1/reports/download", httpSrv.ReportDownload)
+	http.HandleFunc("/api/v1/live/sse", httpSrv.LiveSSE)
+	http.HandleFunc("/api/v1/live/ws", httpSrv.LiveWS)
+	http.HandleFunc("/api/v1/openapi.json", OpenAPI)
+	http.HandleFunc("/api/v1/trail", httpSrv.Trails)
+	http.HandleFunc("/api/v1/metrics", httpSrv.Metrics)
+	if httpSrv.Gateway != nil {
+		for _, p := range []string{"/api/v1/rules", "/api/v1/rules/", "/api/v1/workers", "/api/v1/workers/"} {
+			http.Handle(p, httpSrv.Gateway)
+		}
+	}
+
+	// http://127.0.0.1/getAlerts?date=2019-02-26
+	http.HandleFunc("/getAlerts",
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			if res, err := httpSrv.Alerts(r.Form); err != nil {
+				fmt.Fprintf(w, "%s", err)
+			} else {
+				bytes, err := json.Marshal(res)
+				if err != nil {
+					log.Error("unmarshal alerts result error:(%s).\n", err)
+					return
+				}
+				fmt.Fprintf(w, "%s", bytes)
+			}
+		},
+	)
+
+	// http://127.0.0.1/verify?rule=rule1&date=2019-02-26
+	http.HandleFunc("/verify",
 		func(w http.ResponseWriter, r *http.Request) {
 			r.ParseForm()
-			f := httpSrv.GetDown(r.Form)
-			if f == nil {
-				fmt.Fprintf(w, "error.")
+			report, err := httpSrv.Verify(r.Form)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if report.Broken != nil {
+				w.WriteHeader(http.StatusConflict)
 			}
-			w.Header().Set("Content-Disposition", "attachment; filename=file.xls")
-			f.Write(w)
+			json.NewEncoder(w).Encode(report)
 		},
 	)
 
+	var handler http.Handler = http.DefaultServeMux
+	if httpSrv.Auth != nil {
+		http.HandleFunc("/login", srvLogin)
+		http.HandleFunc("/api/v1/login", httpSrv.Login)
+		http.HandleFunc("/api/v1/logout", httpSrv.Logout)
+		http.HandleFunc("/api/v1/whoami", httpSrv.WhoAmI)
+		handler = Authenticate(httpSrv.Auth, handler)
+	}
+	if httpSrv.Trail != nil {
+		handler = Record(httpSrv.Trail, handler)
+	}
+
 	log.Info("start http server %s.\n", addr)
 
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: httpSrv.TLS}
+	httpSrv.mu.Lock()
+	httpSrv.server = srv
+	httpSrv.mu.Unlock()
+
+	var err error
+	if httpSrv.TLS != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe address (%s) error(%s): ", addr, err)
 	}
 }
@@ -73,6 +143,14 @@ func srvHome(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "home.html")
 }
 
+func srvRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	http.ServeFile(w, r, "rules.html")
+}
+
 type Bean struct {
 	Ipaddr string `json:"ipaddr"`
 	Date   string `json:"date"`
@@ -86,7 +164,40 @@ func NewBean() *Bean {
 type Result []internal.AuditLog
 
 type HttpService struct {
-	SP *dbapi.StorageParts
+	SP    *dbapi.StorageParts
+	Chain *chain.Chain
+	// 单次导出的行数上限, <=0 时为 export.DefaultMaxRows
+	ExportMaxRows int
+	// 定时报表, 为 nil 时报表接口返回 404
+	Reports *report.Manager
+	// 实时记录推送, 为 nil 时实时接口返回 404
+	Live *live.Hub
+	// 规则管理 REST 网关, 为 nil 时不注册 /api/v1/rules 与 /api/v1/workers
+	Gateway http.Handler
+	// 用户认证, 为 nil 时不检查登录与角色
+	Auth *auth.Manager
+	// 操作审计, 为 nil 时不记录且查询接口返回 404
+	Trail *trail.Recorder
+	// 证书配置, 为 nil 时使用 HTTP
+	TLS *tls.Config
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// Shutdown 停止接受连接并等待处理中的请求, ctx 结束时强制关闭连接
+func (h *HttpService) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	srv := h.server
+	h.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
 }
 
 func (h *HttpService) Query(form url.Values) (*Result, error) {
@@ -98,13 +209,26 @@ func (h *HttpService) Query(form url.Values) (*Result, error) {
 		query["Host"] = ipaddr
 		log.Debug("i except get ipaddr (%s).\n", ipaddr)
 	}
-	if date := form.Get("date"); date != "" {
+	date := form.Get("date")
+	if date != "" {
 		query["Date"] = date
-		collectionName = "log_" + strings.Replace(date, "-", "_", 2)
+	} else {
+		date = time.Now().Format("2006-01-02")
 	}
+	collectionName = ll.Collection(date)
 	if _type := form.Get("type"); _type != "" {
 		query["SystemType"] = _type
 	}
+	if category := form.Get("category"); category != "" {
+		query["Categories"] = category
+	}
+	if minrisk := form.Get("minrisk"); minrisk != "" {
+		n, err := strconv.Atoi(minrisk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minrisk (%s).", minrisk)
+		}
+		query["RiskScore"] = bson.M{"$gte": n}
+	}
 	res := new(Result)
 	var _err error
 	dbapi.AccessDatabase(
@@ -123,83 +247,51 @@ func (h *HttpService) Query(form url.Values) (*Result, error) {
 	return res, nil
 }
 
-func (h *HttpService) GetDown(form url.Values) *xlsx.File {
-	res, _ := h.Query(form)
-
-	var cols []string
-
-	cnt := int64(1)
-	file := xlsx.NewFile()
-	sheetName := "Sheet%d"
-	sheelPage := 1
-
-	var (
-		sheet *xlsx.Sheet
-		err   error
+func (h *HttpService) Alerts(form url.Values) ([]alert.Alert, error) {
+	date := form.Get("date")
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	}
+	query := bson.M{}
+	if name := form.Get("name"); name != "" {
+		query["name"] = name
+	}
+	if level := form.Get("level"); level != "" {
+		query["level"] = level
+	}
+	res := make([]alert.Alert, 0)
+	var _err error
+	dbapi.AccessDatabase(
+		h.SP,
+		alert.ALERT_DATABASE,
+		alert.Collection(date),
+		query,
+		&res,
+		dbapi.KEYS,
+		dbapi.KV,
+		&_err,
 	)
-
-	for _, item := range *res {
-		newitem := item
-		if cols == nil {
-			cols = makeColumns(&newitem)
-		}
-
-		if cnt == 1 {
-			sheet, err = file.AddSheet(sf(sheetName, sheelPage))
-			if err != nil {
-				log.Error("%s\n", err)
-				return nil
-			}
-			row := sheet.AddRow()
-			row.SetHeightCM(1.0)
-
-			for _, col := range cols {
-				row.AddCell().Value = col
-			}
-		}
-		row := sheet.AddRow()
-		for _, val := range makeColumnValues(&newitem) {
-			cell := row.AddCell()
-			cell.Value = val
-		}
-
-		cnt++
-		if cnt >= 65534 {
-			sheelPage++
-			cnt = 1
-		}
+	if _err != nil {
+		return nil, _err
 	}
-
-	return file
-
+	sort.Slice(res, func(i, j int) bool { return res[i].LastAt.After(res[j].LastAt) })
+	return res, nil
 }
 
-func makeColumns(r interface{}) []string {
-	rf := reflect.TypeOf(r)
-	if rf.Kind() == reflect.Ptr {
-		rf = rf.Elem()
+func (h *HttpService) Verify(form url.Values) (*chain.Report, error) {
+	rule := form.Get("rule")
+	if rule == "" {
+		return nil, fmt.Errorf("rule is required.")
 	}
-	length := rf.NumField()
-	res := make([]string, length, length)
-	for i := 0; i < length; i++ {
-		res[i] = strings.ToLower(rf.Field(i).Name)
+	date := form.Get("date")
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", date); err != nil {
+		return nil, fmt.Errorf("invalid date (%s).", date)
 	}
-	return res
-}
-
-func makeColumnValues(r interface{}) []string {
-	rf := reflect.ValueOf(r)
-	if rf.Kind() == reflect.Ptr && !rf.IsNil() {
-		rf = rf.Elem()
-	}
-	length := rf.Type().NumField()
-	res := make([]string, length, length)
-	for i := 0; i < length; i++ {
-		field := rf.Field(i)
-		if !field.CanInterface() {
-			continue
-		}
-		res[i] = sf("%s", field.Interface())
+	var pub []byte
+	if h.Chain != nil {
+		pub = h.Chain.PublicKey()
 	}
-	return res
+	return chain.Verify(h.SP, dbapi.KV, rule, date, pub)
 }
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"logauditer/dbapi"
+	"logauditer/query"
+	"logauditer/search"
+	"logauditer/stats"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// 统计接口自身的参数, 其余参数与 /api/v1/records 相同
+var statsParams = []string{"bucket", "by", "n"}
+
+func (h *HttpService) statser() *stats.Service {
+	return &stats.Service{SP: h.SP, PersistType: dbapi.KV}
+}
+
+func statsRequest(r *http.Request) (*search.Request, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &search.Error{Message: err.Error()}
+	}
+	form := make(url.Values)
+	for k, v := range r.Form {
+		form[k] = v
+	}
+	for _, k := range statsParams {
+		delete(form, k)
+	}
+	req, err := search.FromValues(form)
+	if err != nil {
+		return nil, err
+	}
+	if ql := form.Get("ql"); ql != "" {
+		if err := query.Apply(req, ql); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// Stats 统计接口:
+// /api/v1/stats/timeline?bucket=minute|hour|day
+// /api/v1/stats/top?by=user|ip|host|op|category&n=10
+// /api/v1/stats/states
+// /api/v1/stats/rules
+func (h *HttpService) Stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed.")
+		return
+	}
+	req, err := statsRequest(r)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	var res interface{}
+	switch r.URL.Path {
+	case "/api/v1/stats/timeline":
+		res, err = h.statser().Timeline(req, r.Form.Get("bucket"))
+	case "/api/v1/stats/top":
+		n := 0
+		if v := r.Form.Get("n"); v != "" {
+			if n, err = strconv.Atoi(v); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid n ("+v+").")
+				return
+			}
+		}
+		by := r.Form.Get("by")
+		if by == "" {
+			writeError(w, http.StatusBadRequest, "missing by.")
+			return
+		}
+		res, err = h.statser().Top(req, query.Canonical(by), n)
+	case "/api/v1/stats/states":
+		res, err = h.statser().States(req)
+	case "/api/v1/stats/rules":
+		res, err = h.statser().Rules(req)
+	default:
+		writeError(w, http.StatusNotFound, "not found.")
+		return
+	}
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
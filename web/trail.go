@@ -0,0 +1,183 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"logauditer/trail"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 数据访问接口, 按前缀匹配
+var tracedPaths = []string{
+	"/getInfo",
+	"/getDown",
+	"/getAlerts",
+	"/verify",
+	"/api/v1/records",
+	"/api/v1/stats/",
+	"/api/v1/export",
+	"/api/v1/reports/download",
+	"/api/v1/live/",
+	"/api/v1/trail",
+	"/api/v1/login",
+	"/api/v1/logout",
+}
+
+type requestInfoKey struct{}
+
+// requestInfo 由 Authenticate 与 Login 填写当前用户
+type requestInfo struct {
+	user string
+}
+
+func setRequestUser(r *http.Request, user string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.user = user
+	}
+}
+
+// statusWriter 记录响应状态码, 保留实时接口需要的 Flusher 与 Hijacker
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported.")
+	}
+	// 升级为 WebSocket 后按 101 记录
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func traced(r *http.Request) bool {
+	p := r.URL.Path
+	if r.Method != "GET" && (strings.HasPrefix(p, "/api/v1/rules") || strings.HasPrefix(p, "/api/v1/workers")) {
+		return true
+	}
+	for _, prefix := range tracedPaths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 规则管理网关路径中的规则名或 rule 参数
+func requestRule(r *http.Request) string {
+	p := r.URL.EscapedPath()
+	for _, prefix := range []string{"/api/v1/rules/", "/api/v1/workers/"} {
+		if strings.HasPrefix(p, prefix) {
+			name := strings.SplitN(strings.TrimPrefix(p, prefix), "/", 2)[0]
+			if n, err := url.PathUnescape(name); err == nil {
+				return n
+			}
+			return name
+		}
+	}
+	return r.URL.Query().Get("rule")
+}
+
+// Record 记录数据访问与管理操作, 以及所有被拒绝的请求, 须放在 Authenticate 外层
+func Record(rec *trail.Recorder, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		sw := &statusWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		// 先解析表单, 处理函数拿到的请求副本会带上解析结果
+		if r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			r.ParseForm()
+		}
+		next.ServeHTTP(sw, r)
+
+		denied := sw.status == http.StatusUnauthorized || sw.status == http.StatusForbidden
+		if !denied && !traced(r) {
+			return
+		}
+		e := &trail.Entry{
+			Time:    start,
+			User:    info.user,
+			Peer:    r.RemoteAddr,
+			Source:  trail.HTTP,
+			Action:  r.Method + " " + r.URL.Path,
+			Command: r.URL.RawQuery,
+			Rule:    requestRule(r),
+			Result:  trail.OK,
+		}
+		// 登录表单含密码不记录
+		if len(r.PostForm) > 0 && r.URL.Path != "/api/v1/login" {
+			if e.Command != "" {
+				e.Command += "&"
+			}
+			e.Command += r.PostForm.Encode()
+		}
+		switch {
+		case denied:
+			e.Result, e.Message = trail.DENIED, http.StatusText(sw.status)
+		case sw.status >= 400:
+			e.Result, e.Message = trail.ERROR, http.StatusText(sw.status)
+		}
+		rec.Record(e)
+	})
+}
+
+// Trails 查询操作审计记录, 参数 date,user,rule,action,result,limit
+func (h *HttpService) Trails(w http.ResponseWriter, r *http.Request) {
+	if h.Trail == nil {
+		http.Error(w, "trail is not enabled.", http.StatusNotFound)
+		return
+	}
+	form := r.URL.Query()
+	q := &trail.Query{
+		Date:   form.Get("date"),
+		User:   form.Get("user"),
+		Rule:   form.Get("rule"),
+		Action: form.Get("action"),
+		Result: form.Get("result"),
+	}
+	if limit := form.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "invalid limit ("+limit+").", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	res, err := h.Trail.Find(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
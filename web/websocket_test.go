@@ -0,0 +1,197 @@
+package web
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	in "logauditer/internal"
+	"logauditer/live"
+)
+
+// wsClient 测试用的 websocket 客户端, 发送的帧带掩码
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func wsDial(t *testing.T, srv *httptest.Server, path string) (*wsClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsClient{conn: conn, r: r}, res
+}
+
+func (c *wsClient) write(t *testing.T, op byte, payload []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	b := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	b = append(b, mask...)
+	for i, v := range payload {
+		b = append(b, v^mask[i%4])
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsClient) read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0]&0x80 == 0 || hdr[1]&0x80 != 0 {
+		t.Fatalf("frame header %x", hdr)
+	}
+	n := uint64(hdr[1])
+	switch n {
+	case 126:
+		var b [2]byte
+		io.ReadFull(c.r, b[:])
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(c.r, b[:])
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+func (c *wsClient) event(t *testing.T) *liveEvent {
+	t.Helper()
+	op, b := c.read(t)
+	if op != wsText {
+		t.Fatalf("opcode %x, want text", op)
+	}
+	e := &liveEvent{}
+	if err := json.Unmarshal(b, e); err != nil {
+		t.Fatalf("event %s: %s", b, err)
+	}
+	return e
+}
+
+// waitSubscribers 等待订阅数变为 n
+func waitSubscribers(t *testing.T, hub *live.Hub, n int) {
+	t.Helper()
+	for i := 0; hub.Subscribers() != n; i++ {
+		if i == 200 {
+			t.Fatalf("subscribers %d, want %d", hub.Subscribers(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLiveWS(t *testing.T) {
+	hub := live.NewHub()
+	defer hub.Close()
+	h := &HttpService{Live: hub}
+	srv := httptest.NewServer(http.HandlerFunc(h.LiveWS))
+	defer srv.Close()
+
+	// 不是 websocket 握手
+	res, err := http.Get(srv.URL + "/api/v1/live/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain get status %d", res.StatusCode)
+	}
+
+	c, res := wsDial(t, srv, "/api/v1/live/ws?user=root")
+	// RFC 6455 1.3 中的示例
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+		!strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("handshake %d %v", res.StatusCode, res.Header)
+	}
+	waitSubscribers(t, hub, 1)
+
+	hub.Publish(&live.Message{Rule: "ssh", Record: in.AuditLog{UserName: "admin", Operation: "ls"}})
+	hub.Publish(&live.Message{Rule: "ssh", Record: in.AuditLog{UserName: "root", Operation: "rm -rf /"}})
+	if e := c.event(t); e.Type != "record" || e.Message == nil || e.Message.Record.Operation != "rm -rf /" || e.Dropped != 0 {
+		t.Errorf("event %+v", e)
+	}
+
+	// 客户端的数据帧忽略, ping 回复相同内容的 pong
+	c.write(t, wsText, []byte("hello"))
+	c.write(t, wsPing, []byte("beat"))
+	if op, b := c.read(t); op != wsPong || string(b) != "beat" {
+		t.Errorf("pong %x %q", op, b)
+	}
+
+	// 客户端关闭时回复 close 并断开, 取消订阅
+	c.write(t, wsClose, []byte{0x03, 0xE8})
+	if op, b := c.read(t); op != wsClose || string(b) != "\x03\xE8" {
+		t.Errorf("close %x %q", op, b)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+	waitSubscribers(t, hub, 0)
+}
+
+func TestLiveWSDropped(t *testing.T) {
+	hub := live.NewHub()
+	defer hub.Close()
+	h := &HttpService{Live: hub}
+	srv := httptest.NewServer(http.HandlerFunc(h.LiveWS))
+	defer srv.Close()
+
+	c, res := wsDial(t, srv, "/api/v1/live/ws?buffer=1")
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake %d", res.StatusCode)
+	}
+	waitSubscribers(t, hub, 1)
+
+	// 缓冲为 1 的订阅者跟不上时丢弃, 下一条记录前报告丢弃的条数
+	const total = 1000
+	for i := 0; i < total; i++ {
+		hub.Publish(&live.Message{Rule: "ssh", Record: in.AuditLog{UserName: "root"}})
+	}
+	var records, dropped uint64
+	for records+dropped < total {
+		e := c.event(t)
+		switch e.Type {
+		case "record":
+			records++
+		case "dropped":
+			if e.Dropped == 0 {
+				t.Fatalf("dropped event %+v", e)
+			}
+			dropped += e.Dropped
+			if e := c.event(t); e.Type != "record" {
+				t.Fatalf("event after dropped %+v", e)
+			}
+			records++
+		}
+		if dropped > 0 {
+			break
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("no dropped event in %d records", records)
+	}
+}